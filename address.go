@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnurl"
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const (
+	addressMessage          = "⚡️ Your Lightning Address is `%s`"
+	addressNoAddressMessage = "🚫 You don't have a Lightning Address yet. Set a Telegram username or claim an alias with `/address <name>`."
+	addressClaimedMessage   = "✅ Your Lightning Address is now `%s`"
+	addressRemovedMessage   = "✅ Your alias was removed."
+	addressInvalidMessage   = "The alias must be 3 to 32 characters long and may only contain a-z, 0-9, `.`, `-` and `_`."
+	addressTakenMessage     = "🚫 This alias is already taken."
+	addressCooldownMessage  = "🚫 This alias was released recently and can't be claimed yet."
+	addressHelpText         = "📖 Oops, that didn't work. %s\n\n" +
+		"*Usage:* `/address [<name>|remove]`\n" +
+		"*Example:* `/address satoshi`"
+)
+
+func helpAddressUsage(errormsg string) string {
+	return fmt.Sprintf(addressHelpText, errormsg)
+}
+
+// addressHandler is invoked on /address. It shows the Lightning address of the user
+// or claims a new alias with /address <name>.
+func (bot TipBot) addressHandler(ctx *Context) {
+	m := ctx.Message
+	name, err := getArgumentFromCommand(m.Text, 1)
+	if err != nil {
+		// no argument: show the current address
+		address, err := bot.UserGetLightningAddress(m.Sender)
+		if err != nil {
+			bot.trySendMessage(m.Sender, addressNoAddressMessage)
+			return
+		}
+		bot.trySendMessage(m.Sender, fmt.Sprintf(addressMessage, address))
+		return
+	}
+	userName := strconv.Itoa(m.Sender.ID)
+	if strings.ToLower(name) == "remove" {
+		err = lnurl.ReleaseAlias(bot.database, userName)
+		if err != nil {
+			log.Errorf("[/address] Could not release alias of %s: %s", GetUserStr(m.Sender), err)
+			bot.trySendMessage(m.Sender, errorTryLaterMessage)
+			return
+		}
+		log.Infof("[/address] %s released their alias", GetUserStr(m.Sender))
+		bot.trySendMessage(m.Sender, addressRemovedMessage)
+		return
+	}
+	name = strings.ToLower(strings.TrimPrefix(name, "@"))
+	err = lnurl.ClaimAlias(bot.database, userName, name)
+	if err != nil {
+		log.Errorf("[/address] %s could not claim alias %s: %s", GetUserStr(m.Sender), name, err)
+		switch {
+		case errors.Is(err, lnurl.ErrAliasInvalid):
+			bot.trySendMessage(m.Sender, helpAddressUsage(addressInvalidMessage))
+		case errors.Is(err, lnurl.ErrAliasTaken):
+			bot.trySendMessage(m.Sender, addressTakenMessage)
+		case errors.Is(err, lnurl.ErrAliasCooldown):
+			bot.trySendMessage(m.Sender, addressCooldownMessage)
+		default:
+			bot.trySendMessage(m.Sender, errorTryLaterMessage)
+		}
+		return
+	}
+	address, err := bot.UserGetLightningAddress(m.Sender)
+	if err != nil {
+		log.Errorf("[/address] %s", err)
+		return
+	}
+	log.Infof("[/address] %s claimed alias %s", GetUserStr(m.Sender), name)
+	bot.trySendMessage(m.Sender, fmt.Sprintf(addressClaimedMessage, address))
+}
+
+// UserGetLightningAddressName returns the name part of the Lightning address of the user.
+// An alias claimed with /address takes precedence over the Telegram username.
+func (bot *TipBot) UserGetLightningAddressName(user *tb.User) (string, error) {
+	alias, err := lnurl.GetAlias(bot.database, strconv.Itoa(user.ID))
+	if err == nil {
+		return alias.Name, nil
+	}
+	if len(user.Username) > 0 {
+		return strings.ToLower(user.Username), nil
+	}
+	return "", fmt.Errorf("user has no username or alias")
+}
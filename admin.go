@@ -0,0 +1,395 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const (
+	adminHelpText = "📖 Oops, that didn't work. %s\n\n" +
+		"*Usage:*\n" +
+		"`/admin user <@user|id>` shows the wallet and the state of a user\n" +
+		"`/admin reset <@user|id>` ends the dialogs of a user\n" +
+		"`/admin freeze <@user|id> <reason>` stops the payments of a user\n" +
+		"`/admin unfreeze <@user|id> [<reason>]` allows the payments of a user again\n" +
+		"`/admin broadcast <message>` sends a message to all users\n" +
+		"`/admin stats` shows the users, balances and volume\n" +
+		"`/admin unlock <inline-id>` releases a stuck inline send, receive or faucet"
+	adminUserMessage = "👤 *%s* (`%d`)\n\n" +
+		"Wallet: `%s`\n" +
+		"Balance: %s\n" +
+		"Initialized: %t\n" +
+		"Frozen: %s\n" +
+		"Limits: %s per payment, %s per 24 hours (%d sat spent), confirmation above %s\n" +
+		"PIN: %t\n" +
+		"Dialogs: %s\n" +
+		"Lightning address: %s"
+	adminUserNotFoundMessage  = "🚫 There is no user %s."
+	adminResetMessage         = "✅ Ended %d dialogs of %s."
+	adminFrozenMessage        = "🧊 %s is frozen, the keys of their wallet were rotated."
+	adminFrozenKeysMessage    = "🧊 %s is frozen.\n⚠️ The keys of their wallet could not be rotated, apps that they linked with /link can still spend. Try `/admin freeze` again."
+	adminUnfrozenMessage      = "✅ %s is unfrozen."
+	adminNotFrozenMessage     = "ℹ️ %s is not frozen."
+	adminBroadcastMessage     = "📣 Sending the message to %d users."
+	adminBroadcastDoneMessage = "📣 The message was sent to %d users, %d failed."
+	adminStatsMessage         = "📊 *Stats*\n\n" +
+		"Wallets: %d (%d initialized)\n" +
+		"Balances: %d sat\n" +
+		"Last 24 hours: %d payments, %d sat"
+	adminStatsRunningMessage  = "📊 Fetching the balances of %d wallets."
+	adminStatsFailedMessage   = "\n⚠️ The balances of %d wallets could not be fetched."
+	adminUnlockMessage        = "🔓 Unlocked %s."
+	adminUnlockIdleMessage    = "ℹ️ %s was not locked."
+	adminUnlockPaymentNotice  = " Its interrupted payment was reconciled."
+	adminUnlockPayingMessage  = "⏳ %s is paying right now, it is not unlocked. Try again in a few minutes."
+	adminInlineMissingMessage = "🚫 There is no inline send, receive or faucet %s."
+
+	// broadcastInterval spaces the messages of a broadcast, Telegram allows about 30 messages per second
+	broadcastInterval = 50 * time.Millisecond
+	// statsConcurrency limits the concurrent requests to LNbits of /admin stats
+	statsConcurrency = 4
+)
+
+// isAdmin returns whether the Telegram user is an operator of the bot
+func isAdmin(user *tb.User) bool {
+	for _, id := range currentConfiguration().Telegram.AdminIDs {
+		if user.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAdmin ignores messages of users that are not operators of the bot
+func (bot TipBot) requireAdmin(next Handler) Handler {
+	return func(ctx *Context) {
+		if !isAdmin(ctx.Message.Sender) {
+			log.Warnf("[/admin] %s is not an admin", GetUserStr(ctx.Message.Sender))
+			return
+		}
+		next(ctx)
+	}
+}
+
+func helpAdminUsage(errormsg string) string {
+	return fmt.Sprintf(adminHelpText, errormsg)
+}
+
+// adminHandler is invoked on /admin <command> [<argument>]
+func (bot TipBot) adminHandler(ctx *Context) {
+	m := ctx.Message
+	command, err := getArgumentFromCommand(m.Text, 1)
+	if err != nil {
+		bot.trySendMessage(m.Sender, helpAdminUsage(""))
+		return
+	}
+	argument, _ := getArgumentFromCommand(m.Text, 2)
+	switch strings.ToLower(command) {
+	case "stats":
+		bot.adminStats(m)
+		return
+	case "broadcast":
+		bot.adminBroadcast(m)
+		return
+	case "unlock":
+		bot.adminUnlock(m, argument)
+		return
+	case "user", "reset", "freeze", "unfreeze":
+	default:
+		bot.trySendMessage(m.Sender, helpAdminUsage(""))
+		return
+	}
+	if len(argument) == 0 {
+		bot.trySendMessage(m.Sender, helpAdminUsage("Please specify a user."))
+		return
+	}
+	user, err := bot.adminGetUser(argument)
+	if err != nil {
+		bot.trySendMessage(m.Sender, fmt.Sprintf(adminUserNotFoundMessage, MarkdownEscape(argument)))
+		return
+	}
+	switch strings.ToLower(command) {
+	case "user":
+		bot.adminUser(m, user)
+	case "reset":
+		bot.adminReset(m, user)
+	case "freeze":
+		bot.adminFreeze(m, user)
+	case "unfreeze":
+		bot.adminUnfreeze(m, user)
+	}
+}
+
+// adminGetUser returns the user with the @username or Telegram ID
+func (bot TipBot) adminGetUser(argument string) (*lnbits.User, error) {
+	var user *lnbits.User
+	var err error
+	if id, parseErr := strconv.Atoi(argument); parseErr == nil {
+		user, err = bot.users.GetUser(id)
+	} else {
+		user, err = bot.users.GetUserByUsername(strings.TrimPrefix(argument, "@"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Telegram == nil {
+		return nil, errors.New("user has no Telegram account")
+	}
+	return user, nil
+}
+
+func (bot TipBot) adminUser(m *tb.Message, user *lnbits.User) {
+	wallet, balance := "-", "-"
+	if user.Wallet != nil {
+		wallet = user.Wallet.ID
+		user.Wallet.Client = bot.client
+		info, err := bot.client.Info(*user.Wallet)
+		if err != nil {
+			balance = fmt.Sprintf("unavailable (%s)", MarkdownEscape(err.Error()))
+		} else {
+			balance = fmt.Sprintf("%d sat", info.Balance/1000)
+		}
+	}
+	limits := userSpendingLimits(user)
+	spent, err := bot.transactions.SpentSince(user.Telegram.ID, time.Now().Add(-spendingWindow))
+	if err != nil {
+		log.Errorf("[/admin] Could not get spending of %s: %s", GetUserStr(user.Telegram), err)
+	}
+	var dialogs []string
+	for _, dialog := range bot.userDialogs(user.Telegram) {
+		dialogs = append(dialogs, fmt.Sprintf("%s (%s)", dialog.Command, dialog.State))
+	}
+	if len(dialogs) == 0 {
+		dialogs = append(dialogs, "none")
+	}
+	address, err := bot.UserGetLightningAddress(user.Telegram)
+	if err != nil {
+		address = "none"
+	}
+	bot.trySendMessage(m.Sender, fmt.Sprintf(adminUserMessage,
+		GetUserStrMd(user.Telegram), user.Telegram.ID, wallet, balance, user.Initialized, MarkdownEscape(frozenStatus(user)),
+		formatLimit(limits.MaxPayment), formatLimit(limits.DailyLimit), spent, formatLimit(limits.ConfirmAbove),
+		len(user.Spending.PinHash) > 0, MarkdownEscape(strings.Join(dialogs, ", ")), MarkdownEscape(address)))
+}
+
+// adminReset ends the dialogs of a user. The lock of their payments is not released, a payment may
+// still be running and the lock of a stuck payment expires on its own.
+func (bot TipBot) adminReset(m *tb.Message, user *lnbits.User) {
+	dialogs := bot.userDialogs(user.Telegram)
+	for _, dialog := range dialogs {
+		bot.endDialog(dialog)
+	}
+	log.Warnf("[/admin] %s reset %s, ended %d dialogs", GetUserStr(m.Sender), GetUserStr(user.Telegram), len(dialogs))
+	bot.trySendMessage(m.Sender, fmt.Sprintf(adminResetMessage, len(dialogs), GetUserStrMd(user.Telegram)))
+}
+
+// adminFreeze freezes a user with the reason at the end of the command. Users who are frozen
+// already can be frozen again, e.g. if the keys of their wallet could not be rotated.
+func (bot TipBot) adminFreeze(m *tb.Message, user *lnbits.User) {
+	reason := commandRest(m.Text, 3)
+	if len(reason) == 0 {
+		bot.trySendMessage(m.Sender, helpAdminUsage("Please enter a reason."))
+		return
+	}
+	err := bot.freezeUser(user, m.Sender, reason)
+	if errors.Is(err, errKeysNotRotated) {
+		bot.trySendMessage(m.Sender, fmt.Sprintf(adminFrozenKeysMessage, GetUserStrMd(user.Telegram)))
+		return
+	}
+	if err != nil {
+		log.Errorf("[/admin] Could not freeze %s: %s", GetUserStr(user.Telegram), err)
+		bot.trySendMessage(m.Sender, errorTryLaterMessage)
+		return
+	}
+	bot.trySendMessage(m.Sender, fmt.Sprintf(adminFrozenMessage, GetUserStrMd(user.Telegram)))
+}
+
+func (bot TipBot) adminUnfreeze(m *tb.Message, user *lnbits.User) {
+	if !user.Frozen {
+		bot.trySendMessage(m.Sender, fmt.Sprintf(adminNotFrozenMessage, GetUserStrMd(user.Telegram)))
+		return
+	}
+	err := bot.unfreezeUser(user, m.Sender, commandRest(m.Text, 3))
+	if err != nil {
+		log.Errorf("[/admin] Could not unfreeze %s: %s", GetUserStr(user.Telegram), err)
+		bot.trySendMessage(m.Sender, errorTryLaterMessage)
+		return
+	}
+	bot.trySendMessage(m.Sender, fmt.Sprintf(adminUnfrozenMessage, GetUserStrMd(user.Telegram)))
+}
+
+// commandRest returns the text after the first n words of the command
+func commandRest(text string, n int) string {
+	parts := strings.SplitN(text, " ", n+1)
+	if len(parts) <= n {
+		return ""
+	}
+	return strings.TrimSpace(parts[n])
+}
+
+// adminBroadcast sends the message to all users with a wallet in the background
+func (bot TipBot) adminBroadcast(m *tb.Message) {
+	message := commandRest(m.Text, 2)
+	if len(message) == 0 {
+		bot.trySendMessage(m.Sender, helpAdminUsage("Please enter a message."))
+		return
+	}
+	users, err := bot.users.AllUsers()
+	if err != nil {
+		log.Errorf("[/admin] Could not get users: %s", err)
+		bot.trySendMessage(m.Sender, errorTryLaterMessage)
+		return
+	}
+	var recipients []*tb.User
+	for _, user := range users {
+		if user.Initialized && user.Telegram != nil {
+			recipients = append(recipients, user.Telegram)
+		}
+	}
+	log.Warnf("[/admin] %s broadcasts to %d users: %s", GetUserStr(m.Sender), len(recipients), message)
+	bot.trySendMessage(m.Sender, fmt.Sprintf(adminBroadcastMessage, len(recipients)))
+	bot.goTracked("broadcast", func() {
+		sent, failed := bot.broadcast(recipients, message)
+		log.Infof("[/admin] Broadcast sent to %d users, %d failed", sent, failed)
+		bot.trySendMessage(m.Sender, fmt.Sprintf(adminBroadcastDoneMessage, sent, failed))
+	})
+}
+
+// broadcast sends message to the recipients at most once per broadcastInterval.
+// If Telegram asks the bot to slow down, it waits and tries again once.
+func (bot TipBot) broadcast(recipients []*tb.User, message string) (sent int, failed int) {
+	ticker := time.NewTicker(broadcastInterval)
+	defer ticker.Stop()
+	for _, recipient := range recipients {
+		<-ticker.C
+		_, err := bot.telegram.Send(recipient, message)
+		var flood tb.FloodError
+		if errors.As(err, &flood) {
+			time.Sleep(time.Duration(flood.RetryAfter) * time.Second)
+			_, err = bot.telegram.Send(recipient, message)
+		}
+		if err != nil {
+			log.Debugf("[/admin] Could not send broadcast to %s: %s", GetUserStr(recipient), err)
+			failed++
+			continue
+		}
+		sent++
+	}
+	return sent, failed
+}
+
+func (bot TipBot) adminStats(m *tb.Message) {
+	users, err := bot.users.AllUsers()
+	if err != nil {
+		log.Errorf("[/admin] Could not get users: %s", err)
+		bot.trySendMessage(m.Sender, errorTryLaterMessage)
+		return
+	}
+	count, amount, err := bot.transactions.VolumeSince(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		log.Errorf("[/admin] Could not get volume: %s", err)
+		bot.trySendMessage(m.Sender, errorTryLaterMessage)
+		return
+	}
+	initialized := 0
+	for _, user := range users {
+		if user.Initialized {
+			initialized++
+		}
+	}
+	bot.trySendMessage(m.Sender, fmt.Sprintf(adminStatsRunningMessage, len(users)))
+	bot.goTracked("stats", func() {
+		balance, failed := bot.walletBalances(users)
+		message := fmt.Sprintf(adminStatsMessage, len(users), initialized, balance/1000, count, amount)
+		if failed > 0 {
+			message += fmt.Sprintf(adminStatsFailedMessage, failed)
+		}
+		bot.trySendMessage(m.Sender, message)
+	})
+}
+
+// walletBalances returns the sum of the balances of the wallets of users in msat and the number
+// of wallets whose balance could not be fetched. At most statsConcurrency requests run at a time.
+func (bot TipBot) walletBalances(users []*lnbits.User) (balance int64, failed int) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, statsConcurrency)
+	for _, user := range users {
+		if user.Wallet == nil {
+			continue
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(wallet lnbits.Wallet) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			info, err := bot.client.Info(wallet)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+				return
+			}
+			balance += info.Balance
+		}(*user.Wallet)
+	}
+	wg.Wait()
+	return balance, failed
+}
+
+// adminUnlock releases the lock of an inline object whoever holds it
+// and reconciles a payment that was interrupted while it was locked
+func (bot TipBot) adminUnlock(m *tb.Message, id string) {
+	object := newInlineObject(id)
+	if object == nil {
+		bot.trySendMessage(m.Sender, helpAdminUsage("Please specify an inline send, receive or faucet."))
+		return
+	}
+	err := bot.store.Get(object)
+	if err != nil {
+		bot.trySendMessage(m.Sender, fmt.Sprintf(adminInlineMissingMessage, MarkdownEscape(id)))
+		return
+	}
+	// a payment that started within the ttl of its lock may still be running
+	if object.lifetime().Payment != nil && !interruptedPayment(object, inlineLockTTL) {
+		bot.trySendMessage(m.Sender, fmt.Sprintf(adminUnlockPayingMessage, MarkdownEscape(id)))
+		return
+	}
+	released, err := bot.store.ReleaseKey(object.Key())
+	if err != nil {
+		log.Errorf("[/admin] Could not release %s: %s", object.Key(), err)
+		bot.trySendMessage(m.Sender, errorTryLaterMessage)
+		return
+	}
+	lock, err := bot.store.TryLock(object.Key(), "admin", inlineLockTTL)
+	if err != nil {
+		log.Errorf("[/admin] Could not lock %s: %s", object.Key(), err)
+		bot.trySendMessage(m.Sender, errorTryLaterMessage)
+		return
+	}
+	reconciled := false
+	if bot.store.Get(object) == nil && interruptedPayment(object, inlineLockTTL) {
+		bot.recoverInlinePayment(object, lock)
+		reconciled = true
+	}
+	bot.unlockInline(lock)
+	log.Warnf("[/admin] %s unlocked %s, was locked: %t, reconciled payment: %t", GetUserStr(m.Sender), object.Key(), released, reconciled)
+	message := fmt.Sprintf(adminUnlockIdleMessage, MarkdownEscape(id))
+	if released {
+		message = fmt.Sprintf(adminUnlockMessage, MarkdownEscape(id))
+	}
+	if reconciled {
+		message += adminUnlockPaymentNotice
+	}
+	bot.trySendMessage(m.Sender, message)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScenario_admin(t *testing.T) {
+	s := newScenario(t)
+	admin := s.newUser(2000, "admin", 0)
+	alice := s.newUser(2001, "alice", 1000)
+	bob := s.newUser(2002, "bob", 1000)
+	Configuration.Telegram.AdminIDs = []int{admin.ID}
+
+	// other users are ignored
+	s.private(alice, "/admin stats")
+	for _, msg := range s.telegram.botMessages(int64(alice.ID)) {
+		if strings.Contains(msg.Text, "Stats") {
+			t.Errorf("%s got %q", GetUserStr(alice), msg.Text)
+		}
+	}
+
+	s.private(alice, "/send 100 @bob")
+	s.press(alice, s.expect(alice, "Do you want to pay to @bob?"), btnSend.Text)
+	s.expect(alice, "100 sat sent to @bob")
+	s.private(admin, "/admin stats")
+	s.expect(admin, "Fetching the balances of 3 wallets")
+	s.expect(admin, "Wallets: 3 (3 initialized)\nBalances: 2000 sat\nLast 24 hours: 1 payments, 100 sat")
+
+	s.private(alice, "/send")
+	s.expect(alice, sendEnterRecipientMessage)
+	s.private(admin, "/admin user @alice")
+	s.expect(admin, "Balance: 900 sat")
+	s.expect(admin, "Dialogs: send (recipient)")
+	// a payment of alice is running
+	lock, err := s.bot.lockSpending(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.private(admin, fmt.Sprintf("/admin reset %d", alice.ID))
+	s.expect(admin, "Ended 1 dialogs of @alice")
+	if dialogs := s.bot.userDialogs(alice); len(dialogs) > 0 {
+		t.Errorf("dialogs of %s = %v after reset", GetUserStr(alice), dialogs)
+	}
+	if err := s.bot.store.Release(lock); err != nil {
+		t.Errorf("the lock of a running payment was released: %s", err)
+	}
+
+	s.private(admin, "/admin freeze @alice")
+	s.expect(admin, "Please enter a reason")
+
+	s.private(admin, "/admin user @carol")
+	s.expect(admin, "There is no user @carol")
+
+	s.private(admin, "/admin broadcast Maintenance *tonight*")
+	s.expect(admin, "Sending the message to 3 users")
+	s.expect(admin, "The message was sent to 3 users, 0 failed")
+	s.expect(bob, "Maintenance *tonight*")
+}
+
+func TestScenario_adminUnlock(t *testing.T) {
+	s := newScenario(t)
+	admin := s.newUser(2000, "admin", 0)
+	alice := s.newUser(2001, "alice", 0)
+	bob := s.newUser(2002, "bob", 1000)
+	Configuration.Telegram.AdminIDs = []int{admin.ID}
+
+	// a send that a crashed bot left locked
+	result := s.query(bob, "send 30")[0]
+	send := s.choose(bob, "send 30", result)
+	if _, err := s.bot.store.TryLock(result.ID, "crashed", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	s.private(admin, "/admin unlock "+result.ID)
+	s.expect(admin, "Unlocked")
+	s.press(alice, send, btnAcceptInlineSend.Text)
+	s.expect(alice, "@bob sent you 30 sat")
+
+	// a send that a crashed bot left locked while it paid
+	result = s.query(bob, "send 40")[0]
+	s.choose(bob, "send 40", result)
+	inlineSend := &InlineSend{ID: result.ID}
+	if err := s.bot.store.Get(inlineSend); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := s.bot.store.TryLock(result.ID, "crashed", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inlineSend.Payment = newInlinePayment(NewTransaction(&s.bot, bob, alice, 40, TransactionType("inline send")))
+	if err := s.bot.store.SetLocked(lock, inlineSend); err != nil {
+		t.Fatal(err)
+	}
+	// the payment may still be running while its lock did not expire
+	s.private(admin, "/admin unlock "+result.ID)
+	s.expect(admin, "is paying right now")
+	if _, err := s.bot.store.TryLock(result.ID, "test", time.Minute); err == nil {
+		t.Fatal("lock of a running payment was released")
+	}
+	s.checkBalance(bob, 970)
+
+	inlineSend.Payment.StartedAt = time.Now().Add(-inlineLockTTL - time.Second)
+	if err := s.bot.store.SetLocked(lock, inlineSend); err != nil {
+		t.Fatal(err)
+	}
+	s.private(admin, "/admin unlock "+result.ID)
+	s.expect(admin, "Its interrupted payment was reconciled")
+	s.expect(bob, "Your payment of 40 sat to @alice was interrupted")
+	s.checkBalance(bob, 970)
+
+	s.private(admin, "/admin unlock inl-send-missing")
+	s.expect(admin, "There is no inline send, receive or faucet")
+	s.private(admin, "/admin unlock "+result.ID)
+	s.expect(admin, "was not locked")
+}
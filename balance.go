@@ -4,8 +4,6 @@ import (
 	"fmt"
 
 	log "github.com/sirupsen/logrus"
-
-	tb "gopkg.in/tucnak/telebot.v2"
 )
 
 const (
@@ -13,25 +11,8 @@ const (
 	balanceErrorMessage = "🚫 Error fetching your balance. Please try again later."
 )
 
-func (bot TipBot) balanceHandler(m *tb.Message) {
-	// check and print all commands
-	bot.anyTextHandler(m)
-	// reply only in private message
-	if m.Chat.Type != tb.ChatPrivate {
-		// delete message
-		NewMessage(m, WithDuration(0, bot.telegram))
-	}
-	// first check whether the user is initialized
-	fromUser, err := GetUser(m.Sender, bot)
-	if err != nil {
-		log.Errorf("[/balance] Error: %s", err)
-		return
-	}
-	if !fromUser.Initialized {
-		bot.startHandler(m)
-		return
-	}
-
+func (bot TipBot) balanceHandler(ctx *Context) {
+	m := ctx.Message
 	usrStr := GetUserStr(m.Sender)
 	balance, err := bot.GetUserBalance(m.Sender)
 	if err != nil {
@@ -41,6 +22,11 @@ func (bot TipBot) balanceHandler(m *tb.Message) {
 	}
 
 	log.Infof("[/balance] %s's balance: %d sat\n", usrStr, balance)
-	bot.trySendMessage(m.Sender, fmt.Sprintf(balanceMessage, balance))
+	message := fmt.Sprintf(balanceMessage, balance)
+	// /start shows the balance of new users without loading them
+	if ctx.User != nil && ctx.User.Frozen {
+		message += accountFrozenNotice
+	}
+	bot.trySendMessage(m.Sender, message)
 	return
 }
@@ -4,11 +4,12 @@ import (
 	"fmt"
 	"strings"
 	"sync"
-	"time"
 
+	"github.com/LightningTipBot/LightningTipBot/internal/health"
 	"github.com/LightningTipBot/LightningTipBot/internal/storage"
 
 	"github.com/LightningTipBot/LightningTipBot/internal/lnurl"
+	"github.com/LightningTipBot/LightningTipBot/internal/nostr"
 
 	log "github.com/sirupsen/logrus"
 
@@ -20,11 +21,17 @@ import (
 )
 
 type TipBot struct {
-	database *gorm.DB
-	bunt     *storage.DB
-	logger   *gorm.DB
-	telegram *telebot.Bot
-	client   *lnbits.Client
+	database     *gorm.DB
+	users        UserRepository
+	transactions TransactionRepository
+	store        storage.Store
+	telegram     *telebot.Bot
+	client       *lnbits.Client
+	dialogs      dialogRegistry
+	limiter      *rateLimiter
+	txLogger     *gorm.DB
+	health       *health.Checker
+	inFlight     *handlerTracker
 }
 
 var (
@@ -34,75 +41,96 @@ var (
 	sendConfirmationMenu    = &tb.ReplyMarkup{ResizeReplyKeyboard: true}
 	btnCancelSend           = sendConfirmationMenu.Data("🚫 Cancel", "cancel_send")
 	btnSend                 = sendConfirmationMenu.Data("✅ Send", "confirm_send")
+	linkConfirmationMenu    = &tb.ReplyMarkup{ResizeReplyKeyboard: true}
+	btnCancelLink           = linkConfirmationMenu.Data("🚫 Cancel", "cancel_link")
+	btnLinkAdmin            = linkConfirmationMenu.Data("⚠️ Show admin link", "confirm_link_admin")
 
 	botWalletInitialisation     = sync.Once{}
 	telegramHandlerRegistration = sync.Once{}
 )
 
-// NewBot migrates data and creates a new bot
-func NewBot() TipBot {
-	db, txLogger := migration()
-	return TipBot{
-		database: db,
-		logger:   txLogger,
-		bunt:     storage.NewBunt(Configuration.Database.BuntDbPath),
+// NewBot migrates data and creates a new bot. It fails if the databases can't be opened.
+func NewBot() (TipBot, error) {
+	db, txLogger, err := migration()
+	if err != nil {
+		return TipBot{}, err
+	}
+	store, err := openStore(db)
+	if err != nil {
+		return TipBot{}, err
 	}
+	return TipBot{
+		database:     db,
+		txLogger:     txLogger,
+		users:        gormUsers{db: db},
+		transactions: gormTransactions{db: txLogger},
+		store:        store,
+		dialogs:      make(dialogRegistry),
+		limiter:      newRateLimiter(Configuration.RateLimit),
+		health:       &health.Checker{},
+		inFlight:     newHandlerTracker(),
+	}, nil
 }
 
-// newTelegramBot will create a new telegram bot.
-func newTelegramBot() *tb.Bot {
-	tgb, err := tb.NewBot(tb.Settings{
+// newTelegramBot will create a new telegram bot. It fails if the Telegram API is not reachable or the api key is wrong.
+func newTelegramBot() (*tb.Bot, error) {
+	return tb.NewBot(tb.Settings{
 		Token:     Configuration.Telegram.ApiKey,
-		Poller:    &tb.LongPoller{Timeout: 60 * time.Second},
+		Poller:    newTelegramPoller(),
 		ParseMode: tb.ModeMarkdown,
 	})
-	if err != nil {
-		panic(err)
-	}
-	return tgb
 }
 
 // initBotWallet will create / initialize the bot wallet
 // todo -- may want to derive user wallets from this specific bot wallet (master wallet), since lnbits usermanager extension is able to do that.
 func (bot TipBot) initBotWallet() error {
+	var err error
 	botWalletInitialisation.Do(func() {
-		err := bot.initWallet(bot.telegram.Me)
+		err = bot.initWallet(bot.telegram.Me)
 		if err != nil {
 			log.Errorln(fmt.Sprintf("[initBotWallet] Could not initialize bot wallet: %s", err.Error()))
-			return
 		}
 	})
-	return nil
+	return err
 }
 
 // registerTelegramHandlers will register all telegram handlers.
 func (bot TipBot) registerTelegramHandlers() {
 	telegramHandlerRegistration.Do(func() {
-		// Set up handlers
+		// commands are deleted in groups, the bot replies in the private chat
+		dispose := bot.autoDispose(0)
+		faucet := bot.handle(bot.faucetHandler, bot.requireWallet)
+		// Set up handlers, messages recover in bot.handle and inline queries on their own
 		var endpointHandler = map[string]interface{}{
-			"/tip":                  bot.tipHandler,
-			"/pay":                  bot.confirmPaymentHandler,
-			"/invoice":              bot.invoiceHandler,
-			"/balance":              bot.balanceHandler,
-			"/start":                bot.startHandler,
-			"/send":                 bot.confirmSendHandler,
-			"/help":                 bot.helpHandler,
-			"/basics":               bot.basicsHandler,
-			"/donate":               bot.donationHandler,
-			"/advanced":             bot.advancedHelpHandler,
-			"/link":                 bot.lndhubHandler,
-			"/lnurl":                bot.lnurlHandler,
-			"/faucet":               bot.faucetHandler,
-			"/zapfhahn":             bot.faucetHandler,
-			"/kraan":                bot.faucetHandler,
-			tb.OnPhoto:              bot.privatePhotoHandler,
-			tb.OnText:               bot.anyTextHandler,
-			tb.OnQuery:              bot.anyQueryHandler,
-			tb.OnChosenInlineResult: bot.anyChosenInlineHandler,
+			"/tip":                  bot.handle(bot.tipHandler, bot.disposeTip),
+			"/pay":                  bot.handle(bot.confirmPaymentHandler, dispose, bot.requirePrivate, bot.requireWallet),
+			"/invoice":              bot.handle(bot.invoiceHandler, dispose, bot.requirePrivate, bot.requireWallet),
+			"/balance":              bot.handle(bot.balanceHandler, dispose, bot.requireWallet),
+			"/start":                bot.handle(bot.startHandler),
+			"/send":                 bot.handle(bot.confirmSendHandler, bot.requireWallet),
+			"/help":                 bot.handle(bot.helpHandler, dispose),
+			"/basics":               bot.handle(bot.basicsHandler, dispose),
+			"/donate":               bot.handle(bot.donationHandler, bot.requireWallet),
+			"/advanced":             bot.handle(bot.advancedHelpHandler, dispose),
+			"/link":                 bot.handle(bot.lndhubHandler, dispose, bot.requireWallet),
+			"/lnurl":                bot.handle(bot.lnurlHandler, dispose, bot.requireWallet),
+			"/address":              bot.handle(bot.addressHandler, dispose, bot.requireWallet),
+			"/cancel":               bot.handle(bot.cancelHandler, dispose),
+			"/limits":               bot.handle(bot.limitsHandler, dispose, bot.requireWallet),
+			"/pin":                  bot.handle(bot.pinHandler, dispose, bot.requirePrivate, bot.requireWallet),
+			"/admin":                bot.handle(bot.adminHandler, bot.requireAdmin, bot.requirePrivate),
+			"/faucet":               faucet,
+			"/zapfhahn":             faucet,
+			"/kraan":                faucet,
+			tb.OnPhoto:              bot.handle(bot.privatePhotoHandler, bot.ignoreGroups, bot.requireWallet),
+			tb.OnText:               bot.handle(bot.anyTextHandler, bot.ignoreGroups, bot.requireWallet),
+			tb.OnQuery:              bot.recovered(bot.anyQueryHandler),
+			tb.OnChosenInlineResult: bot.recovered(bot.anyChosenInlineHandler),
 		}
 		// assign handler to endpoint
 		for endpoint, handler := range endpointHandler {
 			log.Debugf("Registering: %s", endpoint)
+			handler = bot.tracked(bot.rateLimited(bot.measured(endpoint, handler)))
 			bot.telegram.Handle(endpoint, handler)
 
 			// if the endpoint is a string command (not photo etc)
@@ -112,44 +140,122 @@ func (bot TipBot) registerTelegramHandlers() {
 			}
 		}
 
+		// text input of dialogs
+		bot.registerDialogSteps()
+
 		// button handlers
 		// for /pay
-		bot.telegram.Handle(&btnPay, bot.payHandler)
-		bot.telegram.Handle(&btnCancelPay, bot.cancelPaymentHandler)
+		bot.handleButton(&btnPay, bot.payHandler)
+		bot.handleButton(&btnCancelPay, bot.cancelPaymentHandler)
 		// for /send
-		bot.telegram.Handle(&btnSend, bot.sendHandler)
-		bot.telegram.Handle(&btnCancelSend, bot.cancelSendHandler)
+		bot.handleButton(&btnSend, bot.sendHandler)
+		bot.handleButton(&btnCancelSend, bot.cancelSendHandler)
+		// for /link
+		bot.handleButton(&btnLinkAdmin, bot.linkAdminHandler)
+		bot.handleButton(&btnCancelLink, bot.cancelLinkHandler)
 
 		// register inline button handlers
 		// button for inline send
-		bot.telegram.Handle(&btnAcceptInlineSend, bot.acceptInlineSendHandler)
-		bot.telegram.Handle(&btnCancelInlineSend, bot.cancelInlineSendHandler)
+		bot.handleButton(&btnAcceptInlineSend, bot.acceptInlineSendHandler)
+		bot.handleButton(&btnCancelInlineSend, bot.cancelInlineSendHandler)
 
 		// button for inline receive
-		bot.telegram.Handle(&btnAcceptInlineReceive, bot.acceptInlineReceiveHandler)
-		bot.telegram.Handle(&btnCancelInlineReceive, bot.cancelInlineReceiveHandler)
+		bot.handleButton(&btnAcceptInlineReceive, bot.acceptInlineReceiveHandler)
+		bot.handleButton(&btnCancelInlineReceive, bot.cancelInlineReceiveHandler)
 
 		// // button for inline faucet
-		bot.telegram.Handle(&btnAcceptInlineFaucet, bot.accpetInlineFaucetHandler)
-		bot.telegram.Handle(&btnCancelInlineFaucet, bot.cancelInlineFaucetHandler)
+		bot.handleButton(&btnAcceptInlineFaucet, bot.accpetInlineFaucetHandler)
+		bot.handleButton(&btnCancelInlineFaucet, bot.cancelInlineFaucetHandler)
 
 	})
 }
 
-// Start will initialize the telegram bot and lnbits.
-func (bot TipBot) Start() {
+// lnurlServerOptions returns the options of the LNURL server from the configuration
+func lnurlServerOptions() []lnurl.ServerOption {
+	var options []lnurl.ServerOption
+	if len(Configuration.Nostr.PrivateKey) > 0 {
+		key, err := nostr.ParseSecretKey(Configuration.Nostr.PrivateKey)
+		if err != nil {
+			log.Errorf("Could not parse nostr private key, zaps are disabled: %s", err.Error())
+		} else {
+			log.Infof("[Nostr] Zaps enabled with public key %s", nostr.PublicKey(key))
+			options = append(options, lnurl.WithNostr(key, Configuration.Nostr.Relays, nostr.NewWebsocketPublisher(Configuration.Nostr.Relays)))
+		}
+	}
+	return options
+}
+
+// webhookServerOptions returns the options of the webhook server from the configuration
+func (bot TipBot) webhookServerOptions() []lnbits.WebhookServerOption {
+	var options []lnbits.WebhookServerOption
+	if webhook, ok := bot.telegram.Poller.(*telegramWebhook); ok {
+		options = append(options, lnbits.WithHandler(telegramWebhookPath(), webhook))
+	}
+	if len(Configuration.Lnbits.WebhookTLSCert) > 0 {
+		options = append(options, lnbits.WithTLS(Configuration.Lnbits.WebhookTLSCert, Configuration.Lnbits.WebhookTLSKey))
+	}
+	return options
+}
+
+// Start will initialize the telegram bot and lnbits. It fails if a required dependency is down
+// or a server can't be started.
+func (bot TipBot) Start() error {
+	var err error
 	// set up lnbits api
 	bot.client = lnbits.NewClient(Configuration.Lnbits.AdminKey, Configuration.Lnbits.Url)
 	// set up telebot
-	bot.telegram = newTelegramBot()
+	bot.telegram, err = newTelegramBot()
+	if err != nil {
+		return fmt.Errorf("could not connect to the Telegram API: %w", err)
+	}
 	log.Infof("[Telegram] Authorized on account @%s", bot.telegram.Me.Username)
 	// initialize the bot wallet
-	err := bot.initBotWallet()
+	err = bot.initBotWallet()
 	if err != nil {
-		log.Errorf("Could not initialize bot wallet: %s", err.Error())
+		return fmt.Errorf("could not initialize the bot wallet with LNbits at %s: %w", Configuration.Lnbits.Url, err)
 	}
+	bot.health.Add(bot.healthChecks()...)
+	err = bot.checkHealth()
+	if err != nil {
+		return err
+	}
+	// release what a crashed bot left behind before new updates are handled
+	bot.resetInlineLocks()
+	bot.recoverInlinePayments(0)
 	bot.registerTelegramHandlers()
-	lnbits.NewWebhookServer(Configuration.Lnbits.WebhookServerUrl, bot.telegram, bot.client, bot.database)
-	lnurl.NewServer(Configuration.Bot.LNURLServerUrl, Configuration.Bot.LNURLHostUrl, Configuration.Lnbits.WebhookServer, bot.telegram, bot.client, bot.database)
+	bot.startPanicAlerts()
+	bot.registerMetrics()
+	servers := make(map[string]httpServer)
+	monitoringServer, err := bot.startMonitoringServer()
+	if err != nil {
+		return err
+	}
+	if monitoringServer != nil {
+		servers["metrics"] = monitoringServer
+	}
+	webhookServer, err := lnbits.NewWebhookServer(Configuration.Lnbits.WebhookServerUrl, bot.telegram, bot.client, bot.database, bot.webhookServerOptions()...)
+	if err != nil {
+		bot.shutdown(servers)
+		return err
+	}
+	servers["webhook"] = webhookServer
+	lnurlServer, err := lnurl.NewServer(Configuration.Bot.LNURLServerUrl, Configuration.Bot.LNURLHostUrl, Configuration.Lnbits.WebhookServer, bot.telegram, bot.client, bot.database, lnurlServerOptions()...)
+	if err != nil {
+		bot.shutdown(servers)
+		return err
+	}
+	servers["LNURL"] = lnurlServer
+	webhookServer.AddListener(lnurlServer)
+	bot.startJanitor()
+	err = bot.configureTelegramUpdates()
+	if err != nil {
+		bot.shutdown(servers)
+		return err
+	}
+	bot.stopOnSignal()
+	bot.reloadOnSignal()
+	// blocks until the bot receives SIGTERM
 	bot.telegram.Start()
+	bot.shutdown(servers)
+	return nil
 }
@@ -1,81 +1,435 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 
+	"github.com/LightningTipBot/LightningTipBot/internal/nostr"
+	"github.com/LightningTipBot/LightningTipBot/internal/secret"
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
 	"github.com/jinzhu/configor"
 	log "github.com/sirupsen/logrus"
 )
 
-var Configuration = struct {
-	Bot      BotConfiguration      `yaml:"bot"`
-	Telegram TelegramConfiguration `yaml:"telegram"`
-	Database DatabaseConfiguration `yaml:"database"`
-	Lnbits   LnbitsConfiguration   `yaml:"lnbits"`
-}{}
+// Configuration of the bot, see loadConfiguration
+var Configuration AppConfiguration
+
+// configurationMu guards the settings that are reloaded while the bot runs, see reloadConfiguration
+var configurationMu sync.RWMutex
+
+// AppConfiguration is the content of config.yaml. Every setting can be overridden with the
+// environment variable in its env tag, lists as YAML, e.g. ["wss://relay.damus.io"].
+type AppConfiguration struct {
+	Bot       BotConfiguration       `yaml:"bot"`
+	Telegram  TelegramConfiguration  `yaml:"telegram"`
+	Database  DatabaseConfiguration  `yaml:"database"`
+	Lnbits    LnbitsConfiguration    `yaml:"lnbits"`
+	Nostr     NostrConfiguration     `yaml:"nostr"`
+	Spending  SpendingConfiguration  `yaml:"spending"`
+	RateLimit RateLimitConfiguration `yaml:"rate_limit"`
+}
 
 type BotConfiguration struct {
-	HttpProxy      string   `yaml:"http_proxy"`
-	LNURLServer    string   `yaml:"lnurl_server"`
-	LNURLServerUrl *url.URL `yaml:"-"`
-	LNURLHostName  string   `yaml:"lnurl_public_host_name"`
-	LNURLHostUrl   *url.URL `yaml:"-"`
+	HttpProxy      string   `yaml:"http_proxy" env:"LIGHTNINGTIPBOT_BOT_HTTP_PROXY"`
+	LNURLServer    string   `yaml:"lnurl_server" env:"LIGHTNINGTIPBOT_BOT_LNURL_SERVER"`
+	LNURLServerUrl *url.URL `yaml:"-" env:"-"`
+	LNURLHostName  string   `yaml:"lnurl_public_host_name" env:"LIGHTNINGTIPBOT_BOT_LNURL_PUBLIC_HOST_NAME"`
+	LNURLHostUrl   *url.URL `yaml:"-" env:"-"`
+	// MetricsServer serves Prometheus metrics at /metrics, empty disables it
+	MetricsServer    string   `yaml:"metrics_server" env:"LIGHTNINGTIPBOT_BOT_METRICS_SERVER"`
+	MetricsServerUrl *url.URL `yaml:"-" env:"-"`
 }
 
 type TelegramConfiguration struct {
-	MessageDisposeDuration int64  `yaml:"message_dispose_duration"`
-	ApiKey                 string `yaml:"api_key"`
+	MessageDisposeDuration int64  `yaml:"message_dispose_duration" env:"LIGHTNINGTIPBOT_TELEGRAM_MESSAGE_DISPOSE_DURATION"`
+	ApiKey                 string `yaml:"api_key" env:"LIGHTNINGTIPBOT_TELEGRAM_API_KEY"`
+	// AdminChatID receives summaries of panics and alerts of PIN lockouts, 0 disables them
+	AdminChatID int64 `yaml:"admin_chat_id" env:"LIGHTNINGTIPBOT_TELEGRAM_ADMIN_CHAT_ID"`
+	// AdminIDs are the Telegram user IDs of the operators that can use /admin
+	AdminIDs []int `yaml:"admin_ids" env:"LIGHTNINGTIPBOT_TELEGRAM_ADMIN_IDS"`
+	// Updates is how the bot gets updates from Telegram, polling (default) or webhook
+	Updates string `yaml:"updates" env:"LIGHTNINGTIPBOT_TELEGRAM_UPDATES"`
+	// WebhookUrl is the public HTTPS URL of the Telegram webhook. Its path is served by the webhook server of lnbits.
+	WebhookUrl string `yaml:"webhook_url" env:"LIGHTNINGTIPBOT_TELEGRAM_WEBHOOK_URL"`
+	// WebhookSecret is sent by Telegram with every update, 1-256 characters A-Z, a-z, 0-9, _ and -
+	WebhookSecret string `yaml:"webhook_secret" env:"LIGHTNINGTIPBOT_TELEGRAM_WEBHOOK_SECRET"`
+	// WebhookCertificate is the public key certificate that is uploaded to Telegram if it is self-signed
+	WebhookCertificate string `yaml:"webhook_certificate" env:"LIGHTNINGTIPBOT_TELEGRAM_WEBHOOK_CERTIFICATE"`
 }
+
+const (
+	telegramUpdatesPolling = "polling"
+	telegramUpdatesWebhook = "webhook"
+)
+
+const (
+	ephemeralStoreBunt = "bunt"
+	ephemeralStoreSQL  = "sql"
+)
+
 type DatabaseConfiguration struct {
-	DbPath           string `yaml:"db_path"`
-	BuntDbPath       string `yaml:"buntdb_path"`
-	TransactionsPath string `yaml:"transactions_path"`
+	DbPath           string `yaml:"db_path" env:"LIGHTNINGTIPBOT_DATABASE_DB_PATH"`
+	BuntDbPath       string `yaml:"buntdb_path" env:"LIGHTNINGTIPBOT_DATABASE_BUNTDB_PATH"`
+	TransactionsPath string `yaml:"transactions_path" env:"LIGHTNINGTIPBOT_DATABASE_TRANSACTIONS_PATH"`
+	// Driver of the user and transaction databases, sqlite or postgres.
+	// With postgres, db_path and transactions_path are connection strings.
+	Driver string `yaml:"driver" env:"LIGHTNINGTIPBOT_DATABASE_DRIVER"`
+	// EphemeralStore keeps inline objects, dialogs and tooltips, bunt (buntdb_path) or sql (db_path)
+	EphemeralStore string `yaml:"ephemeral_store" env:"LIGHTNINGTIPBOT_DATABASE_EPHEMERAL_STORE"`
+	// AutoMigrate applies pending migrations on startup, otherwise the bot refuses to start
+	AutoMigrate bool `yaml:"auto_migrate" env:"LIGHTNINGTIPBOT_DATABASE_AUTO_MIGRATE"`
+	// MasterKey encrypts the wallet keys in db_path, 32 base64 encoded bytes
+	MasterKey string `yaml:"master_key" env:"LIGHTNINGTIPBOT_MASTER_KEY"`
+	// OldMasterKeys only decrypt wallet keys that were encrypted before the master key was rotated
+	OldMasterKeys []string `yaml:"old_master_keys" env:"LIGHTNINGTIPBOT_OLD_MASTER_KEYS"`
 }
 
 type LnbitsConfiguration struct {
-	AdminId          string   `yaml:"admin_id"`
-	AdminKey         string   `yaml:"admin_key"`
-	Url              string   `yaml:"url"`
-	LnbitsPublicUrl  string   `yaml:"lnbits_public_url"`
-	WebhookServer    string   `yaml:"webhook_server"`
-	WebhookServerUrl *url.URL `yaml:"-"`
+	AdminId          string   `yaml:"admin_id" env:"LIGHTNINGTIPBOT_LNBITS_ADMIN_ID"`
+	AdminKey         string   `yaml:"admin_key" env:"LIGHTNINGTIPBOT_LNBITS_ADMIN_KEY"`
+	Url              string   `yaml:"url" env:"LIGHTNINGTIPBOT_LNBITS_URL"`
+	LnbitsPublicUrl  string   `yaml:"lnbits_public_url" env:"LIGHTNINGTIPBOT_LNBITS_LNBITS_PUBLIC_URL"`
+	WebhookServer    string   `yaml:"webhook_server" env:"LIGHTNINGTIPBOT_LNBITS_WEBHOOK_SERVER"`
+	WebhookServerUrl *url.URL `yaml:"-" env:"-"`
+	// WebhookTLSCert and WebhookTLSKey serve the webhook server with TLS instead of plain HTTP behind a reverse proxy
+	WebhookTLSCert string `yaml:"webhook_tls_cert" env:"LIGHTNINGTIPBOT_LNBITS_WEBHOOK_TLS_CERT"`
+	WebhookTLSKey  string `yaml:"webhook_tls_key" env:"LIGHTNINGTIPBOT_LNBITS_WEBHOOK_TLS_KEY"`
+}
+
+// SpendingConfiguration limits the payments of every user in sat, 0 disables a limit.
+// Users can set lower limits for themselves with /limits.
+type SpendingConfiguration struct {
+	MaxPayment int `yaml:"max_payment" env:"LIGHTNINGTIPBOT_SPENDING_MAX_PAYMENT"`
+	DailyLimit int `yaml:"daily_limit" env:"LIGHTNINGTIPBOT_SPENDING_DAILY_LIMIT"`
+	// ConfirmAbove is the amount above which payments need the PIN of the user or a confirmation code
+	ConfirmAbove int `yaml:"confirm_above" env:"LIGHTNINGTIPBOT_SPENDING_CONFIRM_ABOVE"`
+}
+
+// RateLimitConfiguration limits the commands and button presses per user, the inline queries
+// per user and the commands per group chat. 0 disables a limit.
+type RateLimitConfiguration struct {
+	UserPerMinute  int `yaml:"user_per_minute" env:"LIGHTNINGTIPBOT_RATE_LIMIT_USER_PER_MINUTE"`
+	UserBurst      int `yaml:"user_burst" env:"LIGHTNINGTIPBOT_RATE_LIMIT_USER_BURST"`
+	QueryPerMinute int `yaml:"query_per_minute" env:"LIGHTNINGTIPBOT_RATE_LIMIT_QUERY_PER_MINUTE"`
+	QueryBurst     int `yaml:"query_burst" env:"LIGHTNINGTIPBOT_RATE_LIMIT_QUERY_BURST"`
+	ChatPerMinute  int `yaml:"chat_per_minute" env:"LIGHTNINGTIPBOT_RATE_LIMIT_CHAT_PER_MINUTE"`
+	ChatBurst      int `yaml:"chat_burst" env:"LIGHTNINGTIPBOT_RATE_LIMIT_CHAT_BURST"`
 }
 
-func init() {
-	err := configor.Load(&Configuration, "config.yaml")
+type NostrConfiguration struct {
+	PrivateKey string   `yaml:"private_key" env:"LIGHTNINGTIPBOT_NOSTR_PRIVATE_KEY"`
+	Relays     []string `yaml:"relays" env:"LIGHTNINGTIPBOT_NOSTR_RELAYS"`
+}
+
+// configurationFile is the path of config.yaml, LIGHTNINGTIPBOT_CONFIG overrides it
+var configurationFile = "config.yaml"
+
+// loadConfiguration reads and checks the configuration file, settings in environment variables
+// override the file. The master keys are set for the wallet keys in the user database.
+func loadConfiguration(path string) error {
+	configuration, err := readConfiguration(path)
+	if err != nil {
+		return err
+	}
+	err = setKeyring(configuration.Database)
+	if err != nil {
+		return err
+	}
+	if len(configuration.Lnbits.LnbitsPublicUrl) == 0 {
+		log.Warnf("No lnbits_public_url configured, users can't link their wallets with /link")
+	}
+	configurationMu.Lock()
+	Configuration = configuration
+	configurationMu.Unlock()
+	configurationFile = path
+	return nil
+}
+
+// readConfiguration reads the configuration file and the environment and returns all problems of the configuration
+func readConfiguration(path string) (AppConfiguration, error) {
+	var configuration AppConfiguration
+	var files []string
+	_, err := os.Stat(path)
+	switch {
+	case err == nil:
+		files = append(files, path)
+	case os.IsNotExist(err):
+		// everything can be configured with environment variables. configor would load config.yaml.example instead.
+		log.Warnf("Configuration %s not found, using environment variables", path)
+	default:
+		return configuration, fmt.Errorf("could not read configuration %s: %w", path, err)
+	}
+	err = configor.New(&configor.Config{ENVPrefix: "-", Silent: true, ErrorOnUnmatchedKeys: true}).Load(&configuration, files...)
 	if err != nil {
-		panic(err)
+		return configuration, fmt.Errorf("could not read configuration %s: %w", path, err)
+	}
+	err = configuration.check()
+	if err != nil {
+		return configuration, fmt.Errorf("invalid configuration %s: %w", path, err)
+	}
+	return configuration, nil
+}
+
+// configurationErrors are all problems of a configuration
+type configurationErrors []string
+
+func (e configurationErrors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+func (e *configurationErrors) add(format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, args...))
+}
+
+// webhookSecretPattern are the characters that Telegram allows in the secret token of a webhook
+var webhookSecretPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+// telegramApiKeyPattern is the format of the tokens of @BotFather
+var telegramApiKeyPattern = regexp.MustCompile(`^[0-9]+:[A-Za-z0-9_-]+$`)
+
+// check validates the configuration and parses its URLs. It returns configurationErrors.
+func (c *AppConfiguration) check() error {
+	var problems configurationErrors
+	c.Bot.LNURLServerUrl = checkUrl(&problems, "bot.lnurl_server", c.Bot.LNURLServer, true, "http", "https")
+	c.Bot.LNURLHostUrl = checkUrl(&problems, "bot.lnurl_public_host_name", c.Bot.LNURLHostName, true, "http", "https")
+	c.Bot.MetricsServerUrl = checkUrl(&problems, "bot.metrics_server", c.Bot.MetricsServer, false, "http")
+	checkUrl(&problems, "bot.http_proxy", c.Bot.HttpProxy, false, "http", "https", "socks5")
+
+	if !telegramApiKeyPattern.MatchString(c.Telegram.ApiKey) {
+		problems.add("telegram.api_key must be the token of @BotFather, e.g. 123456789:AAE...")
+	}
+	for _, id := range c.Telegram.AdminIDs {
+		if id <= 0 {
+			problems.add("telegram.admin_ids must be Telegram user IDs, %d is not", id)
+		}
+	}
+	if c.Telegram.MessageDisposeDuration < 0 {
+		problems.add("telegram.message_dispose_duration must not be negative")
+	}
+	switch c.Telegram.Updates {
+	case telegramUpdatesPolling, "":
+	case telegramUpdatesWebhook:
+		webhookUrl, err := url.Parse(c.Telegram.WebhookUrl)
+		if err != nil || webhookUrl.Scheme != "https" || len(webhookUrl.Host) == 0 || len(strings.Trim(webhookUrl.Path, "/")) == 0 {
+			problems.add("telegram.webhook_url must be an https URL with a path, e.g. https://bot.example.com/telegram")
+		}
+		if !webhookSecretPattern.MatchString(c.Telegram.WebhookSecret) {
+			problems.add("telegram.webhook_secret must have 1-256 characters A-Z, a-z, 0-9, _ and -")
+		}
+		checkFile(&problems, "telegram.webhook_certificate", c.Telegram.WebhookCertificate)
+	default:
+		problems.add("telegram.updates %q is unknown, use polling or webhook", c.Telegram.Updates)
+	}
+
+	checkUrl(&problems, "lnbits.url", c.Lnbits.Url, true, "http", "https")
+	if len(c.Lnbits.AdminId) == 0 {
+		problems.add("lnbits.admin_id is missing")
+	}
+	if len(c.Lnbits.AdminKey) == 0 {
+		problems.add("lnbits.admin_key is missing")
 	}
-	webhookUrl, err := url.Parse(Configuration.Lnbits.WebhookServer)
+	if len(c.Lnbits.LnbitsPublicUrl) > 0 {
+		checkUrl(&problems, "lnbits.lnbits_public_url", c.Lnbits.LnbitsPublicUrl, true, "http", "https")
+		if !strings.HasSuffix(c.Lnbits.LnbitsPublicUrl, "/") {
+			c.Lnbits.LnbitsPublicUrl = c.Lnbits.LnbitsPublicUrl + "/"
+		}
+	}
+	c.Lnbits.WebhookServerUrl = checkUrl(&problems, "lnbits.webhook_server", c.Lnbits.WebhookServer, true, "http", "https")
+	if (len(c.Lnbits.WebhookTLSCert) == 0) != (len(c.Lnbits.WebhookTLSKey) == 0) {
+		problems.add("lnbits.webhook_tls_cert and lnbits.webhook_tls_key must be configured together")
+	}
+	checkFile(&problems, "lnbits.webhook_tls_cert", c.Lnbits.WebhookTLSCert)
+	checkFile(&problems, "lnbits.webhook_tls_key", c.Lnbits.WebhookTLSKey)
+
+	switch c.Database.Driver {
+	case storage.DriverSQLite, storage.DriverPostgres, "":
+	default:
+		problems.add("database.driver %q is unknown, use sqlite or postgres", c.Database.Driver)
+	}
+	if len(c.Database.DbPath) == 0 {
+		problems.add("database.db_path is missing")
+	}
+	if len(c.Database.TransactionsPath) == 0 {
+		problems.add("database.transactions_path is missing")
+	}
+	switch c.Database.EphemeralStore {
+	case ephemeralStoreBunt, "":
+		if len(c.Database.BuntDbPath) == 0 {
+			problems.add("database.buntdb_path is missing")
+		}
+	case ephemeralStoreSQL:
+	default:
+		problems.add("database.ephemeral_store %q is unknown, use bunt or sql", c.Database.EphemeralStore)
+	}
+	if len(c.Database.MasterKey) > 0 {
+		if _, err := secret.ParseKeyring(c.Database.MasterKey, c.Database.OldMasterKeys); err != nil {
+			problems.add("database.master_key or database.old_master_keys are invalid: %s", err)
+		}
+	} else if len(c.Database.OldMasterKeys) > 0 {
+		problems.add("database.old_master_keys are configured without database.master_key")
+	}
+
+	if len(c.Nostr.PrivateKey) > 0 {
+		if _, err := nostr.ParseSecretKey(c.Nostr.PrivateKey); err != nil {
+			problems.add("nostr.private_key must be a hex encoded secret key: %s", err)
+		}
+	}
+	for _, relay := range c.Nostr.Relays {
+		checkUrl(&problems, "nostr.relays", relay, true, "ws", "wss")
+	}
+
+	for name, value := range map[string]int{
+		"spending.max_payment":        c.Spending.MaxPayment,
+		"spending.daily_limit":        c.Spending.DailyLimit,
+		"spending.confirm_above":      c.Spending.ConfirmAbove,
+		"rate_limit.user_per_minute":  c.RateLimit.UserPerMinute,
+		"rate_limit.user_burst":       c.RateLimit.UserBurst,
+		"rate_limit.query_per_minute": c.RateLimit.QueryPerMinute,
+		"rate_limit.query_burst":      c.RateLimit.QueryBurst,
+		"rate_limit.chat_per_minute":  c.RateLimit.ChatPerMinute,
+		"rate_limit.chat_burst":       c.RateLimit.ChatBurst,
+	} {
+		if value < 0 {
+			problems.add("%s must not be negative", name)
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return problems
+	}
+	return nil
+}
+
+// checkUrl parses the URL of a setting. The URL must have a host and one of the schemes.
+// Empty settings are problems if they are required.
+func checkUrl(problems *configurationErrors, name string, value string, required bool, schemes ...string) *url.URL {
+	if len(value) == 0 {
+		if required {
+			problems.add("%s is missing", name)
+		}
+		return &url.URL{}
+	}
+	parsed, err := url.Parse(value)
 	if err != nil {
-		panic(err)
+		problems.add("%s is not a URL: %s", name, err)
+		return &url.URL{}
 	}
-	Configuration.Lnbits.WebhookServerUrl = webhookUrl
+	if len(parsed.Host) == 0 || !contains(schemes, parsed.Scheme) {
+		problems.add("%s %q must be a URL with a host, e.g. %s://example.com", name, value, schemes[0])
+	}
+	return parsed
+}
+
+// checkFile checks that the file of a setting exists if the setting is not empty
+func checkFile(problems *configurationErrors, name string, path string) {
+	if len(path) == 0 {
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		problems.add("%s: %s", name, err)
+	}
+}
 
-	lnUrl, err := url.Parse(Configuration.Bot.LNURLServer)
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// setKeyring sets the master keys that encrypt the wallet keys in the user database
+func setKeyring(database DatabaseConfiguration) error {
+	if len(database.MasterKey) == 0 {
+		log.Warnf("No master_key configured, wallet keys are stored in plaintext")
+		secret.SetKeyring(nil)
+		return nil
+	}
+	keyring, err := secret.ParseKeyring(database.MasterKey, database.OldMasterKeys)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	Configuration.Bot.LNURLServerUrl = lnUrl
-	hostname, err := url.Parse(Configuration.Bot.LNURLHostName)
+	secret.SetKeyring(keyring)
+	return nil
+}
+
+// currentConfiguration returns a copy of the configuration. The settings that reloadConfiguration
+// changes must be read with it.
+func currentConfiguration() AppConfiguration {
+	configurationMu.RLock()
+	defer configurationMu.RUnlock()
+	return Configuration
+}
+
+// reloadConfiguration reads the configuration file again and applies the settings that can change
+// while the bot runs: spending, rate_limit, message_dispose_duration, admin_chat_id, lnbits_public_url
+// and http_proxy. Other settings, including all secrets, are applied after a restart.
+func (bot TipBot) reloadConfiguration() error {
+	configuration, err := readConfiguration(configurationFile)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	configurationMu.Lock()
+	Configuration.Spending = configuration.Spending
+	Configuration.RateLimit = configuration.RateLimit
+	Configuration.Telegram.MessageDisposeDuration = configuration.Telegram.MessageDisposeDuration
+	Configuration.Telegram.AdminChatID = configuration.Telegram.AdminChatID
+	Configuration.Lnbits.LnbitsPublicUrl = configuration.Lnbits.LnbitsPublicUrl
+	Configuration.Bot.HttpProxy = configuration.Bot.HttpProxy
+	restart := !reflect.DeepEqual(Configuration, configuration)
+	configurationMu.Unlock()
+	bot.limiter.configure(configuration.RateLimit)
+	if restart {
+		log.Warnf("[Config] Some changed settings of %s are applied after a restart", configurationFile)
 	}
-	Configuration.Bot.LNURLHostUrl = hostname
-	checkLnbitsConfiguration()
+	log.Infof("[Config] Reloaded %s", configurationFile)
+	return nil
 }
 
-func checkLnbitsConfiguration() {
-	if Configuration.Lnbits.Url == "" {
-		panic(fmt.Errorf("please configure a lnbits url"))
+// reloadOnSignal reloads the configuration on SIGHUP
+func (bot TipBot) reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			err := bot.reloadConfiguration()
+			if err != nil {
+				log.Errorf("[Config] Could not reload, keeping the running configuration: %s", err)
+			}
+		}
+	}()
+}
+
+// configCommand checks the configuration file without starting the bot
+func configCommand(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return fmt.Errorf("usage: config check [<config.yaml>]")
+	}
+	path := configurationFile
+	if len(args) > 1 {
+		path = args[1]
 	}
-	if Configuration.Lnbits.LnbitsPublicUrl == "" {
-		log.Warnf("Please specify a lnbits public url otherwise users won't be able to")
-	} else {
-		if !strings.HasSuffix(Configuration.Lnbits.LnbitsPublicUrl, "/") {
-			Configuration.Lnbits.LnbitsPublicUrl = Configuration.Lnbits.LnbitsPublicUrl + "/"
+	_, err := readConfiguration(path)
+	var problems configurationErrors
+	if errors.As(err, &problems) {
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, problem)
 		}
+		return fmt.Errorf("%s has %d problems", path, len(problems))
+	}
+	if err != nil {
+		return err
 	}
+	fmt.Printf("%s is valid\n", path)
+	return nil
 }
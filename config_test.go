@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfiguration writes config.yaml.example with replacements to a temporary file
+func writeConfiguration(t *testing.T, replacements ...string) string {
+	example, err := ioutil.ReadFile("config.yaml.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config.yaml")
+	writeFile(t, path, strings.NewReplacer(replacements...).Replace(string(example)))
+	return path
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigurationEnvironment(t *testing.T) {
+	// every setting can be overridden
+	var check func(typ reflect.Type)
+	check = func(typ reflect.Type) {
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.Type.Kind() == reflect.Struct {
+				check(field.Type)
+				continue
+			}
+			if field.Tag.Get("yaml") != "-" && !strings.HasPrefix(field.Tag.Get("env"), "LIGHTNINGTIPBOT_") {
+				t.Errorf("%s.%s has no environment variable", typ.Name(), field.Name)
+			}
+		}
+	}
+	check(reflect.TypeOf(AppConfiguration{}))
+
+	env := map[string]string{
+		"LIGHTNINGTIPBOT_TELEGRAM_API_KEY":           "42:secret",
+		"LIGHTNINGTIPBOT_DATABASE_AUTO_MIGRATE":      "false",
+		"LIGHTNINGTIPBOT_SPENDING_DAILY_LIMIT":       "5000",
+		"LIGHTNINGTIPBOT_NOSTR_RELAYS":               `["wss://a.example", "wss://b.example"]`,
+		"LIGHTNINGTIPBOT_BOT_LNURL_PUBLIC_HOST_NAME": "https://ln.example",
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+	configuration, err := readConfiguration("config.yaml.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configuration.Telegram.ApiKey != "42:secret" || configuration.Database.AutoMigrate ||
+		configuration.Spending.DailyLimit != 5000 || len(configuration.Nostr.Relays) != 2 ||
+		configuration.Bot.LNURLHostUrl.Host != "ln.example" {
+		t.Errorf("environment was not applied: %+v", configuration)
+	}
+	if configuration.Lnbits.Url != "http://127.0.0.1:5000" {
+		t.Errorf("lnbits.url = %q, want the file", configuration.Lnbits.Url)
+	}
+}
+
+func TestConfigurationProblems(t *testing.T) {
+	path := writeConfiguration(t,
+		`lnurl_server: "https://mylnurl.com"`, `lnurl_server: "mylnurl.com"`,
+		`api_key: "123456789:your-bot-token"`, `api_key: ""`,
+		`driver: "sqlite"`, `driver: "mysql"`,
+		`webhook_tls_cert: ""`, `webhook_tls_cert: "missing.pem"`,
+		`daily_limit: 0`, `daily_limit: -1`,
+	)
+	_, err := readConfiguration(path)
+	var problems configurationErrors
+	if !errors.As(err, &problems) {
+		t.Fatalf("readConfiguration() = %v, want configuration errors", err)
+	}
+	for _, want := range []string{"bot.lnurl_server", "telegram.api_key", "database.driver", "webhook_tls_key must be configured", "missing.pem", "spending.daily_limit"} {
+		if !strings.Contains(problems.Error(), want) {
+			t.Errorf("problems %q don't mention %s", problems, want)
+		}
+	}
+
+	// typos are not ignored
+	_, err = readConfiguration(writeConfiguration(t, "daily_limit:", "dailylimit:"))
+	if err == nil {
+		t.Error("unknown setting was accepted")
+	}
+}
+
+func TestReloadConfiguration(t *testing.T) {
+	path := writeConfiguration(t)
+	configuration, err := readConfiguration(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, previousFile := currentConfiguration(), configurationFile
+	defer func() { Configuration, configurationFile = previous, previousFile }()
+	Configuration, configurationFile = configuration, path
+	bot := TipBot{limiter: newRateLimiter(configuration.RateLimit)}
+
+	example, _ := ioutil.ReadFile(path)
+	writeFile(t, path, strings.NewReplacer(
+		"daily_limit: 0", "daily_limit: 1000",
+		"admin_chat_id: 0", "admin_chat_id: -100",
+		`api_key: "123456789:your-bot-token"`, `api_key: "1:changed"`,
+	).Replace(string(example)))
+	err = bot.reloadConfiguration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := currentConfiguration()
+	if reloaded.Spending.DailyLimit != 1000 || reloaded.Telegram.AdminChatID != -100 {
+		t.Errorf("settings were not reloaded: %+v %+v", reloaded.Spending, reloaded.Telegram)
+	}
+	if reloaded.Telegram.ApiKey != configuration.Telegram.ApiKey {
+		t.Errorf("api_key was reloaded")
+	}
+
+	// an invalid file keeps the running configuration
+	writeFile(t, path, "spending:\n  daily_limit: -5\n")
+	if bot.reloadConfiguration() == nil {
+		t.Error("invalid configuration was reloaded")
+	}
+	if currentConfiguration().Spending.DailyLimit != 1000 {
+		t.Error("invalid configuration changed the spending limits")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const copyBatchSize = 500
+
+// copyStorageCommand copies the users, transactions and the bunt database of config.yaml to
+// other databases, e.g. to a postgres server that is shared by several bots.
+// Rows that already exist in the target are skipped, so the command can be repeated.
+//
+//	LightningTipBot copy-storage -driver postgres -db "host=... dbname=bot" [-transactions "..."]
+func copyStorageCommand(args []string) error {
+	flags := flag.NewFlagSet("copy-storage", flag.ExitOnError)
+	driver := flags.String("driver", storage.DriverPostgres, "driver of the target databases (sqlite or postgres)")
+	dbDsn := flags.String("db", "", "target database of users and, with -ephemeral, inline objects")
+	txDsn := flags.String("transactions", "", "target database of transactions (default -db)")
+	ephemeral := flags.Bool("ephemeral", true, "copy the bunt database to the target database")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if len(*dbDsn) == 0 {
+		flags.Usage()
+		return fmt.Errorf("-db is required")
+	}
+	if len(*txDsn) == 0 {
+		*txDsn = *dbDsn
+	}
+
+	srcDb, srcTx, err := migration()
+	if err != nil {
+		return err
+	}
+	dstDb, dstTx, err := openDatabases(*driver, *dbDsn, *txDsn)
+	if err != nil {
+		return err
+	}
+	err = migrateDatabases(dstDb, dstTx)
+	if err != nil {
+		return err
+	}
+	for _, model := range userModels {
+		n, err := copyTable(srcDb, dstDb, model)
+		if err != nil {
+			return fmt.Errorf("could not copy %T: %w", model, err)
+		}
+		log.Infof("[copy-storage] Copied %d rows of %T", n, model)
+	}
+	n, err := copyTable(srcTx, dstTx, &Transaction{})
+	if err != nil {
+		return fmt.Errorf("could not copy transactions: %w", err)
+	}
+	log.Infof("[copy-storage] Copied %d transactions", n)
+	if *driver == storage.DriverPostgres {
+		// ids were copied, the sequence has to continue after them
+		err = dstTx.Exec("SELECT setval(pg_get_serial_sequence('transactions', 'id'), COALESCE(MAX(id), 1)) FROM transactions").Error
+		if err != nil {
+			return err
+		}
+		err = dstDb.Exec("SELECT setval(pg_get_serial_sequence('account_freezes', 'id'), COALESCE(MAX(id), 1)) FROM account_freezes").Error
+		if err != nil {
+			return err
+		}
+	}
+
+	if *ephemeral {
+		store, err := storage.NewSQLStore(dstDb)
+		if err != nil {
+			return err
+		}
+		items, err := store.CopyFrom(storage.NewBunt(Configuration.Database.BuntDbPath))
+		if err != nil {
+			return fmt.Errorf("could not copy bunt database: %w", err)
+		}
+		log.Infof("[copy-storage] Copied %d items of the bunt database", items)
+	}
+	log.Infof("[copy-storage] Done. Set the driver, db_path and transactions_path in config.yaml to use the new databases.")
+	return nil
+}
+
+// copyTable copies all rows of the table of model from src to dst and returns the number of new rows
+func copyTable(src *gorm.DB, dst *gorm.DB, model interface{}) (int64, error) {
+	var copied int64
+	// rows is a pointer to a slice of the type of model
+	rows := reflect.New(reflect.SliceOf(reflect.TypeOf(model).Elem())).Interface()
+	res := src.Model(model).FindInBatches(rows, copyBatchSize, func(tx *gorm.DB, batch int) error {
+		res := dst.Clauses(clause.OnConflict{DoNothing: true}).Create(rows)
+		copied += res.RowsAffected
+		return res.Error
+	})
+	return copied, res.Error
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"gorm.io/gorm"
+)
+
+func TestCopyTable(t *testing.T) {
+	dir := t.TempDir()
+	srcDb, srcTx, err := openDatabases(storage.DriverSQLite, filepath.Join(dir, "src.db"), filepath.Join(dir, "src_tx.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstDb, dstTx, err := openDatabases(storage.DriverSQLite, filepath.Join(dir, "dst.db"), filepath.Join(dir, "dst.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, db := range [][2]*gorm.DB{{srcDb, srcTx}, {dstDb, dstTx}} {
+		if err := migrateDatabases(db[0], db[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users := gormUsers{db: srcDb}
+	for _, user := range []*lnbits.User{
+		{Name: "1", Telegram: &tb.User{ID: 1, Username: "alice"}, Wallet: &lnbits.Wallet{ID: "w1"}},
+		{Name: "2", Telegram: &tb.User{ID: 2, Username: "bob"}, Wallet: &lnbits.Wallet{ID: "w2"}},
+	} {
+		if err := users.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := (gormTransactions{db: srcTx}).SaveTransaction(&Transaction{FromId: 1, ToId: 2, Amount: 21}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		n, err := copyTable(srcDb, dstDb, &lnbits.User{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := int64(2 - 2*i); n != want {
+			t.Errorf("copyTable() of users run %d = %d, want %d", i, n, want)
+		}
+	}
+	if n, err := copyTable(srcTx, dstTx, &Transaction{}); err != nil || n != 1 {
+		t.Errorf("copyTable() of transactions = %d, %v", n, err)
+	}
+	user, err := gormUsers{db: dstDb}.GetUserByUsername("Bob")
+	if err != nil || user.Wallet.ID != "w2" {
+		t.Errorf("GetUserByUsername() = %+v, %v", user, err)
+	}
+}
@@ -1,74 +1,130 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
-	"strconv"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	"github.com/LightningTipBot/LightningTipBot/internal/lnurl"
+	"github.com/LightningTipBot/LightningTipBot/internal/migrations"
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
 	tb "gopkg.in/tucnak/telebot.v2"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-func migration() (db *gorm.DB, txLogger *gorm.DB) {
-	txLogger, err := gorm.Open(sqlite.Open(Configuration.Database.TransactionsPath), &gorm.Config{DisableForeignKeyConstraintWhenMigrating: true, FullSaveAssociations: true})
+var gormConfig = &gorm.Config{DisableForeignKeyConstraintWhenMigrating: true, FullSaveAssociations: true}
+
+// userModels are the tables of the user database that copy-storage copies
+var userModels = []interface{}{&lnbits.User{}, &lnbits.InvoiceWebhook{}, &lnurl.Alias{}, &lnurl.ZapRequest{}, &AccountFreeze{}}
+
+// migration opens the user and transaction databases and checks that their migrations are applied
+func migration() (db *gorm.DB, txLogger *gorm.DB, err error) {
+	db, txLogger, err = openDatabases(Configuration.Database.Driver, Configuration.Database.DbPath, Configuration.Database.TransactionsPath)
 	if err != nil {
-		panic("Initialize orm failed.")
+		return nil, nil, fmt.Errorf("could not open databases: %w", err)
 	}
+	for _, migrator := range []*migrations.Migrator{newUserMigrator(db), newTransactionMigrator(txLogger)} {
+		err = migrator.Check()
+		if errors.Is(err, migrations.ErrPending) && Configuration.Database.AutoMigrate {
+			_, err = migrator.Up()
+		}
+		if errors.Is(err, migrations.ErrPending) {
+			return nil, nil, fmt.Errorf("%w, run `LightningTipBot migrate up` or set auto_migrate in config.yaml", err)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return db, txLogger, nil
+}
 
-	orm, err := gorm.Open(sqlite.Open(Configuration.Database.DbPath), &gorm.Config{DisableForeignKeyConstraintWhenMigrating: true, FullSaveAssociations: true})
+// migrateDatabases applies all pending migrations of the user and transaction databases
+func migrateDatabases(db *gorm.DB, txLogger *gorm.DB) error {
+	_, err := newUserMigrator(db).Up()
 	if err != nil {
-		panic("Initialize orm failed.")
+		return err
 	}
+	_, err = newTransactionMigrator(txLogger).Up()
+	return err
+}
 
-	err = orm.AutoMigrate(&lnbits.User{})
+// openDatabases opens the user and transaction databases
+func openDatabases(driver string, dbDsn string, txDsn string) (db *gorm.DB, txLogger *gorm.DB, err error) {
+	txLogger, err = storage.OpenSQL(driver, txDsn, gormConfig)
 	if err != nil {
-		panic(err)
+		return nil, nil, fmt.Errorf("could not open transaction database: %w", err)
 	}
-	err = txLogger.AutoMigrate(&Transaction{})
+	db, err = storage.OpenSQL(driver, dbDsn, gormConfig)
 	if err != nil {
-		panic(err)
+		return nil, nil, fmt.Errorf("could not open database: %w", err)
+	}
+	return db, txLogger, nil
+}
+
+// openStore opens the store of inline objects, dialogs and tooltips configured in ephemeral_store
+func openStore(db *gorm.DB) (storage.Store, error) {
+	switch Configuration.Database.EphemeralStore {
+	case ephemeralStoreBunt, "":
+		store, err := storage.OpenBunt(Configuration.Database.BuntDbPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not open bunt database %s: %w", Configuration.Database.BuntDbPath, err)
+		}
+		return store, nil
+	case ephemeralStoreSQL:
+		return storage.NewSQLStore(db)
 	}
-	return orm, txLogger
+	return nil, fmt.Errorf("unknown ephemeral store %s", Configuration.Database.EphemeralStore)
 }
 
 // GetUser from telegram user. Update the user if user information changed.
 func GetUser(u *tb.User, bot TipBot) (*lnbits.User, error) {
-	user := &lnbits.User{Name: strconv.Itoa(u.ID)}
-	tx := bot.database.First(user)
-	if tx.Error != nil {
+	user, err := bot.users.GetUser(u.ID)
+	if err != nil {
 		errmsg := fmt.Sprintf("[GetUser] Couldn't fetch %s's info from database.", GetUserStr(u))
 		log.Warnln(errmsg)
-		return user, tx.Error
+		return user, err
 	}
 	defer func() {
 		user.Wallet.Client = bot.client
 	}()
-	var err error
-	go func() {
-		userCopy := bot.copyLowercaseUser(u)
-		if !reflect.DeepEqual(userCopy, user.Telegram) {
-			// update possibly changed user details in database
-			user.Telegram = userCopy
-			err = UpdateUserRecord(user, bot)
+	userCopy := bot.copyLowercaseUser(u)
+	if reflect.DeepEqual(userCopy, user.Telegram) {
+		return user, nil
+	}
+	formerUsername := ""
+	if user.Telegram != nil && user.Telegram.Username != userCopy.Username {
+		formerUsername = user.Telegram.Username
+	}
+	user.Telegram = userCopy
+	// update possibly changed user details in database, only the telegram details so that
+	// concurrent changes of the user are kept
+	changed := &lnbits.User{Name: user.Name, Telegram: userCopy}
+	bot.goTracked("GetUser", func() {
+		// keep the Lightning address of a former username working for a while
+		if len(formerUsername) > 0 {
+			err := lnurl.RecordFormerUsername(bot.database, changed.Name, formerUsername)
 			if err != nil {
-				log.Warnln(fmt.Sprintf("[UpdateUserRecord] %s", err.Error()))
+				log.Warnln(fmt.Sprintf("[RecordFormerUsername] %s", err.Error()))
 			}
 		}
-	}()
-	return user, err
+		err := bot.users.SaveTelegram(changed)
+		if err != nil {
+			log.Warnln(fmt.Sprintf("[UpdateUserRecord] %s", err.Error()))
+		}
+	})
+	return user, nil
 }
 
 func UpdateUserRecord(user *lnbits.User, bot TipBot) error {
 	user.Telegram = bot.copyLowercaseUser(user.Telegram)
-	tx := bot.database.Save(user)
-	if tx.Error != nil {
+	err := bot.users.SaveUser(user)
+	if err != nil {
 		errmsg := fmt.Sprintf("[UpdateUserRecord] Error: Couldn't update %s's info in database.", GetUserStr(user.Telegram))
 		log.Errorln(errmsg)
-		return tx.Error
+		return err
 	}
 	log.Debugf("[UpdateUserRecord] Records of user %s updated.", GetUserStr(user.Telegram))
 	return nil
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const (
+	dialogCancelledMessage = "🚫 Cancelled."
+	dialogNothingMessage   = "There is nothing to cancel."
+	dialogExpiredMessage   = "🚫 This has expired. Please start again."
+	dialogTimeout          = 10 * time.Minute
+)
+
+var errNoDialog = errors.New("no active dialog")
+
+// DialogState is a step of a dialog. States are only meaningful together with the command of the dialog.
+type DialogState string
+
+// Dialog is the persisted state of a multi-step conversation of a user with a command.
+// A user can have one dialog per command. Data holds the typed data of the command as json.
+type Dialog struct {
+	UserID    int             `json:"user_id"`
+	Command   string          `json:"command"`
+	State     DialogState     `json:"state"`
+	Data      json.RawMessage `json:"data"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+func dialogKey(userID int, command string) string {
+	return fmt.Sprintf("dialog:%d:%s", userID, command)
+}
+
+func (d Dialog) Key() string {
+	return dialogKey(d.UserID, d.Command)
+}
+
+// Decode unmarshals the data of the dialog into v
+func (d Dialog) Decode(v interface{}) error {
+	return json.Unmarshal(d.Data, v)
+}
+
+// Expires returns when the dialog is removed from the database
+func (d Dialog) Expires() time.Time {
+	return d.ExpiresAt
+}
+
+func (d Dialog) expired() bool {
+	return time.Now().After(d.ExpiresAt)
+}
+
+// parseDialogAmount parses an amount that the user entered in a dialog
+func parseDialogAmount(text string) (int, error) {
+	amount, err := strconv.Atoi(strings.TrimSpace(text))
+	if err != nil {
+		return 0, err
+	}
+	if amount < 1 {
+		return 0, errors.New("amount must be greater than 0")
+	}
+	return amount, nil
+}
+
+// dialogStep handles a text message of the user in a state of a dialog
+type dialogStep func(m *tb.Message, dialog *Dialog)
+
+// dialogRegistry maps the states of the dialog of each command to the step that handles text input
+type dialogRegistry map[string]map[DialogState]dialogStep
+
+func (r dialogRegistry) register(command string, state DialogState, step dialogStep) {
+	if r[command] == nil {
+		r[command] = make(map[DialogState]dialogStep)
+	}
+	r[command][state] = step
+}
+
+// registerDialogSteps registers the text steps of all dialogs
+func (bot TipBot) registerDialogSteps() {
+	bot.dialogs.register(sendCommand, sendDialogRecipient, bot.sendRecipientStep)
+	bot.dialogs.register(sendCommand, sendDialogAmount, bot.sendAmountStep)
+	bot.dialogs.register(invoiceCommand, invoiceDialogAmount, bot.invoiceAmountStep)
+	bot.dialogs.register(lnurlCommand, lnurlDialogAmount, bot.lnurlEnterAmountHandler)
+	bot.dialogs.register(payCommand, payDialogSecondFactor, bot.paySecondFactorStep)
+	bot.dialogs.register(sendCommand, sendDialogSecondFactor, bot.sendSecondFactorStep)
+}
+
+// startDialog starts or restarts the dialog of a command for the user
+func (bot TipBot) startDialog(user *tb.User, command string, state DialogState, data interface{}) (*Dialog, error) {
+	dialog := &Dialog{UserID: user.ID, Command: command}
+	return dialog, bot.continueDialog(dialog, state, data)
+}
+
+// continueDialog moves the dialog to the next state with new data and extends its expiry
+func (bot TipBot) continueDialog(dialog *Dialog, state DialogState, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	dialog.State = state
+	dialog.Data = b
+	dialog.UpdatedAt = time.Now()
+	dialog.ExpiresAt = dialog.UpdatedAt.Add(dialogTimeout)
+	return bot.store.Set(dialog)
+}
+
+// getDialog returns the active dialog of a command of the user
+func (bot TipBot) getDialog(user *tb.User, command string) (*Dialog, error) {
+	dialog := &Dialog{UserID: user.ID, Command: command}
+	err := bot.store.Get(dialog)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return nil, errNoDialog
+		}
+		return nil, err
+	}
+	if dialog.expired() {
+		bot.endDialog(dialog)
+		return nil, errNoDialog
+	}
+	return dialog, nil
+}
+
+// takeDialog ends the dialog of a command of the user if it is in state and returns it.
+// Of concurrent takes, e.g. two presses of a confirmation button, only one gets the dialog.
+func (bot TipBot) takeDialog(user *tb.User, command string, state DialogState) (*Dialog, error) {
+	dialog := &Dialog{UserID: user.ID, Command: command}
+	err := bot.store.Take(dialog, func() bool {
+		return dialog.State == state && !dialog.expired()
+	})
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return nil, errNoDialog
+		}
+		return nil, err
+	}
+	return dialog, nil
+}
+
+// endDialog removes the dialog
+func (bot TipBot) endDialog(dialog *Dialog) {
+	err := bot.store.DeleteKey(dialog.Key())
+	if err != nil && err != storage.ErrNotFound {
+		log.Errorf("[endDialog] Could not delete dialog %s: %s", dialog.Key(), err)
+	}
+}
+
+// userDialogs returns all active dialogs of the user, the most recent first
+func (bot TipBot) userDialogs(user *tb.User) []*Dialog {
+	var dialogs []*Dialog
+	err := bot.store.Ascend(dialogKey(user.ID, "*"), func(key, value string) bool {
+		dialog := &Dialog{}
+		if json.Unmarshal([]byte(value), dialog) == nil {
+			dialogs = append(dialogs, dialog)
+		}
+		return true
+	})
+	if err != nil {
+		log.Errorf("[userDialogs] %s", err)
+	}
+	var active []*Dialog
+	for _, dialog := range dialogs {
+		if dialog.expired() {
+			bot.endDialog(dialog)
+			continue
+		}
+		active = append(active, dialog)
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].UpdatedAt.After(active[j].UpdatedAt)
+	})
+	return active
+}
+
+// handleDialogText dispatches free text to the most recent dialog of the user.
+// It returns false if no dialog waits for text input.
+func (bot TipBot) handleDialogText(m *tb.Message) bool {
+	if strings.HasPrefix(m.Text, "/") {
+		return false
+	}
+	dialogs := bot.userDialogs(m.Sender)
+	if len(dialogs) == 0 {
+		return false
+	}
+	dialog := dialogs[0]
+	step, ok := bot.dialogs[dialog.Command][dialog.State]
+	if !ok {
+		return false
+	}
+	log.Debugf("[dialog] %s: %s in state %s", GetUserStr(m.Sender), dialog.Command, dialog.State)
+	step(m, dialog)
+	return true
+}
+
+// cancelHandler is invoked on /cancel and ends all dialogs of the user
+func (bot TipBot) cancelHandler(ctx *Context) {
+	m := ctx.Message
+	dialogs := bot.userDialogs(m.Sender)
+	if len(dialogs) == 0 {
+		bot.trySendMessage(m.Sender, dialogNothingMessage)
+		return
+	}
+	for _, dialog := range dialogs {
+		bot.endDialog(dialog)
+	}
+	log.Infof("[/cancel] %s cancelled %d dialogs", GetUserStr(m.Sender), len(dialogs))
+	bot.trySendMessage(m.Sender, dialogCancelledMessage)
+}
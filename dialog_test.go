@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+func newDialogTestBot() TipBot {
+	return TipBot{store: storage.NewBunt(":memory:"), dialogs: make(dialogRegistry)}
+}
+
+func TestDialog(t *testing.T) {
+	bot := newDialogTestBot()
+	user := &tb.User{ID: 1}
+	_, err := bot.startDialog(user, sendCommand, sendDialogAmount, sendDialogData{ToUsername: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialog, err := bot.getDialog(user, sendCommand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data sendDialogData
+	if err := dialog.Decode(&data); err != nil || data.ToUsername != "alice" || dialog.State != sendDialogAmount {
+		t.Fatalf("getDialog() = %+v %+v, %v", dialog, data, err)
+	}
+	if _, err := bot.getDialog(user, payCommand); err != errNoDialog {
+		t.Errorf("getDialog() of other command = %v, want errNoDialog", err)
+	}
+	if _, err := bot.getDialog(&tb.User{ID: 2}, sendCommand); err != errNoDialog {
+		t.Errorf("getDialog() of other user = %v, want errNoDialog", err)
+	}
+
+	// expired dialogs are removed
+	dialog.ExpiresAt = time.Now().Add(-time.Second)
+	if err := bot.store.Set(dialog); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bot.getDialog(user, sendCommand); err != errNoDialog {
+		t.Errorf("getDialog() of expired dialog = %v, want errNoDialog", err)
+	}
+	if len(bot.userDialogs(user)) != 0 {
+		t.Errorf("expired dialog was not removed")
+	}
+}
+
+func TestTipBot_handleDialogText(t *testing.T) {
+	bot := newDialogTestBot()
+	user := &tb.User{ID: 1}
+	var handled []string
+	bot.dialogs.register(invoiceCommand, invoiceDialogAmount, func(m *tb.Message, dialog *Dialog) {
+		handled = append(handled, dialog.Command+":"+m.Text)
+	})
+	bot.dialogs.register(sendCommand, sendDialogAmount, func(m *tb.Message, dialog *Dialog) {
+		handled = append(handled, dialog.Command+":"+m.Text)
+	})
+
+	if bot.handleDialogText(&tb.Message{Sender: user, Text: "100"}) {
+		t.Error("text was handled without a dialog")
+	}
+	if _, err := bot.startDialog(user, invoiceCommand, invoiceDialogAmount, invoiceDialogData{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := bot.startDialog(user, sendCommand, sendDialogAmount, sendDialogData{}); err != nil {
+		t.Fatal(err)
+	}
+	// the most recent dialog gets the text, commands are never dispatched
+	if !bot.handleDialogText(&tb.Message{Sender: user, Text: "100"}) || bot.handleDialogText(&tb.Message{Sender: user, Text: "/balance"}) {
+		t.Error("handleDialogText() dispatched wrongly")
+	}
+	// a state without a text step waits for buttons
+	if _, err := bot.startDialog(user, payCommand, payDialogConfirm, payDialogData{}); err != nil {
+		t.Fatal(err)
+	}
+	if bot.handleDialogText(&tb.Message{Sender: user, Text: "200"}) {
+		t.Error("text was handled in a state without a step")
+	}
+	if len(handled) != 1 || handled[0] != "send:100" {
+		t.Errorf("handled = %v, want [send:100]", handled)
+	}
+}
+
+func Test_parseDialogAmount(t *testing.T) {
+	for text, want := range map[string]int{"100": 100, " 21 ": 21, "0": 0, "-5": 0, "abc": 0} {
+		amount, err := parseDialogAmount(text)
+		if amount != want || (err == nil) != (want > 0) {
+			t.Errorf("parseDialogAmount(%q) = %d, %v, want %d", text, amount, err, want)
+		}
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
 	log "github.com/sirupsen/logrus"
 	tb "gopkg.in/tucnak/telebot.v2"
 )
@@ -38,10 +37,8 @@ func helpDonateUsage(errormsg string) string {
 	}
 }
 
-func (bot TipBot) donationHandler(m *tb.Message) {
-	// check and print all commands
-	bot.anyTextHandler(m)
-
+func (bot TipBot) donationHandler(ctx *Context) {
+	m := ctx.Message
 	if len(strings.Split(m.Text, " ")) < 2 {
 		bot.trySendMessage(m.Sender, helpDonateUsage(donateEnterAmountMessage))
 		return
@@ -72,13 +69,7 @@ func (bot TipBot) donationHandler(m *tb.Message) {
 	}
 
 	// send donation invoice
-	user, err := GetUser(m.Sender, bot)
-	if err != nil {
-		return
-	}
-
-	// bot.trySendMessage(user.Telegram, string(body))
-	_, err = user.Wallet.Pay(lnbits.PaymentParams{Out: true, Bolt11: string(body)}, *user.Wallet)
+	_, err = bot.payInvoice(m.Sender, string(body), amount, "Donation", "donate", false)
 	if err != nil {
 		userStr := GetUserStr(m.Sender)
 		errmsg := fmt.Sprintf("[/donate] Donation failed for user %s: %s", userStr, err)
@@ -156,7 +147,7 @@ func (bot TipBot) parseCmdDonHandler(m *tb.Message) error {
 
   bot.trySendMessage(m.Sender, MarkdownEscape(donationInterceptMessage))
 	m.Text = fmt.Sprintf("/donate %d", amount)
-	bot.donationHandler(m)
+	bot.requireWallet(bot.donationHandler)(&Context{Message: m})
 	// returning nil here will abort the parent handler (/pay or /tip)
 	return nil
 }
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	"github.com/LightningTipBot/LightningTipBot/internal/secret"
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// fakeTelegram is a fake of the Telegram Bot API. It answers all requests, records the calls with
+// their parameters and keeps the messages that the bot sent, edited and deleted.
+type fakeTelegram struct {
+	mu       sync.Mutex
+	requests []telegramCall
+	messages []*fakeMessage
+	answers  map[string][]fakeInlineResult
+	lastID   int
+}
+
+type telegramCall struct {
+	method string
+	params map[string]string
+}
+
+// fakeMessage is a message in a chat of the fake Telegram API. Messages of users have a sender,
+// inline messages have an inline ID instead of a chat.
+type fakeMessage struct {
+	ID       int
+	ChatID   int64
+	InlineID string
+	From     int
+	ReplyTo  *fakeMessage
+	Photo    bool
+	Text     string
+	Buttons  [][]tb.InlineButton
+	Edited   bool
+	Deleted  bool
+}
+
+// fakeInlineResult is a result that the bot answered to an inline query
+type fakeInlineResult struct {
+	ID          string                   `json:"id"`
+	Title       string                   `json:"title"`
+	Text        string                   `json:"message_text"`
+	ReplyMarkup *tb.InlineKeyboardMarkup `json:"reply_markup"`
+}
+
+func newFakeTelegramAPI() *fakeTelegram {
+	return &fakeTelegram{answers: make(map[string][]fakeInlineResult)}
+}
+
+func (f *fakeTelegram) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	path := strings.Split(request.URL.Path, "/")
+	call := telegramCall{method: path[len(path)-1], params: readTelegramParams(request)}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, call)
+	var result interface{} = true
+	switch call.method {
+	case "getMe":
+		result = map[string]interface{}{"id": 1, "is_bot": true, "username": "LightningTipBot"}
+	case "sendMessage", "sendPhoto":
+		text := call.params["text"]
+		if call.method == "sendPhoto" {
+			text = call.params["caption"]
+		}
+		chatID, _ := strconv.ParseInt(call.params["chat_id"], 10, 64)
+		msg := &fakeMessage{ChatID: chatID, Photo: call.method == "sendPhoto", Text: text, Buttons: parseButtons(call.params["reply_markup"])}
+		if replyTo, ok := call.params["reply_to_message_id"]; ok {
+			msg.ReplyTo = f.find(call.params["chat_id"], replyTo, "")
+		}
+		result = f.add(msg).result()
+	case "forwardMessage":
+		chatID, _ := strconv.ParseInt(call.params["chat_id"], 10, 64)
+		forwarded := &fakeMessage{ChatID: chatID}
+		if original := f.find(call.params["from_chat_id"], call.params["message_id"], ""); original != nil {
+			forwarded.Text = original.Text
+		}
+		result = f.add(forwarded).result()
+	case "editMessageText", "editMessageCaption", "editMessageReplyMarkup":
+		msg := f.find(call.params["chat_id"], call.params["message_id"], call.params["inline_message_id"])
+		if msg == nil {
+			break
+		}
+		if text, ok := call.params["text"]; ok {
+			msg.Text = text
+		}
+		if caption, ok := call.params["caption"]; ok {
+			msg.Text = caption
+		}
+		msg.Buttons = parseButtons(call.params["reply_markup"])
+		msg.Edited = true
+		if len(msg.InlineID) == 0 {
+			// Telegram answers edits of inline messages with true
+			result = msg.result()
+		}
+	case "deleteMessage":
+		if msg := f.find(call.params["chat_id"], call.params["message_id"], ""); msg != nil {
+			msg.Deleted = true
+		}
+	case "answerInlineQuery":
+		var results []fakeInlineResult
+		json.Unmarshal([]byte(call.params["results"]), &results)
+		f.answers[call.params["inline_query_id"]] = results
+	}
+	json.NewEncoder(writer).Encode(map[string]interface{}{"ok": true, "result": result})
+}
+
+// readTelegramParams reads the parameters of a JSON or multipart request of telebot. Values that
+// are not strings are kept as JSON.
+func readTelegramParams(request *http.Request) map[string]string {
+	params := make(map[string]string)
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		if request.ParseMultipartForm(1<<20) == nil {
+			for key, values := range request.MultipartForm.Value {
+				params[key] = values[0]
+			}
+		}
+		return params
+	}
+	var values map[string]interface{}
+	if json.NewDecoder(request.Body).Decode(&values) != nil {
+		return params
+	}
+	for key, value := range values {
+		if s, ok := value.(string); ok {
+			params[key] = s
+			continue
+		}
+		b, _ := json.Marshal(value)
+		params[key] = string(b)
+	}
+	return params
+}
+
+func parseButtons(markup string) [][]tb.InlineButton {
+	var keyboard tb.InlineKeyboardMarkup
+	json.Unmarshal([]byte(markup), &keyboard)
+	return keyboard.InlineKeyboard
+}
+
+// add adds a message to its chat and assigns the next message ID. f.mu must be held.
+func (f *fakeTelegram) add(msg *fakeMessage) *fakeMessage {
+	f.lastID++
+	msg.ID = f.lastID
+	f.messages = append(f.messages, msg)
+	return msg
+}
+
+// find returns the message with the ID in the chat or the inline message. f.mu must be held.
+func (f *fakeTelegram) find(chatID string, messageID string, inlineID string) *fakeMessage {
+	for _, msg := range f.messages {
+		if len(inlineID) > 0 && msg.InlineID == inlineID {
+			return msg
+		}
+		if len(inlineID) == 0 && strconv.FormatInt(msg.ChatID, 10) == chatID && strconv.Itoa(msg.ID) == messageID {
+			return msg
+		}
+	}
+	return nil
+}
+
+// result is the message as the Telegram API returns it
+func (msg *fakeMessage) result() map[string]interface{} {
+	result := map[string]interface{}{
+		"message_id": msg.ID,
+		"chat":       map[string]interface{}{"id": msg.ChatID},
+		"date":       time.Now().Unix(),
+	}
+	if msg.Photo {
+		result["photo"] = []map[string]interface{}{{"file_id": fmt.Sprintf("photo%d", msg.ID), "width": 256, "height": 256}}
+		result["caption"] = msg.Text
+	} else {
+		result["text"] = msg.Text
+	}
+	if msg.ReplyTo != nil {
+		result["reply_to_message"] = msg.ReplyTo.result()
+	}
+	return result
+}
+
+// message returns the message as telebot receives it
+func (msg *fakeMessage) message() *tb.Message {
+	if len(msg.InlineID) > 0 {
+		return &tb.Message{InlineID: msg.InlineID}
+	}
+	return &tb.Message{ID: msg.ID, Chat: &tb.Chat{ID: msg.ChatID}, Text: msg.Text}
+}
+
+// button returns the button with the text
+func (msg *fakeMessage) button(text string) (tb.InlineButton, bool) {
+	for _, row := range msg.Buttons {
+		for _, button := range row {
+			if button.Text == text {
+				return button, true
+			}
+		}
+	}
+	return tb.InlineButton{}, false
+}
+
+// addMessage adds a message of a user or an inline message that was sent via the bot
+func (f *fakeTelegram) addMessage(msg *fakeMessage) *fakeMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.add(msg)
+}
+
+// botMessages returns copies of the messages that the bot sent to a chat, including inline messages
+// if chatID is 0
+func (f *fakeTelegram) botMessages(chatID int64) []fakeMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var messages []fakeMessage
+	for _, msg := range f.messages {
+		if msg.From == 0 && msg.ChatID == chatID {
+			messages = append(messages, *msg)
+		}
+	}
+	return messages
+}
+
+// lookup returns a copy of the current state of a message
+func (f *fakeTelegram) lookup(msg *fakeMessage) fakeMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return *msg
+}
+
+// byID returns the message with the ID
+func (f *fakeTelegram) byID(id int) *fakeMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, msg := range f.messages {
+		if msg.ID == id {
+			return msg
+		}
+	}
+	return nil
+}
+
+// inlineAnswer returns the results that the bot answered to an inline query
+func (f *fakeTelegram) inlineAnswer(queryID string) []fakeInlineResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.answers[queryID]
+}
+
+// calls returns the parameters of the calls of a method
+func (f *fakeTelegram) calls(method string) []map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls []map[string]string
+	for _, call := range f.requests {
+		if call.method == method {
+			calls = append(calls, call.params)
+		}
+	}
+	return calls
+}
+
+// waitForCalls waits until method was called n times and returns the parameters of the calls
+func (f *fakeTelegram) waitForCalls(t *testing.T, method string, n int) []map[string]string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(f.calls(method)) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s was called %d times, want %d", method, len(f.calls(method)), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return f.calls(method)
+}
+
+// newFakeTelegram returns a bot that talks to a fake Telegram API and handles updates one by one
+func newFakeTelegram(t *testing.T, poller tb.Poller) (*tb.Bot, *fakeTelegram) {
+	fake := newFakeTelegramAPI()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	telegram, err := tb.NewBot(tb.Settings{URL: server.URL, Token: "test", Poller: poller, Synchronous: true, ParseMode: tb.ModeMarkdown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return telegram, fake
+}
+
+// fakeLNbits is a fake of the user manager and the payments of the LNbits API. Its invoices are
+// signed BOLT11 invoices. Payments of its own invoices are internal, others are paid to the outside.
+// Balances are in msat like in LNbits.
+type fakeLNbits struct {
+	mu       sync.Mutex
+	key      *btcec.PrivateKey
+	users    map[string]*lnbits.User
+	wallets  map[string]*lnbits.Wallet
+	invoices map[string]*fakeInvoice
+	external []string
+	lastID   int
+}
+
+type fakeInvoice struct {
+	hash    string
+	bolt11  string
+	wallet  string
+	amount  int64
+	memo    string
+	webhook string
+	paid    bool
+}
+
+func newFakeLNbits(t *testing.T) (*fakeLNbits, string) {
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeLNbits{
+		key:      key,
+		users:    make(map[string]*lnbits.User),
+		wallets:  make(map[string]*lnbits.Wallet),
+		invoices: make(map[string]*fakeInvoice),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server.URL
+}
+
+func (f *fakeLNbits) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := request.URL.Path
+	var response interface{}
+	var err error
+	switch {
+	case path == "/usermanager/api/v1/users" && request.Method == http.MethodPost:
+		var params struct {
+			WalletName string `json:"wallet_name"`
+			UserName   string `json:"user_name"`
+		}
+		json.NewDecoder(request.Body).Decode(&params)
+		user := f.createUser(params.UserName)
+		f.createWallet(user.ID, params.WalletName)
+		response = user
+	case strings.HasPrefix(path, "/usermanager/api/v1/users/"):
+		user, ok := f.users[strings.TrimPrefix(path, "/usermanager/api/v1/users/")]
+		if !ok {
+			err = fmt.Errorf("user not found")
+			break
+		}
+		response = user
+	case path == "/usermanager/api/v1/wallets" && request.Method == http.MethodPost:
+		var params struct {
+			UserId     string `json:"user_id"`
+			WalletName string `json:"wallet_name"`
+		}
+		json.NewDecoder(request.Body).Decode(&params)
+		response = f.createWallet(params.UserId, params.WalletName)
+	case strings.HasPrefix(path, "/usermanager/api/v1/wallets/") && request.Method == http.MethodDelete:
+		delete(f.wallets, strings.TrimPrefix(path, "/usermanager/api/v1/wallets/"))
+		response = map[string]string{}
+	case strings.HasPrefix(path, "/usermanager/api/v1/wallets/"):
+		wallets := []lnbits.Wallet{}
+		for _, wallet := range f.wallets {
+			if wallet.User == strings.TrimPrefix(path, "/usermanager/api/v1/wallets/") {
+				wallets = append(wallets, *wallet)
+			}
+		}
+		response = wallets
+	case path == "/api/v1/wallet":
+		wallet, ok := f.walletOfKey(request, false)
+		if !ok {
+			err = fmt.Errorf("invalid key")
+			break
+		}
+		response = wallet
+	case path == "/api/v1/payments" && request.Method == http.MethodPost:
+		var params struct {
+			lnbits.InvoiceParams
+			Bolt11 string `json:"bolt11"`
+		}
+		json.NewDecoder(request.Body).Decode(&params)
+		if params.Out {
+			response, err = f.pay(request, params.Bolt11)
+		} else {
+			response, err = f.invoice(request, params.InvoiceParams)
+		}
+	case strings.HasPrefix(path, "/api/v1/payments/"):
+		wallet, ok := f.walletOfKey(request, false)
+		invoice, found := f.invoices[strings.TrimPrefix(path, "/api/v1/payments/")]
+		if !ok || !found || invoice.wallet != wallet.ID {
+			err = fmt.Errorf("payment not found")
+			break
+		}
+		response = lnbits.Payment{Paid: invoice.paid, Details: invoice.details()}
+	default:
+		http.NotFound(writer, request)
+		return
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		response = lnbits.Error{Message: err.Error(), Status: http.StatusBadRequest}
+	}
+	json.NewEncoder(writer).Encode(response)
+}
+
+// createUser creates a user of the user manager. f.mu must be held.
+func (f *fakeLNbits) createUser(name string) *lnbits.User {
+	f.lastID++
+	user := &lnbits.User{ID: fmt.Sprintf("user%d", f.lastID), Name: name}
+	f.users[user.ID] = user
+	return user
+}
+
+// createWallet creates a wallet of a user. f.mu must be held.
+func (f *fakeLNbits) createWallet(userID string, name string) *lnbits.Wallet {
+	f.lastID++
+	wallet := &lnbits.Wallet{
+		ID:       fmt.Sprintf("wallet%d", f.lastID),
+		Adminkey: secret.String(fmt.Sprintf("admin%d", f.lastID)),
+		Inkey:    secret.String(fmt.Sprintf("invoice%d", f.lastID)),
+		Name:     name,
+		User:     userID,
+	}
+	f.wallets[wallet.ID] = wallet
+	return wallet
+}
+
+// walletOfKey returns the wallet of the API key of the request. f.mu must be held.
+func (f *fakeLNbits) walletOfKey(request *http.Request, admin bool) (*lnbits.Wallet, bool) {
+	key := request.Header.Get("X-Api-Key")
+	for _, wallet := range f.wallets {
+		if string(wallet.Adminkey) == key || (!admin && string(wallet.Inkey) == key) {
+			return wallet, true
+		}
+	}
+	return nil, false
+}
+
+// invoice creates an invoice of the wallet of the request. f.mu must be held.
+func (f *fakeLNbits) invoice(request *http.Request, params lnbits.InvoiceParams) (lnbits.BitInvoice, error) {
+	wallet, ok := f.walletOfKey(request, false)
+	if !ok {
+		return lnbits.BitInvoice{}, fmt.Errorf("invalid key")
+	}
+	invoice, err := f.newInvoice(params.Amount, params.Memo, params.DescriptionHash)
+	if err != nil {
+		return lnbits.BitInvoice{}, err
+	}
+	invoice.wallet = wallet.ID
+	invoice.webhook = params.Webhook
+	f.invoices[invoice.hash] = invoice
+	return lnbits.BitInvoice{PaymentHash: invoice.hash, PaymentRequest: invoice.bolt11}, nil
+}
+
+// pay pays an invoice with the wallet of the admin key of the request. f.mu must be held.
+func (f *fakeLNbits) pay(request *http.Request, bolt11 string) (lnbits.BitInvoice, error) {
+	wallet, ok := f.walletOfKey(request, true)
+	if !ok {
+		return lnbits.BitInvoice{}, fmt.Errorf("invalid key")
+	}
+	decoded, err := zpay32.Decode(bolt11, &chaincfg.MainNetParams)
+	if err != nil || decoded.MilliSat == nil {
+		return lnbits.BitInvoice{}, fmt.Errorf("invalid bolt11 invoice")
+	}
+	amount := int64(*decoded.MilliSat)
+	if wallet.Balance < amount {
+		return lnbits.BitInvoice{}, fmt.Errorf("Insufficient balance.")
+	}
+	hash := hex.EncodeToString(decoded.PaymentHash[:])
+	invoice, internal := f.invoices[hash]
+	if internal && invoice.paid {
+		return lnbits.BitInvoice{}, fmt.Errorf("invoice already paid")
+	}
+	wallet.Balance -= amount
+	if !internal {
+		f.external = append(f.external, bolt11)
+		return lnbits.BitInvoice{PaymentHash: hash}, nil
+	}
+	invoice.paid = true
+	f.wallets[invoice.wallet].Balance += amount
+	if len(invoice.webhook) > 0 {
+		// LNbits calls the webhook after the payment
+		go postWebhook(invoice.webhook, invoice.details())
+	}
+	return lnbits.BitInvoice{PaymentHash: hash}, nil
+}
+
+func postWebhook(url string, payment lnbits.Webhook) {
+	body, _ := json.Marshal(payment)
+	resp, err := http.Post(url, "application/json", strings.NewReader(string(body)))
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// newInvoice creates a signed invoice of sat
+func (f *fakeLNbits) newInvoice(sat int64, memo string, descriptionHash string) (*fakeInvoice, error) {
+	var preimage, hash [32]byte
+	_, err := rand.Read(preimage[:])
+	if err != nil {
+		return nil, err
+	}
+	hash = sha256.Sum256(preimage[:])
+	options := []func(*zpay32.Invoice){zpay32.Amount(lnwire.MilliSatoshi(sat * 1000))}
+	if len(descriptionHash) > 0 {
+		var h [32]byte
+		decoded, err := hex.DecodeString(descriptionHash)
+		if err != nil || len(decoded) != len(h) {
+			return nil, fmt.Errorf("invalid description hash")
+		}
+		copy(h[:], decoded)
+		options = append(options, zpay32.DescriptionHash(h))
+	} else {
+		options = append(options, zpay32.Description(memo))
+	}
+	invoice, err := zpay32.NewInvoice(&chaincfg.MainNetParams, hash, time.Now(), options...)
+	if err != nil {
+		return nil, err
+	}
+	bolt11, err := invoice.Encode(zpay32.MessageSigner{SignCompact: func(h []byte) ([]byte, error) {
+		return btcec.SignCompact(btcec.S256(), f.key, h, true)
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return &fakeInvoice{hash: hex.EncodeToString(hash[:]), bolt11: bolt11, amount: sat * 1000, memo: memo}, nil
+}
+
+func (invoice *fakeInvoice) details() lnbits.Webhook {
+	return lnbits.Webhook{
+		PaymentHash: invoice.hash,
+		Amount:      int(invoice.amount),
+		Memo:        invoice.memo,
+		Bolt11:      invoice.bolt11,
+		WalletID:    invoice.wallet,
+		Webhook:     invoice.webhook,
+	}
+}
+
+// externalInvoice returns an invoice of a node outside of LNbits
+func (f *fakeLNbits) externalInvoice(t *testing.T, sat int64, memo string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	invoice, err := f.newInvoice(sat, memo, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return invoice.bolt11
+}
+
+// deposit adds sat to the balance of a wallet as if it received a payment from the outside
+func (f *fakeLNbits) deposit(walletID string, sat int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.wallets[walletID].Balance += int64(sat) * 1000
+}
+
+// balance returns the balance of a wallet in sat
+func (f *fakeLNbits) balance(walletID string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return int(f.wallets[walletID].Balance / 1000)
+}
+
+// externalPayments returns the invoices that were paid to the outside
+func (f *fakeLNbits) externalPayments() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.external...)
+}
+
+// barrierStore holds the first n gets and takes of items with keys starting with prefix until
+// all of them arrived. Gets are held after reading, so that concurrent handlers see the same items.
+type barrierStore struct {
+	storage.Store
+	prefix   string
+	mu       sync.Mutex
+	waiting  int
+	arrived  sync.WaitGroup
+	released chan struct{}
+}
+
+func newBarrierStore(store storage.Store, prefix string, n int) *barrierStore {
+	b := &barrierStore{Store: store, prefix: prefix, released: make(chan struct{})}
+	b.arrived.Add(n)
+	b.waiting = n
+	go func() {
+		b.arrived.Wait()
+		close(b.released)
+	}()
+	return b
+}
+
+func (b *barrierStore) wait(key string) {
+	if !strings.HasPrefix(key, b.prefix) {
+		return
+	}
+	b.mu.Lock()
+	if b.waiting > 0 {
+		b.waiting--
+		b.arrived.Done()
+	}
+	b.mu.Unlock()
+	select {
+	case <-b.released:
+	case <-time.After(time.Second):
+	}
+}
+
+func (b *barrierStore) Get(object storage.Storable) error {
+	err := b.Store.Get(object)
+	b.wait(object.Key())
+	return err
+}
+
+func (b *barrierStore) Take(object storage.Storable, match func() bool) error {
+	b.wait(object.Key())
+	return b.Store.Take(object, match)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const (
+	accountFrozenMessage = "🧊 *Your account is frozen.*\n\n" +
+		"You can't tip, send, pay or link your wallet until the operators of the bot unfreeze it. " +
+		"You can still receive payments, your funds stay in your wallet."
+	accountFrozenNotice    = "\n\n🧊 Your account is frozen. You can receive payments but you can't send or pay."
+	accountUnfrozenMessage = "✅ *Your account was unfrozen.* You can tip, send and pay again."
+)
+
+var errKeysNotRotated = errors.New("keys of the wallet were not rotated")
+
+// AccountFreeze is a freeze or unfreeze of a user by an admin. The history of a user
+// is kept after they were unfrozen, the reason is only shown to admins.
+type AccountFreeze struct {
+	ID       uint      `gorm:"primarykey"`
+	Time     time.Time `json:"time"`
+	UserName string    `json:"user_name" gorm:"index"` // Name of the lnbits.User
+	Frozen   bool      `json:"frozen"`
+	Reason   string    `json:"reason"`
+	AdminID  int       `json:"admin_id"`
+}
+
+// freezeUser stops all payments of the user and tells them if they were not frozen yet. The keys of the wallet are rotated
+// like with /link revoke so that apps that the user linked can't spend either. If that fails,
+// the user is frozen and errKeysNotRotated is returned.
+func (bot TipBot) freezeUser(user *lnbits.User, admin *tb.User, reason string) error {
+	now := time.Now()
+	wasFrozen := user.Frozen
+	user.Frozen, user.FrozenReason, user.FrozenAt = true, reason, &now
+	err := bot.users.SetFrozen(user, &AccountFreeze{Time: now, UserName: user.Name, Frozen: true, Reason: reason, AdminID: admin.ID})
+	if err != nil {
+		return err
+	}
+	log.Warnf("[freeze] %s froze %s: %s", GetUserStr(admin), GetUserStr(user.Telegram), reason)
+	if !wasFrozen {
+		bot.trySendMessage(user.Telegram, accountFrozenMessage)
+	}
+	if user.Wallet == nil {
+		return nil
+	}
+
+	lock, err := bot.store.TryLock("link-revoke:"+strconv.Itoa(user.Telegram.ID), "freeze", linkRevokeTTL)
+	if err != nil {
+		if !errors.Is(err, storage.ErrLocked) {
+			log.Errorf("[freeze] Could not lock %s: %s", GetUserStr(user.Telegram), err)
+		}
+		return errKeysNotRotated
+	}
+	defer bot.store.Release(lock)
+	oldWallet := user.Wallet.ID
+	user.Wallet.Client = bot.client
+	err = bot.revokeLink(user)
+	if err != nil {
+		log.Errorf("[freeze] Could not rotate the keys of %s: %s", GetUserStr(user.Telegram), err)
+		return errKeysNotRotated
+	}
+	log.Infof("[freeze] %s moved from wallet %s to %s", GetUserStr(user.Telegram), oldWallet, user.Wallet.ID)
+	return nil
+}
+
+// unfreezeUser allows the payments of the user again and tells them
+func (bot TipBot) unfreezeUser(user *lnbits.User, admin *tb.User, reason string) error {
+	user.Frozen, user.FrozenReason, user.FrozenAt = false, "", nil
+	err := bot.users.SetFrozen(user, &AccountFreeze{Time: time.Now(), UserName: user.Name, Frozen: false, Reason: reason, AdminID: admin.ID})
+	if err != nil {
+		return err
+	}
+	log.Warnf("[freeze] %s unfroze %s: %s", GetUserStr(admin), GetUserStr(user.Telegram), reason)
+	bot.trySendMessage(user.Telegram, accountUnfrozenMessage)
+	return nil
+}
+
+// frozenStatus describes the freeze of a user for admins
+func frozenStatus(user *lnbits.User) string {
+	if !user.Frozen {
+		return "no"
+	}
+	status := "yes"
+	if user.FrozenAt != nil {
+		status = fmt.Sprintf("since %s", user.FrozenAt.UTC().Format("2006-01-02 15:04 MST"))
+	}
+	if len(user.FrozenReason) > 0 {
+		status = fmt.Sprintf("%s (%s)", status, user.FrozenReason)
+	}
+	return status
+}
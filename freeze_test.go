@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScenario_freeze(t *testing.T) {
+	s := newScenario(t)
+	admin := s.newUser(2000, "admin", 0)
+	alice := s.newUser(2001, "alice", 1000)
+	bob := s.newUser(2002, "bob", 1000)
+	Configuration.Telegram.AdminIDs = []int{admin.ID}
+	oldWallet := s.wallet(alice)
+
+	s.private(admin, "/admin freeze @alice reported stolen phone")
+	s.expect(admin, "@alice is frozen, the keys of their wallet were rotated")
+	s.expect(alice, "Your account is frozen")
+	if s.wallet(alice) == oldWallet {
+		t.Error("the keys of the wallet were not rotated")
+	}
+	s.checkBalance(alice, 1000)
+	s.private(admin, "/admin user @alice")
+	s.expect(admin, "(reported stolen phone)")
+
+	// outgoing payments are stopped
+	refusals := 0
+	refused := func(step string) {
+		t.Helper()
+		refusals++
+		n := 0
+		for _, msg := range s.telegram.botMessages(int64(alice.ID)) {
+			if strings.Contains(msg.Text, errAccountFrozen.Error()) {
+				n++
+			}
+		}
+		if n != refusals {
+			t.Errorf("%s was not refused", step)
+		}
+	}
+	s.private(alice, "/send 10 @bob")
+	refused("/send")
+	s.reply(alice, s.group(bob, "gm"), "/tip 10")
+	refused("/tip")
+	s.group(alice, "/faucet 100 10")
+	refused("/faucet")
+	if results := s.query(alice, "send 10"); len(results) != 1 || !strings.Contains(results[0].Title, errAccountFrozen.Error()) {
+		t.Errorf("inline results = %v, want a frozen account", results)
+	}
+	s.private(alice, "/link")
+	s.expect(alice, "You can't tip, send, pay or link your wallet")
+	s.private(alice, "/balance")
+	s.expect(alice, "Your account is frozen. You can receive payments")
+	s.checkBalance(alice, 1000)
+
+	// deposits still arrive
+	s.reply(bob, s.group(alice, "gm"), "/tip 21")
+	s.expect(alice, "@bob has tipped you 21 sat")
+	s.checkBalance(alice, 1021)
+
+	s.private(admin, "/admin unfreeze @alice verified by phone")
+	s.expect(admin, "@alice is unfrozen")
+	s.expect(alice, accountUnfrozenMessage)
+	s.private(alice, "/send 10 @bob")
+	s.press(alice, s.expect(alice, "Do you want to pay to @bob?"), btnSend.Text)
+	s.expect(alice, "10 sat sent to @bob")
+	s.private(admin, "/admin unfreeze @alice")
+	s.expect(admin, "@alice is not frozen")
+
+	var history []AccountFreeze
+	if err := s.bot.database.Order("id").Find(&history).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || !history[0].Frozen || history[0].Reason != "reported stolen phone" ||
+		history[1].Frozen || history[1].Reason != "verified by phone" || history[1].AdminID != admin.ID {
+		t.Errorf("history = %+v", history)
+	}
+}
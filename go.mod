@@ -3,19 +3,26 @@ module github.com/LightningTipBot/LightningTipBot
 go 1.15
 
 require (
+	github.com/btcsuite/btcd v0.20.1-beta.0.20200515232429-9f0179fd2c46
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1
 	github.com/fiatjaf/go-lnurl v1.4.0
 	github.com/fiatjaf/ln-decodepay v1.1.0
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/imroc/req v0.3.0
 	github.com/jinzhu/configor v1.2.1
+	github.com/lightningnetwork/lnd v0.10.1-beta
 	github.com/makiuchi-d/gozxing v0.0.2
-	github.com/sirupsen/logrus v1.2.0
+	github.com/prometheus/client_golang v1.3.0
+	github.com/sirupsen/logrus v1.4.2
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/tidwall/btree v0.6.1 // indirect
 	github.com/tidwall/buntdb v1.2.6
 	github.com/tidwall/gjson v1.8.1
 	github.com/tidwall/pretty v1.2.0 // indirect
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	gopkg.in/tucnak/telebot.v2 v2.3.5
+	gorm.io/driver/postgres v1.1.0
 	gorm.io/driver/sqlite v1.1.4
 	gorm.io/gorm v1.21.12
 )
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/health"
+	"github.com/LightningTipBot/LightningTipBot/internal/metrics"
+	"github.com/LightningTipBot/LightningTipBot/internal/recovery"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// healthChecks returns the checks of the dependencies of the bot for the readiness endpoint
+func (bot TipBot) healthChecks() []health.Check {
+	return []health.Check{
+		{Name: "lnbits", Check: bot.checkLnbits},
+		{Name: "telegram", Check: func() error {
+			_, err := bot.telegram.Raw("getMe", nil)
+			return err
+		}},
+		{Name: "database", Check: pingDatabase(bot.database)},
+		{Name: "transactions", Check: pingDatabase(bot.txLogger)},
+		{Name: "store", Check: func() error {
+			_, err := bot.store.Stats()
+			return err
+		}},
+	}
+}
+
+// checkLnbits fetches the wallet of the bot from LNbits
+func (bot TipBot) checkLnbits() error {
+	user, err := bot.users.GetUser(bot.telegram.Me.ID)
+	if err != nil {
+		return fmt.Errorf("could not get bot wallet: %w", err)
+	}
+	if user.Wallet == nil {
+		return fmt.Errorf("bot has no wallet")
+	}
+	user.Wallet.Client = bot.client
+	_, err = bot.client.Info(*user.Wallet)
+	return err
+}
+
+// pingDatabase returns a check of a SQL database
+func pingDatabase(db *gorm.DB) func() error {
+	return func() error {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return err
+		}
+		return sqlDB.Ping()
+	}
+}
+
+// checkHealth checks all dependencies at startup
+func (bot TipBot) checkHealth() error {
+	_, err := bot.health.Run()
+	if err != nil {
+		return fmt.Errorf("dependencies are down, %w", err)
+	}
+	log.Infof("[Health] LNbits, Telegram and the databases are available")
+	return nil
+}
+
+// startMonitoringServer serves the metrics at /metrics and the health and readiness probes at /healthz
+// and /readyz of the metrics server, if one is configured
+func (bot TipBot) startMonitoringServer() (*http.Server, error) {
+	if len(Configuration.Bot.MetricsServer) == 0 {
+		return nil, nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", health.Healthz)
+	mux.HandleFunc("/readyz", bot.health.Readyz)
+	server := &http.Server{
+		Handler:      recovery.Middleware("Metrics")(mux),
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+	listener, err := net.Listen("tcp", Configuration.Bot.MetricsServerUrl.Host)
+	if err != nil {
+		return nil, fmt.Errorf("metrics server could not listen at %s: %w", Configuration.Bot.MetricsServerUrl.Host, err)
+	}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("[Metrics] Server stopped: %s", err)
+		}
+	}()
+	log.Infof("[Metrics] Server started at %s", Configuration.Bot.MetricsServerUrl)
+	return server, nil
+}
@@ -38,7 +38,7 @@ const (
 		"❤️ *Donate*\n" +
 		"_This bot charges no fees but costs satoshis to operate. If you like the bot, please consider supporting this project with a donation. To donate, use_ `/donate 1000`"
 
-	helpNoUsernameMessage = "ℹ️ Please set a Telegram username."
+	helpNoUsernameMessage = "ℹ️ Please set a Telegram username or claim an /address."
 
 	advancedMessage = "%s\n\n" +
 		"👉 *Inline commands*\n" +
@@ -47,15 +47,20 @@ const (
 		"*faucet* 🚰 Create a faucet: `%s faucet <capacity> <per_user>`\n\n" +
 		"📖 You can use inline commands in every chat, even in private conversations. Wait a second after entering an inline command and *click* the result, don't press enter.\n\n" +
 		"⚙️ *Advanced commands*\n" +
-		"*/link* 🔗 Link your wallet to [BlueWallet](https://bluewallet.io/) or [Zeus](https://zeusln.app/)\n" +
+		"*/link* 🔗 Link your wallet to [BlueWallet](https://bluewallet.io/) or [Zeus](https://zeusln.app/), `/link readonly` for point-of-sale devices, `/link revoke` if a link got into the wrong hands\n" +
 		"*/lnurl* ⚡️ Lnurl receive or pay: `/lnurl` or `/lnurl <lnurl>`\n" +
-		"*/faucet* 🚰 Create a faucet `/faucet <capacity> <per_user>`"
+		"*/address* 📫 Claim a Lightning Address: `/address <name>`\n" +
+		"*/lnurl settings* ⚙️ Set your receive limits, description and avatar: `/lnurl <min|max> <amount>`, `/lnurl description <text>`, `/lnurl avatar`\n" +
+		"*/faucet* 🚰 Create a faucet `/faucet <capacity> <per_user>`\n" +
+		"*/limits* 🛡 Show or lower your spending limits: `/limits <payment|daily|confirm> <amount>`\n" +
+		"*/pin* 🔐 Set a PIN to confirm large payments: `/pin <pin>`\n" +
+		"*/cancel* 🚫 Cancel the command you are entering"
 )
 
 func (bot TipBot) makeHelpMessage(m *tb.Message) string {
 	dynamicHelpMessage := ""
-	// user has no username set
-	if len(m.Sender.Username) == 0 {
+	// user has no username or alias set
+	if _, err := bot.UserGetLightningAddressName(m.Sender); err != nil {
 		// return fmt.Sprintf(helpMessage, fmt.Sprintf("%s\n\n", helpNoUsernameMessage))
 		dynamicHelpMessage = dynamicHelpMessage + fmt.Sprintf("%s\n", helpNoUsernameMessage)
 	} else {
@@ -71,32 +76,22 @@ func (bot TipBot) makeHelpMessage(m *tb.Message) string {
 	return fmt.Sprintf(helpMessage, dynamicHelpMessage)
 }
 
-func (bot TipBot) helpHandler(m *tb.Message) {
-	// check and print all commands
-	bot.anyTextHandler(m)
-	if !m.Private() {
-		// delete message
-		NewMessage(m, WithDuration(0, bot.telegram))
-	}
+func (bot TipBot) helpHandler(ctx *Context) {
+	m := ctx.Message
 	bot.trySendMessage(m.Sender, bot.makeHelpMessage(m), tb.NoPreview)
 	return
 }
 
-func (bot TipBot) basicsHandler(m *tb.Message) {
-	// check and print all commands
-	bot.anyTextHandler(m)
-	if !m.Private() {
-		// delete message
-		NewMessage(m, WithDuration(0, bot.telegram))
-	}
+func (bot TipBot) basicsHandler(ctx *Context) {
+	m := ctx.Message
 	bot.trySendMessage(m.Sender, infoMessage, tb.NoPreview)
 	return
 }
 
 func (bot TipBot) makeadvancedHelpMessage(m *tb.Message) string {
 	dynamicHelpMessage := ""
-	// user has no username set
-	if len(m.Sender.Username) == 0 {
+	// user has no username or alias set
+	if _, err := bot.UserGetLightningAddressName(m.Sender); err != nil {
 		// return fmt.Sprintf(helpMessage, fmt.Sprintf("%s\n\n", helpNoUsernameMessage))
 		dynamicHelpMessage = dynamicHelpMessage + fmt.Sprintf("%s", helpNoUsernameMessage)
 	} else {
@@ -120,13 +115,8 @@ func (bot TipBot) makeadvancedHelpMessage(m *tb.Message) string {
 	return fmt.Sprintf(advancedMessage, dynamicHelpMessage, GetUserStrMd(bot.telegram.Me), GetUserStrMd(bot.telegram.Me), GetUserStrMd(bot.telegram.Me))
 }
 
-func (bot TipBot) advancedHelpHandler(m *tb.Message) {
-	// check and print all commands
-	bot.anyTextHandler(m)
-	if !m.Private() {
-		// delete message
-		NewMessage(m, WithDuration(0, bot.telegram))
-	}
+func (bot TipBot) advancedHelpHandler(ctx *Context) {
+	m := ctx.Message
 	bot.trySendMessage(m.Sender, bot.makeadvancedHelpMessage(m), tb.NoPreview)
 	return
 }
@@ -26,10 +26,7 @@ func GetMemoFromCommand(command string, fromWord int) string {
 	memo := ""
 	if len(strings.Split(command, " ")) > fromWord {
 		memo = strings.SplitN(command, " ", fromWord+1)[fromWord]
-		memoMaxLen := 159
-		if len(memo) > memoMaxLen {
-			memo = memo[:memoMaxLen]
-		}
+		memo = truncateRunes(memo, 159)
 	}
 	return memo
 }
@@ -41,3 +38,12 @@ func MakeProgressbar(current int, total int) string {
 	progressbar += strings.Repeat("⬜️", MAX_BARS-int(progress))
 	return progressbar
 }
+
+// truncateRunes shortens s to at most n characters without splitting multi-byte characters
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
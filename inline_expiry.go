@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/recovery"
+	"github.com/LightningTipBot/LightningTipBot/internal/runtime"
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const (
+	inlineExpiredMessage = "⌛️ Expired."
+	// inlineExpiry is the time after which inline sends, receives and faucets can't be used anymore
+	inlineExpiry = 24 * time.Hour
+	// inlineRecordTTL is the time after which inline records are removed from the database.
+	// It is longer than inlineExpiry so that the janitor can still edit the expired messages.
+	inlineRecordTTL = 7 * 24 * time.Hour
+	// tooltipTTL is the time after the last tip after which a tip tooltip is forgotten
+	tooltipTTL      = 30 * 24 * time.Hour
+	janitorInterval = 10 * time.Minute
+)
+
+var errInlineExpired = errors.New("inline message expired")
+
+// InlineLifetime is embedded in inline sends, receives and faucets. It tracks their
+// age and the message they were posted in so that they can be expired.
+type InlineLifetime struct {
+	CreatedAt     time.Time         `json:"inline_created_at"`
+	InlineMessage *tb.StoredMessage `json:"inline_message,omitempty"`
+	// Payment is set while a payment of the object is made, see recoverInlinePayments
+	Payment *InlinePayment `json:"inline_payment,omitempty"`
+}
+
+func newInlineLifetime() InlineLifetime {
+	return InlineLifetime{CreatedAt: time.Now()}
+}
+
+// Expires returns when the record is removed from the database
+func (l InlineLifetime) Expires() time.Time {
+	if l.CreatedAt.IsZero() {
+		return time.Time{}
+	}
+	return l.CreatedAt.Add(inlineRecordTTL)
+}
+
+func (l InlineLifetime) expired() bool {
+	return !l.CreatedAt.IsZero() && time.Now().After(l.CreatedAt.Add(inlineExpiry))
+}
+
+func (l *InlineLifetime) lifetime() *InlineLifetime {
+	return l
+}
+
+// inlineObject is an inline send, receive or faucet
+type inlineObject interface {
+	storage.Expirable
+	lifetime() *InlineLifetime
+	isActive() bool
+	deactivate()
+	// revertPayment undoes an interrupted payment that was not made and returns the new text of
+	// the inline message, if it changes
+	revertPayment(payment *InlinePayment) string
+}
+
+// newInlineObject returns an empty inline object for the database key id or nil if id is no inline object
+func newInlineObject(id string) inlineObject {
+	switch {
+	case strings.HasPrefix(id, "inl-send-"):
+		inlineSend := NewInlineSend()
+		inlineSend.ID = id
+		return inlineSend
+	case strings.HasPrefix(id, "inl-receive-"):
+		inlineReceive := NewInlineReceive()
+		inlineReceive.ID = id
+		return inlineReceive
+	case strings.HasPrefix(id, "inl-faucet-"):
+		inlineFaucet := NewInlineFaucet()
+		inlineFaucet.ID = id
+		return inlineFaucet
+	}
+	return nil
+}
+
+// storedMessage returns a reference to msg that can be persisted and edited later
+func storedMessage(msg tb.Editable) *tb.StoredMessage {
+	messageID, chatID := msg.MessageSig()
+	return &tb.StoredMessage{MessageID: messageID, ChatID: chatID}
+}
+
+// checkInlineExpiry remembers the message of the callback and expires the locked object if it is too old.
+// Callbacks of inline messages only have the inline message ID.
+func (bot TipBot) checkInlineExpiry(object inlineObject, lock *storage.Lock, c *tb.Callback) error {
+	lifetime := object.lifetime()
+	remembered := false
+	if lifetime.InlineMessage == nil {
+		if c.Message != nil {
+			lifetime.InlineMessage = storedMessage(c.Message)
+			remembered = true
+		} else if len(c.MessageID) > 0 {
+			lifetime.InlineMessage = &tb.StoredMessage{MessageID: c.MessageID}
+			remembered = true
+		}
+	}
+	if object.isActive() && lifetime.expired() {
+		bot.expireInline(object, lock)
+		return errInlineExpired
+	}
+	if remembered {
+		runtime.IgnoreError(bot.store.SetLocked(lock, object))
+	}
+	return nil
+}
+
+// expireInline deactivates the locked object and replaces its message with inlineExpiredMessage
+func (bot TipBot) expireInline(object inlineObject, lock *storage.Lock) {
+	if msg := object.lifetime().InlineMessage; msg != nil {
+		bot.tryEditMessage(msg, inlineExpiredMessage, &tb.ReplyMarkup{})
+	}
+	object.deactivate()
+	err := bot.store.SetLocked(lock, object)
+	if err != nil {
+		log.Errorf("[Janitor] Could not expire %s: %s", object.Key(), err)
+		return
+	}
+	log.Infof("[Janitor] Expired %s", object.Key())
+}
+
+// anyChosenInlineHandler remembers the message of a chosen inline send, receive or faucet so that
+// the janitor can expire it. Telegram only sends chosen results if inline feedback is enabled with @BotFather.
+func (bot TipBot) anyChosenInlineHandler(q *tb.ChosenInlineResult) {
+	object := newInlineObject(q.ResultID)
+	if object == nil || len(q.MessageID) == 0 {
+		return
+	}
+	lock, err := bot.store.Lock(object.Key(), q.ResultID, inlineLockTTL, inlineLockTimeout)
+	if err != nil {
+		log.Errorf("[anyChosenInlineHandler] Could not lock %s: %s", q.ResultID, err)
+		return
+	}
+	defer bot.unlockInline(lock)
+	err = bot.store.Get(object)
+	if err != nil {
+		log.Errorf("[anyChosenInlineHandler] Could not get %s: %s", q.ResultID, err)
+		return
+	}
+	object.lifetime().InlineMessage = &tb.StoredMessage{MessageID: q.MessageID}
+	runtime.IgnoreError(bot.store.SetLocked(lock, object))
+}
+
+// startJanitor periodically expires old inline messages, reconciles interrupted payments, sweeps retired wallets
+// and logs the size of the database, the rate limits and panics. It stops when the bot stops, a running
+// cleanup is drained like the handlers.
+func (bot TipBot) startJanitor() {
+	go func() {
+		ticker := time.NewTicker(janitorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-bot.inFlight.done():
+				return
+			case <-ticker.C:
+			}
+			if !bot.inFlight.begin() {
+				return
+			}
+			bot.cleanUp()
+			bot.inFlight.end()
+		}
+	}()
+}
+
+// cleanUp runs the tasks of the janitor, a panic of a task is reported and the other tasks still run
+func (bot TipBot) cleanUp() {
+	for _, task := range []struct {
+		name string
+		run  func()
+	}{
+		{"expire inline objects", bot.expireInlineObjects},
+		{"recover inline payments", func() { bot.recoverInlinePayments(inlineLockTTL) }},
+		{"sweep retired wallets", bot.sweepRetiredWallets},
+		{"log store stats", bot.logStoreStats},
+		{"log rate limit stats", bot.logRateLimitStats},
+		{"log panic stats", logPanicStats},
+	} {
+		func() {
+			defer recovery.Recover("janitor", log.Fields{"task": task.name}, nil)
+			task.run()
+		}()
+	}
+}
+
+// expireInlineObjects expires all active inline objects that are older than inlineExpiry and were posted
+// in a known message. Objects without a message are expired when someone presses one of their buttons.
+func (bot TipBot) expireInlineObjects() {
+	var objects []inlineObject
+	err := bot.store.Ascend("inl-*", func(key, value string) bool {
+		object := newInlineObject(key)
+		if object == nil || json.Unmarshal([]byte(value), object) != nil {
+			return true
+		}
+		if janitorShouldExpire(object) {
+			objects = append(objects, object)
+		}
+		return true
+	})
+	if err != nil {
+		log.Errorf("[Janitor] %s", err)
+		return
+	}
+	for _, object := range objects {
+		// objects that are in use are expired in the next run
+		lock, err := bot.store.TryLock(object.Key(), "janitor", inlineLockTTL)
+		if err != nil {
+			continue
+		}
+		// read the object again, it could have changed before it was locked
+		if bot.store.Get(object) == nil && janitorShouldExpire(object) {
+			if object.lifetime().CreatedAt.IsZero() {
+				object.lifetime().CreatedAt = time.Now()
+				runtime.IgnoreError(bot.store.SetLocked(lock, object))
+			} else {
+				bot.expireInline(object, lock)
+			}
+		}
+		bot.unlockInline(lock)
+	}
+}
+
+// janitorShouldExpire returns whether the janitor expires the object or gives it a lifetime.
+// Records that were created before inline objects expired get their lifetime now.
+func janitorShouldExpire(object inlineObject) bool {
+	lifetime := object.lifetime()
+	return lifetime.CreatedAt.IsZero() ||
+		object.isActive() && lifetime.InlineMessage != nil && lifetime.expired()
+}
+
+// logStoreStats logs the number of keys in the store
+func (bot TipBot) logStoreStats() {
+	stats, err := bot.store.Stats()
+	if err != nil {
+		log.Errorf("[Janitor] Could not get database stats: %s", err)
+		return
+	}
+	total := 0
+	prefixes := make([]string, 0, len(stats))
+	for prefix, n := range stats {
+		total += n
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	var counts []string
+	for _, prefix := range prefixes {
+		counts = append(counts, prefix+": "+strconv.Itoa(stats[prefix]))
+	}
+	log.Infof("[Janitor] %d keys in store (%s)", total, strings.Join(counts, ", "))
+}
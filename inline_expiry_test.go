@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+func TestInlineExpiry(t *testing.T) {
+	bot := TipBot{store: storage.NewBunt(":memory:")}
+	inlineSend := NewInlineSend()
+	inlineSend.ID = "inl-send-1-21-abcde"
+	if err := bot.store.Set(inlineSend); err != nil {
+		t.Fatal(err)
+	}
+	_, lock, err := bot.getInlineSend(&tb.Callback{Data: inlineSend.ID, MessageID: "inline-1"})
+	if err != nil {
+		t.Fatalf("getInlineSend() = %v", err)
+	}
+	bot.unlockInline(lock)
+	remembered := newInlineObject(inlineSend.ID)
+	if err := bot.store.Get(remembered); err != nil {
+		t.Fatal(err)
+	}
+	if msg := remembered.lifetime().InlineMessage; msg == nil || msg.MessageID != "inline-1" {
+		t.Errorf("inline message = %+v, want inline-1", msg)
+	}
+
+	inlineSend.CreatedAt = time.Now().Add(-inlineExpiry - time.Minute)
+	if err := bot.store.Set(inlineSend); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := bot.getInlineSend(&tb.Callback{Data: inlineSend.ID}); err != errInlineExpired {
+		t.Fatalf("getInlineSend() of old send = %v, want errInlineExpired", err)
+	}
+	stored := newInlineObject(inlineSend.ID)
+	if err := bot.store.Get(stored); err != nil || stored.isActive() {
+		t.Errorf("expired send is still active: %v", err)
+	}
+}
+
+func TestExpireInlineObjectsLegacy(t *testing.T) {
+	bot := TipBot{store: storage.NewBunt(":memory:")}
+	inlineFaucet := NewInlineFaucet()
+	inlineFaucet.ID = "inl-faucet-1-210-abcde"
+	inlineFaucet.CreatedAt = time.Time{}
+	if err := bot.store.Set(inlineFaucet); err != nil {
+		t.Fatal(err)
+	}
+	bot.expireInlineObjects()
+	stored := NewInlineFaucet()
+	stored.ID = inlineFaucet.ID
+	stored.CreatedAt = time.Time{}
+	if err := bot.store.Get(stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.CreatedAt.IsZero() || !stored.Active {
+		t.Errorf("legacy faucet = %+v, want a lifetime and active", stored)
+	}
+}
+
+func TestInlineFaucetLockRace(t *testing.T) {
+	bot := TipBot{store: storage.NewBunt(":memory:")}
+	inlineFaucet := NewInlineFaucet()
+	inlineFaucet.ID = "inl-faucet-1-100-abcde"
+	inlineFaucet.RemainingAmount = 100
+	if err := bot.store.Set(inlineFaucet); err != nil {
+		t.Fatal(err)
+	}
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			faucet, lock, err := bot.getInlineFaucet(&tb.Callback{ID: strconv.Itoa(i), Data: inlineFaucet.ID})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer bot.unlockInline(lock)
+			faucet.RemainingAmount -= 1
+			if err := bot.store.SetLocked(lock, faucet); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := bot.store.Get(inlineFaucet); err != nil {
+		t.Fatal(err)
+	}
+	if inlineFaucet.RemainingAmount != 100-n {
+		t.Errorf("RemainingAmount = %d, want %d", inlineFaucet.RemainingAmount, 100-n)
+	}
+}
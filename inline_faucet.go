@@ -3,9 +3,9 @@ package main
 import (
 	"fmt"
 	"strconv"
-	"time"
 
 	"github.com/LightningTipBot/LightningTipBot/internal/runtime"
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
 	log "github.com/sirupsen/logrus"
 	tb "gopkg.in/tucnak/telebot.v2"
 )
@@ -40,6 +40,7 @@ var (
 )
 
 type InlineFaucet struct {
+	InlineLifetime
 	Message         string     `json:"inline_faucet_message"`
 	Amount          int        `json:"inline_faucet_amount"`
 	RemainingAmount int        `json:"inline_faucet_remainingamount"`
@@ -52,15 +53,14 @@ type InlineFaucet struct {
 	NTotal          int        `json:"inline_faucet_ntotal"`
 	NTaken          int        `json:"inline_faucet_ntaken"`
 	UserNeedsWallet bool       `json:"inline_faucet_userneedswallet"`
-	InTransaction   bool       `json:"inline_faucet_intransaction"`
 }
 
 func NewInlineFaucet() *InlineFaucet {
 	inlineFaucet := &InlineFaucet{
+		InlineLifetime:  newInlineLifetime(),
 		Message:         "",
 		NTaken:          0,
 		UserNeedsWallet: false,
-		InTransaction:   false,
 		Active:          true,
 	}
 	return inlineFaucet
@@ -71,63 +71,49 @@ func (msg InlineFaucet) Key() string {
 	return msg.ID
 }
 
-func (bot *TipBot) LockFaucet(tx *InlineFaucet) error {
-	// immediatelly set intransaction to block duplicate calls
-	tx.InTransaction = true
-	err := bot.bunt.Set(tx)
-	if err != nil {
-		return err
-	}
-	return nil
+func (msg *InlineFaucet) isActive() bool {
+	return msg.Active
 }
 
-func (bot *TipBot) ReleaseFaucet(tx *InlineFaucet) error {
-	// immediatelly set intransaction to block duplicate calls
-	tx.InTransaction = false
-	err := bot.bunt.Set(tx)
-	if err != nil {
-		return err
+func (msg *InlineFaucet) deactivate() {
+	msg.Active = false
+}
+
+// revertPayment gives the amount of the interrupted payout back to the faucet
+func (msg *InlineFaucet) revertPayment(payment *InlinePayment) string {
+	for i, to := range msg.To {
+		if to.ID == payment.To.ID {
+			msg.To = append(msg.To[:i], msg.To[i+1:]...)
+			msg.NTaken -= 1
+			msg.RemainingAmount += payment.Amount
+			break
+		}
 	}
-	return nil
+	return ""
 }
 
-func (bot *TipBot) inactivateFaucet(tx *InlineFaucet) error {
+func (bot *TipBot) inactivateFaucet(tx *InlineFaucet, lock *storage.Lock) error {
 	tx.Active = false
-	err := bot.bunt.Set(tx)
+	err := bot.store.SetLocked(lock, tx)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// tipTooltipExists checks if this tip is already known
-func (bot *TipBot) getInlineFaucet(c *tb.Callback) (*InlineFaucet, error) {
+// getInlineFaucet locks the inline faucet of the callback and returns it. The lock must be released with unlockInline.
+func (bot *TipBot) getInlineFaucet(c *tb.Callback) (*InlineFaucet, *storage.Lock, error) {
 	inlineFaucet := NewInlineFaucet()
 	inlineFaucet.ID = c.Data
-	err := bot.bunt.Get(inlineFaucet)
-
-	// to avoid race conditions, we block the call if there is
-	// already an active transaction by loop until InTransaction is false
-	ticker := time.NewTicker(time.Second * 10)
-
-	for inlineFaucet.InTransaction {
-		select {
-		case <-ticker.C:
-			return nil, fmt.Errorf("[faucet] faucet %s timeout", inlineFaucet.ID)
-		default:
-			log.Infof("[faucet] faucet %s already in transaction", inlineFaucet.ID)
-			time.Sleep(time.Duration(500) * time.Millisecond)
-			err = bot.bunt.Get(inlineFaucet)
-		}
-	}
+	lock, err := bot.lockInline(inlineFaucet, c)
 	if err != nil {
-		return nil, fmt.Errorf("could not get inline faucet: %s", err)
+		return nil, nil, err
 	}
-	return inlineFaucet, nil
-
+	return inlineFaucet, lock, nil
 }
 
-func (bot TipBot) faucetHandler(m *tb.Message) {
+func (bot TipBot) faucetHandler(ctx *Context) {
+	m := ctx.Message
 	if m.Private() {
 		bot.trySendMessage(m.Sender, fmt.Sprintf(inlineFaucetHelpText, inlineFaucetHelpFaucetInGroup))
 		return
@@ -170,11 +156,18 @@ func (bot TipBot) faucetHandler(m *tb.Message) {
 	}
 	// check if fromUser has balance
 	if balance < inlineFaucet.Amount {
-		log.Errorln("Balance of user %s too low", fromUserStr)
+		log.Errorf("Balance of user %s too low", fromUserStr)
 		bot.trySendMessage(m.Sender, fmt.Sprintf(inlineSendBalanceLowMessage, balance))
 		bot.tryDeleteMessage(m)
 		return
 	}
+	// the faucet counts as one payment of its capacity, its payouts are checked again
+	err = bot.checkSpending(ctx.User, inlineFaucet.Amount, false)
+	if err != nil {
+		bot.trySendMessage(m.Sender, fmt.Sprintf(tipErrorMessage, err))
+		bot.tryDeleteMessage(m)
+		return
+	}
 
 	// // check for memo in command
 	memo := GetMemoFromCommand(m.Text, 3)
@@ -189,13 +182,15 @@ func (bot TipBot) faucetHandler(m *tb.Message) {
 	btnAcceptInlineFaucet.Data = inlineFaucet.ID
 	btnCancelInlineFaucet.Data = inlineFaucet.ID
 	inlineFaucetMenu.Inline(inlineFaucetMenu.Row(btnAcceptInlineFaucet, btnCancelInlineFaucet))
-	bot.trySendMessage(m.Chat, inlineMessage, inlineFaucetMenu)
+	if msg := bot.trySendMessage(m.Chat, inlineMessage, inlineFaucetMenu); msg != nil {
+		inlineFaucet.InlineMessage = storedMessage(msg)
+	}
 	log.Infof("[faucet] %s created faucet %s: %d sat (%d per user)", fromUserStr, inlineFaucet.ID, inlineFaucet.Amount, inlineFaucet.PerUserAmount)
 	inlineFaucet.Message = inlineMessage
 	inlineFaucet.From = m.Sender
 	inlineFaucet.Memo = memo
 	inlineFaucet.RemainingAmount = inlineFaucet.Amount
-	runtime.IgnoreError(bot.bunt.Set(inlineFaucet))
+	runtime.IgnoreError(bot.store.Set(inlineFaucet))
 
 }
 
@@ -238,10 +233,16 @@ func (bot TipBot) handleInlineFaucetQuery(q *tb.Query) {
 	}
 	// check if fromUser has balance
 	if balance < inlineFaucet.Amount {
-		log.Errorln("Balance of user %s too low", fromUserStr)
+		log.Errorf("Balance of user %s too low", fromUserStr)
 		bot.inlineQueryReplyWithError(q, fmt.Sprintf(inlineSendBalanceLowMessage, balance), fmt.Sprintf(inlineQueryFaucetDescription, bot.telegram.Me.Username))
 		return
 	}
+	// the faucet counts as one payment of its capacity, its payouts are checked again
+	err = bot.checkUserSpending(&q.From, inlineFaucet.Amount)
+	if err != nil {
+		bot.inlineQueryReplyWithError(q, fmt.Sprintf(tipErrorMessage, err), fmt.Sprintf(inlineQueryFaucetDescription, bot.telegram.Me.Username))
+		return
+	}
 
 	// check for memo in command
 	memo := GetMemoFromCommand(q.Text, 3)
@@ -279,7 +280,7 @@ func (bot TipBot) handleInlineFaucetQuery(q *tb.Query) {
 		inlineFaucet.From = &q.From
 		inlineFaucet.RemainingAmount = inlineFaucet.Amount
 		inlineFaucet.Memo = memo
-		runtime.IgnoreError(bot.bunt.Set(inlineFaucet))
+		runtime.IgnoreError(bot.store.Set(inlineFaucet))
 	}
 
 	err = bot.telegram.Answer(q, &tb.QueryResponse{
@@ -293,22 +294,17 @@ func (bot TipBot) handleInlineFaucetQuery(q *tb.Query) {
 }
 
 func (bot *TipBot) accpetInlineFaucetHandler(c *tb.Callback) {
-	inlineFaucet, err := bot.getInlineFaucet(c)
-	if err != nil {
-		log.Errorf("[faucet] %s", err)
-		return
-	}
-	err = bot.LockFaucet(inlineFaucet)
+	inlineFaucet, lock, err := bot.getInlineFaucet(c)
 	if err != nil {
 		log.Errorf("[faucet] %s", err)
 		return
 	}
+	// release faucet no matter what
+	defer bot.unlockInline(lock)
 	if !inlineFaucet.Active {
 		log.Errorf("[faucet] inline send not active anymore")
 		return
 	}
-	// release faucet no matter what
-	defer bot.ReleaseFaucet(inlineFaucet)
 
 	to := c.Sender
 	from := inlineFaucet.From
@@ -349,9 +345,20 @@ func (bot *TipBot) accpetInlineFaucetHandler(c *tb.Callback) {
 
 		// todo: user new get username function to get userStrings
 		transactionMemo := fmt.Sprintf("Faucet from %s to %s (%d sat).", fromUserStr, toUserStr, inlineFaucet.PerUserAmount)
-		t := NewTransaction(bot, from, to, inlineFaucet.PerUserAmount, TransactionType("faucet"))
+		t := NewTransaction(bot, from, to, inlineFaucet.PerUserAmount, TransactionType("faucet"), bot.recordPaymentHash(inlineFaucet, lock))
 		t.Memo = transactionMemo
 
+		// take from the faucet before paying to avoid double payouts
+		inlineFaucet.NTaken += 1
+		inlineFaucet.To = append(inlineFaucet.To, to)
+		inlineFaucet.RemainingAmount = inlineFaucet.RemainingAmount - inlineFaucet.PerUserAmount
+		inlineFaucet.Payment = newInlinePayment(t)
+		err = bot.store.SetLocked(lock, inlineFaucet)
+		if err != nil {
+			log.Errorf("[faucet] Could not update faucet %s: %s", inlineFaucet.ID, err)
+			return
+		}
+
 		success, err := t.Send()
 		if !success {
 			if err != nil {
@@ -361,13 +368,17 @@ func (bot *TipBot) accpetInlineFaucetHandler(c *tb.Callback) {
 			}
 			errMsg := fmt.Sprintf("[faucet] Transaction failed: %s", err)
 			log.Errorln(errMsg)
+			// give the amount back to the faucet with the end of the payment. If the lock was lost,
+			// the payment stays stored and the janitor gives the amount back.
+			inlineFaucet.NTaken -= 1
+			inlineFaucet.To = inlineFaucet.To[:len(inlineFaucet.To)-1]
+			inlineFaucet.RemainingAmount = inlineFaucet.RemainingAmount + inlineFaucet.PerUserAmount
+			bot.finishInlinePayment(inlineFaucet, lock)
 			return
 		}
+		bot.finishInlinePayment(inlineFaucet, lock)
 
 		log.Infof("[faucet] faucet %s: %d sat from %s to %s ", inlineFaucet.ID, inlineFaucet.PerUserAmount, fromUserStr, toUserStr)
-		inlineFaucet.NTaken += 1
-		inlineFaucet.To = append(inlineFaucet.To, to)
-		inlineFaucet.RemainingAmount = inlineFaucet.RemainingAmount - inlineFaucet.PerUserAmount
 
 		_, err = bot.telegram.Send(to, fmt.Sprintf(inlineFaucetReceivedMessage, fromUserStrMd, inlineFaucet.PerUserAmount))
 		_, err = bot.telegram.Send(from, fmt.Sprintf(inlineFaucetSentMessage, inlineFaucet.PerUserAmount, toUserStrMd))
@@ -405,21 +416,23 @@ func (bot *TipBot) accpetInlineFaucetHandler(c *tb.Callback) {
 		bot.tryEditMessage(c.Message, inlineFaucet.Message)
 		inlineFaucet.Active = false
 	}
-
+	err = bot.store.SetLocked(lock, inlineFaucet)
+	if err != nil {
+		log.Errorf("[faucet] Could not update faucet %s: %s", inlineFaucet.ID, err)
+	}
 }
 
 func (bot *TipBot) cancelInlineFaucetHandler(c *tb.Callback) {
-	inlineFaucet, err := bot.getInlineFaucet(c)
+	inlineFaucet, lock, err := bot.getInlineFaucet(c)
 	if err != nil {
 		log.Errorf("[cancelInlineSendHandler] %s", err)
 		return
 	}
+	defer bot.unlockInline(lock)
 	if c.Sender.ID == inlineFaucet.From.ID {
 		bot.tryEditMessage(c.Message, inlineFaucetCancelledMessage, &tb.ReplyMarkup{})
 		// set the inlineFaucet inactive
-		inlineFaucet.Active = false
-		inlineFaucet.InTransaction = false
-		runtime.IgnoreError(bot.bunt.Set(inlineFaucet))
+		runtime.IgnoreError(bot.inactivateFaucet(inlineFaucet, lock))
 	}
 	return
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const (
+	// inlineLockTTL is the lease of a lock on an inline object. It covers creating the wallet of the
+	// receiver, waiting for the spending lock and the payment.
+	inlineLockTTL = 2 * spendingLockTTL
+	// inlineLockTimeout is how long a callback waits for the callback of another user to finish
+	inlineLockTimeout = 10 * time.Second
+)
+
+// lockInline locks the inline object of the callback and reads it under the lock.
+// It returns errInlineExpired if the object is too old.
+func (bot TipBot) lockInline(object inlineObject, c *tb.Callback) (*storage.Lock, error) {
+	lock, err := bot.store.Lock(object.Key(), c.ID, inlineLockTTL, inlineLockTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not lock %s: %w", object.Key(), err)
+	}
+	err = bot.store.Get(object)
+	if err != nil {
+		err = fmt.Errorf("could not get %s: %w", object.Key(), err)
+	} else {
+		err = bot.checkInlineExpiry(object, lock, c)
+	}
+	if err != nil {
+		bot.unlockInline(lock)
+		return nil, err
+	}
+	return lock, nil
+}
+
+// unlockInline releases the lock of an inline object
+func (bot TipBot) unlockInline(lock *storage.Lock) {
+	err := bot.store.Release(lock)
+	if err != nil {
+		log.Errorf("[unlockInline] Could not release %s: %s", lock.Key, err)
+	}
+}
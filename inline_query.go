@@ -83,10 +83,6 @@ func (bot TipBot) inlineQueryReplyWithError(q *tb.Query, message string, help st
 	}
 }
 
-func (bot TipBot) anyChosenInlineHandler(q *tb.ChosenInlineResult) {
-	fmt.Printf(q.Query)
-}
-
 func (bot TipBot) anyQueryHandler(q *tb.Query) {
 	if q.Text == "" {
 		bot.inlineQueryInstructions(q)
@@ -2,9 +2,9 @@ package main
 
 import (
 	"fmt"
-	"time"
 
 	"github.com/LightningTipBot/LightningTipBot/internal/runtime"
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
 	log "github.com/sirupsen/logrus"
 	tb "gopkg.in/tucnak/telebot.v2"
 )
@@ -29,21 +29,21 @@ var (
 )
 
 type InlineReceive struct {
-	Message       string   `json:"inline_receive_message"`
-	Amount        int      `json:"inline_receive_amount"`
-	From          *tb.User `json:"inline_receive_from"`
-	To            *tb.User `json:"inline_receive_to"`
-	Memo          string
-	ID            string `json:"inline_receive_id"`
-	Active        bool   `json:"inline_receive_active"`
-	InTransaction bool   `json:"inline_receive_intransaction"`
+	InlineLifetime
+	Message string   `json:"inline_receive_message"`
+	Amount  int      `json:"inline_receive_amount"`
+	From    *tb.User `json:"inline_receive_from"`
+	To      *tb.User `json:"inline_receive_to"`
+	Memo    string
+	ID      string `json:"inline_receive_id"`
+	Active  bool   `json:"inline_receive_active"`
 }
 
 func NewInlineReceive() *InlineReceive {
 	inlineReceive := &InlineReceive{
-		Message:       "",
-		Active:        true,
-		InTransaction: false,
+		InlineLifetime: newInlineLifetime(),
+		Message:        "",
+		Active:         true,
 	}
 	return inlineReceive
 
@@ -53,59 +53,37 @@ func (msg InlineReceive) Key() string {
 	return msg.ID
 }
 
-func (bot *TipBot) LockReceive(tx *InlineReceive) error {
-	// immediatelly set intransaction to block duplicate calls
-	tx.InTransaction = true
-	err := bot.bunt.Set(tx)
-	if err != nil {
-		return err
-	}
-	return nil
+func (msg *InlineReceive) isActive() bool {
+	return msg.Active
 }
 
-func (bot *TipBot) ReleaseReceive(tx *InlineReceive) error {
-	// immediatelly set intransaction to block duplicate calls
-	tx.InTransaction = false
-	err := bot.bunt.Set(tx)
-	if err != nil {
-		return err
-	}
-	return nil
+func (msg *InlineReceive) deactivate() {
+	msg.Active = false
+}
+
+// revertPayment keeps the interrupted receive inactive, the receiver can ask again
+func (msg *InlineReceive) revertPayment(payment *InlinePayment) string {
+	return inlineReceiveFailedMessage
 }
 
-func (bot *TipBot) inactivateReceive(tx *InlineReceive) error {
+func (bot *TipBot) inactivateReceive(tx *InlineReceive, lock *storage.Lock) error {
 	tx.Active = false
-	err := bot.bunt.Set(tx)
+	err := bot.store.SetLocked(lock, tx)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// tipTooltipExists checks if this tip is already known
-func (bot *TipBot) getInlineReceive(c *tb.Callback) (*InlineReceive, error) {
+// getInlineReceive locks the inline receive of the callback and returns it. The lock must be released with unlockInline.
+func (bot *TipBot) getInlineReceive(c *tb.Callback) (*InlineReceive, *storage.Lock, error) {
 	inlineReceive := NewInlineReceive()
 	inlineReceive.ID = c.Data
-	err := bot.bunt.Get(inlineReceive)
-	// to avoid race conditions, we block the call if there is
-	// already an active transaction by loop until InTransaction is false
-	ticker := time.NewTicker(time.Second * 10)
-
-	for inlineReceive.InTransaction {
-		select {
-		case <-ticker.C:
-			return nil, fmt.Errorf("inline send timeout")
-		default:
-			log.Infoln("in transaction")
-			time.Sleep(time.Duration(500) * time.Millisecond)
-			err = bot.bunt.Get(inlineReceive)
-		}
-	}
+	lock, err := bot.lockInline(inlineReceive, c)
 	if err != nil {
-		return nil, fmt.Errorf("could not get inline receive message")
+		return nil, nil, err
 	}
-	return inlineReceive, nil
-
+	return inlineReceive, lock, nil
 }
 
 func (bot TipBot) handleInlineReceiveQuery(q *tb.Query) {
@@ -163,7 +141,7 @@ func (bot TipBot) handleInlineReceiveQuery(q *tb.Query) {
 		inlineReceive.To = &q.From // The user who wants to receive
 		// add result to persistent struct
 		inlineReceive.Message = inlineMessage
-		runtime.IgnoreError(bot.bunt.Set(inlineReceive))
+		runtime.IgnoreError(bot.store.Set(inlineReceive))
 	}
 
 	err = bot.telegram.Answer(q, &tb.QueryResponse{
@@ -178,25 +156,18 @@ func (bot TipBot) handleInlineReceiveQuery(q *tb.Query) {
 }
 
 func (bot *TipBot) acceptInlineReceiveHandler(c *tb.Callback) {
-	inlineReceive, err := bot.getInlineReceive(c)
-	// immediatelly set intransaction to block duplicate calls
-	if err != nil {
-		log.Errorf("[getInlineReceive] %s", err)
-		return
-	}
-	err = bot.LockReceive(inlineReceive)
+	inlineReceive, lock, err := bot.getInlineReceive(c)
 	if err != nil {
 		log.Errorf("[acceptInlineReceiveHandler] %s", err)
 		return
 	}
+	defer bot.unlockInline(lock)
 
 	if !inlineReceive.Active {
 		log.Errorf("[acceptInlineReceiveHandler] inline receive not active anymore")
 		return
 	}
 
-	defer bot.ReleaseReceive(inlineReceive)
-
 	// user `from` is the one who is SENDING
 	// user `to` is the one who is RECEIVING
 	from := c.Sender
@@ -220,19 +191,25 @@ func (bot *TipBot) acceptInlineReceiveHandler(c *tb.Callback) {
 	}
 	// check if fromUser has balance
 	if balance < inlineReceive.Amount {
-		log.Errorln("[acceptInlineReceiveHandler] balance of user %s too low", fromUserStr)
+		log.Errorf("[acceptInlineReceiveHandler] balance of user %s too low", fromUserStr)
 		bot.trySendMessage(from, fmt.Sprintf(inlineSendBalanceLowMessage, balance))
 		return
 	}
 
-	// set inactive to avoid double-sends
-	bot.inactivateReceive(inlineReceive)
-
 	// todo: user new get username function to get userStrings
 	transactionMemo := fmt.Sprintf("Send from %s to %s (%d sat).", fromUserStr, toUserStr, inlineReceive.Amount)
-	t := NewTransaction(bot, from, to, inlineReceive.Amount, TransactionType("inline send"))
+	t := NewTransaction(bot, from, to, inlineReceive.Amount, TransactionType("inline send"), bot.recordPaymentHash(inlineReceive, lock))
 	t.Memo = transactionMemo
+
+	// set inactive to avoid double-sends
+	inlineReceive.Payment = newInlinePayment(t)
+	err = bot.inactivateReceive(inlineReceive, lock)
+	if err != nil {
+		log.Errorf("[acceptInlineReceiveHandler] Could not inactivate %s: %s", inlineReceive.ID, err)
+		return
+	}
 	success, err := t.Send()
+	bot.finishInlinePayment(inlineReceive, lock)
 	if !success {
 		if err != nil {
 			bot.trySendMessage(from, fmt.Sprintf(tipErrorMessage, err))
@@ -269,17 +246,16 @@ func (bot *TipBot) acceptInlineReceiveHandler(c *tb.Callback) {
 }
 
 func (bot *TipBot) cancelInlineReceiveHandler(c *tb.Callback) {
-	inlineReceive, err := bot.getInlineReceive(c)
+	inlineReceive, lock, err := bot.getInlineReceive(c)
 	if err != nil {
 		log.Errorf("[cancelInlineReceiveHandler] %s", err)
 		return
 	}
+	defer bot.unlockInline(lock)
 	if c.Sender.ID == inlineReceive.To.ID {
 		bot.tryEditMessage(c.Message, sendCancelledMessage, &tb.ReplyMarkup{})
 		// set the inlineReceive inactive
-		inlineReceive.Active = false
-		inlineReceive.InTransaction = false
-		runtime.IgnoreError(bot.bunt.Set(inlineReceive))
+		runtime.IgnoreError(bot.inactivateReceive(inlineReceive, lock))
 	}
 	return
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const inlinePaymentInterruptedMessage = "⚠️ Your payment of %d sat to %s was interrupted by a restart of the bot and was not recorded. Check your /balance before you try again."
+
+// InlinePayment is a payment of an inline send, receive or faucet that was started but not finished.
+// It is stored with the object so that payments that were interrupted by a crash can be reconciled.
+type InlinePayment struct {
+	From      *tb.User  `json:"from"`
+	To        *tb.User  `json:"to"`
+	Amount    int       `json:"amount"`
+	Type      string    `json:"type"`
+	StartedAt time.Time `json:"started_at"`
+	// PaymentHash is the hash of the invoice of the receiver, it is stored before the invoice is paid
+	PaymentHash string `json:"payment_hash,omitempty"`
+}
+
+func newInlinePayment(t *Transaction) *InlinePayment {
+	return &InlinePayment{From: t.From, To: t.To, Amount: t.Amount, Type: t.Type, StartedAt: t.Time}
+}
+
+// recordPaymentHash returns a transaction option that stores the payment hash with the payment of
+// the locked object before the invoice is paid. The invoice is not paid if the object can't be saved.
+func (bot TipBot) recordPaymentHash(object inlineObject, lock *storage.Lock) TransactionOption {
+	return TransactionBeforePayment(func(t *Transaction) error {
+		payment := object.lifetime().Payment
+		if payment == nil {
+			return nil
+		}
+		payment.PaymentHash = t.PaymentHash
+		return bot.store.SetLocked(lock, object)
+	})
+}
+
+// finishInlinePayment removes the payment of the locked object after the payment succeeded or failed
+func (bot TipBot) finishInlinePayment(object inlineObject, lock *storage.Lock) {
+	object.lifetime().Payment = nil
+	err := bot.store.SetLocked(lock, object)
+	if errors.Is(err, storage.ErrLockLost) {
+		log.Errorf("[finishInlinePayment] Lock of %s expired during the payment, the janitor reconciles it", object.Key())
+	} else if err != nil {
+		log.Errorf("[finishInlinePayment] Could not update %s: %s", object.Key(), err)
+	}
+}
+
+// resetInlineLocks releases the locks that a crashed bot left in a bunt store. Locks in a SQL store
+// can belong to other bots that share the database, they expire after inlineLockTTL.
+func (bot TipBot) resetInlineLocks() {
+	db, ok := bot.store.(*storage.DB)
+	if !ok {
+		return
+	}
+	n, err := db.ResetLocks()
+	if err != nil {
+		log.Errorf("[Recovery] Could not reset locks: %s", err)
+		return
+	}
+	if n > 0 {
+		log.Warnf("[Recovery] Released %d locks of the last run", n)
+	}
+}
+
+// recoverInlinePayments reconciles the payments of inline objects that were interrupted, e.g. by a crash.
+// Payments that are in the transaction log or whose invoice was paid are kept, the others are reverted
+// and the payer is told.
+// Payments younger than minAge could still be in progress and are left alone.
+func (bot TipBot) recoverInlinePayments(minAge time.Duration) {
+	var objects []inlineObject
+	err := bot.store.Ascend("inl-*", func(key, value string) bool {
+		object := newInlineObject(key)
+		if object == nil || json.Unmarshal([]byte(value), object) != nil {
+			return true
+		}
+		if interruptedPayment(object, minAge) {
+			objects = append(objects, object)
+		}
+		return true
+	})
+	if err != nil {
+		log.Errorf("[Recovery] %s", err)
+		return
+	}
+	for _, object := range objects {
+		// payments of objects that are in use are still running
+		lock, err := bot.store.TryLock(object.Key(), "recovery", inlineLockTTL)
+		if err != nil {
+			continue
+		}
+		// read the object again, the payment could have finished before it was locked
+		if bot.store.Get(object) == nil && interruptedPayment(object, minAge) {
+			bot.recoverInlinePayment(object, lock)
+		}
+		bot.unlockInline(lock)
+	}
+}
+
+func interruptedPayment(object inlineObject, minAge time.Duration) bool {
+	payment := object.lifetime().Payment
+	return payment != nil && time.Since(payment.StartedAt) >= minAge
+}
+
+// recoverInlinePayment reconciles the interrupted payment of a locked object
+func (bot TipBot) recoverInlinePayment(object inlineObject, lock *storage.Lock) {
+	payment := object.lifetime().Payment
+	if payment.From == nil || payment.To == nil {
+		bot.finishInlinePayment(object, lock)
+		return
+	}
+	// the transaction is logged with the time of the payment, allow for the precision of the database
+	since := payment.StartedAt.Add(-time.Second)
+	paid, err := bot.transactions.PaidSince(payment.From.ID, payment.To.ID, payment.Amount, payment.Type, since)
+	if err == nil && !paid {
+		// the bot could have crashed after the invoice was paid and before the transaction was logged
+		paid, err = bot.invoicePaid(payment)
+	}
+	if err != nil {
+		log.Errorf("[Recovery] Could not look up payment of %s: %s", object.Key(), err)
+		return
+	}
+	if paid {
+		log.Infof("[Recovery] Interrupted payment of %s was made, %d sat from %s to %s", object.Key(), payment.Amount, GetUserStr(payment.From), GetUserStr(payment.To))
+		bot.finishInlinePayment(object, lock)
+		return
+	}
+	message := object.revertPayment(payment)
+	bot.finishInlinePayment(object, lock)
+	log.Warnf("[Recovery] Reverted interrupted payment of %s, %d sat from %s to %s", object.Key(), payment.Amount, GetUserStr(payment.From), GetUserStr(payment.To))
+	if inlineMessage := object.lifetime().InlineMessage; inlineMessage != nil && len(message) > 0 {
+		bot.tryEditMessage(inlineMessage, message, &tb.ReplyMarkup{})
+	}
+	bot.trySendMessage(payment.From, fmt.Sprintf(inlinePaymentInterruptedMessage, payment.Amount, GetUserStrMd(payment.To)))
+}
+
+// invoicePaid asks LNbits whether the invoice of the interrupted payment was paid
+func (bot TipBot) invoicePaid(payment *InlinePayment) (bool, error) {
+	if len(payment.PaymentHash) == 0 {
+		return false, nil
+	}
+	toUser, err := GetUser(payment.To, bot)
+	if err != nil {
+		return false, err
+	}
+	status, err := toUser.Wallet.Payment(payment.PaymentHash, *toUser.Wallet)
+	if err != nil {
+		return false, err
+	}
+	return status.Paid, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+func TestTipBot_recoverInlinePayments(t *testing.T) {
+	db, txLogger := openFixture(t, "", "")
+	if err := migrateDatabases(db, txLogger); err != nil {
+		t.Fatal(err)
+	}
+	telegram, fake := newFakeTelegram(t, &tb.LongPoller{})
+	bot := TipBot{store: storage.NewBunt(":memory:"), transactions: gormTransactions{db: txLogger}, telegram: telegram}
+	from, paidTo, unpaidTo := &tb.User{ID: 1}, &tb.User{ID: 2}, &tb.User{ID: 3}
+
+	// the payment to paidTo was logged before the bot crashed, the payment to unpaidTo was not
+	paid := NewTransaction(&bot, from, paidTo, 21, TransactionType("faucet"))
+	paid.Success = true
+	if err := bot.transactions.SaveTransaction(paid); err != nil {
+		t.Fatal(err)
+	}
+	unpaid := NewTransaction(&bot, from, unpaidTo, 21, TransactionType("faucet"))
+	faucet := NewInlineFaucet()
+	faucet.ID = "inl-faucet-1-210-abcde"
+	faucet.From = from
+	faucet.Amount, faucet.PerUserAmount = 210, 21
+	faucet.To = []*tb.User{paidTo, unpaidTo}
+	faucet.NTaken, faucet.RemainingAmount = 2, 168
+	faucet.Payment = newInlinePayment(unpaid)
+	if err := bot.store.Set(faucet); err != nil {
+		t.Fatal(err)
+	}
+	// a stale lock of the crashed bot
+	if _, err := bot.store.TryLock(faucet.ID, "crashed", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := func() *InlineFaucet {
+		stored := &InlineFaucet{ID: faucet.ID}
+		if err := bot.store.Get(stored); err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+	bot.recoverInlinePayments(0)
+	if stored().Payment == nil {
+		t.Fatal("payment of a locked faucet was recovered")
+	}
+	bot.resetInlineLocks()
+	bot.recoverInlinePayments(0)
+	faucet = stored()
+	if faucet.Payment != nil || faucet.NTaken != 1 || faucet.RemainingAmount != 189 || len(faucet.To) != 1 || faucet.To[0].ID != paidTo.ID {
+		t.Errorf("faucet = %+v, want the unpaid payout reverted", faucet)
+	}
+	if calls := fake.calls("sendMessage"); len(calls) != 1 || calls[0]["chat_id"] != "1" {
+		t.Errorf("sent messages = %v, want the payer to be told", calls)
+	}
+
+	// a payment that was logged is kept
+	faucet.To = append(faucet.To, unpaidTo)
+	faucet.Payment = newInlinePayment(paid)
+	if err := bot.store.Set(faucet); err != nil {
+		t.Fatal(err)
+	}
+	bot.recoverInlinePayments(0)
+	if faucet = stored(); faucet.Payment != nil || len(faucet.To) != 2 {
+		t.Errorf("faucet = %+v, want the paid payout kept", faucet)
+	}
+}
+
+func TestScenario_recoverPaidInlinePayment(t *testing.T) {
+	s := newScenario(t)
+	alice := s.newUser(2001, "alice", 0)
+	bob := s.newUser(2002, "bob", 1000)
+	carol := s.newUser(2003, "carol", 0)
+
+	faucet := NewInlineFaucet()
+	faucet.ID = "inl-faucet-2002-210-abcde"
+	faucet.From = bob
+	faucet.Amount, faucet.PerUserAmount = 210, 21
+	payout := func(to *tb.User, pay bool) {
+		t.Helper()
+		lock, err := s.bot.store.TryLock(faucet.ID, "test", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.bot.unlockInline(lock)
+		faucet.To = append(faucet.To, to)
+		faucet.NTaken, faucet.RemainingAmount = faucet.NTaken+1, faucet.RemainingAmount-21
+		// the bot crashes after the invoice was paid or created, before the transaction was logged
+		errCrash := errors.New("crash")
+		payment := NewTransaction(&s.bot, bob, to, 21, TransactionType("faucet"), s.bot.recordPaymentHash(faucet, lock))
+		record := payment.beforePayment
+		payment.beforePayment = func(t *Transaction) error {
+			if err := record(t); err != nil || pay {
+				return err
+			}
+			return errCrash
+		}
+		faucet.Payment = newInlinePayment(payment)
+		if err := s.bot.store.SetLocked(lock, faucet); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := payment.SendTransaction(&s.bot, bob, to, 21, "faucet"); pay == (err != nil) {
+			t.Fatalf("SendTransaction() = %v", err)
+		}
+	}
+	stored := func() *InlineFaucet {
+		stored := &InlineFaucet{ID: faucet.ID}
+		if err := s.bot.store.Get(stored); err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+	faucet.RemainingAmount = 210
+	if err := s.bot.store.Set(faucet); err != nil {
+		t.Fatal(err)
+	}
+
+	payout(alice, true)
+	if stored().Payment.PaymentHash == "" {
+		t.Fatal("payment hash was not stored before paying")
+	}
+	s.bot.recoverInlinePayments(0)
+	if faucet = stored(); faucet.Payment != nil || faucet.NTaken != 1 || faucet.RemainingAmount != 189 {
+		t.Errorf("faucet = %+v, want the paid payout kept", faucet)
+	}
+	s.checkBalance(alice, 21)
+
+	payout(carol, false)
+	s.bot.recoverInlinePayments(0)
+	if faucet = stored(); faucet.Payment != nil || faucet.NTaken != 1 || faucet.RemainingAmount != 189 || len(faucet.To) != 1 {
+		t.Errorf("faucet = %+v, want the unpaid payout reverted", faucet)
+	}
+	s.expect(bob, "Your payment of 21 sat to @carol was interrupted")
+	s.checkBalance(carol, 0)
+	s.checkBalance(bob, 979)
+}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"fmt"
-	"time"
 
 	"github.com/LightningTipBot/LightningTipBot/internal/runtime"
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
 	log "github.com/sirupsen/logrus"
 	tb "gopkg.in/tucnak/telebot.v2"
 )
@@ -31,21 +31,21 @@ var (
 )
 
 type InlineSend struct {
-	Message       string   `json:"inline_send_message"`
-	Amount        int      `json:"inline_send_amount"`
-	From          *tb.User `json:"inline_send_from"`
-	To            *tb.User `json:"inline_send_to"`
-	Memo          string   `json:"inline_send_memo"`
-	ID            string   `json:"inline_send_id"`
-	Active        bool     `json:"inline_send_active"`
-	InTransaction bool     `json:"inline_send_intransaction"`
+	InlineLifetime
+	Message string   `json:"inline_send_message"`
+	Amount  int      `json:"inline_send_amount"`
+	From    *tb.User `json:"inline_send_from"`
+	To      *tb.User `json:"inline_send_to"`
+	Memo    string   `json:"inline_send_memo"`
+	ID      string   `json:"inline_send_id"`
+	Active  bool     `json:"inline_send_active"`
 }
 
 func NewInlineSend() *InlineSend {
 	inlineSend := &InlineSend{
-		Message:       "",
-		Active:        true,
-		InTransaction: false,
+		InlineLifetime: newInlineLifetime(),
+		Message:        "",
+		Active:         true,
 	}
 	return inlineSend
 
@@ -55,61 +55,37 @@ func (msg InlineSend) Key() string {
 	return msg.ID
 }
 
-func (bot *TipBot) LockSend(tx *InlineSend) error {
-	// immediatelly set intransaction to block duplicate calls
-	tx.InTransaction = true
-	err := bot.bunt.Set(tx)
-	if err != nil {
-		return err
-	}
-	return nil
+func (msg *InlineSend) isActive() bool {
+	return msg.Active
 }
 
-func (bot *TipBot) ReleaseSend(tx *InlineSend) error {
-	// immediatelly set intransaction to block duplicate calls
-	tx.InTransaction = false
-	err := bot.bunt.Set(tx)
-	if err != nil {
-		return err
-	}
-	return nil
+func (msg *InlineSend) deactivate() {
+	msg.Active = false
 }
 
-func (bot *TipBot) inactivateSend(tx *InlineSend) error {
+// revertPayment keeps the interrupted send inactive, the sender can send again
+func (msg *InlineSend) revertPayment(payment *InlinePayment) string {
+	return inlineSendFailedMessage
+}
+
+func (bot *TipBot) inactivateSend(tx *InlineSend, lock *storage.Lock) error {
 	tx.Active = false
-	err := bot.bunt.Set(tx)
+	err := bot.store.SetLocked(lock, tx)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (bot *TipBot) getInlineSend(c *tb.Callback) (*InlineSend, error) {
+// getInlineSend locks the inline send of the callback and returns it. The lock must be released with unlockInline.
+func (bot *TipBot) getInlineSend(c *tb.Callback) (*InlineSend, *storage.Lock, error) {
 	inlineSend := NewInlineSend()
 	inlineSend.ID = c.Data
-
-	err := bot.bunt.Get(inlineSend)
-
-	// to avoid race conditions, we block the call if there is
-	// already an active transaction by loop until InTransaction is false
-	ticker := time.NewTicker(time.Second * 10)
-
-	for inlineSend.InTransaction {
-		select {
-		case <-ticker.C:
-			return nil, fmt.Errorf("inline send timeout")
-		default:
-			log.Infoln("in transaction")
-			time.Sleep(time.Duration(500) * time.Millisecond)
-			err = bot.bunt.Get(inlineSend)
-		}
-	}
+	lock, err := bot.lockInline(inlineSend, c)
 	if err != nil {
-		return nil, fmt.Errorf("could not get inline send message")
+		return nil, nil, err
 	}
-
-	return inlineSend, nil
-
+	return inlineSend, lock, nil
 }
 
 func (bot TipBot) handleInlineSendQuery(q *tb.Query) {
@@ -133,10 +109,15 @@ func (bot TipBot) handleInlineSendQuery(q *tb.Query) {
 	}
 	// check if fromUser has balance
 	if balance < inlineSend.Amount {
-		log.Errorln("Balance of user %s too low", fromUserStr)
+		log.Errorf("Balance of user %s too low", fromUserStr)
 		bot.inlineQueryReplyWithError(q, fmt.Sprintf(inlineSendBalanceLowMessage, balance), fmt.Sprintf(inlineQuerySendDescription, bot.telegram.Me.Username))
 		return
 	}
+	err = bot.checkUserSpending(&q.From, inlineSend.Amount)
+	if err != nil {
+		bot.inlineQueryReplyWithError(q, fmt.Sprintf(tipErrorMessage, err), fmt.Sprintf(inlineQuerySendDescription, bot.telegram.Me.Username))
+		return
+	}
 
 	// check for memo in command
 	inlineSend.Memo = GetMemoFromCommand(q.Text, 2)
@@ -177,7 +158,7 @@ func (bot TipBot) handleInlineSendQuery(q *tb.Query) {
 		inlineSend.ID = id
 		inlineSend.From = &q.From
 		// add result to persistent struct
-		runtime.IgnoreError(bot.bunt.Set(inlineSend))
+		runtime.IgnoreError(bot.store.Set(inlineSend))
 	}
 
 	err = bot.telegram.Answer(q, &tb.QueryResponse{
@@ -191,24 +172,18 @@ func (bot TipBot) handleInlineSendQuery(q *tb.Query) {
 }
 
 func (bot *TipBot) acceptInlineSendHandler(c *tb.Callback) {
-	inlineSend, err := bot.getInlineSend(c)
+	inlineSend, lock, err := bot.getInlineSend(c)
 	if err != nil {
 		log.Errorf("[acceptInlineSendHandler] %s", err)
 		return
 	}
-	// immediatelly set intransaction to block duplicate calls
-	err = bot.LockSend(inlineSend)
-	if err != nil {
-		log.Errorf("[getInlineSend] %s", err)
-		return
-	}
+	defer bot.unlockInline(lock)
+
 	if !inlineSend.Active {
 		log.Errorf("[acceptInlineSendHandler] inline send not active anymore")
 		return
 	}
 
-	defer bot.ReleaseSend(inlineSend)
-
 	amount := inlineSend.Amount
 	to := c.Sender
 	from := inlineSend.From
@@ -236,14 +211,20 @@ func (bot *TipBot) acceptInlineSendHandler(c *tb.Callback) {
 			return
 		}
 	}
-	// set inactive to avoid double-sends
-	bot.inactivateSend(inlineSend)
-
 	// todo: user new get username function to get userStrings
 	transactionMemo := fmt.Sprintf("Send from %s to %s (%d sat).", fromUserStr, toUserStr, amount)
-	t := NewTransaction(bot, from, to, amount, TransactionType("inline send"))
+	t := NewTransaction(bot, from, to, amount, TransactionType("inline send"), bot.recordPaymentHash(inlineSend, lock))
 	t.Memo = transactionMemo
+
+	// set inactive to avoid double-sends
+	inlineSend.Payment = newInlinePayment(t)
+	err = bot.inactivateSend(inlineSend, lock)
+	if err != nil {
+		log.Errorf("[sendInline] Could not inactivate %s: %s", inlineSend.ID, err)
+		return
+	}
 	success, err := t.Send()
+	bot.finishInlinePayment(inlineSend, lock)
 	if !success {
 		if err != nil {
 			bot.trySendMessage(from, fmt.Sprintf(tipErrorMessage, err))
@@ -280,17 +261,16 @@ func (bot *TipBot) acceptInlineSendHandler(c *tb.Callback) {
 }
 
 func (bot *TipBot) cancelInlineSendHandler(c *tb.Callback) {
-	inlineSend, err := bot.getInlineSend(c)
+	inlineSend, lock, err := bot.getInlineSend(c)
 	if err != nil {
 		log.Errorf("[cancelInlineSendHandler] %s", err)
 		return
 	}
+	defer bot.unlockInline(lock)
 	if c.Sender.ID == inlineSend.From.ID {
 		bot.tryEditMessage(c.Message, sendCancelledMessage, &tb.ReplyMarkup{})
 		// set the inlineSend inactive
-		inlineSend.Active = false
-		inlineSend.InTransaction = false
-		runtime.IgnoreError(bot.bunt.Set(inlineSend))
+		runtime.IgnoreError(bot.inactivateSend(inlineSend, lock))
 	}
 	return
 }
@@ -0,0 +1,118 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkTimeout is the time after which a dependency that did not answer counts as down
+const checkTimeout = 5 * time.Second
+
+// Check reports whether a dependency of the bot is available
+type Check struct {
+	Name string
+	// Check returns an error if the dependency is down
+	Check func() error
+}
+
+// Checker checks the dependencies of the bot for the readiness endpoint and at startup
+type Checker struct {
+	mu     sync.Mutex
+	checks []Check
+}
+
+// Add adds checks of dependencies
+func (c *Checker) Add(checks ...Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, checks...)
+}
+
+// Result is the status of a dependency, "ok" or the error
+type Result map[string]string
+
+// Run runs all checks in parallel and returns their results and an error that lists the
+// dependencies that are down
+func (c *Checker) Run() (Result, error) {
+	c.mu.Lock()
+	checks := append([]Check(nil), c.checks...)
+	c.mu.Unlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	result := make(Result, len(checks))
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check Check) {
+			defer wg.Done()
+			err := run(check)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				result[check.Name] = err.Error()
+				return
+			}
+			result[check.Name] = "ok"
+		}(check)
+	}
+	wg.Wait()
+	return result, result.err()
+}
+
+// run runs a check with a timeout
+func run(check Check) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check.Check()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(checkTimeout):
+		return fmt.Errorf("no answer within %s", checkTimeout)
+	}
+}
+
+func (r Result) err() error {
+	var down []string
+	for name, status := range r {
+		if status != "ok" {
+			down = append(down, fmt.Sprintf("%s (%s)", name, status))
+		}
+	}
+	if len(down) == 0 {
+		return nil
+	}
+	sort.Strings(down)
+	return fmt.Errorf("unavailable: %s", strings.Join(down, ", "))
+}
+
+// Healthz answers liveness probes, the bot is alive as long as it serves HTTP
+func Healthz(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readyz answers readiness probes with the status of every dependency. It responds with
+// 503 Service Unavailable if a dependency is down.
+func (c *Checker) Readyz(writer http.ResponseWriter, request *http.Request) {
+	result, err := c.Run()
+	status, code := "ok", http.StatusOK
+	if err != nil {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	writeJSON(writer, code, struct {
+		Status string `json:"status"`
+		Checks Result `json:"checks"`
+	}{status, result})
+}
+
+func writeJSON(writer http.ResponseWriter, code int, response interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(code)
+	json.NewEncoder(writer).Encode(response)
+}
@@ -0,0 +1,40 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChecker(t *testing.T) {
+	checker := &Checker{}
+	checker.Add(
+		Check{Name: "lnbits", Check: func() error { return nil }},
+		Check{Name: "telegram", Check: func() error { return errors.New("timeout") }},
+	)
+	result, err := checker.Run()
+	if err == nil || err.Error() != "unavailable: telegram (timeout)" {
+		t.Errorf("err = %v", err)
+	}
+	if result["lnbits"] != "ok" || result["telegram"] != "timeout" {
+		t.Errorf("result = %v", result)
+	}
+
+	recorder := httptest.NewRecorder()
+	checker.Readyz(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable || !strings.Contains(recorder.Body.String(), `"telegram":"timeout"`) {
+		t.Errorf("readyz = %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	checker := &Checker{}
+	checker.Add(Check{Name: "store", Check: func() error { return nil }})
+	recorder := httptest.NewRecorder()
+	checker.Readyz(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"status":"ok"`) {
+		t.Errorf("readyz = %d %s", recorder.Code, recorder.Body.String())
+	}
+}
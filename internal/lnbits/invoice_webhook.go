@@ -0,0 +1,98 @@
+package lnbits
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+	"gorm.io/gorm"
+)
+
+// InvoiceWebhook authenticates the webhook call of an invoice. The secret token is
+// part of the webhook URL so that only LNbits knows where to report the payment.
+// ChatID and MessageID refer to the message that shows the invoice, if any.
+type InvoiceWebhook struct {
+	Token       string `gorm:"primaryKey"`
+	PaymentHash string `gorm:"index"`
+	WalletID    string
+	ChatID      int64
+	MessageID   string
+	CreatedAt   time.Time
+	DeliveredAt *time.Time
+}
+
+// newWebhookToken returns a random token for a webhook URL
+func newWebhookToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// InvoiceWithWebhook creates an invoice for wallet w whose payment is reported to webhookServer
+// with a secret per-invoice token. Without a webhook server, the invoice has no webhook.
+func InvoiceWithWebhook(db *gorm.DB, webhookServer string, params InvoiceParams, w Wallet) (BitInvoice, error) {
+	if len(webhookServer) == 0 {
+		return w.Invoice(params, w)
+	}
+	token, err := newWebhookToken()
+	if err != nil {
+		return BitInvoice{}, err
+	}
+	params.Webhook = fmt.Sprintf("%s/%s", strings.TrimSuffix(webhookServer, "/"), token)
+	invoice, err := w.Invoice(params, w)
+	if err != nil {
+		return invoice, err
+	}
+	err = db.Create(&InvoiceWebhook{
+		Token:       token,
+		PaymentHash: invoice.PaymentHash,
+		WalletID:    w.ID,
+		CreatedAt:   time.Now(),
+	}).Error
+	if err != nil {
+		return invoice, fmt.Errorf("could not store webhook of invoice: %w", err)
+	}
+	return invoice, nil
+}
+
+// SetInvoiceMessage remembers the message that shows the invoice so that it can be
+// updated when the invoice is paid
+func SetInvoiceMessage(db *gorm.DB, paymentHash string, message tb.Editable) error {
+	messageID, chatID := message.MessageSig()
+	return db.Model(&InvoiceWebhook{}).
+		Where("payment_hash = ?", paymentHash).
+		Updates(map[string]interface{}{"chat_id": chatID, "message_id": messageID}).Error
+}
+
+// message returns the message that shows the invoice
+func (w InvoiceWebhook) message() (tb.Editable, bool) {
+	if w.ChatID == 0 || len(w.MessageID) == 0 {
+		return nil, false
+	}
+	return tb.StoredMessage{MessageID: w.MessageID, ChatID: w.ChatID}, true
+}
+
+// getInvoiceWebhook returns the webhook of an invoice by its token
+func getInvoiceWebhook(db *gorm.DB, token string) (*InvoiceWebhook, error) {
+	webhook := &InvoiceWebhook{}
+	tx := db.Where("token = ?", token).First(webhook)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return webhook, nil
+}
+
+// markPaymentDelivered marks the webhook of a payment as delivered. It returns false if the
+// payment was delivered before so that repeated webhook calls are only handled once.
+func markPaymentDelivered(db *gorm.DB, paymentHash string) (bool, error) {
+	tx := db.Model(&InvoiceWebhook{}).
+		Where("payment_hash = ? AND delivered_at IS NULL", paymentHash).
+		Update("delivered_at", time.Now())
+	return tx.RowsAffected == 1, tx.Error
+}
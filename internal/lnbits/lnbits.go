@@ -1,13 +1,26 @@
 package lnbits
 
 import (
+	"net/url"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/metrics"
+	"github.com/LightningTipBot/LightningTipBot/internal/secret"
 	"github.com/imroc/req"
 )
 
+// RequestTimeout is the timeout of a request to the LNbits API. Locks that are held during
+// payments must outlast the requests of the payment.
+const RequestTimeout = 30 * time.Second
+
 // NewClient returns a new lnbits api client. Pass your API key and url here.
 func NewClient(key, url string) *Client {
+	requests := req.New()
+	// create the http client now, req creates it lazily and concurrent requests would race
+	requests.Client().Timeout = RequestTimeout
 	return &Client{
-		url: url,
+		requests: requests,
+		url:      url,
 		header: req.Header{
 			"Content-Type": "application/json",
 			"Accept":       "application/json",
@@ -16,9 +29,28 @@ func NewClient(key, url string) *Client {
 	}
 }
 
+// observe records the latency and the error of a request to the LNbits API:
+//
+//	defer observe("pay", time.Now(), &err)
+func observe(operation string, start time.Time, err *error) {
+	metrics.LNbitsRequest(operation, time.Since(start), *err)
+}
+
+// walletHeader returns the headers of a request with a key of a wallet. The header of the
+// client is shared by concurrent requests and keeps the key of the user manager.
+func (c Client) walletHeader(key secret.String) req.Header {
+	header := req.Header{}
+	for k, value := range c.header {
+		header[k] = value
+	}
+	header["X-Api-Key"] = string(key)
+	return header
+}
+
 // GetUser returns user information
 func (c *Client) GetUser(userId string) (user User, err error) {
-	resp, err := req.Post(c.url+"/usermanager/api/v1/users/"+userId, c.header, nil)
+	defer observe("get_user", time.Now(), &err)
+	resp, err := c.requests.Post(c.url+"/usermanager/api/v1/users/"+userId, c.header, nil)
 	if err != nil {
 		return
 	}
@@ -36,7 +68,8 @@ func (c *Client) GetUser(userId string) (user User, err error) {
 
 // CreateUserWithInitialWallet creates new user with initial wallet
 func (c *Client) CreateUserWithInitialWallet(userName, walletName, adminId string, email string) (wal User, err error) {
-	resp, err := req.Post(c.url+"/usermanager/api/v1/users", c.header, req.BodyJSON(struct {
+	defer observe("create_user", time.Now(), &err)
+	resp, err := c.requests.Post(c.url+"/usermanager/api/v1/users", c.header, req.BodyJSON(struct {
 		WalletName string `json:"wallet_name"`
 		AdminId    string `json:"admin_id"`
 		UserName   string `json:"user_name"`
@@ -58,7 +91,8 @@ func (c *Client) CreateUserWithInitialWallet(userName, walletName, adminId strin
 
 // CreateWallet creates a new wallet.
 func (c *Client) CreateWallet(userId, walletName, adminId string) (wal Wallet, err error) {
-	resp, err := req.Post(c.url+"/usermanager/api/v1/wallets", c.header, req.BodyJSON(struct {
+	defer observe("create_wallet", time.Now(), &err)
+	resp, err := c.requests.Post(c.url+"/usermanager/api/v1/wallets", c.header, req.BodyJSON(struct {
 		UserId     string `json:"user_id"`
 		WalletName string `json:"wallet_name"`
 		AdminId    string `json:"admin_id"`
@@ -78,10 +112,27 @@ func (c *Client) CreateWallet(userId, walletName, adminId string) (wal Wallet, e
 	return
 }
 
+// DeleteWallet deletes a wallet of the user manager. Its keys stop working.
+func (c *Client) DeleteWallet(walletId string) (err error) {
+	defer observe("delete_wallet", time.Now(), &err)
+	resp, err := c.requests.Delete(c.url+"/usermanager/api/v1/wallets/"+url.PathEscape(walletId), c.header, nil)
+	if err != nil {
+		return
+	}
+
+	if resp.Response().StatusCode >= 300 {
+		var reqErr Error
+		resp.ToJSON(&reqErr)
+		err = reqErr
+		return
+	}
+	return
+}
+
 // Invoice creates an invoice associated with this wallet.
 func (c Client) Invoice(params InvoiceParams, w Wallet) (lntx BitInvoice, err error) {
-	c.header["X-Api-Key"] = w.Adminkey
-	resp, err := req.Post(c.url+"/api/v1/payments", w.header, req.BodyJSON(&params))
+	defer observe("invoice", time.Now(), &err)
+	resp, err := c.requests.Post(c.url+"/api/v1/payments", c.walletHeader(w.Adminkey), req.BodyJSON(&params))
 	if err != nil {
 		return
 	}
@@ -99,8 +150,8 @@ func (c Client) Invoice(params InvoiceParams, w Wallet) (lntx BitInvoice, err er
 
 // Info returns wallet information
 func (c Client) Info(w Wallet) (wtx Wallet, err error) {
-	c.header["X-Api-Key"] = w.Adminkey
-	resp, err := req.Get(w.url+"/api/v1/wallet", w.header, nil)
+	defer observe("info", time.Now(), &err)
+	resp, err := c.requests.Get(c.url+"/api/v1/wallet", c.walletHeader(w.Adminkey), nil)
 	if err != nil {
 		return
 	}
@@ -116,9 +167,33 @@ func (c Client) Info(w Wallet) (wtx Wallet, err error) {
 	return
 }
 
+// Payment returns the payment with the payment hash from the wallet
+func (c Client) Payment(paymentHash string, w Wallet) (payment Payment, err error) {
+	defer observe("payment", time.Now(), &err)
+	key := w.Inkey
+	if len(key) == 0 {
+		key = w.Adminkey
+	}
+	resp, err := c.requests.Get(c.url+"/api/v1/payments/"+url.PathEscape(paymentHash), c.walletHeader(key), nil)
+	if err != nil {
+		return
+	}
+
+	if resp.Response().StatusCode >= 300 {
+		var reqErr Error
+		resp.ToJSON(&reqErr)
+		err = reqErr
+		return
+	}
+
+	err = resp.ToJSON(&payment)
+	return
+}
+
 // Wallets returns all wallets belonging to an user
 func (c Client) Wallets(w User) (wtx []Wallet, err error) {
-	resp, err := req.Get(c.url+"/usermanager/api/v1/wallets/"+w.ID, c.header, nil)
+	defer observe("wallets", time.Now(), &err)
+	resp, err := c.requests.Get(c.url+"/usermanager/api/v1/wallets/"+w.ID, c.header, nil)
 	if err != nil {
 		return
 	}
@@ -136,8 +211,8 @@ func (c Client) Wallets(w User) (wtx []Wallet, err error) {
 
 // Pay pays a given invoice with funds from the wallet.
 func (c Client) Pay(params PaymentParams, w Wallet) (wtx BitInvoice, err error) {
-	c.header["X-Api-Key"] = w.Adminkey
-	resp, err := req.Post(c.url+"/api/v1/payments", w.header, req.BodyJSON(&params))
+	defer observe("pay", time.Now(), &err)
+	resp, err := c.requests.Post(c.url+"/api/v1/payments", c.walletHeader(w.Adminkey), req.BodyJSON(&params))
 	if err != nil {
 		return
 	}
@@ -0,0 +1,53 @@
+package lnbits
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/secret"
+)
+
+func TestWalletKeys(t *testing.T) {
+	var mu sync.Mutex
+	keys := make(map[string][]string)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mu.Lock()
+		keys[request.URL.Path] = append(keys[request.URL.Path], request.Header.Get("X-Api-Key"))
+		mu.Unlock()
+		json.NewEncoder(writer).Encode(struct{}{})
+	}))
+	defer server.Close()
+	client := NewClient("admin", server.URL)
+
+	var wg sync.WaitGroup
+	for _, key := range []string{"wallet1", "wallet2"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			wallet := Wallet{Client: client, Adminkey: secret.String(key)}
+			if _, err := client.Info(wallet); err != nil {
+				t.Error(err)
+			}
+		}(key)
+	}
+	wg.Wait()
+	if _, err := client.GetUser("1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := keys["/usermanager/api/v1/users/1"]; len(got) != 1 || got[0] != "admin" {
+		t.Errorf("key of the user manager = %v, want admin", got)
+	}
+	if got := keys["/api/v1/wallet"]; len(got) != 2 || got[0] == got[1] {
+		t.Errorf("keys of the wallets = %v, want wallet1 and wallet2", got)
+	}
+}
+
+func TestNewClient_timeout(t *testing.T) {
+	// the locks of payments rely on requests that end after RequestTimeout
+	if timeout := NewClient("admin", "http://lnbits").requests.Client().Timeout; timeout != RequestTimeout {
+		t.Errorf("timeout = %s, want %s", timeout, RequestTimeout)
+	}
+}
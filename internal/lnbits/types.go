@@ -1,11 +1,15 @@
 package lnbits
 
 import (
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/secret"
 	"github.com/imroc/req"
 	tb "gopkg.in/tucnak/telebot.v2"
 )
 
 type Client struct {
+	requests   *req.Req
 	header     req.Header
 	url        string
 	AdminKey   string
@@ -13,27 +17,35 @@ type Client struct {
 }
 
 type User struct {
-	ID          string       `json:"id"`
-	Name        string       `json:"name" gorm:"primaryKey"`
-	Initialized bool         `json:"initialized"`
-	Telegram    *tb.User     `gorm:"embedded;embeddedPrefix:telegram_"`
-	Wallet      *Wallet      `gorm:"embedded;embeddedPrefix:wallet_"`
-	StateKey    UserStateKey `json:"stateKey"`
-	StateData   string       `json:"stateData"`
+	ID          string           `json:"id"`
+	Name        string           `json:"name" gorm:"primaryKey"`
+	Initialized bool             `json:"initialized"`
+	Telegram    *tb.User         `gorm:"embedded;embeddedPrefix:telegram_"`
+	Wallet      *Wallet          `gorm:"embedded;embeddedPrefix:wallet_"`
+	LNURL       LNURLSettings    `json:"lnurl" gorm:"embedded;embeddedPrefix:lnurl_"`
+	Spending    SpendingSettings `json:"spending" gorm:"embedded;embeddedPrefix:spending_"`
+	// Frozen users can't make payments, see /admin freeze
+	Frozen       bool       `json:"frozen"`
+	FrozenReason string     `json:"frozen_reason"`
+	FrozenAt     *time.Time `json:"frozen_at"`
 }
 
-const (
-	UserStateConfirmPayment = iota + 1
-	UserStateConfirmSend
-	UserStateLNURLEnterAmount
-	UserStateConfirmLNURLPay
-)
-
-type UserStateKey int
+// SpendingSettings are the limits that the user set for their own payments.
+// Zero values fall back to the limits of the bot, the limits of the bot can't be exceeded.
+type SpendingSettings struct {
+	MaxPayment   int64  `json:"max_payment"`   // sat
+	DailyLimit   int64  `json:"daily_limit"`   // sat
+	ConfirmAbove int64  `json:"confirm_above"` // sat, payments above need the PIN or a confirmation code
+	PinHash      string `json:"-"`
+}
 
-func (u *User) ResetState() {
-	u.StateData = ""
-	u.StateKey = 0
+// LNURLSettings are the user's preferences for payments received via LNURL-pay.
+// Zero values fall back to the defaults of the LNURL server.
+type LNURLSettings struct {
+	MinReceivable int64  `json:"min_receivable"` // sat
+	MaxReceivable int64  `json:"max_receivable"` // sat
+	Description   string `json:"description"`
+	Avatar        string `json:"avatar"` // base64 encoded png
 }
 
 type InvoiceParams struct {
@@ -75,17 +87,26 @@ func (err Error) Error() string {
 
 type Wallet struct {
 	*Client  `gorm:"-"`
-	ID       string `json:"id" gorm:"id"`
-	Adminkey string `json:"adminkey"`
-	Inkey    string `json:"inkey"`
-	Balance  int64  `json:"balance"`
-	Name     string `json:"name"`
-	User     string `json:"user"`
+	ID       string        `json:"id" gorm:"id"`
+	Adminkey secret.String `json:"adminkey"` // encrypted at rest
+	Inkey    secret.String `json:"inkey"`    // encrypted at rest
+	Balance  int64         `json:"balance"`
+	Name     string        `json:"name"`
+	User     string        `json:"user"`
 }
 type BitInvoice struct {
 	PaymentHash    string `json:"payment_hash"`
 	PaymentRequest string `json:"payment_request"`
 }
+
+// Payment is the status of a payment of a wallet
+type Payment struct {
+	Paid     bool    `json:"paid"`
+	Preimage string  `json:"preimage"`
+	Details  Webhook `json:"details"`
+}
+
+// Webhook is the payment that LNbits reports to the webhook of an invoice
 type Webhook struct {
 	CheckingID  string `json:"checking_id"`
 	Pending     int    `json:"pending"`
@@ -1,13 +1,17 @@
 package lnbits
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"gorm.io/gorm"
+	"net"
 	"net/url"
 	"time"
 
+	"github.com/LightningTipBot/LightningTipBot/internal/metrics"
+	"github.com/LightningTipBot/LightningTipBot/internal/recovery"
 	"github.com/gorilla/mux"
 	tb "gopkg.in/tucnak/telebot.v2"
 
@@ -16,6 +20,7 @@ import (
 
 const (
 	invoiceReceivedMessage = "⚡️ You received %d sat."
+	invoicePaidCaption     = "✅ Paid"
 )
 
 type WebhookServer struct {
@@ -23,9 +28,42 @@ type WebhookServer struct {
 	bot        *tb.Bot
 	c          *Client
 	database   *gorm.DB
+	listeners  []PaymentListener
+	handlers   map[string]http.Handler
+	tlsCert    string
+	tlsKey     string
 }
 
-func NewWebhookServer(addr *url.URL, bot *tb.Bot, client *Client, database *gorm.DB) *WebhookServer {
+// WebhookServerOption configures optional features of the webhook server
+type WebhookServerOption func(w *WebhookServer)
+
+// WithHandler serves handler at path in addition to the webhooks of invoices, e.g. the Telegram webhook
+func WithHandler(path string, handler http.Handler) WebhookServerOption {
+	return func(w *WebhookServer) {
+		w.handlers[path] = handler
+	}
+}
+
+// WithTLS serves the webhook server with TLS
+func WithTLS(certFile, keyFile string) WebhookServerOption {
+	return func(w *WebhookServer) {
+		w.tlsCert = certFile
+		w.tlsKey = keyFile
+	}
+}
+
+// PaymentListener is notified about every payment that the webhook server receives
+type PaymentListener interface {
+	PaymentReceived(user *User, payment Webhook)
+}
+
+// AddListener registers a listener that is notified about received payments
+func (w *WebhookServer) AddListener(listener PaymentListener) {
+	w.listeners = append(w.listeners, listener)
+}
+
+// NewWebhookServer starts the webhook server at addr. It fails if it can't listen at addr.
+func NewWebhookServer(addr *url.URL, bot *tb.Bot, client *Client, database *gorm.DB, options ...WebhookServerOption) (*WebhookServer, error) {
 	srv := &http.Server{
 		Addr: addr.Host,
 		// Good practice: enforce timeouts for servers you create!
@@ -37,11 +75,36 @@ func NewWebhookServer(addr *url.URL, bot *tb.Bot, client *Client, database *gorm
 		database:   database,
 		bot:        bot,
 		httpServer: srv,
+		handlers:   make(map[string]http.Handler),
+	}
+	for _, option := range options {
+		option(apiServer)
 	}
 	apiServer.httpServer.Handler = apiServer.newRouter()
-	go apiServer.httpServer.ListenAndServe()
+	if len(apiServer.tlsCert) > 0 {
+		certificate, err := tls.LoadX509KeyPair(apiServer.tlsCert, apiServer.tlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("webhook server could not load TLS certificate: %w", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	}
+	listener, err := net.Listen("tcp", addr.Host)
+	if err != nil {
+		return nil, fmt.Errorf("webhook server could not listen at %s: %w", addr.Host, err)
+	}
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			err = apiServer.httpServer.ServeTLS(listener, "", "")
+		} else {
+			err = apiServer.httpServer.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("[Webhook] Server stopped: %s", err)
+		}
+	}()
 	log.Infof("[Webhook] Server started at %s", addr)
-	return apiServer
+	return apiServer, nil
 }
 
 func (w *WebhookServer) GetUserByWalletId(walletId string) (*User, error) {
@@ -56,27 +119,84 @@ func (w *WebhookServer) GetUserByWalletId(walletId string) (*User, error) {
 
 func (w *WebhookServer) newRouter() *mux.Router {
 	router := mux.NewRouter()
-	router.HandleFunc("/", w.receive).Methods(http.MethodPost)
+	router.Use(recovery.Middleware("Webhook"))
+	// additional handlers take precedence over the tokens of invoices
+	for path, handler := range w.handlers {
+		router.Handle(path, handler)
+	}
+	router.HandleFunc("/{token}", w.receive).Methods(http.MethodPost)
 	return router
 }
 
-func (w WebhookServer) receive(writer http.ResponseWriter, request *http.Request) {
-	depositEvent := Webhook{}
-	request.Header.Del("content-length")
-	err := json.NewDecoder(request.Body).Decode(&depositEvent)
+// receive handles the webhook call of an invoice. The body of the request is not trusted:
+// the payment is looked up by the token of the webhook URL and verified with LNbits.
+func (w *WebhookServer) receive(writer http.ResponseWriter, request *http.Request) {
+	defer request.Body.Close()
+	outcome := "error"
+	defer func() { metrics.WebhookDelivery(outcome) }()
+	webhook, err := getInvoiceWebhook(w.database, mux.Vars(request)["token"])
 	if err != nil {
-		writer.WriteHeader(400)
+		log.Warnf("[WebHook] Unknown webhook token from %s", request.RemoteAddr)
+		outcome = "unknown_token"
+		writer.WriteHeader(http.StatusNotFound)
 		return
 	}
-	user, err := w.GetUserByWalletId(depositEvent.WalletID)
+	user, err := w.GetUserByWalletId(webhook.WalletID)
 	if err != nil {
-		writer.WriteHeader(400)
+		log.Errorf("[WebHook] Could not find wallet %s: %v", webhook.WalletID, err)
+		outcome = "unknown_wallet"
+		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	payment, err := w.c.Payment(webhook.PaymentHash, *user.Wallet)
+	if err != nil {
+		log.Errorf("[WebHook] Could not verify payment %s: %v", webhook.PaymentHash, err)
+		outcome = "verify_failed"
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !payment.Paid {
+		log.Warnf("[WebHook] Payment %s is not paid", webhook.PaymentHash)
+		outcome = "unpaid"
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	deliver, err := markPaymentDelivered(w.database, webhook.PaymentHash)
+	if err != nil {
+		log.Errorf("[WebHook] Could not mark payment %s as delivered: %v", webhook.PaymentHash, err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !deliver {
+		// repeated delivery of a payment that was already handled
+		outcome = "repeated"
+		writer.WriteHeader(http.StatusOK)
+		return
+	}
+	depositEvent := payment.Details
+	depositEvent.PaymentHash = webhook.PaymentHash
+	if len(depositEvent.Preimage) == 0 {
+		depositEvent.Preimage = payment.Preimage
+	}
 	log.Infoln(fmt.Sprintf("[WebHook] User %s (%d) received invoice of %d sat.", user.Telegram.Username, user.Telegram.ID, depositEvent.Amount/1000))
+	if message, ok := webhook.message(); ok {
+		_, err = w.bot.EditCaption(message, invoicePaidCaption)
+		if err != nil {
+			log.Errorf("[WebHook] Could not update invoice message of %s: %v", webhook.PaymentHash, err)
+		}
+	}
 	_, err = w.bot.Send(user.Telegram, fmt.Sprintf(invoiceReceivedMessage, depositEvent.Amount/1000))
 	if err != nil {
 		log.Errorln(err)
 	}
-	writer.WriteHeader(200)
+	for _, listener := range w.listeners {
+		listener.PaymentReceived(user, depositEvent)
+	}
+	outcome = "delivered"
+	writer.WriteHeader(http.StatusOK)
+}
+
+// Shutdown stops the server after the running requests are finished
+func (w *WebhookServer) Shutdown(ctx context.Context) error {
+	return w.httpServer.Shutdown(ctx)
 }
@@ -0,0 +1,152 @@
+package lnbits
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// fakeBackend serves the parts of the LNbits and Telegram APIs that the webhook server uses
+type fakeBackend struct {
+	mu       sync.Mutex
+	paid     map[string]bool
+	messages []string
+	captions []string
+}
+
+func (f *fakeBackend) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case request.URL.Path == "/api/v1/payments" && request.Method == http.MethodPost:
+		hash := strings.Repeat("0", 63) + string(rune('0'+len(f.paid)))
+		f.paid[hash] = false
+		json.NewEncoder(writer).Encode(BitInvoice{PaymentHash: hash, PaymentRequest: "lnbc" + hash})
+	case strings.HasPrefix(request.URL.Path, "/api/v1/payments/"):
+		hash := strings.TrimPrefix(request.URL.Path, "/api/v1/payments/")
+		json.NewEncoder(writer).Encode(Payment{Paid: f.paid[hash], Details: Webhook{PaymentHash: hash, Amount: 21000}})
+	case strings.HasSuffix(request.URL.Path, "/getMe"):
+		writer.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"bot","username":"bot"}}`))
+	case strings.HasSuffix(request.URL.Path, "/sendMessage"):
+		var message struct {
+			Text string `json:"text"`
+		}
+		json.NewDecoder(request.Body).Decode(&message)
+		f.messages = append(f.messages, message.Text)
+		writer.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":2},"date":0}}`))
+	case strings.HasSuffix(request.URL.Path, "/editMessageCaption"):
+		var edit struct {
+			Caption string `json:"caption"`
+		}
+		json.NewDecoder(request.Body).Decode(&edit)
+		f.captions = append(f.captions, edit.Caption)
+		writer.Write([]byte(`{"ok":true,"result":{"message_id":7,"chat":{"id":2},"date":0}}`))
+	default:
+		http.NotFound(writer, request)
+	}
+}
+
+func (f *fakeBackend) setPaid(hash string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paid[hash] = true
+}
+
+func (f *fakeBackend) messageCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.messages)
+}
+
+func TestWebhookServer_receive(t *testing.T) {
+	backend := &fakeBackend{paid: make(map[string]bool)}
+	backendServer := httptest.NewServer(backend)
+	defer backendServer.Close()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "bot.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&User{}, &InvoiceWebhook{}); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient("key", backendServer.URL)
+	wallet := &Wallet{Client: client, ID: "w1", Adminkey: "admin", Inkey: "invoice"}
+	if err := db.Create(&User{Name: "2", Initialized: true, Telegram: &tb.User{ID: 2}, Wallet: wallet}).Error; err != nil {
+		t.Fatal(err)
+	}
+	bot, err := tb.NewBot(tb.Settings{URL: backendServer.URL, Token: "token", Synchronous: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &WebhookServer{bot: bot, c: client, database: db}
+	server := httptest.NewServer(w.newRouter())
+	defer server.Close()
+
+	invoice, err := InvoiceWithWebhook(db, server.URL, InvoiceParams{Amount: 21}, *wallet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetInvoiceMessage(db, invoice.PaymentHash, tb.StoredMessage{MessageID: "7", ChatID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	webhook := &InvoiceWebhook{}
+	if err := db.Where("payment_hash = ?", invoice.PaymentHash).First(webhook).Error; err != nil {
+		t.Fatal(err)
+	}
+	post := func(token string) int {
+		resp, err := http.Post(server.URL+"/"+token, "application/json", strings.NewReader(`{"amount":100000000,"wallet_id":"w1"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := post("spoofed"); status != http.StatusNotFound {
+		t.Errorf("unknown token: status %d, want %d", status, http.StatusNotFound)
+	}
+	if status := post(webhook.Token); status != http.StatusBadRequest {
+		t.Errorf("unpaid invoice: status %d, want %d", status, http.StatusBadRequest)
+	}
+	if backend.messageCount() != 0 {
+		t.Fatalf("user was notified about an unverified payment")
+	}
+	backend.setPaid(invoice.PaymentHash)
+	for i := 0; i < 2; i++ {
+		if status := post(webhook.Token); status != http.StatusOK {
+			t.Errorf("paid invoice: status %d, want %d", status, http.StatusOK)
+		}
+	}
+	if backend.messageCount() != 1 {
+		t.Fatalf("user was notified %d times, want once", backend.messageCount())
+	}
+	if backend.messages[0] != "⚡️ You received 21 sat." {
+		t.Errorf("message = %q, want the verified amount", backend.messages[0])
+	}
+	if len(backend.captions) != 1 || backend.captions[0] != invoicePaidCaption {
+		t.Errorf("invoice captions = %v, want %q", backend.captions, invoicePaidCaption)
+	}
+}
+
+func TestNewWebhookServer_addressInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, err = NewWebhookServer(&url.URL{Scheme: "http", Host: listener.Addr().String()}, nil, nil, nil)
+	if err == nil {
+		t.Error("webhook server started at an address in use")
+	}
+}
@@ -0,0 +1,183 @@
+package lnurl
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	"gorm.io/gorm"
+)
+
+// AliasKind distinguishes aliases claimed with /address from former Telegram usernames
+type AliasKind int
+
+const (
+	AliasClaimed AliasKind = iota + 1
+	AliasFormerUsername
+)
+
+var (
+	// AliasCooldown is the time a released alias can not be claimed by another user
+	AliasCooldown = time.Hour * 24 * 30
+	// UsernameGracePeriod is the time a former Telegram username keeps resolving to its previous owner
+	UsernameGracePeriod = time.Hour * 24 * 30
+
+	ErrAliasInvalid  = errors.New("alias is not valid")
+	ErrAliasTaken    = errors.New("alias is already taken")
+	ErrAliasCooldown = errors.New("alias was released recently")
+
+	aliasPattern   = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{2,31}$`)
+	reservedAlias  = []string{"remove", "admin", "support", "lnurlp"}
+	errAliasNoUser = errors.New("alias does not resolve to a user")
+)
+
+// Alias is a Lightning address name that resolves to a user, independent of the Telegram username.
+type Alias struct {
+	Name       string    `gorm:"primaryKey"`
+	UserName   string    `gorm:"index"` // lnbits.User.Name
+	Kind       AliasKind `gorm:"index"`
+	CreatedAt  time.Time
+	ReleasedAt *time.Time
+}
+
+// active returns whether the alias still resolves to its user
+func (a Alias) active(now time.Time) bool {
+	switch a.Kind {
+	case AliasClaimed:
+		return a.ReleasedAt == nil
+	case AliasFormerUsername:
+		return a.ReleasedAt != nil && now.Sub(*a.ReleasedAt) < UsernameGracePeriod
+	}
+	return false
+}
+
+// reserved returns whether the alias can not be claimed by another user than its owner
+func (a Alias) reserved(now time.Time) bool {
+	if a.active(now) {
+		return true
+	}
+	return a.Kind == AliasClaimed && now.Sub(*a.ReleasedAt) < AliasCooldown
+}
+
+// ValidateAlias checks whether name can be used as a Lightning address
+func ValidateAlias(name string) error {
+	if !aliasPattern.MatchString(name) {
+		return ErrAliasInvalid
+	}
+	for _, reserved := range reservedAlias {
+		if name == reserved {
+			return ErrAliasInvalid
+		}
+	}
+	return nil
+}
+
+// GetAlias returns the active alias that a user has claimed
+func GetAlias(db *gorm.DB, userName string) (*Alias, error) {
+	alias := &Alias{}
+	tx := db.Where("user_name = ? AND kind = ? AND released_at IS NULL", userName, AliasClaimed).First(alias)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return alias, nil
+}
+
+// ClaimAlias assigns the alias name to a user and releases the alias that the user had before.
+func ClaimAlias(db *gorm.DB, userName string, name string) error {
+	name = strings.ToLower(name)
+	err := ValidateAlias(name)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return db.Transaction(func(tx *gorm.DB) error {
+		existing := &Alias{}
+		res := tx.Where("name = ?", name).Limit(1).Find(existing)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected > 0 && existing.UserName != userName && existing.reserved(now) {
+			if existing.active(now) {
+				return ErrAliasTaken
+			}
+			return ErrAliasCooldown
+		}
+		// the alias must not shadow the Telegram username of another user
+		var count int64
+		res = tx.Model(&lnbits.User{}).Where("telegram_username = ? AND name <> ?", name, userName).Count(&count)
+		if res.Error != nil {
+			return res.Error
+		}
+		if count > 0 {
+			return ErrAliasTaken
+		}
+		err := releaseAlias(tx, userName, now)
+		if err != nil {
+			return err
+		}
+		return tx.Save(&Alias{Name: name, UserName: userName, Kind: AliasClaimed, CreatedAt: now}).Error
+	})
+}
+
+// ReleaseAlias releases the active alias of a user. The alias stays reserved for AliasCooldown.
+func ReleaseAlias(db *gorm.DB, userName string) error {
+	return releaseAlias(db, userName, time.Now())
+}
+
+func releaseAlias(db *gorm.DB, userName string, now time.Time) error {
+	return db.Model(&Alias{}).
+		Where("user_name = ? AND kind = ? AND released_at IS NULL", userName, AliasClaimed).
+		Update("released_at", now).Error
+}
+
+// RecordFormerUsername keeps a former Telegram username of a user resolving to them for UsernameGracePeriod.
+// Claimed aliases are never overwritten.
+func RecordFormerUsername(db *gorm.DB, userName string, username string) error {
+	username = strings.ToLower(username)
+	if len(username) == 0 {
+		return nil
+	}
+	now := time.Now()
+	return db.Transaction(func(tx *gorm.DB) error {
+		existing := &Alias{}
+		res := tx.Where("name = ?", username).Limit(1).Find(existing)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected > 0 && existing.Kind == AliasClaimed && existing.reserved(now) {
+			return nil
+		}
+		return tx.Save(&Alias{Name: username, UserName: userName, Kind: AliasFormerUsername, CreatedAt: now, ReleasedAt: &now}).Error
+	})
+}
+
+// ResolveUser returns the user that receives payments to name. Claimed aliases take precedence
+// over current Telegram usernames, which take precedence over former Telegram usernames.
+func ResolveUser(db *gorm.DB, name string) (*lnbits.User, error) {
+	name = strings.ToLower(name)
+	now := time.Now()
+	alias := &Alias{}
+	res := db.Where("name = ?", name).Limit(1).Find(alias)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	hasAlias := res.RowsAffected > 0 && alias.active(now)
+	user := &lnbits.User{}
+	if hasAlias && alias.Kind == AliasClaimed {
+		return user, db.Where("name = ?", alias.UserName).First(user).Error
+	}
+	res = db.Where("telegram_username = ?", name).Limit(1).Find(user)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected > 0 {
+		return user, nil
+	}
+	if hasAlias {
+		return user, db.Where("name = ?", alias.UserName).First(user).Error
+	}
+	return nil, fmt.Errorf("%w: %s", errAliasNoUser, name)
+}
@@ -0,0 +1,121 @@
+package lnurl
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func newAliasTestDatabase(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "bot.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&lnbits.User{}, &Alias{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []*lnbits.User{
+		{Name: "1", Initialized: true, Telegram: &tb.User{ID: 1, Username: "alice"}, Wallet: &lnbits.Wallet{ID: "w1"}},
+		{Name: "2", Initialized: true, Telegram: &tb.User{ID: 2, Username: "bob"}, Wallet: &lnbits.Wallet{ID: "w2"}},
+	} {
+		if err := db.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestValidateAlias(t *testing.T) {
+	for name, valid := range map[string]bool{"satoshi": true, "s4t.o-s_i": true, "ab": false, "Satoshi": false, "-satoshi": false, "remove": false, "sat oshi": false} {
+		if err := ValidateAlias(name); (err == nil) != valid {
+			t.Errorf("ValidateAlias(%q) = %v, want valid %v", name, err, valid)
+		}
+	}
+}
+
+func TestClaimAlias(t *testing.T) {
+	db := newAliasTestDatabase(t)
+
+	if err := ClaimAlias(db, "1", "Satoshi"); err != nil {
+		t.Fatalf("ClaimAlias() = %v", err)
+	}
+	user, err := ResolveUser(db, "satoshi")
+	if err != nil || user.Name != "1" {
+		t.Fatalf("ResolveUser(satoshi) = %v, %v, want user 1", user, err)
+	}
+	// the alias and the usernames of other users are taken
+	if err := ClaimAlias(db, "2", "satoshi"); !errors.Is(err, ErrAliasTaken) {
+		t.Errorf("ClaimAlias() = %v, want %v", err, ErrAliasTaken)
+	}
+	if err := ClaimAlias(db, "2", "alice"); !errors.Is(err, ErrAliasTaken) {
+		t.Errorf("ClaimAlias() = %v, want %v", err, ErrAliasTaken)
+	}
+	// a new alias releases the old one, which is then in its cooldown period
+	if err := ClaimAlias(db, "1", "nakamoto"); err != nil {
+		t.Fatalf("ClaimAlias() = %v", err)
+	}
+	if _, err := ResolveUser(db, "satoshi"); err == nil {
+		t.Errorf("ResolveUser(satoshi) resolved a released alias")
+	}
+	if err := ClaimAlias(db, "2", "satoshi"); !errors.Is(err, ErrAliasCooldown) {
+		t.Errorf("ClaimAlias() = %v, want %v", err, ErrAliasCooldown)
+	}
+	// after the cooldown, the alias can be claimed by another user
+	released := time.Now().Add(-AliasCooldown - time.Minute)
+	if err := db.Model(&Alias{}).Where("name = ?", "satoshi").Update("released_at", released).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := ClaimAlias(db, "2", "satoshi"); err != nil {
+		t.Errorf("ClaimAlias() = %v", err)
+	}
+	alias, err := GetAlias(db, "2")
+	if err != nil || alias.Name != "satoshi" {
+		t.Errorf("GetAlias() = %v, %v, want satoshi", alias, err)
+	}
+}
+
+func TestRecordFormerUsername(t *testing.T) {
+	db := newAliasTestDatabase(t)
+
+	// alice renames herself to carol
+	if err := RecordFormerUsername(db, "1", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&lnbits.User{}).Where("name = ?", "1").Update("telegram_username", "carol").Error; err != nil {
+		t.Fatal(err)
+	}
+	user, err := ResolveUser(db, "alice")
+	if err != nil || user.Name != "1" {
+		t.Fatalf("ResolveUser(alice) = %v, %v, want user 1", user, err)
+	}
+	// the former username is reserved during the grace period
+	if err := ClaimAlias(db, "2", "alice"); !errors.Is(err, ErrAliasTaken) {
+		t.Errorf("ClaimAlias() = %v, want %v", err, ErrAliasTaken)
+	}
+	// the new owner of the Telegram username takes precedence
+	if err := db.Model(&lnbits.User{}).Where("name = ?", "2").Update("telegram_username", "alice").Error; err != nil {
+		t.Fatal(err)
+	}
+	user, err = ResolveUser(db, "alice")
+	if err != nil || user.Name != "2" {
+		t.Fatalf("ResolveUser(alice) = %v, %v, want user 2", user, err)
+	}
+	// after the grace period, the former username does not resolve anymore
+	released := time.Now().Add(-UsernameGracePeriod - time.Minute)
+	if err := db.Model(&Alias{}).Where("name = ?", "alice").Update("released_at", released).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&lnbits.User{}).Where("name = ?", "2").Update("telegram_username", "bob").Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveUser(db, "alice"); err == nil {
+		t.Errorf("ResolveUser(alice) resolved after the grace period")
+	}
+}
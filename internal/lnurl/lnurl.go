@@ -8,9 +8,10 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
-	"strings"
 
 	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	"github.com/LightningTipBot/LightningTipBot/internal/metrics"
+	"github.com/LightningTipBot/LightningTipBot/internal/nostr"
 	"github.com/fiatjaf/go-lnurl"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
@@ -19,21 +20,26 @@ import (
 func (w Server) handleLnUrl(writer http.ResponseWriter, request *http.Request) {
 	var err error
 	var response interface{}
+	kind, status := "pay_request", "error"
+	defer func() { metrics.LNURLRequest(kind, status) }()
 	username := mux.Vars(request)["username"]
 	if request.URL.RawQuery == "" {
 		response, err = w.serveLNURLpFirst(username)
 	} else {
+		kind = "callback"
 		stringAmount := request.FormValue("amount")
 		if stringAmount == "" {
+			status = "bad_request"
 			NotFoundHandler(writer, fmt.Errorf("[serveLNURLpSecond] Form value 'amount' is not set"))
 			return
 		}
 		amount, parseError := strconv.Atoi(stringAmount)
 		if parseError != nil {
+			status = "bad_request"
 			NotFoundHandler(writer, fmt.Errorf("[serveLNURLpSecond] Couldn't cast amount to int %v", parseError))
 			return
 		}
-		response, err = w.serveLNURLpSecond(username, int64(amount))
+		response, err = w.serveLNURLpSecond(username, int64(amount), request.FormValue("nostr"))
 	}
 	// check if error was returned from first or second handlers
 	if err != nil {
@@ -41,6 +47,7 @@ func (w Server) handleLnUrl(writer http.ResponseWriter, request *http.Request) {
 		log.Errorf("[LNURL] %v", err)
 		if response != nil {
 			// there is a valid error response
+			status = "rejected"
 			err = writeResponse(writer, response)
 			if err != nil {
 				NotFoundHandler(writer, err)
@@ -52,72 +59,104 @@ func (w Server) handleLnUrl(writer http.ResponseWriter, request *http.Request) {
 	err = writeResponse(writer, response)
 	if err != nil {
 		NotFoundHandler(writer, err)
+		return
 	}
+	status = "ok"
 }
 
 // serveLNURLpFirst serves the first part of the LNURLp protocol with the endpoint
 // to call and the metadata that matches the description hash of the second response
-func (w Server) serveLNURLpFirst(username string) (*lnurl.LNURLPayResponse1, error) {
+func (w Server) serveLNURLpFirst(username string) (*LNURLPayResponse1, error) {
 	log.Infof("[LNURL] Serving endpoint for user %s", username)
+	user, err := w.getUser(username)
+	if err != nil {
+		return &LNURLPayResponse1{
+			LNURLPayResponse1: lnurl.LNURLPayResponse1{
+				LNURLResponse: lnurl.LNURLResponse{
+					Status: statusError,
+					Reason: "Unknown user."},
+			},
+		}, err
+	}
 	callbackURL, err := url.Parse(fmt.Sprintf("%s/%s/%s", w.callbackHostname.String(), lnurlEndpoint, username))
 	if err != nil {
 		return nil, err
 	}
-	metadata := w.metaData(username)
+	metadata := w.metaData(username, user.LNURL)
 	jsonMeta, err := json.Marshal(metadata)
 	if err != nil {
 		return nil, err
 	}
+	min, max := sendableRange(user.LNURL)
 
-	return &lnurl.LNURLPayResponse1{
-		LNURLResponse:   lnurl.LNURLResponse{Status: statusOk},
-		Tag:             payRequestTag,
-		Callback:        callbackURL.String(),
-		CallbackURL:     callbackURL, // probably no need to set this here
-		MinSendable:     minSendable,
-		MaxSendable:     MaxSendable,
-		EncodedMetadata: string(jsonMeta),
-	}, nil
+	response := &LNURLPayResponse1{
+		LNURLPayResponse1: lnurl.LNURLPayResponse1{
+			LNURLResponse:   lnurl.LNURLResponse{Status: statusOk},
+			Tag:             payRequestTag,
+			Callback:        callbackURL.String(),
+			CallbackURL:     callbackURL, // probably no need to set this here
+			MinSendable:     min,
+			MaxSendable:     max,
+			EncodedMetadata: string(jsonMeta),
+		},
+	}
+	if w.zapsEnabled() {
+		response.AllowsNostr = true
+		response.NostrPubkey = nostr.PublicKey(w.nostrKey)
+	}
+	return response, nil
 
 }
 
-// serveLNURLpSecond serves the second LNURL response with the payment request with the correct description hash
-func (w Server) serveLNURLpSecond(username string, amount int64) (*lnurl.LNURLPayResponse2, error) {
+// serveLNURLpSecond serves the second LNURL response with the payment request with the correct description hash.
+// If zapRequest is set, the invoice commits to the zap request instead of the metadata (NIP-57).
+func (w Server) serveLNURLpSecond(username string, amount int64, zapRequest string) (*lnurl.LNURLPayResponse2, error) {
 	log.Infof("[LNURL] Serving invoice for user %s", username)
-	if amount < minSendable || amount > MaxSendable {
+	user, err := w.getUser(username)
+	if err != nil {
+		return &lnurl.LNURLPayResponse2{
+			LNURLResponse: lnurl.LNURLResponse{
+				Status: statusError,
+				Reason: "Unknown user."},
+		}, err
+	}
+	min, max := sendableRange(user.LNURL)
+	if amount < min || amount > max {
 		// amount is not ok
 		return &lnurl.LNURLPayResponse2{
 			LNURLResponse: lnurl.LNURLResponse{
 				Status: statusError,
-				Reason: fmt.Sprintf("Amount out of bounds (min: %d mSat, max: %d mSat).", minSendable, MaxSendable)},
+				Reason: fmt.Sprintf("Amount out of bounds (min: %d mSat, max: %d mSat).", min, max)},
 		}, fmt.Errorf("amount out of bounds")
 	}
-	// amount is ok now check for the user
-	user := &lnbits.User{}
-	tx := w.database.Where("telegram_username = ?", strings.ToLower(username)).First(user)
-	if tx.Error != nil {
-		return nil, fmt.Errorf("[GetUser] Couldn't fetch user info from database: %v", tx.Error)
-	}
-	if user.Wallet == nil || user.Initialized == false {
-		return nil, fmt.Errorf("[serveLNURLpSecond] invalid user data")
-	}
 
 	// set wallet lnbits client
 	user.Wallet.Client = w.c
 	var resp *lnurl.LNURLPayResponse2
 
 	// the same description_hash needs to be built in the second request
-	metadata := w.metaData(username)
+	metadata := w.metaData(username, user.LNURL)
 	descriptionHash, err := w.descriptionHash(metadata)
 	if err != nil {
 		return nil, err
 	}
-	invoice, err := user.Wallet.Invoice(
+	isZap := len(zapRequest) > 0 && w.zapsEnabled()
+	if isZap {
+		_, err = validateZapRequest(zapRequest, amount)
+		if err != nil {
+			return &lnurl.LNURLPayResponse2{
+				LNURLResponse: lnurl.LNURLResponse{
+					Status: statusError,
+					Reason: "Invalid zap request."},
+			}, err
+		}
+		descriptionHash = zapDescriptionHash(zapRequest)
+	}
+	invoice, err := lnbits.InvoiceWithWebhook(w.database, w.WebhookServer,
 		lnbits.InvoiceParams{
 			Amount:          amount / 1000,
 			Out:             false,
-			DescriptionHash: descriptionHash,
-			Webhook:         w.WebhookServer},
+			DescriptionHash: descriptionHash},
 		*user.Wallet)
 	if err != nil {
 		err = fmt.Errorf("[serveLNURLpSecond] Couldn't create invoice: %v", err)
@@ -128,6 +167,16 @@ func (w Server) serveLNURLpSecond(username string, amount int64) (*lnurl.LNURLPa
 		}
 		return resp, err
 	}
+	if isZap {
+		err = storeZapRequest(w.database, invoice.PaymentHash, user.Name, zapRequest, amount)
+		if err != nil {
+			return &lnurl.LNURLPayResponse2{
+				LNURLResponse: lnurl.LNURLResponse{
+					Status: statusError,
+					Reason: "Couldn't create invoice."},
+			}, fmt.Errorf("[serveLNURLpSecond] Couldn't store zap request: %v", err)
+		}
+	}
 	return &lnurl.LNURLPayResponse2{
 		LNURLResponse: lnurl.LNURLResponse{Status: statusOk},
 		PR:            invoice.PaymentRequest,
@@ -137,6 +186,36 @@ func (w Server) serveLNURLpSecond(username string, amount int64) (*lnurl.LNURLPa
 
 }
 
+// getUser returns the initialized user that receives payments for username
+func (w Server) getUser(username string) (*lnbits.User, error) {
+	user, err := ResolveUser(w.database, username)
+	if err != nil {
+		return nil, fmt.Errorf("[GetUser] Couldn't fetch user info from database: %v", err)
+	}
+	if user.Wallet == nil || user.Initialized == false {
+		return nil, fmt.Errorf("[GetUser] invalid user data")
+	}
+	return user, nil
+}
+
+// ReceivableBounds returns the range in sat of the limits that users can set for LNURL payments
+func ReceivableBounds() (min int64, max int64) {
+	return minSendable / 1000, MaxSendable / 1000
+}
+
+// sendableRange returns the min and max sendable amount in mSat for the settings of a user.
+// Settings outside of the bounds of the server are ignored.
+func sendableRange(settings lnbits.LNURLSettings) (min int64, max int64) {
+	min, max = minSendable, MaxSendable
+	if settings.MinReceivable*1000 > min && settings.MinReceivable*1000 <= max {
+		min = settings.MinReceivable * 1000
+	}
+	if settings.MaxReceivable > 0 && settings.MaxReceivable*1000 >= min && settings.MaxReceivable*1000 < max {
+		max = settings.MaxReceivable * 1000
+	}
+	return
+}
+
 // descriptionHash is the SHA256 hash of the metadata
 func (w Server) descriptionHash(metadata lnurl.Metadata) (string, error) {
 	jsonMeta, err := json.Marshal(metadata)
@@ -150,8 +229,16 @@ func (w Server) descriptionHash(metadata lnurl.Metadata) (string, error) {
 
 // metaData returns the metadata that is sent in the first response
 // and is used again in the second response to verify the description hash
-func (w Server) metaData(username string) lnurl.Metadata {
-	return lnurl.Metadata{
+func (w Server) metaData(username string, settings lnbits.LNURLSettings) lnurl.Metadata {
+	description := fmt.Sprintf("Pay to %s@%s", username, w.callbackHostname.Hostname())
+	if len(settings.Description) > 0 {
+		description = settings.Description
+	}
+	metadata := lnurl.Metadata{
 		{"text/identifier", fmt.Sprintf("%s@%s", username, w.callbackHostname.Hostname())},
-		{"text/plain", fmt.Sprintf("Pay to %s@%s", username, w.callbackHostname.Hostname())}}
+		{"text/plain", description}}
+	if len(settings.Avatar) > 0 {
+		metadata = append(metadata, []string{"image/png;base64", settings.Avatar})
+	}
+	return metadata
 }
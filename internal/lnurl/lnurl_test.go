@@ -0,0 +1,66 @@
+package lnurl
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+)
+
+func Test_sendableRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings lnbits.LNURLSettings
+		wantMin  int64
+		wantMax  int64
+	}{
+		{name: "default", settings: lnbits.LNURLSettings{}, wantMin: minSendable, wantMax: MaxSendable},
+		{name: "min", settings: lnbits.LNURLSettings{MinReceivable: 100}, wantMin: 100000, wantMax: MaxSendable},
+		{name: "max", settings: lnbits.LNURLSettings{MaxReceivable: 5000}, wantMin: minSendable, wantMax: 5000000},
+		{name: "min and max", settings: lnbits.LNURLSettings{MinReceivable: 10, MaxReceivable: 20}, wantMin: 10000, wantMax: 20000},
+		{name: "max above server bound", settings: lnbits.LNURLSettings{MaxReceivable: MaxSendable}, wantMin: minSendable, wantMax: MaxSendable},
+		{name: "max below min", settings: lnbits.LNURLSettings{MinReceivable: 20, MaxReceivable: 10}, wantMin: 20000, wantMax: MaxSendable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			min, max := sendableRange(tt.settings)
+			if min != tt.wantMin || max != tt.wantMax {
+				t.Errorf("sendableRange() = (%d, %d), want (%d, %d)", min, max, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestServer_metaData(t *testing.T) {
+	hostname, _ := url.Parse("https://ln.tips")
+	w := Server{callbackHostname: hostname}
+	tests := []struct {
+		name     string
+		settings lnbits.LNURLSettings
+		want     [][]string
+	}{
+		{
+			name:     "default",
+			settings: lnbits.LNURLSettings{},
+			want:     [][]string{{"text/identifier", "alice@ln.tips"}, {"text/plain", "Pay to alice@ln.tips"}},
+		},
+		{
+			name:     "description and avatar",
+			settings: lnbits.LNURLSettings{Description: "Tips welcome", Avatar: "aGVsbG8="},
+			want:     [][]string{{"text/identifier", "alice@ln.tips"}, {"text/plain", "Tips welcome"}, {"image/png;base64", "aGVsbG8="}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := w.metaData("alice", tt.settings)
+			if len(got) != len(tt.want) {
+				t.Fatalf("metaData() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i][0] != tt.want[i][0] || got[i][1] != tt.want[i][1] {
+					t.Errorf("metaData()[%d] = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
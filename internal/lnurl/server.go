@@ -1,12 +1,18 @@
 package lnurl
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"time"
 
 	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	"github.com/LightningTipBot/LightningTipBot/internal/nostr"
+	"github.com/LightningTipBot/LightningTipBot/internal/recovery"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	tb "gopkg.in/tucnak/telebot.v2"
@@ -20,8 +26,14 @@ type Server struct {
 	database         *gorm.DB
 	callbackHostname *url.URL
 	WebhookServer    string
+	nostrKey         *secp256k1.PrivateKey
+	nostrRelays      []string
+	nostrPublisher   nostr.Publisher
 }
 
+// ServerOption configures optional features of the LNURL server
+type ServerOption func(s *Server)
+
 const (
 	statusError   = "ERROR"
 	statusOk      = "OK"
@@ -31,7 +43,8 @@ const (
 	MaxSendable   = 1000000000
 )
 
-func NewServer(addr, callbackHostname *url.URL, webhookServer string, bot *tb.Bot, client *lnbits.Client, database *gorm.DB) *Server {
+// NewServer starts the LNURL server at addr. It fails if it can't listen at addr.
+func NewServer(addr, callbackHostname *url.URL, webhookServer string, bot *tb.Bot, client *lnbits.Client, database *gorm.DB, options ...ServerOption) (*Server, error) {
 	srv := &http.Server{
 		Addr: addr.Host,
 		// Good practice: enforce timeouts for servers you create!
@@ -46,15 +59,28 @@ func NewServer(addr, callbackHostname *url.URL, webhookServer string, bot *tb.Bo
 		callbackHostname: callbackHostname,
 		WebhookServer:    webhookServer,
 	}
+	for _, option := range options {
+		option(apiServer)
+	}
 
 	apiServer.httpServer.Handler = apiServer.newRouter()
-	go apiServer.httpServer.ListenAndServe()
+	listener, err := net.Listen("tcp", addr.Host)
+	if err != nil {
+		return nil, fmt.Errorf("LNURL server could not listen at %s: %w", addr.Host, err)
+	}
+	go func() {
+		err := apiServer.httpServer.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("[LNURL] Server stopped: %s", err)
+		}
+	}()
 	log.Infof("[LNURL] Server started at %s", addr.Host)
-	return apiServer
+	return apiServer, nil
 }
 
 func (w *Server) newRouter() *mux.Router {
 	router := mux.NewRouter()
+	router.Use(recovery.Middleware("LNURL"))
 	router.HandleFunc("/.well-known/lnurlp/{username}", w.handleLnUrl).Methods(http.MethodGet)
 	router.HandleFunc("/@{username}", w.handleLnUrl).Methods(http.MethodGet)
 	return router
@@ -74,3 +100,8 @@ func writeResponse(writer http.ResponseWriter, response interface{}) error {
 	_, err = writer.Write(jsonResponse)
 	return err
 }
+
+// Shutdown stops the server after the running requests are finished
+func (w *Server) Shutdown(ctx context.Context) error {
+	return w.httpServer.Shutdown(ctx)
+}
@@ -0,0 +1,205 @@
+package lnurl
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	"github.com/LightningTipBot/LightningTipBot/internal/nostr"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/fiatjaf/go-lnurl"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	// maxZapRelays is the maximum number of relays a zap receipt is published to
+	maxZapRelays   = 10
+	publishTimeout = 10 * time.Second
+)
+
+var errInvalidZapRequest = errors.New("invalid zap request")
+
+// ZapRequest is a NIP-57 zap request that was committed to in the description hash of an invoice.
+type ZapRequest struct {
+	PaymentHash string `gorm:"primaryKey"`
+	UserName    string `gorm:"index"` // lnbits.User.Name of the recipient
+	Request     string // the zap request event as received
+	Amount      int64  // mSat
+	CreatedAt   time.Time
+	PublishedAt *time.Time
+}
+
+// LNURLPayResponse1 is the first LNURL-pay response with the NIP-57 fields
+type LNURLPayResponse1 struct {
+	lnurl.LNURLPayResponse1
+	AllowsNostr bool   `json:"allowsNostr,omitempty"`
+	NostrPubkey string `json:"nostrPubkey,omitempty"`
+}
+
+// WithNostr enables zaps. Zap receipts are signed with key and published to the relays of
+// the zap request and to relays using publisher. publisher must treat only relays as trusted,
+// see nostr.NewWebsocketPublisher.
+func WithNostr(key *secp256k1.PrivateKey, relays []string, publisher nostr.Publisher) ServerOption {
+	return func(s *Server) {
+		s.nostrKey = key
+		s.nostrRelays = relays
+		s.nostrPublisher = publisher
+	}
+}
+
+// zapsEnabled returns whether the server accepts zap requests
+func (w Server) zapsEnabled() bool {
+	return w.nostrKey != nil && w.nostrPublisher != nil
+}
+
+// validateZapRequest checks a zap request according to NIP-57 for an invoice of amount mSat
+func validateZapRequest(raw string, amount int64) (nostr.Event, error) {
+	event, err := nostr.ParseEvent(raw)
+	if err != nil {
+		return event, fmt.Errorf("%w: %v", errInvalidZapRequest, err)
+	}
+	if event.Kind != nostr.KindZapRequest {
+		return event, fmt.Errorf("%w: kind %d", errInvalidZapRequest, event.Kind)
+	}
+	err = event.CheckSignature()
+	if err != nil {
+		return event, fmt.Errorf("%w: %v", errInvalidZapRequest, err)
+	}
+	if len(event.Tags) == 0 {
+		return event, fmt.Errorf("%w: no tags", errInvalidZapRequest)
+	}
+	p := event.TagValues("p")
+	if len(p) != 1 || len(p[0]) == 0 || len(p[0][0]) != 64 {
+		return event, fmt.Errorf("%w: must have exactly one p tag", errInvalidZapRequest)
+	}
+	if len(event.TagValues("e")) > 1 {
+		return event, fmt.Errorf("%w: must have at most one e tag", errInvalidZapRequest)
+	}
+	if relays, ok := event.Tag("relays"); !ok || len(relays) < 2 {
+		return event, fmt.Errorf("%w: no relays", errInvalidZapRequest)
+	}
+	if tag, ok := event.Tag("amount"); ok {
+		if len(tag) < 2 || tag[1] != strconv.FormatInt(amount, 10) {
+			return event, fmt.Errorf("%w: amount does not match", errInvalidZapRequest)
+		}
+	}
+	return event, nil
+}
+
+// zapDescriptionHash is the SHA256 hash of the zap request that the invoice commits to
+func zapDescriptionHash(raw string) string {
+	hash := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(hash[:])
+}
+
+// PaymentReceived publishes a zap receipt if the payment was a zap. Receipts are published only once.
+func (w Server) PaymentReceived(user *lnbits.User, payment lnbits.Webhook) {
+	if !w.zapsEnabled() || len(payment.PaymentHash) == 0 {
+		return
+	}
+	zap := &ZapRequest{}
+	res := w.database.Where("payment_hash = ? AND published_at IS NULL", payment.PaymentHash).Limit(1).Find(zap)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return
+	}
+	request, err := nostr.ParseEvent(zap.Request)
+	if err != nil {
+		log.Errorf("[Zap] Could not parse zap request %s: %v", payment.PaymentHash, err)
+		return
+	}
+	receipt, err := w.zapReceipt(request, zap.Request, payment)
+	if err != nil {
+		log.Errorf("[Zap] Could not create zap receipt %s: %v", payment.PaymentHash, err)
+		return
+	}
+	// claim the receipt so that a repeated webhook doesn't publish it again
+	res = w.database.Model(&ZapRequest{}).
+		Where("payment_hash = ? AND published_at IS NULL", payment.PaymentHash).
+		Update("published_at", time.Now())
+	if res.Error != nil || res.RowsAffected == 0 {
+		return
+	}
+	relays := zapRelays(request, w.nostrRelays)
+	log.Infof("[Zap] Publishing zap receipt %s for user %s to %d relays", receipt.ID, user.Name, len(relays))
+	go w.publish(receipt, relays)
+}
+
+// zapReceipt returns the signed zap receipt (kind 9735) for a paid zap request
+func (w Server) zapReceipt(request nostr.Event, rawRequest string, payment lnbits.Webhook) (nostr.Event, error) {
+	createdAt := int64(payment.Time)
+	if createdAt == 0 {
+		createdAt = time.Now().Unix()
+	}
+	receipt := nostr.Event{
+		CreatedAt: createdAt,
+		Kind:      nostr.KindZapReceipt,
+		Tags:      [][]string{},
+	}
+	for _, name := range []string{"p", "e", "a"} {
+		if tag, ok := request.Tag(name); ok {
+			receipt.Tags = append(receipt.Tags, tag)
+		}
+	}
+	receipt.Tags = append(receipt.Tags,
+		[]string{"P", request.PubKey},
+		[]string{"bolt11", payment.Bolt11},
+		[]string{"description", rawRequest})
+	if len(payment.Preimage) > 0 {
+		receipt.Tags = append(receipt.Tags, []string{"preimage", payment.Preimage})
+	}
+	err := receipt.Sign(w.nostrKey)
+	return receipt, err
+}
+
+// zapRelays returns the relays of the zap request and the configured relays. The relays of the
+// request are not trusted, the publisher must only dial them at public addresses.
+func zapRelays(request nostr.Event, configured []string) []string {
+	var relays []string
+	seen := make(map[string]bool)
+	candidates := configured
+	if tag, ok := request.Tag("relays"); ok {
+		candidates = append(append([]string{}, configured...), tag[1:]...)
+	}
+	for _, relay := range candidates {
+		relay = strings.TrimSpace(relay)
+		if seen[relay] || !(strings.HasPrefix(relay, "wss://") || strings.HasPrefix(relay, "ws://")) {
+			continue
+		}
+		seen[relay] = true
+		relays = append(relays, relay)
+		if len(relays) == maxZapRelays {
+			break
+		}
+	}
+	return relays
+}
+
+// publish sends the event to all relays
+func (w Server) publish(event nostr.Event, relays []string) {
+	for _, relay := range relays {
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		err := w.nostrPublisher.Publish(ctx, relay, event)
+		cancel()
+		if err != nil {
+			log.Warnf("[Zap] Could not publish %s to %s: %v", event.ID, relay, err)
+		}
+	}
+}
+
+// storeZapRequest remembers the zap request of an invoice until it is paid
+func storeZapRequest(db *gorm.DB, paymentHash string, userName string, request string, amount int64) error {
+	return db.Create(&ZapRequest{
+		PaymentHash: paymentHash,
+		UserName:    userName,
+		Request:     request,
+		Amount:      amount,
+		CreatedAt:   time.Now(),
+	}).Error
+}
@@ -0,0 +1,130 @@
+package lnurl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	"github.com/LightningTipBot/LightningTipBot/internal/nostr"
+)
+
+// fakeRelay records the events that are published to it
+type fakeRelay struct {
+	mu        sync.Mutex
+	published map[string][]nostr.Event
+	done      chan struct{}
+}
+
+func (r *fakeRelay) Publish(ctx context.Context, relay string, event nostr.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.published[relay] = append(r.published[relay], event)
+	r.done <- struct{}{}
+	return nil
+}
+
+func newZapRequest(t *testing.T, tags [][]string) string {
+	key, err := nostr.ParseSecretKey(strings.Repeat("02", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := nostr.Event{CreatedAt: time.Now().Unix(), Kind: nostr.KindZapRequest, Tags: tags}
+	if err := event.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+func Test_validateZapRequest(t *testing.T) {
+	p := []string{"p", strings.Repeat("ab", 32)}
+	relays := []string{"relays", "wss://relay.example"}
+	tests := []struct {
+		name    string
+		request string
+		valid   bool
+	}{
+		{name: "valid", request: newZapRequest(t, [][]string{p, relays}), valid: true},
+		{name: "amount", request: newZapRequest(t, [][]string{p, relays, {"amount", "21000"}}), valid: true},
+		{name: "wrong amount", request: newZapRequest(t, [][]string{p, relays, {"amount", "1000"}})},
+		{name: "no p tag", request: newZapRequest(t, [][]string{relays})},
+		{name: "two p tags", request: newZapRequest(t, [][]string{p, p, relays})},
+		{name: "no relays", request: newZapRequest(t, [][]string{p})},
+		{name: "two e tags", request: newZapRequest(t, [][]string{p, relays, {"e", "1"}, {"e", "2"}})},
+		{name: "no json", request: "zap"},
+		{name: "bad signature", request: strings.Replace(newZapRequest(t, [][]string{p, relays}), `"sig":"`, `"sig":"00`, 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := validateZapRequest(tt.request, 21000)
+			if (err == nil) != tt.valid {
+				t.Errorf("validateZapRequest() = %v, want valid %v", err, tt.valid)
+			}
+			if err != nil && !errors.Is(err, errInvalidZapRequest) {
+				t.Errorf("validateZapRequest() = %v, want errInvalidZapRequest", err)
+			}
+		})
+	}
+}
+
+func TestServer_PaymentReceived(t *testing.T) {
+	db := newAliasTestDatabase(t)
+	if err := db.AutoMigrate(&ZapRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	key, err := nostr.ParseSecretKey(strings.Repeat("01", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := &fakeRelay{published: make(map[string][]nostr.Event), done: make(chan struct{}, 10)}
+	w := Server{database: db}
+	WithNostr(key, []string{"wss://bot.example", "https://no.relay"}, relay)(&w)
+
+	request := newZapRequest(t, [][]string{{"p", strings.Repeat("ab", 32)}, {"e", "note"}, {"relays", "wss://relay.example", "wss://bot.example"}})
+	if err := storeZapRequest(db, "hash", "1", request, 21000); err != nil {
+		t.Fatal(err)
+	}
+	payment := lnbits.Webhook{PaymentHash: "hash", Bolt11: "lnbc210n1", Preimage: "preimage", Amount: 21000}
+	user := &lnbits.User{Name: "1"}
+	w.PaymentReceived(user, payment)
+	// a repeated webhook must not publish the receipt again
+	w.PaymentReceived(user, payment)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-relay.done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("zap receipt was not published")
+		}
+	}
+	select {
+	case <-relay.done:
+		t.Fatal("zap receipt was published more than once")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	if len(relay.published) != 2 || len(relay.published["wss://bot.example"]) != 1 || len(relay.published["wss://relay.example"]) != 1 {
+		t.Fatalf("published = %v, want one receipt on each relay", relay.published)
+	}
+	receipt := relay.published["wss://relay.example"][0]
+	if receipt.Kind != nostr.KindZapReceipt || receipt.PubKey != nostr.PublicKey(key) {
+		t.Errorf("receipt kind %d pubkey %s", receipt.Kind, receipt.PubKey)
+	}
+	if err := receipt.CheckSignature(); err != nil {
+		t.Errorf("receipt signature: %v", err)
+	}
+	for name, want := range map[string]string{"p": strings.Repeat("ab", 32), "e": "note", "bolt11": "lnbc210n1", "description": request, "preimage": "preimage"} {
+		if tag, ok := receipt.Tag(name); !ok || tag[1] != want {
+			t.Errorf("receipt tag %s = %v, want %s", name, tag, want)
+		}
+	}
+}
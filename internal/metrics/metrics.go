@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace prefixes all metrics. The names of metrics and labels are used by dashboards,
+// don't rename them.
+const namespace = "lightningtipbot"
+
+// Outcomes of payments
+const (
+	PaymentSuccess  = "success"
+	PaymentFailed   = "failed"
+	PaymentRejected = "rejected"
+)
+
+var (
+	commands = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "commands_total",
+		Help:      "Commands, button presses and inline queries handled by endpoint.",
+	}, []string{"endpoint"})
+	commandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "command_duration_seconds",
+		Help:      "Time to handle commands, button presses and inline queries by endpoint.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"endpoint"})
+
+	payments = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "payments_total",
+		Help:      "Payments by type and outcome (success, failed or rejected by spending limits).",
+	}, []string{"type", "outcome"})
+	paymentAmount = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "payment_amount_sat",
+		Help:      "Amounts of successful payments by type.",
+		Buckets:   prometheus.ExponentialBuckets(1, 10, 8),
+	}, []string{"type"})
+
+	lnbitsDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "lnbits_request_duration_seconds",
+		Help:      "Latency of requests to the LNbits API by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"operation"})
+	lnbitsErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lnbits_request_errors_total",
+		Help:      "Failed requests to the LNbits API by operation.",
+	}, []string{"operation"})
+
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Invoice webhook calls of LNbits by outcome.",
+	}, []string{"outcome"})
+
+	lnurlRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lnurl_requests_total",
+		Help:      "Requests to the LNURL server by kind (pay_request or callback) and status (ok, rejected, bad_request or error).",
+	}, []string{"kind", "status"})
+)
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Command records a handled command, button press or inline query
+func Command(endpoint string, duration time.Duration) {
+	commands.WithLabelValues(endpoint).Inc()
+	commandDuration.WithLabelValues(endpoint).Observe(duration.Seconds())
+}
+
+// Payment records a payment of amount sat
+func Payment(paymentType string, outcome string, amount int) {
+	payments.WithLabelValues(paymentType, outcome).Inc()
+	if outcome == PaymentSuccess {
+		paymentAmount.WithLabelValues(paymentType).Observe(float64(amount))
+	}
+}
+
+// LNbitsRequest records a request to the LNbits API
+func LNbitsRequest(operation string, duration time.Duration, err error) {
+	lnbitsDuration.WithLabelValues(operation).Observe(duration.Seconds())
+	if err != nil {
+		lnbitsErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// WebhookDelivery records a webhook call of LNbits
+func WebhookDelivery(outcome string) {
+	webhookDeliveries.WithLabelValues(outcome).Inc()
+}
+
+// LNURLRequest records a request to the LNURL server
+func LNURLRequest(kind string, status string) {
+	lnurlRequests.WithLabelValues(kind, status).Inc()
+}
+
+// MustRegister registers collectors of the bot, e.g. of the size of its databases
+func MustRegister(collectors ...prometheus.Collector) {
+	prometheus.MustRegister(collectors...)
+}
+
+// NewGaugeFunc returns a gauge with the value of f, it has to be registered
+func NewGaugeFunc(name string, help string, f func() float64) prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Namespace: namespace, Name: name, Help: help}, f)
+}
+
+// NewCounterFunc returns a counter with the value of f, it has to be registered
+func NewCounterFunc(name string, help string, f func() float64) prometheus.Collector {
+	return prometheus.NewCounterFunc(prometheus.CounterOpts{Namespace: namespace, Name: name, Help: help}, f)
+}
+
+// NewLabeledGaugeFunc returns gauges with one label whose values are collected with f on every
+// scrape, e.g. the number of keys per prefix in the store. It has to be registered.
+func NewLabeledGaugeFunc(name string, help string, label string, f func() (map[string]float64, error)) prometheus.Collector {
+	return &labeledGaugeFunc{
+		desc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, []string{label}, nil),
+		f:    f,
+	}
+}
+
+type labeledGaugeFunc struct {
+	desc *prometheus.Desc
+	f    func() (map[string]float64, error)
+}
+
+func (g *labeledGaugeFunc) Describe(descs chan<- *prometheus.Desc) {
+	descs <- g.desc
+}
+
+func (g *labeledGaugeFunc) Collect(metrics chan<- prometheus.Metric) {
+	values, err := g.f()
+	if err != nil {
+		metrics <- prometheus.NewInvalidMetric(g.desc, err)
+		return
+	}
+	for label, value := range values {
+		metrics <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, value, label)
+	}
+}
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	Command("/tip", 20*time.Millisecond)
+	Payment("tip", PaymentSuccess, 21)
+	LNbitsRequest("pay", time.Second, errors.New("timeout"))
+	WebhookDelivery("delivered")
+	LNURLRequest("callback", "ok")
+	MustRegister(NewLabeledGaugeFunc("test_keys", "Test keys.", "prefix", func() (map[string]float64, error) {
+		return map[string]float64{"dialog": 2}, nil
+	}))
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := ioutil.ReadAll(recorder.Body)
+	for _, want := range []string{
+		`lightningtipbot_commands_total{endpoint="/tip"} 1`,
+		`lightningtipbot_command_duration_seconds_count{endpoint="/tip"} 1`,
+		`lightningtipbot_payments_total{outcome="success",type="tip"} 1`,
+		`lightningtipbot_lnbits_request_errors_total{operation="pay"} 1`,
+		`lightningtipbot_webhook_deliveries_total{outcome="delivered"} 1`,
+		`lightningtipbot_lnurl_requests_total{kind="callback",status="ok"} 1`,
+		`lightningtipbot_test_keys{prefix="dialog"} 2`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics do not contain %s", want)
+		}
+	}
+}
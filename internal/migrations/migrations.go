@@ -0,0 +1,202 @@
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrPending        = errors.New("database has pending migrations")
+	ErrUnknownVersion = errors.New("database has migrations that this version doesn't know")
+	ErrNoDown         = errors.New("migration can't be rolled back")
+)
+
+// Migration is a versioned change of the schema or the data of a database.
+// Up and Down run in a transaction. Migrations must not use the models of the bot
+// because the models change with later migrations.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(tx *gorm.DB) error
+	Down        func(tx *gorm.DB) error
+}
+
+// appliedMigration records a migration that was applied to a database
+type appliedMigration struct {
+	Version     int `gorm:"primaryKey;autoIncrement:false"`
+	Description string
+	AppliedAt   time.Time
+}
+
+// Migrator applies the migrations of a database and records them in a table
+type Migrator struct {
+	db         *gorm.DB
+	table      string
+	migrations []Migration
+}
+
+// New returns a migrator for db that records the applied migrations in table.
+// It panics if two migrations have the same version.
+func New(db *gorm.DB, table string, migrations []Migration) *Migrator {
+	sorted := append([]Migration{}, migrations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].Version == sorted[i-1].Version {
+			panic(fmt.Errorf("duplicate migration version %d", sorted[i].Version))
+		}
+	}
+	return &Migrator{db: db, table: table, migrations: sorted}
+}
+
+func (m *Migrator) records() *gorm.DB {
+	return m.db.Table(m.table)
+}
+
+// init creates the table of applied migrations
+func (m *Migrator) init() error {
+	return m.records().AutoMigrate(&appliedMigration{})
+}
+
+// applied returns the versions of the applied migrations
+func (m *Migrator) applied() (map[int]bool, error) {
+	err := m.init()
+	if err != nil {
+		return nil, err
+	}
+	var versions []int
+	err = m.records().Pluck("version", &versions).Error
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]bool)
+	for _, version := range versions {
+		applied[version] = true
+	}
+	return applied, nil
+}
+
+// Version returns the highest applied version, 0 if no migration was applied
+func (m *Migrator) Version() (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// Pending returns the migrations that were not applied yet in the order they will be applied
+func (m *Migrator) Pending() ([]Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, migration := range m.migrations {
+		if !applied[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Check returns ErrPending if migrations have to be applied and ErrUnknownVersion
+// if the database was migrated by a newer version of the bot
+func (m *Migrator) Check() error {
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+	known := make(map[int]bool)
+	for _, migration := range m.migrations {
+		known[migration.Version] = true
+	}
+	for version := range applied {
+		if !known[version] {
+			return fmt.Errorf("%w: %s version %d", ErrUnknownVersion, m.table, version)
+		}
+	}
+	if len(applied) < len(m.migrations) {
+		return fmt.Errorf("%w: %s has %d of %d", ErrPending, m.table, len(applied), len(m.migrations))
+	}
+	return nil
+}
+
+// Up applies all pending migrations and returns the number of applied migrations
+func (m *Migrator) Up() (int, error) {
+	return m.UpTo(0)
+}
+
+// UpTo applies the pending migrations up to version, all pending migrations if version is 0
+func (m *Migrator) UpTo(version int) (int, error) {
+	pending, err := m.Pending()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, migration := range pending {
+		if version > 0 && migration.Version > version {
+			break
+		}
+		err = m.db.Transaction(func(tx *gorm.DB) error {
+			err := migration.Up(tx)
+			if err != nil {
+				return err
+			}
+			return tx.Table(m.table).Create(&appliedMigration{
+				Version:     migration.Version,
+				Description: migration.Description,
+				AppliedAt:   time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return n, fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Description, err)
+		}
+		log.Infof("[Migrations] %s: applied %d (%s)", m.table, migration.Version, migration.Description)
+		n++
+	}
+	return n, nil
+}
+
+// Down rolls back the last steps applied migrations and returns the number of rolled back migrations
+func (m *Migrator) Down(steps int) (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := len(m.migrations) - 1; i >= 0 && n < steps; i-- {
+		migration := m.migrations[i]
+		if !applied[migration.Version] {
+			continue
+		}
+		if migration.Down == nil {
+			return n, fmt.Errorf("%w: %d (%s)", ErrNoDown, migration.Version, migration.Description)
+		}
+		err = m.db.Transaction(func(tx *gorm.DB) error {
+			err := migration.Down(tx)
+			if err != nil {
+				return err
+			}
+			return tx.Table(m.table).Where("version = ?", migration.Version).Delete(&appliedMigration{}).Error
+		})
+		if err != nil {
+			return n, fmt.Errorf("rollback of migration %d (%s) failed: %w", migration.Version, migration.Description, err)
+		}
+		log.Infof("[Migrations] %s: rolled back %d (%s)", m.table, migration.Version, migration.Description)
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,125 @@
+package migrations
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func openTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func exec(query string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		return tx.Exec(query).Error
+	}
+}
+
+// testMigrations are given out of order to check that New sorts them
+var testMigrations = []Migration{
+	{Version: 2, Description: "create s", Up: exec("CREATE TABLE s (b text)"), Down: exec("DROP TABLE s")},
+	{Version: 1, Description: "create t", Up: exec("CREATE TABLE t (a text)"), Down: exec("DROP TABLE t")},
+}
+
+func TestUpDown(t *testing.T) {
+	db := openTestDB(t)
+	m := New(db, "migrations", testMigrations)
+	if err := m.Check(); !errors.Is(err, ErrPending) {
+		t.Errorf("Check() = %v, want ErrPending", err)
+	}
+	if n, err := m.UpTo(1); err != nil || n != 1 {
+		t.Fatalf("UpTo(1) = %d, %v", n, err)
+	}
+	if v, err := m.Version(); err != nil || v != 1 {
+		t.Errorf("Version() = %d, %v, want 1", v, err)
+	}
+	if n, err := m.Up(); err != nil || n != 1 {
+		t.Fatalf("Up() = %d, %v", n, err)
+	}
+	if err := m.Check(); err != nil {
+		t.Errorf("Check() = %v", err)
+	}
+	if err := db.Exec("INSERT INTO s (b) VALUES ('b')").Error; err != nil {
+		t.Fatal(err)
+	}
+	if n, err := m.Up(); err != nil || n != 0 {
+		t.Errorf("Up() of a migrated database = %d, %v", n, err)
+	}
+
+	if n, err := m.Down(1); err != nil || n != 1 {
+		t.Fatalf("Down(1) = %d, %v", n, err)
+	}
+	if db.Migrator().HasTable("s") || !db.Migrator().HasTable("t") {
+		t.Error("Down(1) did not roll back only the last migration")
+	}
+	if n, err := m.Down(5); err != nil || n != 1 {
+		t.Fatalf("Down(5) = %d, %v", n, err)
+	}
+	if v, err := m.Version(); err != nil || v != 0 {
+		t.Errorf("Version() = %d, %v, want 0", v, err)
+	}
+}
+
+func TestFailedMigration(t *testing.T) {
+	db := openTestDB(t)
+	failing := append([]Migration{}, testMigrations...)
+	failing = append(failing, Migration{
+		Version:     3,
+		Description: "fail",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Exec("CREATE TABLE u (a text)").Error; err != nil {
+				return err
+			}
+			return tx.Exec("SELECT * FROM missing").Error
+		},
+	})
+	m := New(db, "migrations", failing)
+	if n, err := m.Up(); err == nil || n != 2 {
+		t.Fatalf("Up() = %d, %v, want 2 and an error", n, err)
+	}
+	if db.Migrator().HasTable("u") {
+		t.Error("failed migration was not rolled back")
+	}
+	if v, _ := m.Version(); v != 2 {
+		t.Errorf("Version() = %d, want 2", v)
+	}
+	if _, err := m.Down(1); err != nil {
+		t.Fatal(err)
+	}
+	m.migrations[2].Down = nil
+	m.migrations[2].Up = exec("CREATE TABLE u (a text)")
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Down(1); !errors.Is(err, ErrNoDown) {
+		t.Errorf("Down() without Down func = %v, want ErrNoDown", err)
+	}
+}
+
+func TestUnknownVersion(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := New(db, "migrations", testMigrations).Up(); err != nil {
+		t.Fatal(err)
+	}
+	older := New(db, "migrations", testMigrations[1:])
+	if err := older.Check(); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("Check() = %v, want ErrUnknownVersion", err)
+	}
+}
+
+func TestDuplicateVersion(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("New() with duplicate versions did not panic")
+		}
+	}()
+	New(openTestDB(t), "migrations", append(testMigrations, testMigrations[0]))
+}
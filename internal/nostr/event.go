@@ -0,0 +1,175 @@
+package nostr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+const (
+	KindZapRequest = 9734
+	KindZapReceipt = 9735
+)
+
+// Event is a nostr event as defined in NIP-01
+type Event struct {
+	ID        string     `json:"id"`
+	PubKey    string     `json:"pubkey"`
+	CreatedAt int64      `json:"created_at"`
+	Kind      int        `json:"kind"`
+	Tags      [][]string `json:"tags"`
+	Content   string     `json:"content"`
+	Sig       string     `json:"sig"`
+}
+
+// Serialize returns the canonical serialization of the event that its id is computed from
+func (e Event) Serialize() []byte {
+	var sb strings.Builder
+	sb.WriteString(`[0,"`)
+	sb.WriteString(e.PubKey)
+	sb.WriteString(`",`)
+	sb.WriteString(strconv.FormatInt(e.CreatedAt, 10))
+	sb.WriteString(",")
+	sb.WriteString(strconv.Itoa(e.Kind))
+	sb.WriteString(",[")
+	for i, tag := range e.Tags {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString("[")
+		for j, value := range tag {
+			if j > 0 {
+				sb.WriteString(",")
+			}
+			writeString(&sb, value)
+		}
+		sb.WriteString("]")
+	}
+	sb.WriteString("],")
+	writeString(&sb, e.Content)
+	sb.WriteString("]")
+	return []byte(sb.String())
+}
+
+// writeString writes a json string with the escaping rules of NIP-01
+func writeString(sb *strings.Builder, s string) {
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\b':
+			sb.WriteString(`\b`)
+		case '\f':
+			sb.WriteString(`\f`)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+}
+
+// GetID returns the hex encoded sha256 of the serialized event
+func (e Event) GetID() string {
+	hash := sha256.Sum256(e.Serialize())
+	return hex.EncodeToString(hash[:])
+}
+
+// Sign sets the public key, id and signature of the event
+func (e *Event) Sign(key *secp256k1.PrivateKey) error {
+	e.PubKey = PublicKey(key)
+	e.ID = e.GetID()
+	id, err := hex.DecodeString(e.ID)
+	if err != nil {
+		return err
+	}
+	sig, err := sign(key, id)
+	if err != nil {
+		return err
+	}
+	e.Sig = hex.EncodeToString(sig)
+	return nil
+}
+
+// CheckSignature checks that the id and the signature of the event are valid
+func (e Event) CheckSignature() error {
+	if e.ID != e.GetID() {
+		return fmt.Errorf("invalid event id")
+	}
+	pubKey, err := hex.DecodeString(e.PubKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+	sig, err := hex.DecodeString(e.Sig)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	id, err := hex.DecodeString(e.ID)
+	if err != nil {
+		return err
+	}
+	return verifySchnorr(pubKey, id, sig)
+}
+
+// Tag returns the first tag with the given name
+func (e Event) Tag(name string) ([]string, bool) {
+	for _, tag := range e.Tags {
+		if len(tag) > 0 && tag[0] == name {
+			return tag, true
+		}
+	}
+	return nil, false
+}
+
+// TagValues returns the values of all tags with the given name
+func (e Event) TagValues(name string) [][]string {
+	var values [][]string
+	for _, tag := range e.Tags {
+		if len(tag) > 0 && tag[0] == name {
+			values = append(values, tag[1:])
+		}
+	}
+	return values
+}
+
+// ParseEvent decodes an event from its json representation
+func ParseEvent(raw string) (Event, error) {
+	var event Event
+	err := json.Unmarshal([]byte(raw), &event)
+	return event, err
+}
+
+// ParseSecretKey decodes a hex encoded secret key
+func ParseSecretKey(secretKey string) (*secp256k1.PrivateKey, error) {
+	b, err := hex.DecodeString(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("secret key must be 32 bytes")
+	}
+	key := secp256k1.PrivKeyFromBytes(b)
+	if key.Key.IsZero() {
+		return nil, fmt.Errorf("secret key must not be zero")
+	}
+	return key, nil
+}
+
+// PublicKey returns the hex encoded x-only public key of a secret key
+func PublicKey(key *secp256k1.PrivateKey) string {
+	pubKey, _ := xOnly(key.PubKey())
+	return hex.EncodeToString(pubKey)
+}
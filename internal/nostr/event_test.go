@@ -0,0 +1,92 @@
+package nostr
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// test vectors from BIP-340
+func Test_signSchnorr(t *testing.T) {
+	tests := []struct {
+		secretKey string
+		publicKey string
+		aux       string
+		message   string
+		signature string
+	}{
+		{
+			secretKey: "0000000000000000000000000000000000000000000000000000000000000003",
+			publicKey: "f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9",
+			aux:       "0000000000000000000000000000000000000000000000000000000000000000",
+			message:   "0000000000000000000000000000000000000000000000000000000000000000",
+			signature: "e907831f80848d1069a5371b402410364bdf1c5f8307b0084c55f1ce2dca821525f66a4a85ea8b71e482a74f382d2ce5ebeee8fdb2172f477df4900d310536c0",
+		},
+		{
+			secretKey: "b7e151628aed2a6abf7158809cf4f3c762e7160f38b4da56a784d9045190cfef",
+			publicKey: "dff1d77f2a671c5f36183726db2341be58feae1da2deced843240f7b502ba659",
+			aux:       "0000000000000000000000000000000000000000000000000000000000000001",
+			message:   "243f6a8885a308d313198a2e03707344a4093822299f31d0082efa98ec4e6c89",
+			signature: "6896bd60eeae296db48a229ff71dfe071bde413e6d43f917dc8dcf8c78de33418906d11ac976abccb20b091292bff4ea897efcb639ea871cfa95f6de339e4b0a",
+		},
+	}
+	for _, tt := range tests {
+		key := secp256k1.PrivKeyFromBytes(mustDecodeHex(t, tt.secretKey))
+		if got := PublicKey(key); got != tt.publicKey {
+			t.Errorf("PublicKey() = %s, want %s", got, tt.publicKey)
+		}
+		sig, err := signSchnorr(key, mustDecodeHex(t, tt.message), mustDecodeHex(t, tt.aux))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(sig); got != tt.signature {
+			t.Errorf("signSchnorr() = %s, want %s", got, tt.signature)
+		}
+		err = verifySchnorr(mustDecodeHex(t, tt.publicKey), mustDecodeHex(t, tt.message), sig)
+		if err != nil {
+			t.Errorf("verifySchnorr() = %v", err)
+		}
+	}
+}
+
+func TestEvent_Sign(t *testing.T) {
+	key, err := ParseSecretKey(strings.Repeat("01", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := Event{
+		CreatedAt: 1700000000,
+		Kind:      KindZapRequest,
+		Tags:      [][]string{{"p", strings.Repeat("ab", 32)}, {"relays", "wss://relay.example"}},
+		Content:   "zap \"with\" quotes\n",
+	}
+	err = event.Sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = event.CheckSignature()
+	if err != nil {
+		t.Fatalf("CheckSignature() = %v", err)
+	}
+	tampered := event
+	tampered.Content = "tampered"
+	if tampered.CheckSignature() == nil {
+		t.Error("CheckSignature() accepted an event with a wrong id")
+	}
+	tampered = event
+	tampered.Content = "tampered"
+	tampered.ID = tampered.GetID()
+	if tampered.CheckSignature() == nil {
+		t.Error("CheckSignature() accepted an event with a wrong signature")
+	}
+}
@@ -0,0 +1,136 @@
+package nostr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Publisher publishes events to nostr relays
+type Publisher interface {
+	Publish(ctx context.Context, relay string, event Event) error
+}
+
+// ErrPrivateAddress is returned for relays that are not trusted and resolve to an address that is not public
+var ErrPrivateAddress = errors.New("relay is not at a public address")
+
+// privateNetworks are the networks besides loopback, link-local and multicast addresses that
+// relays which are not trusted can't be dialed at
+var privateNetworks = parseNetworks("0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")
+
+// WebsocketPublisher publishes events to relays via websockets (NIP-01). Relays that are not
+// trusted, e.g. the relays of zap requests, are only dialed at public addresses.
+type WebsocketPublisher struct {
+	// Dialer connects to the trusted relays
+	Dialer *websocket.Dialer
+	// PublicDialer connects to all other relays
+	PublicDialer *websocket.Dialer
+	Trusted      map[string]bool
+}
+
+// NewWebsocketPublisher returns a publisher that connects to the trusted relays with the default
+// websocket dialer and to other relays only at public addresses
+func NewWebsocketPublisher(trusted []string) *WebsocketPublisher {
+	p := &WebsocketPublisher{
+		Dialer: websocket.DefaultDialer,
+		PublicDialer: &websocket.Dialer{
+			NetDialContext:   (&net.Dialer{Timeout: 30 * time.Second, Control: publicAddress}).DialContext,
+			HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+		},
+		Trusted: make(map[string]bool),
+	}
+	for _, relay := range trusted {
+		p.Trusted[relay] = true
+	}
+	return p
+}
+
+// Publish sends the event to the relay and waits until the relay accepted it
+func (p *WebsocketPublisher) Publish(ctx context.Context, relay string, event Event) error {
+	dialer := p.PublicDialer
+	if p.Trusted[relay] {
+		dialer = p.Dialer
+	}
+	conn, _, err := dialer.DialContext(ctx, relay, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+		conn.SetWriteDeadline(deadline)
+	}
+	err = conn.WriteJSON([]interface{}{"EVENT", event})
+	if err != nil {
+		return err
+	}
+	// wait for the ["OK", <event_id>, <accepted>, <message>] response of the relay
+	for {
+		var message []json.RawMessage
+		err = conn.ReadJSON(&message)
+		if err != nil {
+			return err
+		}
+		var messageType, eventId string
+		if len(message) < 3 || json.Unmarshal(message[0], &messageType) != nil || messageType != "OK" {
+			continue
+		}
+		if json.Unmarshal(message[1], &eventId) != nil || eventId != event.ID {
+			continue
+		}
+		var accepted bool
+		var reason string
+		json.Unmarshal(message[2], &accepted)
+		if len(message) > 3 {
+			json.Unmarshal(message[3], &reason)
+		}
+		if !accepted {
+			return fmt.Errorf("relay %s rejected event: %s", relay, reason)
+		}
+		return nil
+	}
+}
+
+// publicAddress rejects connections to addresses that are not public. It checks the resolved
+// address, so that host names can't point to internal services.
+func publicAddress(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !publicIP(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, address)
+	}
+	return nil
+}
+
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
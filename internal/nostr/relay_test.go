@@ -0,0 +1,72 @@
+package nostr
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestRelay starts a relay on a loopback address that accepts every event
+func newTestRelay(t *testing.T) string {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var message []interface{}
+		if conn.ReadJSON(&message) != nil || len(message) < 2 {
+			return
+		}
+		messageType, _ := message[0].(string)
+		event, _ := message[1].(map[string]interface{})
+		conn.WriteJSON([]interface{}{"OK", event["id"], messageType == "EVENT", ""})
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestWebsocketPublisher_Publish(t *testing.T) {
+	relay := newTestRelay(t)
+	event := Event{ID: "event-id"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := NewWebsocketPublisher([]string{relay}).Publish(ctx, relay, event); err != nil {
+		t.Errorf("Publish() to a trusted relay = %v", err)
+	}
+	if err := NewWebsocketPublisher(nil).Publish(ctx, relay, event); !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("Publish() to a relay on a loopback address = %v, want ErrPrivateAddress", err)
+	}
+}
+
+func Test_publicIP(t *testing.T) {
+	tests := map[string]bool{
+		"1.1.1.1":         true,
+		"2606:4700::1":    true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"100.64.0.1":      false,
+		"169.254.169.254": false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"0.0.0.0":         false,
+		"224.0.0.1":       false,
+	}
+	for address, want := range tests {
+		if got := publicIP(net.ParseIP(address)); got != want {
+			t.Errorf("publicIP(%s) = %t, want %t", address, got, want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package nostr
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+// BIP-340 schnorr signatures over secp256k1 as required by NIP-01.
+
+var (
+	errInvalidPublicKey = errors.New("invalid public key")
+	errInvalidSignature = errors.New("invalid signature")
+)
+
+// taggedHash returns sha256(sha256(tag) || sha256(tag) || msgs...)
+func taggedHash(tag string, msgs ...[]byte) [32]byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, msg := range msgs {
+		h.Write(msg)
+	}
+	var hash [32]byte
+	copy(hash[:], h.Sum(nil))
+	return hash
+}
+
+// xOnly returns the 32 byte x coordinate of a public key and whether its y coordinate is odd
+func xOnly(pub *secp256k1.PublicKey) ([]byte, bool) {
+	compressed := pub.SerializeCompressed()
+	return compressed[1:], compressed[0] == secp256k1.PubKeyFormatCompressedOdd
+}
+
+// parseXOnlyPublicKey returns the point with the given x coordinate and an even y coordinate
+func parseXOnlyPublicKey(pubKey []byte) (*secp256k1.PublicKey, error) {
+	if len(pubKey) != 32 {
+		return nil, errInvalidPublicKey
+	}
+	pub, err := secp256k1.ParsePubKey(append([]byte{secp256k1.PubKeyFormatCompressedEven}, pubKey...))
+	if err != nil {
+		return nil, errInvalidPublicKey
+	}
+	return pub, nil
+}
+
+// signSchnorr signs a 32 byte message with the auxiliary randomness aux
+func signSchnorr(key *secp256k1.PrivateKey, msg []byte, aux []byte) ([]byte, error) {
+	d := key.Key
+	if d.IsZero() {
+		return nil, errors.New("invalid secret key")
+	}
+	pubKey, odd := xOnly(key.PubKey())
+	if odd {
+		d.Negate()
+	}
+	dBytes := d.Bytes()
+	auxHash := taggedHash("BIP0340/aux", aux)
+	var t [32]byte
+	for i := range t {
+		t[i] = dBytes[i] ^ auxHash[i]
+	}
+	nonce := taggedHash("BIP0340/nonce", t[:], pubKey, msg)
+	var k secp256k1.ModNScalar
+	k.SetBytes(&nonce)
+	if k.IsZero() {
+		return nil, errors.New("invalid nonce")
+	}
+	var r secp256k1.JacobianPoint
+	secp256k1.ScalarBaseMultNonConst(&k, &r)
+	r.ToAffine()
+	if r.Y.IsOdd() {
+		k.Negate()
+	}
+	rBytes := r.X.Bytes()
+	challenge := taggedHash("BIP0340/challenge", rBytes[:], pubKey, msg)
+	var e secp256k1.ModNScalar
+	e.SetBytes(&challenge)
+	s := new(secp256k1.ModNScalar).Mul2(&e, &d).Add(&k)
+	sBytes := s.Bytes()
+	return append(rBytes[:], sBytes[:]...), nil
+}
+
+// verifySchnorr verifies a 64 byte signature of a 32 byte message under an x-only public key
+func verifySchnorr(pubKey []byte, msg []byte, sig []byte) error {
+	if len(sig) != 64 {
+		return errInvalidSignature
+	}
+	pub, err := parseXOnlyPublicKey(pubKey)
+	if err != nil {
+		return err
+	}
+	var r secp256k1.FieldVal
+	if r.SetByteSlice(sig[:32]) {
+		return errInvalidSignature
+	}
+	var s secp256k1.ModNScalar
+	if s.SetByteSlice(sig[32:]) {
+		return errInvalidSignature
+	}
+	challenge := taggedHash("BIP0340/challenge", sig[:32], pubKey, msg)
+	var e secp256k1.ModNScalar
+	e.SetBytes(&challenge)
+	e.Negate()
+	// R = s*G - e*P
+	var p, sG, eP, R secp256k1.JacobianPoint
+	pub.AsJacobian(&p)
+	secp256k1.ScalarBaseMultNonConst(&s, &sG)
+	secp256k1.ScalarMultNonConst(&e, &p, &eP)
+	secp256k1.AddNonConst(&sG, &eP, &R)
+	if (R.X.IsZero() && R.Y.IsZero()) || R.Z.IsZero() {
+		return errInvalidSignature
+	}
+	R.ToAffine()
+	if R.Y.IsOdd() || !R.X.Equals(&r) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+// sign signs a 32 byte message with fresh auxiliary randomness
+func sign(key *secp256k1.PrivateKey, msg []byte) ([]byte, error) {
+	aux := make([]byte, 32)
+	_, err := rand.Read(aux)
+	if err != nil {
+		return nil, err
+	}
+	return signSchnorr(key, msg, aux)
+}
@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sweepInterval is how often buckets that refilled completely are removed
+const sweepInterval = 10 * time.Minute
+
+// Limiter is a token bucket per key. Every key can make burst requests at once,
+// the bucket refills with perMinute tokens per minute.
+type Limiter struct {
+	mu        sync.Mutex
+	rate      float64 // tokens per second
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	rejected  uint64
+	now       func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New returns a limiter that allows perMinute requests per key and minute with bursts of burst requests.
+// A limiter with perMinute <= 0 allows every request.
+func New(perMinute int, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token of key. If the bucket of key is empty, it returns false and
+// how long it takes until the next token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true, 0
+	}
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		atomic.AddUint64(&l.rejected, 1)
+		wait := time.Duration(math.Ceil((1 - b.tokens) / l.rate * float64(time.Second)))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// SetLimit changes the limit of all keys. Buckets keep their tokens up to the new burst.
+func (l *Limiter) SetLimit(perMinute int, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(perMinute) / 60
+	l.burst = float64(burst)
+	for _, b := range l.buckets {
+		b.tokens = math.Min(l.burst, b.tokens)
+	}
+}
+
+// Rejected returns the number of requests that were not allowed
+func (l *Limiter) Rejected() uint64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&l.rejected)
+}
+
+// refill returns the tokens of b at now
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+}
+
+// sweep removes full buckets, they are the same as a new bucket
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(60, 2)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d of burst rejected", i)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok || wait != time.Second {
+		t.Fatalf("Allow() of empty bucket = %v, %s, want false, 1s", ok, wait)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("other key rejected")
+	}
+	if l.Rejected() != 1 {
+		t.Errorf("Rejected() = %d, want 1", l.Rejected())
+	}
+
+	now = now.Add(time.Second)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("refilled bucket rejected")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Error("bucket refilled more than one token")
+	}
+
+	now = now.Add(sweepInterval)
+	l.Allow("c")
+	if len(l.buckets) != 1 {
+		t.Errorf("sweep kept %d buckets, want 1", len(l.buckets))
+	}
+}
+
+func TestDisabledLimiter(t *testing.T) {
+	var nilLimiter *Limiter
+	for _, l := range []*Limiter{New(0, 0), nilLimiter} {
+		for i := 0; i < 100; i++ {
+			if ok, _ := l.Allow("a"); !ok {
+				t.Fatal("disabled limiter rejected a request")
+			}
+		}
+	}
+}
+
+func TestSetLimit(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(0, 0)
+	l.now = func() time.Time { return now }
+	l.Allow("a")
+
+	l.SetLimit(60, 1)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("first request after enabling the limit rejected")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatal("enabled limit allowed more than the burst")
+	}
+	l.SetLimit(0, 0)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("disabled limit rejected a request")
+	}
+}
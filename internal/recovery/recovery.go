@@ -0,0 +1,146 @@
+package recovery
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxSummaryLines is the number of different panics in a summary
+const maxSummaryLines = 10
+
+var (
+	panics uint64
+
+	mu       sync.Mutex
+	notifier *summaryNotifier
+)
+
+// Panics returns the number of panics that were recovered since the start
+func Panics() uint64 {
+	return atomic.LoadUint64(&panics)
+}
+
+// Recover recovers a panic of the calling goroutine and reports it. source names what panicked,
+// e.g. a command, and fields describe the update that caused the panic. onPanic runs after the
+// panic was reported, e.g. to tell the user. Recover has to be deferred directly:
+//
+//	defer recovery.Recover("/tip", fields, nil)
+func Recover(source string, fields log.Fields, onPanic func()) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	Report(source, r, fields)
+	if onPanic != nil {
+		onPanic()
+	}
+}
+
+// Report logs a recovered panic with the stack and counts it
+func Report(source string, value interface{}, fields log.Fields) {
+	atomic.AddUint64(&panics, 1)
+	log.WithFields(fields).Errorf("[%s] Panic: %v\n%s", source, value, debug.Stack())
+	mu.Lock()
+	n := notifier
+	mu.Unlock()
+	if n != nil {
+		n.add(fmt.Sprintf("[%s] %v", source, value))
+	}
+}
+
+// Notifier sends a summary of panics, e.g. to an admin chat
+type Notifier func(summary string)
+
+// SetNotifier sends summaries of the panics with notify, at most one per interval.
+// A nil notify stops the summaries.
+func SetNotifier(notify Notifier, interval time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	if notify == nil {
+		notifier = nil
+		return
+	}
+	notifier = &summaryNotifier{notify: notify, interval: interval, pending: make(map[string]int)}
+}
+
+// Middleware recovers panics of the HTTP handlers of a server and responds with an internal server error
+func Middleware(server string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			defer Recover(server, log.Fields{"method": request.Method, "path": request.URL.Path}, func() {
+				http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			})
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+// summaryNotifier collects panics and sends them in one summary per interval
+type summaryNotifier struct {
+	mu        sync.Mutex
+	notify    Notifier
+	interval  time.Duration
+	pending   map[string]int
+	last      time.Time
+	scheduled bool
+}
+
+func (n *summaryNotifier) add(description string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.pending[description]++
+	if n.scheduled {
+		return
+	}
+	n.scheduled = true
+	// the first panic after a quiet interval is sent right away
+	delay := time.Until(n.last.Add(n.interval))
+	if delay < 0 {
+		delay = 0
+	}
+	time.AfterFunc(delay, n.flush)
+}
+
+func (n *summaryNotifier) flush() {
+	n.mu.Lock()
+	pending := n.pending
+	n.pending = make(map[string]int)
+	n.last = time.Now()
+	n.scheduled = false
+	n.mu.Unlock()
+	n.notify(summary(pending))
+}
+
+// summary lists the panics with their number, the most frequent first
+func summary(pending map[string]int) string {
+	total := 0
+	lines := make([]string, 0, len(pending))
+	for description, count := range pending {
+		total += count
+		lines = append(lines, description)
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		if pending[lines[i]] != pending[lines[j]] {
+			return pending[lines[i]] > pending[lines[j]]
+		}
+		return lines[i] < lines[j]
+	})
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "⚠️ %d panics recovered\n", total)
+	for i, line := range lines {
+		if i == maxSummaryLines {
+			fmt.Fprintf(&sb, "\n… and %d more", len(lines)-maxSummaryLines)
+			break
+		}
+		fmt.Fprintf(&sb, "\n%d× %s", pending[line], line)
+	}
+	return sb.String()
+}
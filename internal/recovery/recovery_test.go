@@ -0,0 +1,67 @@
+package recovery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecover(t *testing.T) {
+	before := Panics()
+	recovered := false
+	func() {
+		defer Recover("test", nil, func() {
+			recovered = true
+		})
+		var m map[string]int
+		m["a"] = 1
+	}()
+	if !recovered || Panics() != before+1 {
+		t.Errorf("panic was not recovered or counted: %v, %d", recovered, Panics()-before)
+	}
+	func() {
+		defer Recover("test", nil, func() {
+			t.Error("onPanic called without panic")
+		})
+	}()
+}
+
+func TestMiddleware(t *testing.T) {
+	handler := Middleware("test")(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		panic("boom")
+	}))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", recorder.Code)
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	summaries := make(chan string, 10)
+	SetNotifier(func(summary string) {
+		summaries <- summary
+	}, 100*time.Millisecond)
+	defer SetNotifier(nil, 0)
+
+	Report("a", "boom", nil)
+	first := <-summaries
+	if !strings.Contains(first, "1 panics") || !strings.Contains(first, "[a] boom") {
+		t.Errorf("first summary = %q", first)
+	}
+	// panics within the interval are sent in one summary
+	Report("a", "boom", nil)
+	Report("b", "bang", nil)
+	Report("a", "boom", nil)
+	select {
+	case summary := <-summaries:
+		t.Fatalf("summary %q sent within the interval", summary)
+	case <-time.After(50 * time.Millisecond):
+	}
+	second := <-summaries
+	if !strings.Contains(second, "3 panics") || !strings.Contains(second, "2× [a] boom\n1× [b] bang") {
+		t.Errorf("second summary = %q", second)
+	}
+}
@@ -0,0 +1,202 @@
+// Package secret encrypts values at rest with envelope encryption. Every value is encrypted
+// with its own random data key, the data key is encrypted with a master key of a Keyring.
+// Master keys are rotated by adding a new current key and re-encrypting with it, values
+// encrypted with older keys of the keyring stay readable in the meantime.
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// prefix marks encrypted values, values without it are plaintext
+	prefix  = "enc1:"
+	keySize = 32
+)
+
+var (
+	ErrNoKeyring  = errors.New("value is encrypted but no master key is configured")
+	ErrUnknownKey = errors.New("value is encrypted with an unknown master key")
+	ErrMalformed  = errors.New("malformed encrypted value")
+)
+
+// Keyring holds the current master key that encrypts and older master keys that only decrypt
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// ParseKey decodes a base64 encoded master key of 32 bytes, e.g. from `openssl rand -base64 32`
+func ParseKey(key string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, fmt.Errorf("master key is not base64: %w", err)
+	}
+	if len(b) != keySize {
+		return nil, fmt.Errorf("master key has %d bytes, want %d", len(b), keySize)
+	}
+	return b, nil
+}
+
+// NewKeyring returns a keyring that encrypts with current and decrypts with current and old
+func NewKeyring(current []byte, old ...[]byte) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	for i, key := range append([][]byte{current}, old...) {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		id := keyID(key)
+		k.keys[id] = aead
+		if i == 0 {
+			k.current = id
+		}
+	}
+	return k, nil
+}
+
+// ParseKeyring returns a keyring of base64 encoded master keys
+func ParseKeyring(current string, old []string) (*Keyring, error) {
+	currentKey, err := ParseKey(current)
+	if err != nil {
+		return nil, err
+	}
+	var oldKeys [][]byte
+	for _, key := range old {
+		oldKey, err := ParseKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("old master key: %w", err)
+		}
+		oldKeys = append(oldKeys, oldKey)
+	}
+	return NewKeyring(currentKey, oldKeys...)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("key has %d bytes, want %d", len(key), keySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyID identifies a master key without revealing it
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// seal encrypts plaintext with a random nonce and prepends the nonce
+func seal(aead cipher.AEAD, plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+}
+
+// Encrypt encrypts plaintext with a new data key. Without keyring it returns plaintext.
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	if k == nil || len(plaintext) == 0 || IsEncrypted(plaintext) {
+		return plaintext, nil
+	}
+	dataKey := make([]byte, keySize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(k.keys[k.current], dataKey, []byte(k.current))
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(aead, []byte(plaintext), nil)
+	if err != nil {
+		return "", err
+	}
+	return prefix + strings.Join([]string{
+		k.current,
+		base64.RawStdEncoding.EncodeToString(wrapped),
+		base64.RawStdEncoding.EncodeToString(ciphertext),
+	}, ":"), nil
+}
+
+// Decrypt decrypts a value of Encrypt. Plaintext values are returned as they are.
+func (k *Keyring) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	if k == nil {
+		return "", ErrNoKeyring
+	}
+	parts := strings.Split(strings.TrimPrefix(value, prefix), ":")
+	if len(parts) != 3 {
+		return "", ErrMalformed
+	}
+	master, ok := k.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("%w %s", ErrUnknownKey, parts[0])
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrMalformed
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrMalformed
+	}
+	dataKey, err := open(master, wrapped, []byte(parts[0]))
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt data key: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(aead, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt value: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// Reencrypt returns value encrypted with the current master key and whether it changed.
+// Without keyring, it returns value as it is.
+func (k *Keyring) Reencrypt(value string) (string, bool, error) {
+	if k == nil || len(value) == 0 || strings.HasPrefix(value, prefix+k.current+":") {
+		return value, false, nil
+	}
+	plaintext, err := k.Decrypt(value)
+	if err != nil {
+		return "", false, err
+	}
+	encrypted, err := k.Encrypt(plaintext)
+	return encrypted, err == nil, err
+}
+
+// IsEncrypted reports whether value was encrypted by a keyring
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
@@ -0,0 +1,96 @@
+package secret
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, keySize)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	k, err := NewKeyring(testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := k.Encrypt("adminkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := k.Encrypt("adminkey")
+	if !IsEncrypted(a) || strings.Contains(a, "adminkey") || a == b {
+		t.Errorf("Encrypt() = %s, %s", a, b)
+	}
+	if plaintext, err := k.Decrypt(a); err != nil || plaintext != "adminkey" {
+		t.Errorf("Decrypt() = %s, %v", plaintext, err)
+	}
+	if plaintext, err := k.Decrypt("legacy"); err != nil || plaintext != "legacy" {
+		t.Errorf("Decrypt() of plaintext = %s, %v", plaintext, err)
+	}
+	if _, err := (*Keyring)(nil).Decrypt(a); !errors.Is(err, ErrNoKeyring) {
+		t.Errorf("Decrypt() without keyring = %v", err)
+	}
+	tampered := a[:len(a)-2] + "AA"
+	if _, err := k.Decrypt(tampered); err == nil {
+		t.Error("Decrypt() of a tampered value succeeded")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	old, _ := NewKeyring(testKey(1))
+	encrypted, _ := old.Encrypt("adminkey")
+	rotated, err := NewKeyring(testKey(2), testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := rotated.Decrypt(encrypted); err != nil || plaintext != "adminkey" {
+		t.Errorf("Decrypt() with old key = %s, %v", plaintext, err)
+	}
+	reencrypted, changed, err := rotated.Reencrypt(encrypted)
+	if err != nil || !changed {
+		t.Fatalf("Reencrypt() = %s, %v, %v", reencrypted, changed, err)
+	}
+	if _, changed, _ := rotated.Reencrypt(reencrypted); changed {
+		t.Error("Reencrypt() of a value with the current key changed it")
+	}
+	current, _ := NewKeyring(testKey(2))
+	if plaintext, err := current.Decrypt(reencrypted); err != nil || plaintext != "adminkey" {
+		t.Errorf("Decrypt() after rotation = %s, %v", plaintext, err)
+	}
+	if _, err := current.Decrypt(encrypted); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Decrypt() with removed key = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(testKey(1))
+	if _, err := ParseKeyring(key, []string{base64.StdEncoding.EncodeToString(testKey(2))}); err != nil {
+		t.Error(err)
+	}
+	for _, invalid := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := ParseKeyring(invalid, nil); err == nil {
+			t.Errorf("ParseKeyring(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	k, _ := NewKeyring(testKey(1))
+	SetKeyring(k)
+	defer SetKeyring(nil)
+	value, err := String("adminkey").Value()
+	if err != nil || !IsEncrypted(value.(string)) {
+		t.Fatalf("Value() = %v, %v", value, err)
+	}
+	var s String
+	if err := s.Scan([]byte(value.(string))); err != nil || s != "adminkey" {
+		t.Errorf("Scan() = %s, %v", s, err)
+	}
+	if err := s.Scan(nil); err != nil || s != "" {
+		t.Errorf("Scan(nil) = %s, %v", s, err)
+	}
+}
@@ -0,0 +1,55 @@
+package secret
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"sync"
+)
+
+var (
+	defaultKeyring *Keyring
+	keyringMutex   sync.RWMutex
+)
+
+// SetKeyring sets the keyring of String. A nil keyring stores new values in plaintext.
+func SetKeyring(k *Keyring) {
+	keyringMutex.Lock()
+	defer keyringMutex.Unlock()
+	defaultKeyring = k
+}
+
+// DefaultKeyring returns the keyring of String
+func DefaultKeyring() *Keyring {
+	keyringMutex.RLock()
+	defer keyringMutex.RUnlock()
+	return defaultKeyring
+}
+
+// String is a string that is encrypted with the default keyring when it is written to
+// a database and decrypted when it is read. In memory and in JSON it is plaintext.
+type String string
+
+// Value implements driver.Valuer
+func (s String) Value() (driver.Value, error) {
+	return DefaultKeyring().Encrypt(string(s))
+}
+
+// Scan implements sql.Scanner
+func (s *String) Scan(value interface{}) error {
+	var stored string
+	switch v := value.(type) {
+	case nil:
+	case string:
+		stored = v
+	case []byte:
+		stored = string(v)
+	default:
+		return fmt.Errorf("can't scan %T into secret.String", value)
+	}
+	plaintext, err := DefaultKeyring().Decrypt(stored)
+	if err != nil {
+		return err
+	}
+	*s = String(plaintext)
+	return nil
+}
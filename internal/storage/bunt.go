@@ -2,6 +2,9 @@ package storage
 
 import (
 	"encoding/json"
+	"strings"
+	"time"
+
 	"github.com/LightningTipBot/LightningTipBot/internal/runtime"
 	log "github.com/sirupsen/logrus"
 	"github.com/tidwall/buntdb"
@@ -12,6 +15,13 @@ type Storable interface {
 	Key() string
 }
 
+// Expirable items are removed from the database when they expire.
+// Items with a zero expiry are kept forever.
+type Expirable interface {
+	Storable
+	Expires() time.Time
+}
+
 type DB struct {
 	*buntdb.DB
 }
@@ -22,20 +32,29 @@ const (
 )
 
 func NewBunt(filePath string) *DB {
-	db, err := buntdb.Open(filePath)
+	db, err := OpenBunt(filePath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return db
+}
+
+// OpenBunt opens the buntdb file at filePath, it fails if the file can't be opened
+func OpenBunt(filePath string) (*DB, error) {
+	db, err := buntdb.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
 	err = db.CreateIndex(MessageOrderedByReplyToFrom, "*", buntdb.IndexJSON(MessageOrderedByReplyToFrom))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	err = db.CreateIndex(MessageOrderedByReplyTo, "*", buntdb.IndexJSON(MessageOrderedByReplyTo))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return &DB{db}
+	return &DB{db}, nil
 }
 
 // Exists checks is storable item exists
@@ -83,13 +102,81 @@ func (db *DB) Set(object Storable) error {
 		if err != nil {
 			return err
 		}
-		_, _, err = tx.Set(object.Key(), string(b), nil)
+		_, _, err = tx.Set(object.Key(), string(b), setOptions(object))
 
 		return err
 	})
 	return err
 }
 
+// DeleteKey deletes the item with the key
+func (db *DB) DeleteKey(key string) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(key)
+		return err
+	})
+}
+
+// Take gets a storable item and deletes it if match reports true for it
+func (db *DB) Take(object Storable, match func() bool) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(object.Key())
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal([]byte(val), object)
+		if err != nil {
+			return err
+		}
+		if match != nil && !match() {
+			return ErrNotFound
+		}
+		_, err = tx.Delete(object.Key())
+		return err
+	})
+}
+
+// Ascend iterates over all items with keys matching pattern in key order
+func (db *DB) Ascend(pattern string, iterator func(key, value string) bool) error {
+	return db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys(pattern, iterator)
+	})
+}
+
+// setOptions returns the TTL of expirable items
+func setOptions(object Storable) *buntdb.SetOptions {
+	expirable, ok := object.(Expirable)
+	if !ok || expirable.Expires().IsZero() {
+		return nil
+	}
+	return &buntdb.SetOptions{Expires: true, TTL: time.Until(expirable.Expires())}
+}
+
+// Stats returns the number of keys in the database per key prefix.
+// The prefix of a key is everything before its first digit, e.g. inl-send for inl-send-1234-21-abcde.
+func (db *DB) Stats() (map[string]int, error) {
+	stats := make(map[string]int)
+	err := db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys("*", func(key, value string) bool {
+			stats[keyPrefix(key)]++
+			return true
+		})
+	})
+	return stats, err
+}
+
+func keyPrefix(key string) string {
+	end := strings.IndexAny(key, "0123456789")
+	if end < 0 {
+		end = len(key)
+	}
+	prefix := strings.TrimRight(key[:end], "-:")
+	if len(prefix) == 0 {
+		return "other"
+	}
+	return prefix
+}
+
 // Delete a storable item.
 // todo -- not ascend users index
 func (db *DB) Delete(index string, object Storable) error {
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+type item struct {
+	ID      string    `json:"id"`
+	Expiry  time.Time `json:"expiry"`
+	Payload string    `json:"payload"`
+}
+
+func (i item) Key() string {
+	return i.ID
+}
+
+func (i item) Expires() time.Time {
+	return i.Expiry
+}
+
+func TestSetExpirable(t *testing.T) {
+	db := NewBunt(":memory:")
+	err := db.Set(item{ID: "inl-send-1-21-abcde", Expiry: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Set(item{ID: "inl-send-2-21-abcde", Expiry: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Set(item{ID: "dialog:1:send"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx *buntdb.Tx) error {
+		ttl, err := tx.TTL("inl-send-1-21-abcde")
+		if err != nil {
+			return err
+		}
+		if ttl <= 0 || ttl > time.Hour {
+			t.Errorf("TTL() = %s, want up to 1h", ttl)
+		}
+		ttl, err = tx.TTL("dialog:1:send")
+		if err != nil {
+			return err
+		}
+		if ttl >= 0 {
+			t.Errorf("TTL() of item without expiry = %s, want none", ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Get(&item{ID: "inl-send-2-21-abcde"}); err != buntdb.ErrNotFound {
+		t.Errorf("Get() of expired item = %v, want ErrNotFound", err)
+	}
+
+}
+
+func TestStats(t *testing.T) {
+	db := NewBunt(":memory:")
+	for _, id := range []string{"inl-send-1-21-abcde", "inl-send-2-21-abcde", "dialog:1:send"} {
+		if err := db.Set(item{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats["inl-send"] != 2 || stats["dialog"] != 1 {
+		t.Errorf("Stats() = %v", stats)
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	for key, want := range map[string]string{
+		"inl-faucet-1234-210-abcde": "inl-faucet",
+		"dialog:1234:send":          "dialog",
+		"4321":                      "other",
+		"settings":                  "settings",
+	} {
+		if got := keyPrefix(key); got != want {
+			t.Errorf("keyPrefix(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestTake(t *testing.T) {
+	db := NewBunt(":memory:")
+	testTake(t, db)
+}
+
+// testTake checks that an item is taken once by concurrent takes and that items that don't match are kept
+func testTake(t *testing.T, store Store) {
+	if err := store.Set(item{ID: "dialog:1:pay", Payload: "confirm"}); err != nil {
+		t.Fatal(err)
+	}
+	got := &item{ID: "dialog:1:pay"}
+	if err := store.Take(got, func() bool { return got.Payload == "pin" }); err != ErrNotFound {
+		t.Errorf("Take() of item that doesn't match = %v, want ErrNotFound", err)
+	}
+	if err := store.Get(&item{ID: "dialog:1:pay"}); err != nil {
+		t.Errorf("Get() after Take() of item that doesn't match = %v", err)
+	}
+	const n = 10
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	taken := 0
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got := &item{ID: "dialog:1:pay"}
+			err := store.Take(got, func() bool { return got.Payload == "confirm" })
+			if err == ErrNotFound {
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			taken++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if taken != 1 {
+		t.Errorf("item was taken %d times, want once", taken)
+	}
+	if err := store.Get(&item{ID: "dialog:1:pay"}); err != ErrNotFound {
+		t.Errorf("Get() after Take() = %v, want ErrNotFound", err)
+	}
+}
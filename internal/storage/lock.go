@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	lockPrefix = "lock:"
+	// fenceKey holds the last fencing token. Tokens are unique and increase with every acquired lock.
+	fenceKey          = "lock-fence"
+	lockRetryInterval = 50 * time.Millisecond
+)
+
+var (
+	ErrLocked   = errors.New("locked by another owner")
+	ErrLockLost = errors.New("lock expired or taken over")
+)
+
+// Lock is a lease on a key. It expires after its TTL so that a crashed owner
+// can't keep an item locked forever. The fencing token of a lock is greater than
+// the tokens of all locks acquired before, writes with SetLocked are only
+// accepted while the lock is still held.
+type Lock struct {
+	Key     string    `json:"key"`
+	Owner   string    `json:"owner"`
+	Token   uint64    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+func lockKey(key string) string {
+	return lockPrefix + key
+}
+
+// TryLock acquires the lock of key for ttl. It returns ErrLocked if the key is already locked.
+func (db *DB) TryLock(key string, owner string, ttl time.Duration) (*Lock, error) {
+	var lock *Lock
+	err := db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Get(lockKey(key))
+		if err == nil {
+			return ErrLocked
+		}
+		if err != buntdb.ErrNotFound {
+			return err
+		}
+		token, err := nextFence(tx)
+		if err != nil {
+			return err
+		}
+		lock = &Lock{Key: key, Owner: owner, Token: token, Expires: time.Now().Add(ttl)}
+		b, err := json.Marshal(lock)
+		if err != nil {
+			return err
+		}
+		_, _, err = tx.Set(lockKey(key), string(b), &buntdb.SetOptions{Expires: true, TTL: ttl})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Lock acquires the lock of key for ttl and waits up to timeout for other owners to release it
+func (db *DB) Lock(key string, owner string, ttl time.Duration, timeout time.Duration) (*Lock, error) {
+	return retryLock(func() (*Lock, error) {
+		return db.TryLock(key, owner, ttl)
+	}, timeout)
+}
+
+// Release releases the lock. It returns ErrLockLost if the lock expired in the meantime.
+func (db *DB) Release(lock *Lock) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		err := checkLock(tx, lock)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Delete(lockKey(lock.Key))
+		return err
+	})
+}
+
+// ReleaseKey releases the lock of key whoever holds it and reports whether it was locked
+func (db *DB) ReleaseKey(key string) (bool, error) {
+	released := false
+	err := db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(lockKey(key))
+		if err == buntdb.ErrNotFound {
+			return nil
+		}
+		released = err == nil
+		return err
+	})
+	return released, err
+}
+
+// SetLocked sets a storable item if lock is still held. It returns ErrLockLost otherwise.
+func (db *DB) SetLocked(lock *Lock, object Storable) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		err := checkLock(tx, lock)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(object)
+		if err != nil {
+			return err
+		}
+		_, _, err = tx.Set(object.Key(), string(b), setOptions(object))
+		return err
+	})
+}
+
+// ResetLocks releases all locks and returns their number. Only use it while no other process
+// uses the database, e.g. when the bot starts, to release the locks of a bot that crashed.
+func (db *DB) ResetLocks() (int, error) {
+	n := 0
+	err := db.Update(func(tx *buntdb.Tx) error {
+		var keys []string
+		err := tx.AscendKeys(lockPrefix+"*", func(key, value string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			_, err = tx.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	return n, err
+}
+
+// checkLock returns ErrLockLost if the current lock of the key is not lock
+func checkLock(tx *buntdb.Tx, lock *Lock) error {
+	val, err := tx.Get(lockKey(lock.Key))
+	if err == buntdb.ErrNotFound {
+		return ErrLockLost
+	}
+	if err != nil {
+		return err
+	}
+	current := Lock{}
+	err = json.Unmarshal([]byte(val), &current)
+	if err != nil {
+		return err
+	}
+	if current.Token != lock.Token {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// nextFence increments and returns the fencing token
+func nextFence(tx *buntdb.Tx) (uint64, error) {
+	var token uint64
+	val, err := tx.Get(fenceKey)
+	if err != nil && err != buntdb.ErrNotFound {
+		return 0, err
+	}
+	if err == nil {
+		token, err = strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+	}
+	token++
+	_, _, err = tx.Set(fenceKey, strconv.FormatUint(token, 10), nil)
+	return token, err
+}
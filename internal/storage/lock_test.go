@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTryLock(t *testing.T) {
+	db := NewBunt(":memory:")
+	lock, err := db.TryLock("inl-send-1", "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.TryLock("inl-send-1", "b", time.Minute); err != ErrLocked {
+		t.Fatalf("TryLock() of locked key = %v, want ErrLocked", err)
+	}
+	if err := db.Release(lock); err != nil {
+		t.Fatal(err)
+	}
+	next, err := db.TryLock("inl-send-1", "b", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Token <= lock.Token {
+		t.Errorf("fencing token %d not greater than %d", next.Token, lock.Token)
+	}
+	if err := db.Release(lock); err != ErrLockLost {
+		t.Errorf("Release() of released lock = %v, want ErrLockLost", err)
+	}
+}
+
+func TestLockLease(t *testing.T) {
+	db := NewBunt(":memory:")
+	stale, err := db.TryLock("inl-faucet-1", "crashed", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock, err := db.Lock("inl-faucet-1", "b", time.Minute, time.Second)
+	if err != nil {
+		t.Fatalf("Lock() after lease expiry = %v", err)
+	}
+	if err := db.SetLocked(stale, item{ID: "inl-faucet-1", Payload: "stale"}); err != ErrLockLost {
+		t.Errorf("SetLocked() with expired lock = %v, want ErrLockLost", err)
+	}
+	if err := db.SetLocked(lock, item{ID: "inl-faucet-1", Payload: "current"}); err != nil {
+		t.Fatal(err)
+	}
+	got := &item{ID: "inl-faucet-1"}
+	if err := db.Get(got); err != nil || got.Payload != "current" {
+		t.Errorf("Get() = %+v, %v", got, err)
+	}
+}
+
+func TestLockRace(t *testing.T) {
+	db := NewBunt(":memory:")
+	counter := &item{ID: "counter"}
+	if err := db.Set(counter); err != nil {
+		t.Fatal(err)
+	}
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lock, err := db.Lock(counter.ID, fmt.Sprint(i), time.Minute, 10*time.Second)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c := &item{ID: counter.ID}
+			if err := db.Get(c); err != nil {
+				t.Error(err)
+			}
+			c.Payload += "x"
+			if err := db.SetLocked(lock, c); err != nil {
+				t.Error(err)
+			}
+			if err := db.Release(lock); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := db.Get(counter); err != nil {
+		t.Fatal(err)
+	}
+	if len(counter.Payload) != n {
+		t.Errorf("%d of %d increments survived", len(counter.Payload), n)
+	}
+}
+
+func TestReleaseKey(t *testing.T) {
+	db := NewBunt(":memory:")
+	lock, err := db.TryLock("inl-send-1", "stuck", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released, err := db.ReleaseKey("inl-send-1"); err != nil || !released {
+		t.Fatalf("ReleaseKey() = %v, %v, want true", released, err)
+	}
+	if err := db.SetLocked(lock, item{ID: "inl-send-1"}); err != ErrLockLost {
+		t.Errorf("SetLocked() after ReleaseKey() = %v, want ErrLockLost", err)
+	}
+	if released, err := db.ReleaseKey("inl-send-1"); err != nil || released {
+		t.Errorf("ReleaseKey() of unlocked key = %v, %v, want false", released, err)
+	}
+}
+
+func TestResetLocks(t *testing.T) {
+	db := NewBunt(":memory:")
+	for _, key := range []string{"inl-send-1", "inl-faucet-1"} {
+		if _, err := db.TryLock(key, "crashed", time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := db.ResetLocks(); err != nil || n != 2 {
+		t.Fatalf("ResetLocks() = %d, %v, want 2", n, err)
+	}
+	if _, err := db.TryLock("inl-send-1", "a", time.Minute); err != nil {
+		t.Errorf("TryLock() after reset = %v", err)
+	}
+}
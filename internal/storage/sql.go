@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/buntdb"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+
+	sweepInterval = time.Minute
+)
+
+// OpenSQL opens a SQL database. dsn is a file path for sqlite and a connection string for postgres.
+func OpenSQL(driver string, dsn string, config *gorm.Config) (*gorm.DB, error) {
+	switch driver {
+	case DriverSQLite, "":
+		return gorm.Open(sqlite.Open(dsn), config)
+	case DriverPostgres:
+		return gorm.Open(postgres.Open(dsn), config)
+	}
+	return nil, fmt.Errorf("unknown database driver %s", driver)
+}
+
+// sqlItem is an item of a SQLStore
+type sqlItem struct {
+	Key       string `gorm:"primaryKey"`
+	Value     string
+	ExpiresAt *time.Time `gorm:"index"`
+}
+
+func (sqlItem) TableName() string {
+	return "ephemeral_items"
+}
+
+// sqlLock is a lock of a SQLStore
+type sqlLock struct {
+	Key       string `gorm:"primaryKey"`
+	Owner     string
+	Token     uint64
+	ExpiresAt time.Time
+}
+
+func (sqlLock) TableName() string {
+	return "ephemeral_locks"
+}
+
+// sqlFence holds the last fencing token in its only row
+type sqlFence struct {
+	ID    int `gorm:"primaryKey"`
+	Token uint64
+}
+
+func (sqlFence) TableName() string {
+	return "ephemeral_fences"
+}
+
+// SQLStore is a Store in a SQL database. Expired items are removed in the background.
+type SQLStore struct {
+	db   *gorm.DB
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewSQLStore creates the tables of the store in db
+func NewSQLStore(db *gorm.DB) (*SQLStore, error) {
+	err := db.AutoMigrate(&sqlItem{}, &sqlLock{}, &sqlFence{})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Clauses(clause.OnConflict{DoNothing: true}).Create(&sqlFence{ID: 1}).Error
+	if err != nil {
+		return nil, err
+	}
+	s := &SQLStore{db: db, stop: make(chan struct{})}
+	go s.sweep()
+	return s, nil
+}
+
+// sweep periodically deletes expired items and locks until the store is closed
+func (s *SQLStore) sweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		err := s.db.Where("expires_at < ?", now).Delete(&sqlItem{}).Error
+		if err == nil {
+			err = s.db.Where("expires_at < ?", now).Delete(&sqlLock{}).Error
+		}
+		if err != nil {
+			log.Errorf("[SQLStore] Could not delete expired items: %s", err)
+		}
+	}
+}
+
+// Close stops deleting expired items. The database is not closed, it belongs to the caller.
+func (s *SQLStore) Close() error {
+	s.once.Do(func() {
+		close(s.stop)
+	})
+	return nil
+}
+
+// notExpired selects items and locks that did not expire
+func notExpired(db *gorm.DB) *gorm.DB {
+	return db.Where("expires_at IS NULL OR expires_at > ?", time.Now())
+}
+
+// Get a storable item
+func (s *SQLStore) Get(object Storable) error {
+	item := &sqlItem{}
+	res := s.db.Scopes(notExpired).Where("key = ?", object.Key()).Limit(1).Find(item)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return json.Unmarshal([]byte(item.Value), object)
+}
+
+// Set a storable item
+func (s *SQLStore) Set(object Storable) error {
+	return setSQL(s.db, object)
+}
+
+func setSQL(db *gorm.DB, object Storable) error {
+	b, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	item := &sqlItem{Key: object.Key(), Value: string(b)}
+	if expirable, ok := object.(Expirable); ok && !expirable.Expires().IsZero() {
+		expires := expirable.Expires()
+		item.ExpiresAt = &expires
+	}
+	return SetRaw(db, item.Key, item.Value, item.ExpiresAt)
+}
+
+// SetRaw sets the value of a key in the store in db. expires is nil for items that don't expire.
+func SetRaw(db *gorm.DB, key string, value string, expires *time.Time) error {
+	return db.Clauses(clause.OnConflict{UpdateAll: true}).
+		Create(&sqlItem{Key: key, Value: value, ExpiresAt: expires}).Error
+}
+
+// DeleteKey deletes the item with the key
+func (s *SQLStore) DeleteKey(key string) error {
+	return s.db.Where("key = ?", key).Delete(&sqlItem{}).Error
+}
+
+// Take gets a storable item and deletes it if match reports true for it. The item is only
+// deleted if its value did not change in the meantime, of concurrent takes only one deletes it.
+func (s *SQLStore) Take(object Storable, match func() bool) error {
+	item := &sqlItem{}
+	res := s.db.Scopes(notExpired).Where("key = ?", object.Key()).Limit(1).Find(item)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	err := json.Unmarshal([]byte(item.Value), object)
+	if err != nil {
+		return err
+	}
+	if match != nil && !match() {
+		return ErrNotFound
+	}
+	res = s.db.Where("key = ? AND value = ?", item.Key, item.Value).Delete(&sqlItem{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Ascend iterates over all items with keys matching pattern in key order
+func (s *SQLStore) Ascend(pattern string, iterator func(key, value string) bool) error {
+	rows, err := s.db.Model(&sqlItem{}).Scopes(notExpired).
+		Where("key LIKE ? ESCAPE '\\'", likePattern(pattern)).
+		Order("key").Select("key", "value").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, value string
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			return err
+		}
+		if !iterator(key, value) {
+			break
+		}
+	}
+	return rows.Err()
+}
+
+// likePattern converts a buntdb pattern to a LIKE pattern
+func likePattern(pattern string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`, "*", "%", "?", "_").Replace(pattern)
+}
+
+// Stats returns the number of items and locks in the store per key prefix
+func (s *SQLStore) Stats() (map[string]int, error) {
+	stats := make(map[string]int)
+	var keys []string
+	err := s.db.Model(&sqlItem{}).Scopes(notExpired).Pluck("key", &keys).Error
+	if err != nil {
+		return nil, err
+	}
+	var locks []string
+	err = s.db.Model(&sqlLock{}).Scopes(notExpired).Pluck("key", &locks).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		stats[keyPrefix(key)]++
+	}
+	for _, key := range locks {
+		stats[keyPrefix(lockKey(key))]++
+	}
+	return stats, nil
+}
+
+// TryLock acquires the lock of key for ttl. It returns ErrLocked if the key is already locked.
+func (s *SQLStore) TryLock(key string, owner string, ttl time.Duration) (*Lock, error) {
+	var lock *Lock
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("key = ? AND expires_at <= ?", key, time.Now()).Delete(&sqlLock{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&sqlFence{}).Where("id = 1").Update("token", gorm.Expr("token + 1")).Error
+		if err != nil {
+			return err
+		}
+		fence := &sqlFence{}
+		err = tx.First(fence, 1).Error
+		if err != nil {
+			return err
+		}
+		lock = &Lock{Key: key, Owner: owner, Token: fence.Token, Expires: time.Now().Add(ttl)}
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&sqlLock{Key: key, Owner: owner, Token: lock.Token, ExpiresAt: lock.Expires})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrLocked
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Lock acquires the lock of key for ttl and waits up to timeout for other owners to release it
+func (s *SQLStore) Lock(key string, owner string, ttl time.Duration, timeout time.Duration) (*Lock, error) {
+	return retryLock(func() (*Lock, error) {
+		return s.TryLock(key, owner, ttl)
+	}, timeout)
+}
+
+// Release releases the lock. It returns ErrLockLost if the lock expired in the meantime.
+func (s *SQLStore) Release(lock *Lock) error {
+	res := s.db.Where("key = ? AND token = ? AND expires_at > ?", lock.Key, lock.Token, time.Now()).Delete(&sqlLock{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// ReleaseKey releases the lock of key whoever holds it and reports whether it was locked
+func (s *SQLStore) ReleaseKey(key string) (bool, error) {
+	res := s.db.Where("key = ? AND expires_at > ?", key, time.Now()).Delete(&sqlLock{})
+	return res.RowsAffected > 0, res.Error
+}
+
+// SetLocked sets a storable item if lock is still held. It returns ErrLockLost otherwise.
+func (s *SQLStore) SetLocked(lock *Lock, object Storable) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("key = ? AND token = ? AND expires_at > ?", lock.Key, lock.Token, time.Now()).
+			Limit(1).Find(&sqlLock{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrLockLost
+		}
+		return setSQL(tx, object)
+	})
+}
+
+// CopyFrom copies all items of a bunt database to the store and returns the number of copied items.
+// Locks are not copied.
+func (s *SQLStore) CopyFrom(src *DB) (int, error) {
+	copied := 0
+	var err error
+	viewErr := src.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys("*", func(key, value string) bool {
+			if strings.HasPrefix(key, lockPrefix) || key == fenceKey {
+				return true
+			}
+			var expires *time.Time
+			ttl, ttlErr := tx.TTL(key)
+			if ttlErr == nil && ttl >= 0 {
+				t := time.Now().Add(ttl)
+				expires = &t
+			}
+			err = SetRaw(s.db, key, value, expires)
+			if err != nil {
+				return false
+			}
+			copied++
+			return true
+		})
+	})
+	if viewErr != nil {
+		return copied, viewErr
+	}
+	return copied, err
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func newTestSQLStore(t *testing.T) *SQLStore {
+	dsn := filepath.Join(t.TempDir(), "store.db") + "?_busy_timeout=5000&_txlock=immediate"
+	db, err := OpenSQL(DriverSQLite, dsn, &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewSQLStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestSQLStore(t *testing.T) {
+	var _ Store = &SQLStore{}
+	var _ Store = &DB{}
+	store := newTestSQLStore(t)
+	for _, i := range []item{
+		{ID: "dialog:1:send", Payload: "a"},
+		{ID: "dialog:1:pay", Payload: "b"},
+		{ID: "dialog:2:send", Payload: "c"},
+		{ID: "dialog:1:old", Expiry: time.Now().Add(-time.Second)},
+		{ID: "inl_send", Payload: "no wildcard"},
+	} {
+		if err := store.Set(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Set(item{ID: "dialog:1:send", Payload: "updated"}); err != nil {
+		t.Fatal(err)
+	}
+	got := &item{ID: "dialog:1:send"}
+	if err := store.Get(got); err != nil || got.Payload != "updated" {
+		t.Errorf("Get() = %+v, %v", got, err)
+	}
+	if err := store.Get(&item{ID: "dialog:1:old"}); err != ErrNotFound {
+		t.Errorf("Get() of expired item = %v, want ErrNotFound", err)
+	}
+	var keys []string
+	err := store.Ascend("dialog:1:*", func(key, value string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil || fmt.Sprint(keys) != "[dialog:1:pay dialog:1:send]" {
+		t.Errorf("Ascend() = %v, %v", keys, err)
+	}
+	keys = nil
+	err = store.Ascend("inl_*", func(key, value string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil || fmt.Sprint(keys) != "[inl_send]" {
+		t.Errorf("Ascend() with escaped pattern = %v, %v", keys, err)
+	}
+	if err := store.DeleteKey("dialog:1:pay"); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := store.Stats()
+	if err != nil || stats["dialog"] != 2 {
+		t.Errorf("Stats() = %v, %v", stats, err)
+	}
+}
+
+func TestSQLStoreLock(t *testing.T) {
+	store := newTestSQLStore(t)
+	lock, err := store.TryLock("inl-send-1", "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.TryLock("inl-send-1", "b", time.Minute); err != ErrLocked {
+		t.Fatalf("TryLock() of locked key = %v, want ErrLocked", err)
+	}
+	if err := store.Release(lock); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetLocked(lock, item{ID: "inl-send-1"}); err != ErrLockLost {
+		t.Errorf("SetLocked() with released lock = %v, want ErrLockLost", err)
+	}
+	stale, err := store.TryLock("inl-send-1", "crashed", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale.Token <= lock.Token {
+		t.Errorf("fencing token %d not greater than %d", stale.Token, lock.Token)
+	}
+	next, err := store.Lock("inl-send-1", "b", time.Minute, time.Second)
+	if err != nil {
+		t.Fatalf("Lock() after lease expiry = %v", err)
+	}
+	if err := store.SetLocked(stale, item{ID: "inl-send-1"}); err != ErrLockLost {
+		t.Errorf("SetLocked() with expired lock = %v, want ErrLockLost", err)
+	}
+	if released, err := store.ReleaseKey("inl-send-1"); err != nil || !released {
+		t.Errorf("ReleaseKey() = %v, %v, want true", released, err)
+	}
+	if err := store.Release(next); err != ErrLockLost {
+		t.Errorf("Release() after ReleaseKey() = %v, want ErrLockLost", err)
+	}
+}
+
+func TestSQLStoreLockRace(t *testing.T) {
+	store := newTestSQLStore(t)
+	counter := &item{ID: "counter"}
+	if err := store.Set(counter); err != nil {
+		t.Fatal(err)
+	}
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lock, err := store.Lock(counter.ID, fmt.Sprint(i), time.Minute, 20*time.Second)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c := &item{ID: counter.ID}
+			if err := store.Get(c); err != nil {
+				t.Error(err)
+			}
+			c.Payload += "x"
+			if err := store.SetLocked(lock, c); err != nil {
+				t.Error(err)
+			}
+			if err := store.Release(lock); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := store.Get(counter); err != nil {
+		t.Fatal(err)
+	}
+	if len(counter.Payload) != n {
+		t.Errorf("%d of %d increments survived", len(counter.Payload), n)
+	}
+}
+
+func TestSQLStoreTake(t *testing.T) {
+	testTake(t, newTestSQLStore(t))
+}
+
+func TestCopyFrom(t *testing.T) {
+	src := NewBunt(":memory:")
+	if err := src.Set(item{ID: "dialog:1:send", Payload: "a", Expiry: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Set(item{ID: "4321", Payload: "tooltip"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.TryLock("4321", "a", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	store := newTestSQLStore(t)
+	n, err := store.CopyFrom(src)
+	if err != nil || n != 2 {
+		t.Fatalf("CopyFrom() = %d, %v", n, err)
+	}
+	got := &item{ID: "dialog:1:send"}
+	if err := store.Get(got); err != nil || got.Payload != "a" {
+		t.Errorf("Get() = %+v, %v", got, err)
+	}
+	if _, err := store.TryLock("4321", "b", time.Minute); err != nil {
+		t.Errorf("locks were copied: %v", err)
+	}
+}
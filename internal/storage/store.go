@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// ErrNotFound is returned by stores if an item does not exist or has expired
+var ErrNotFound = buntdb.ErrNotFound
+
+// Store keeps ephemeral items such as inline sends, dialogs and tip tooltips.
+// Items expire if they are Expirable. Locks are leases on the keys of items.
+// DB keeps the items in a local buntdb file, SQLStore in a SQL database that
+// can be shared between bot replicas.
+type Store interface {
+	Get(object Storable) error
+	Set(object Storable) error
+	DeleteKey(key string) error
+	// Take gets an item and deletes it in one step if match reports true for it, match may be nil.
+	// Of concurrent takes of the same item only one succeeds, the others get ErrNotFound
+	// like takes of items that don't match.
+	Take(object Storable, match func() bool) error
+	// Ascend iterates over all items with keys matching pattern in key order.
+	// Patterns may contain the wildcards * and ?.
+	Ascend(pattern string, iterator func(key, value string) bool) error
+	Stats() (map[string]int, error)
+
+	TryLock(key string, owner string, ttl time.Duration) (*Lock, error)
+	Lock(key string, owner string, ttl time.Duration, timeout time.Duration) (*Lock, error)
+	Release(lock *Lock) error
+	SetLocked(lock *Lock, object Storable) error
+	// ReleaseKey releases the lock of key whoever holds it and reports whether it was locked.
+	// Writes of the former owner fail with ErrLockLost. Only for operators, e.g. /admin unlock.
+	ReleaseKey(key string) (bool, error)
+
+	Close() error
+}
+
+// retryLock calls tryLock until the lock is acquired or timeout
+func retryLock(tryLock func() (*Lock, error), timeout time.Duration) (*Lock, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		lock, err := tryLock()
+		if err != ErrLocked || time.Now().After(deadline) {
+			return lock, err
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
@@ -15,11 +15,22 @@ import (
 const (
 	invoiceEnterAmountMessage = "Did you enter an amount?"
 	invoiceValidAmountMessage = "Did you enter a valid amount?"
+	invoiceAskAmountMessage   = "⌨️ Enter the amount of the invoice, or /cancel."
 	invoiceHelpText           = "📖 Oops, that didn't work. %s\n\n" +
 		"*Usage:* `/invoice <amount> [<memo>]`\n" +
 		"*Example:* `/invoice 1000 Thank you!`"
 )
 
+const (
+	invoiceCommand                  = "invoice"
+	invoiceDialogAmount DialogState = "amount"
+)
+
+// invoiceDialogData is the invoice that the user is preparing
+type invoiceDialogData struct {
+	Memo string `json:"memo"`
+}
+
 func helpInvoiceUsage(errormsg string) string {
 	if len(errormsg) > 0 {
 		return fmt.Sprintf(invoiceHelpText, fmt.Sprintf("%s", errormsg))
@@ -28,20 +39,21 @@ func helpInvoiceUsage(errormsg string) string {
 	}
 }
 
-func (bot TipBot) invoiceHandler(m *tb.Message) {
-	// check and print all commands
-	bot.anyTextHandler(m)
-	if m.Chat.Type != tb.ChatPrivate {
-		// delete message
-		NewMessage(m, WithDuration(0, bot.telegram))
-		return
-	}
+func (bot TipBot) invoiceHandler(ctx *Context) {
+	m := ctx.Message
 	if len(strings.Split(m.Text, " ")) < 2 {
-		bot.trySendMessage(m.Sender, helpInvoiceUsage(invoiceEnterAmountMessage))
+		// ask for the amount
+		_, err := bot.startDialog(m.Sender, invoiceCommand, invoiceDialogAmount, invoiceDialogData{})
+		if err != nil {
+			log.Errorf("[/invoice] Could not start dialog: %s", err)
+			bot.trySendMessage(m.Sender, helpInvoiceUsage(invoiceEnterAmountMessage))
+			return
+		}
+		bot.trySendMessage(m.Sender, invoiceAskAmountMessage, tb.ForceReply)
 		return
 	}
 
-	user, err := GetUser(m.Sender, bot)
+	user := ctx.User
 	userStr := GetUserStr(m.Sender)
 	amount, err := decodeAmountFromCommand(m.Text)
 	if err != nil {
@@ -67,12 +79,11 @@ func (bot TipBot) invoiceHandler(m *tb.Message) {
 
 	log.Infof("[/invoice] Creating invoice for %s of %d sat.", userStr, amount)
 	// generate invoice
-	invoice, err := user.Wallet.Invoice(
+	invoice, err := lnbits.InvoiceWithWebhook(bot.database, Configuration.Lnbits.WebhookServer,
 		lnbits.InvoiceParams{
-			Out:     false,
-			Amount:  int64(amount),
-			Memo:    memo,
-			Webhook: Configuration.Lnbits.WebhookServer},
+			Out:    false,
+			Amount: int64(amount),
+			Memo:   memo},
 		*user.Wallet)
 	if err != nil {
 		errmsg := fmt.Sprintf("[/invoice] Could not create an invoice: %s", err)
@@ -89,7 +100,33 @@ func (bot TipBot) invoiceHandler(m *tb.Message) {
 	}
 
 	// send the invoice data to user
-	bot.trySendMessage(m.Sender, &tb.Photo{File: tb.File{FileReader: bytes.NewReader(qr)}, Caption: fmt.Sprintf("`%s`", invoice.PaymentRequest)})
+	invoiceMessage := bot.trySendMessage(m.Sender, &tb.Photo{File: tb.File{FileReader: bytes.NewReader(qr)}, Caption: fmt.Sprintf("`%s`", invoice.PaymentRequest)})
+	if invoiceMessage != nil {
+		// the invoice message is updated when the invoice is paid
+		err = lnbits.SetInvoiceMessage(bot.database, invoice.PaymentHash, invoiceMessage)
+		if err != nil {
+			log.Errorf("[/invoice] Could not store invoice message: %s", err)
+		}
+	}
 	log.Printf("[/invoice] Incvoice created. User: %s, amount: %d sat.", userStr, amount)
 	return
 }
+
+// invoiceAmountStep handles the amount that the user entered in an invoice dialog
+func (bot TipBot) invoiceAmountStep(m *tb.Message, dialog *Dialog) {
+	var data invoiceDialogData
+	err := dialog.Decode(&data)
+	if err != nil {
+		log.Errorf("[/invoice] Could not decode dialog: %s", err)
+		bot.endDialog(dialog)
+		return
+	}
+	amount, err := parseDialogAmount(m.Text)
+	if err != nil {
+		bot.trySendMessage(m.Sender, invoiceAskAmountMessage, tb.ForceReply)
+		return
+	}
+	bot.endDialog(dialog)
+	m.Text = strings.TrimSpace(fmt.Sprintf("/invoice %d %s", amount, data.Memo))
+	bot.requireWallet(bot.invoiceHandler)(&Context{Message: m})
+}
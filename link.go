@@ -2,7 +2,15 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
 	log "github.com/sirupsen/logrus"
 	"github.com/skip2/go-qrcode"
 	tb "gopkg.in/tucnak/telebot.v2"
@@ -13,39 +21,336 @@ var (
 		"⚠️ Never share the URL or the QR code with anyone or they will be able to access your funds.\n\n" +
 		"- *BlueWallet:* Press *New wallet*, *Import wallet*, *Scan or import a file*, and scan the QR code.\n" +
 		"- *Zeus:* Copy the URL below, press *Add a new node*, *Import* (the URL), *Save Node Config*."
-	couldNotLinkMessage = "🚫 Couldn't link your wallet. Please try again later."
+	walletConnectReadonlyMessage = "🔗 *Link your wallet (read-only)*\n\n" +
+		"Apps with this link can create invoices and see your balance, but they can't spend your funds. Use it for point-of-sale devices and watch-only wallets.\n\n" +
+		"- *BlueWallet:* Press *New wallet*, *Import wallet*, *Scan or import a file*, and scan the QR code.\n" +
+		"- *Zeus:* Copy the URL below, press *Add a new node*, *Import* (the URL), *Save Node Config*."
+	confirmLinkAdminMessage = "⚠️ *The admin link gives full access to your funds.* Anyone who sees the URL or the QR code can spend your sats.\n\n" +
+		"Use `/link readonly` for point-of-sale devices and watch-only apps. If a link gets into the wrong hands, use `/link revoke`.\n\n" +
+		"Do you want to show the admin link?"
+	linkCancelledMessage = "🚫 Link cancelled."
+	couldNotLinkMessage  = "🚫 Couldn't link your wallet. Please try again later."
+	linkHelpText         = "📖 Oops, that didn't work. %s\n\n" +
+		"*Usage:* `/link [admin|readonly|revoke]`\n" +
+		"*Example:* `/link readonly`"
+	linkRevokedMessage = "🔐 *Link revoked*\n\n" +
+		"Your funds were moved to a new wallet with new keys. URLs and QR codes of /link that you got before don't work anymore. " +
+		"Invoices that you created before can still be paid, the payments are moved to your new wallet.\n\n" +
+		"⚠️ Apps that are still connected with an old link (BlueWallet, Zeus) show an empty wallet now. Remove the wallet from these apps and use /link to connect them again."
+	linkRevokeFailedMessage  = "🚫 Couldn't revoke your link. Your funds are still in your wallet. Please try again later."
+	linkRevokePendingMessage = "⏳ Your link is being revoked."
 )
 
-func (bot TipBot) lndhubHandler(m *tb.Message) {
-	if Configuration.Lnbits.LnbitsPublicUrl == "" {
+func helpLinkUsage(errormsg string) string {
+	return fmt.Sprintf(linkHelpText, errormsg)
+}
+
+const (
+	linkCommand                        = "link"
+	linkDialogConfirmAdmin DialogState = "confirm_admin"
+
+	// lndhub URLs of the LndHub extension of LNbits, the user is the kind of the key
+	lndhubAdmin   = "admin"
+	lndhubInvoice = "invoice"
+
+	// linkRevokeTTL is the lease of the lock that prevents concurrent revocations of a user
+	linkRevokeTTL = time.Minute
+	// retiredWalletTTL is how long the old wallet of a revocation is kept. It is longer than
+	// invoices of LNbits are valid so that invoices of the old wallet can still be paid.
+	retiredWalletTTL = 24 * time.Hour
+)
+
+// RetiredWallet is the old wallet of a user after /link revoke. The janitor moves payments that
+// arrive in the wallet to the current wallet of the user and deletes it after retiredWalletTTL.
+type RetiredWallet struct {
+	WalletID   string    `json:"wallet_id"`
+	TelegramID int       `json:"telegram_id"`
+	RetiredAt  time.Time `json:"retired_at"`
+}
+
+func (r RetiredWallet) Key() string {
+	return fmt.Sprintf("retired-wallet:%d:%s", r.TelegramID, r.WalletID)
+}
+
+// lndhubHandler is invoked on /link [admin|readonly|revoke]. The admin link needs a confirmation.
+func (bot TipBot) lndhubHandler(ctx *Context) {
+	m := ctx.Message
+	// links would give access to the funds of frozen users
+	if ctx.User.Frozen {
+		bot.trySendMessage(m.Sender, accountFrozenMessage)
+		return
+	}
+	argument, _ := getArgumentFromCommand(m.Text, 1)
+	argument = strings.ToLower(argument)
+	if argument == "revoke" {
+		bot.linkRevokeHandler(ctx)
+		return
+	}
+	if currentConfiguration().Lnbits.LnbitsPublicUrl == "" {
 		bot.trySendMessage(m.Sender, couldNotLinkMessage)
 		return
 	}
-	// check and print all commands
-	bot.anyTextHandler(m)
-	// reply only in private message
-	if m.Chat.Type != tb.ChatPrivate {
-		// delete message
-		NewMessage(m, WithDuration(0, bot.telegram))
+	fromUser := ctx.User
+	switch argument {
+	case "readonly":
+		err := bot.ensureInvoiceKey(fromUser)
+		if err != nil {
+			log.Errorf("[/link] Could not get invoice key of %s: %s", GetUserStr(m.Sender), err)
+			bot.trySendMessage(m.Sender, couldNotLinkMessage)
+			return
+		}
+		bot.sendLndhubLink(m.Sender, walletConnectReadonlyMessage, lndhubInvoice, string(fromUser.Wallet.Inkey))
+	case "admin", "":
+		_, err := bot.startDialog(m.Sender, linkCommand, linkDialogConfirmAdmin, nil)
+		if err != nil {
+			log.Errorf("[/link] Could not start dialog: %s", err)
+			bot.trySendMessage(m.Sender, errorTryLaterMessage)
+			return
+		}
+		linkConfirmationMenu.Inline(linkConfirmationMenu.Row(btnLinkAdmin, btnCancelLink))
+		bot.trySendMessage(m.Sender, confirmLinkAdminMessage, linkConfirmationMenu)
+	default:
+		bot.trySendMessage(m.Sender, helpLinkUsage(""))
+	}
+}
+
+// linkAdminHandler is invoked when the user confirmed the admin link
+func (bot TipBot) linkAdminHandler(c *tb.Callback) {
+	bot.tryEditMessage(c.Message, c.Message.Text, &tb.ReplyMarkup{})
+	_, err := bot.takeDialog(c.Sender, linkCommand, linkDialogConfirmAdmin)
+	if err != nil {
+		bot.trySendMessage(c.Sender, dialogExpiredMessage)
+		return
 	}
-	// first check whether the user is initialized
-	fromUser, err := GetUser(m.Sender, bot)
+	user, err := GetUser(c.Sender, bot)
 	if err != nil {
-		log.Errorf("[/balance] Error: %s", err)
+		log.Errorf("[/link] Error: %s", err)
 		return
 	}
-	bot.trySendMessage(m.Sender, walletConnectMessage)
+	if user.Frozen {
+		bot.trySendMessage(c.Sender, accountFrozenMessage)
+		return
+	}
+	log.Infof("[/link] %s confirmed the admin link", GetUserStr(c.Sender))
+	bot.sendLndhubLink(c.Sender, walletConnectMessage, lndhubAdmin, string(user.Wallet.Adminkey))
+}
+
+// cancelLinkHandler is invoked when the user cancelled the admin link
+func (bot TipBot) cancelLinkHandler(c *tb.Callback) {
+	dialog, err := bot.getDialog(c.Sender, linkCommand)
+	if err == nil {
+		bot.endDialog(dialog)
+	}
+	bot.tryDeleteMessage(c.Message)
+	bot.trySendMessage(c.Sender, linkCancelledMessage)
+}
 
-	lndhubUrl := fmt.Sprintf("lndhub://admin:%s@%slndhub/ext/", fromUser.Wallet.Adminkey, Configuration.Lnbits.LnbitsPublicUrl)
+// sendLndhubLink sends the lndhub URL with a key of the wallet as text and QR code
+func (bot TipBot) sendLndhubLink(to *tb.User, message string, kind string, key string) {
+	lndhubUrl := fmt.Sprintf("lndhub://%s:%s@%slndhub/ext/", kind, key, currentConfiguration().Lnbits.LnbitsPublicUrl)
 
 	// create qr code
 	qr, err := qrcode.Encode(lndhubUrl, qrcode.Medium, 256)
 	if err != nil {
-		errmsg := fmt.Sprintf("[/invoice] Failed to create QR code for invoice: %s", err)
-		log.Errorln(errmsg)
+		log.Errorf("[/link] Failed to create QR code: %s", err)
+		bot.trySendMessage(to, couldNotLinkMessage)
+		return
+	}
+	bot.trySendMessage(to, message)
+	bot.trySendMessage(to, &tb.Photo{File: tb.File{FileReader: bytes.NewReader(qr)}, Caption: fmt.Sprintf("`%s`", lndhubUrl)})
+}
+
+// ensureInvoiceKey fills in the invoice key of wallets that were stored without it
+func (bot TipBot) ensureInvoiceKey(user *lnbits.User) error {
+	if len(user.Wallet.Inkey) > 0 {
+		return nil
+	}
+	wallets, err := bot.client.Wallets(*user)
+	if err != nil {
+		return err
+	}
+	for _, wallet := range wallets {
+		if wallet.ID == user.Wallet.ID && len(wallet.Inkey) > 0 {
+			user.Wallet.Inkey = wallet.Inkey
+			return bot.users.ReplaceWallet(user, user.Wallet.ID)
+		}
+	}
+	return fmt.Errorf("wallet %s has no invoice key", user.Wallet.ID)
+}
+
+// linkRevokeHandler is invoked on /link revoke. It moves the funds of the user to a new wallet
+// so that the admin key in URLs of /link that were shared before stops working.
+func (bot TipBot) linkRevokeHandler(ctx *Context) {
+	m := ctx.Message
+	user := ctx.User
+	lock, err := bot.store.TryLock("link-revoke:"+strconv.Itoa(m.Sender.ID), strconv.Itoa(m.ID), linkRevokeTTL)
+	if err != nil {
+		if errors.Is(err, storage.ErrLocked) {
+			bot.trySendMessage(m.Sender, linkRevokePendingMessage)
+			return
+		}
+		log.Errorf("[/link revoke] Could not lock %s: %s", GetUserStr(m.Sender), err)
+		bot.trySendMessage(m.Sender, linkRevokeFailedMessage)
+		return
+	}
+	defer bot.store.Release(lock)
+
+	oldWallet := user.Wallet.ID
+	err = bot.revokeLink(user)
+	if err != nil {
+		log.Errorf("[/link revoke] Could not revoke link of %s: %s", GetUserStr(m.Sender), err)
+		bot.trySendMessage(m.Sender, linkRevokeFailedMessage)
 		return
 	}
+	log.Infof("[/link revoke] %s moved from wallet %s to %s", GetUserStr(m.Sender), oldWallet, user.Wallet.ID)
+	bot.trySendMessage(m.Sender, linkRevokedMessage)
+}
+
+// revokeLink moves the balance of the user to a new wallet, points the user record to it
+// and retires the old wallet. On errors, the user keeps the old wallet.
+func (bot TipBot) revokeLink(user *lnbits.User) error {
+	// a running payment must not pay from the old wallet after its balance was moved
+	lock, err := bot.lockSpending(user.Telegram)
+	if err != nil {
+		return err
+	}
+	defer bot.unlockSpending(lock)
+	oldWallet := *user.Wallet
+	newWallet, err := bot.client.CreateWallet(user.ID, oldWallet.Name, Configuration.Lnbits.AdminId)
+	if err != nil {
+		return fmt.Errorf("could not create wallet: %w", err)
+	}
+	newWallet.Client = bot.client
+	_, err = bot.moveBalance(&oldWallet, &newWallet)
+	if err != nil {
+		// the payment failed, the new wallet is empty
+		deleteErr := bot.client.DeleteWallet(newWallet.ID)
+		if deleteErr != nil {
+			log.Errorf("[revokeLink] Could not delete unused wallet %s: %s", newWallet.ID, deleteErr)
+		}
+		return fmt.Errorf("could not move balance: %w", err)
+	}
+	user.Wallet = &newWallet
+	err = bot.users.ReplaceWallet(user, oldWallet.ID)
+	if err != nil {
+		user.Wallet = &oldWallet
+		// the funds have to stay in the wallet of the user record
+		amount, moveErr := bot.moveBalance(&newWallet, &oldWallet)
+		if moveErr != nil {
+			log.Errorf("[revokeLink] Could not move %d sat back from wallet %s to %s: %s", amount, newWallet.ID, oldWallet.ID, moveErr)
+		} else if deleteErr := bot.client.DeleteWallet(newWallet.ID); deleteErr != nil {
+			log.Errorf("[revokeLink] Could not delete unused wallet %s: %s", newWallet.ID, deleteErr)
+		}
+		return fmt.Errorf("could not update user: %w", err)
+	}
+	// invoices of the old wallet can still be paid, the janitor moves their payments
+	err = bot.store.Set(&RetiredWallet{WalletID: oldWallet.ID, TelegramID: user.Telegram.ID, RetiredAt: time.Now()})
+	if err != nil {
+		log.Errorf("[revokeLink] Could not retire wallet %s: %s", oldWallet.ID, err)
+	}
+	// payments that arrived in the old wallet while the balance was moved
+	amount, err := bot.moveBalance(&oldWallet, &newWallet)
+	if err != nil {
+		log.Errorf("[revokeLink] Could not move remaining %d sat from wallet %s to %s: %s", amount, oldWallet.ID, newWallet.ID, err)
+	}
+	return nil
+}
 
-	// send the invoice data to user
-	bot.trySendMessage(m.Sender, &tb.Photo{File: tb.File{FileReader: bytes.NewReader(qr)}, Caption: fmt.Sprintf("`%s`", lndhubUrl)})
+// sweepRetiredWallets moves payments that arrived in retired wallets to the current wallets
+// of their users and deletes retired wallets after retiredWalletTTL
+func (bot TipBot) sweepRetiredWallets() {
+	var retired []RetiredWallet
+	err := bot.store.Ascend("retired-wallet:*", func(key, value string) bool {
+		var r RetiredWallet
+		if json.Unmarshal([]byte(value), &r) == nil {
+			retired = append(retired, r)
+		}
+		return true
+	})
+	if err != nil {
+		log.Errorf("[sweepRetiredWallets] %s", err)
+		return
+	}
+	for _, r := range retired {
+		err = bot.sweepRetiredWallet(r)
+		if err != nil {
+			log.Errorf("[sweepRetiredWallets] Could not sweep wallet %s: %s", r.WalletID, err)
+		}
+	}
+}
+
+// sweepRetiredWallet moves the balance of a retired wallet and deletes it if it is old enough
+func (bot TipBot) sweepRetiredWallet(r RetiredWallet) error {
+	// the user could revoke again in the meantime
+	lock, err := bot.store.TryLock("link-revoke:"+strconv.Itoa(r.TelegramID), "janitor", linkRevokeTTL)
+	if err != nil {
+		if errors.Is(err, storage.ErrLocked) {
+			return nil
+		}
+		return err
+	}
+	defer bot.store.Release(lock)
+	user, err := bot.users.GetUser(r.TelegramID)
+	if err != nil {
+		return err
+	}
+	if user.Wallet == nil {
+		return fmt.Errorf("user %d has no wallet", r.TelegramID)
+	}
+	user.Wallet.Client = bot.client
+	wallets, err := bot.client.Wallets(*user)
+	if err != nil {
+		return err
+	}
+	var oldWallet *lnbits.Wallet
+	for i := range wallets {
+		if wallets[i].ID == r.WalletID {
+			oldWallet = &wallets[i]
+		}
+	}
+	if oldWallet == nil {
+		// deleted before
+		return bot.store.DeleteKey(r.Key())
+	}
+	oldWallet.Client = bot.client
+	amount, err := bot.moveBalance(oldWallet, user.Wallet)
+	if err != nil {
+		return fmt.Errorf("could not move %d sat: %w", amount, err)
+	}
+	if amount > 0 {
+		log.Infof("[sweepRetiredWallets] Moved %d sat from retired wallet %s of %d to %s", amount, r.WalletID, r.TelegramID, user.Wallet.ID)
+	}
+	if time.Since(r.RetiredAt) < retiredWalletTTL {
+		return nil
+	}
+	err = bot.client.DeleteWallet(r.WalletID)
+	if err != nil {
+		return err
+	}
+	log.Infof("[sweepRetiredWallets] Deleted retired wallet %s of %d", r.WalletID, r.TelegramID)
+	return bot.store.DeleteKey(r.Key())
+}
+
+// moveBalance pays the whole balance of from to to and returns the amount in sat
+func (bot TipBot) moveBalance(from *lnbits.Wallet, to *lnbits.Wallet) (int, error) {
+	info, err := from.Info(*from)
+	if err != nil {
+		return 0, err
+	}
+	// msat to sat
+	amount := int(info.Balance / 1000)
+	if amount < 1 {
+		return 0, nil
+	}
+	invoice, err := to.Invoice(
+		lnbits.InvoiceParams{
+			Amount: int64(amount),
+			Out:    false,
+			Memo:   "Revoked /link"},
+		*to)
+	if err != nil {
+		return amount, err
+	}
+	_, err = from.Pay(lnbits.PaymentParams{Out: true, Bolt11: invoice.PaymentRequest}, *from)
+	return amount, err
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScenario_linkRevoke(t *testing.T) {
+	s := newScenario(t)
+	alice := s.newUser(2001, "alice", 1000)
+	oldWallet := s.wallet(alice)
+
+	s.private(alice, "/link revoke")
+	s.expect(alice, "Link revoked")
+	if s.wallet(alice) == oldWallet {
+		t.Fatal("wallet was not replaced")
+	}
+	s.checkBalance(alice, 1000)
+
+	// an invoice of the old wallet is paid after the revocation
+	s.lnbits.deposit(oldWallet, 100)
+	s.bot.sweepRetiredWallets()
+	s.checkBalance(alice, 1100)
+	if s.lnbits.balance(oldWallet) != 0 {
+		t.Errorf("retired wallet has %d sat left", s.lnbits.balance(oldWallet))
+	}
+
+	retired := &RetiredWallet{WalletID: oldWallet, TelegramID: alice.ID}
+	if err := s.bot.store.Get(retired); err != nil {
+		t.Fatal(err)
+	}
+	retired.RetiredAt = time.Now().Add(-retiredWalletTTL - time.Minute)
+	if err := s.bot.store.Set(retired); err != nil {
+		t.Fatal(err)
+	}
+	s.bot.sweepRetiredWallets()
+	s.lnbits.mu.Lock()
+	_, exists := s.lnbits.wallets[oldWallet]
+	s.lnbits.mu.Unlock()
+	if exists {
+		t.Error("retired wallet was not deleted")
+	}
+	if err := s.bot.store.Get(retired); err == nil {
+		t.Error("retired wallet is still swept")
+	}
+}
+
+func TestScenario_linkRevokeWaitsForPayments(t *testing.T) {
+	s := newScenario(t)
+	alice := s.newUser(2001, "alice", 1000)
+	oldWallet := s.wallet(alice)
+
+	// a payment of alice is running
+	lock, err := s.bot.lockSpending(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked := make(chan struct{})
+	go func() {
+		s.private(alice, "/link revoke")
+		close(revoked)
+	}()
+	select {
+	case <-revoked:
+		t.Fatal("link was revoked while a payment was running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	s.bot.unlockSpending(lock)
+	<-revoked
+	s.expect(alice, "Link revoked")
+	if s.wallet(alice) == oldWallet {
+		t.Fatal("wallet was not replaced")
+	}
+	s.checkBalance(alice, 1000)
+}
@@ -11,7 +11,6 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
 	lnurl "github.com/fiatjaf/go-lnurl"
 	log "github.com/sirupsen/logrus"
 	"github.com/skip2/go-qrcode"
@@ -26,28 +25,43 @@ const (
 	lnurlPaymentFailed             = "🚫 Payment failed: %s"
 	lnurlInvalidAmountMessage      = "🚫 Invalid amount."
 	lnurlInvalidAmountRangeMessage = "🚫 Amount must be between %d and %d sat."
-	lnurlNoUsernameMessage         = "🚫 You need to set a Telegram username to receive via LNURL."
+	lnurlNoUsernameMessage         = "🚫 You need to set a Telegram username or claim an /address to receive via LNURL."
 	lnurlEnterAmountMessage        = "⌨️ Enter an amount between %d and %d sat."
 	lnurlHelpText                  = "📖 Oops, that didn't work. %s\n\n" +
 		"*Usage:* `/lnurl [amount] <lnurl>`\n" +
 		"*Example:* `/lnurl LNURL1DP68GUR...`"
 )
 
+const (
+	lnurlCommand                   = "lnurl"
+	lnurlDialogAmount  DialogState = "amount"
+	lnurlDialogConfirm DialogState = "confirm"
+)
+
 // lnurlHandler is invoked on /lnurl command
-func (bot TipBot) lnurlHandler(m *tb.Message) {
+func (bot TipBot) lnurlHandler(ctx *Context) {
 	// commands:
 	// /lnurl
 	// /lnurl <LNURL>
 	// or /lnurl <amount> <LNURL>
-	log.Infof("[lnurlHandler] %s", m.Text)
+	m := ctx.Message
 
 	// if only /lnurl is entered, show the lnurl of the user
 	if m.Text == "/lnurl" {
 		bot.lnurlReceiveHandler(m)
 		return
 	}
+	// /lnurl <min|max|description|avatar> changes the LNURL settings of the user
+	if isLnurlSettingsCommand(m.Text) {
+		bot.lnurlSettingsHandler(ctx)
+		return
+	}
 
 	// assume payment
+	if ctx.User.Frozen {
+		bot.trySendMessage(m.Sender, accountFrozenMessage)
+		return
+	}
 	// HandleLNURL by fiatjaf/go-lnurl
 	msg := bot.trySendMessage(m.Sender, lnurlResolvingUrlMessage)
 	_, params, err := HandleLNURL(m.Text)
@@ -68,58 +82,42 @@ func (bot TipBot) lnurlHandler(m *tb.Message) {
 		// bot.trySendMessage(m.Sender, err.Error())
 		return
 	}
-	user, err := GetUser(m.Sender, bot)
+	// if no amount is in the command, ask for it
+	state := lnurlDialogAmount
+	amount, err := decodeAmountFromCommand(m.Text)
+	if err == nil && amount > 0 {
+		// amount is already present in the command
+		payParams.Amount = amount
+		state = lnurlDialogConfirm
+	}
+	_, err = bot.startDialog(m.Sender, lnurlCommand, state, payParams)
 	if err != nil {
 		log.Errorln(err)
 		bot.tryEditMessage(msg, fmt.Sprintf(lnurlPaymentFailed, "database error."))
 		return
 	}
-
-	// if no amount is in the command, ask for it
-	amount, err := decodeAmountFromCommand(m.Text)
-	if err != nil || amount < 1 {
-		// set LNURLPayResponse1 in the state of the user
-		paramsJson, err := json.Marshal(payParams)
-		if err != nil {
-			log.Errorln(err)
-			return
-		}
-
-		SetUserState(user, bot, lnbits.UserStateLNURLEnterAmount, string(paramsJson))
-
-		bot.tryDeleteMessage(msg)
+	bot.tryDeleteMessage(msg)
+	if state == lnurlDialogAmount {
 		// Let the user enter an amount and return
 		bot.trySendMessage(m.Sender, fmt.Sprintf(lnurlEnterAmountMessage, payParams.MinSendable/1000, payParams.MaxSendable/1000), tb.ForceReply)
-	} else {
-		// amount is already present in the command
-		// set also amount in the state of the user
-		// todo: this is repeated code, could be shorter
-		payParams.Amount = amount
-		paramsJson, err := json.Marshal(payParams)
-		if err != nil {
-			log.Errorln(err)
-			// bot.trySendMessage(m.Sender, err.Error())
-			return
-		}
-		SetUserState(user, bot, lnbits.UserStateConfirmLNURLPay, string(paramsJson))
-		bot.tryDeleteMessage(msg)
-		// directly go to confirm
-		bot.lnurlPayHandler(m)
+		return
 	}
+	// directly go to confirm
+	bot.lnurlPayHandler(m)
 }
 
 func (bot *TipBot) UserGetLightningAddress(user *tb.User) (string, error) {
-	if len(user.Username) > 0 {
-		return fmt.Sprintf("%s@%s", strings.ToLower(user.Username), strings.ToLower(Configuration.Bot.LNURLHostUrl.Hostname())), nil
-	} else {
-		return "", fmt.Errorf("user has no username")
+	name, err := bot.UserGetLightningAddressName(user)
+	if err != nil {
+		return "", err
 	}
+	return fmt.Sprintf("%s@%s", name, strings.ToLower(Configuration.Bot.LNURLHostUrl.Hostname())), nil
 }
 
 func (bot *TipBot) UserGetLNURL(user *tb.User) (string, error) {
-	name := strings.ToLower(strings.ToLower(user.Username))
-	if len(name) == 0 {
-		return "", fmt.Errorf("user has no username.")
+	name, err := bot.UserGetLightningAddressName(user)
+	if err != nil {
+		return "", err
 	}
 	callback := fmt.Sprintf("%s/.well-known/lnurlp/%s", Configuration.Bot.LNURLHostName, name)
 	log.Debugf("[lnurlReceiveHandler] %s's LNURL: %s", GetUserStr(user), callback)
@@ -137,7 +135,8 @@ func (bot TipBot) lnurlReceiveHandler(m *tb.Message) {
 	if err != nil {
 		errmsg := fmt.Sprintf("[lnurlReceiveHandler] Failed to get LNURL: %s", err)
 		log.Errorln(errmsg)
-		bot.telegram.Send(m.Sender, lnurlNoUsernameMessage)
+		bot.trySendMessage(m.Sender, lnurlNoUsernameMessage)
+		return
 	}
 	// create qr code
 	qr, err := qrcode.Encode(lnurlEncode, qrcode.Medium, 256)
@@ -152,48 +151,36 @@ func (bot TipBot) lnurlReceiveHandler(m *tb.Message) {
 	bot.trySendMessage(m.Sender, &tb.Photo{File: tb.File{FileReader: bytes.NewReader(qr)}, Caption: fmt.Sprintf("`%s`", lnurlEncode)})
 }
 
-func (bot TipBot) lnurlEnterAmountHandler(m *tb.Message) {
-	user, err := GetUser(m.Sender, bot)
+// lnurlEnterAmountHandler handles the amount that the user entered for an LNURL payment
+func (bot TipBot) lnurlEnterAmountHandler(m *tb.Message, dialog *Dialog) {
+	var stateResponse LnurlStateResponse
+	err := dialog.Decode(&stateResponse)
 	if err != nil {
 		log.Errorln(err)
-		// bot.trySendMessage(m.Sender, err.Error())
-		ResetUserState(user, bot)
+		bot.endDialog(dialog)
 		return
 	}
-	if user.StateKey == lnbits.UserStateLNURLEnterAmount {
-		a, err := strconv.Atoi(m.Text)
-		if err != nil {
-			log.Errorln(err)
-			bot.trySendMessage(m.Sender, lnurlInvalidAmountMessage)
-			ResetUserState(user, bot)
-			return
-		}
-		amount := int64(a)
-		var stateResponse LnurlStateResponse
-		err = json.Unmarshal([]byte(user.StateData), &stateResponse)
-		if err != nil {
-			log.Errorln(err)
-			ResetUserState(user, bot)
-			return
-		}
-		// amount not in allowed range from LNURL
-		if amount > (stateResponse.MaxSendable/1000) || amount < (stateResponse.MinSendable/1000) {
-			err = fmt.Errorf("amount not in range")
-			log.Errorln(err)
-			bot.trySendMessage(m.Sender, fmt.Sprintf(lnurlInvalidAmountRangeMessage, stateResponse.MinSendable/1000, stateResponse.MaxSendable/1000))
-			ResetUserState(user, bot)
-			return
-		}
-		stateResponse.Amount = a
-		state, err := json.Marshal(stateResponse)
-		if err != nil {
-			log.Errorln(err)
-			ResetUserState(user, bot)
-			return
-		}
-		SetUserState(user, bot, lnbits.UserStateConfirmLNURLPay, string(state))
-		bot.lnurlPayHandler(m)
+	amount, err := parseDialogAmount(m.Text)
+	if err != nil {
+		log.Errorln(err)
+		bot.trySendMessage(m.Sender, lnurlInvalidAmountMessage)
+		return
+	}
+	// amount not in allowed range from LNURL
+	if int64(amount) > (stateResponse.MaxSendable/1000) || int64(amount) < (stateResponse.MinSendable/1000) {
+		err = fmt.Errorf("amount not in range")
+		log.Errorln(err)
+		bot.trySendMessage(m.Sender, fmt.Sprintf(lnurlInvalidAmountRangeMessage, stateResponse.MinSendable/1000, stateResponse.MaxSendable/1000))
+		return
 	}
+	stateResponse.Amount = amount
+	err = bot.continueDialog(dialog, lnurlDialogConfirm, stateResponse)
+	if err != nil {
+		log.Errorln(err)
+		bot.endDialog(dialog)
+		return
+	}
+	bot.lnurlPayHandler(m)
 }
 
 // LnurlStateResponse saves the state of the user for an LNURL payment
@@ -206,71 +193,69 @@ type LnurlStateResponse struct {
 func (bot TipBot) lnurlPayHandler(c *tb.Message) {
 	msg := bot.trySendMessage(c.Sender, lnurlGettingUserMessage)
 
-	user, err := GetUser(c.Sender, bot)
+	// the dialog ends here, the payment is confirmed with /pay
+	dialog, err := bot.takeDialog(c.Sender, lnurlCommand, lnurlDialogConfirm)
+	if err != nil {
+		log.Errorln(err)
+		bot.tryEditMessage(msg, fmt.Sprintf(lnurlPaymentFailed, "payment expired."))
+		return
+	}
+	client, err := getHttpClient()
 	if err != nil {
 		log.Errorln(err)
 		// bot.trySendMessage(c.Sender, err.Error())
-		bot.tryEditMessage(msg, fmt.Sprintf(lnurlPaymentFailed, "database error."))
+		bot.tryEditMessage(msg, fmt.Sprintf(lnurlPaymentFailed, err))
 		return
 	}
-	if user.StateKey == lnbits.UserStateConfirmLNURLPay {
-		client, err := getHttpClient()
-		if err != nil {
-			log.Errorln(err)
-			// bot.trySendMessage(c.Sender, err.Error())
-			bot.tryEditMessage(msg, fmt.Sprintf(lnurlPaymentFailed, err))
-			return
-		}
-		var stateResponse LnurlStateResponse
-		err = json.Unmarshal([]byte(user.StateData), &stateResponse)
-		if err != nil {
-			log.Errorln(err)
-			// bot.trySendMessage(c.Sender, err.Error())
-			bot.tryEditMessage(msg, fmt.Sprintf(lnurlPaymentFailed, err))
-			return
-		}
-		callbackUrl, err := url.Parse(stateResponse.Callback)
-		if err != nil {
-			log.Errorln(err)
-			// bot.trySendMessage(c.Sender, err.Error())
-			bot.tryEditMessage(msg, fmt.Sprintf(lnurlPaymentFailed, err))
-			return
-		}
-		qs := callbackUrl.Query()
-		qs.Set("amount", strconv.Itoa(stateResponse.Amount*1000))
-		callbackUrl.RawQuery = qs.Encode()
+	var stateResponse LnurlStateResponse
+	err = dialog.Decode(&stateResponse)
+	if err != nil {
+		log.Errorln(err)
+		// bot.trySendMessage(c.Sender, err.Error())
+		bot.tryEditMessage(msg, fmt.Sprintf(lnurlPaymentFailed, err))
+		return
+	}
+	callbackUrl, err := url.Parse(stateResponse.Callback)
+	if err != nil {
+		log.Errorln(err)
+		// bot.trySendMessage(c.Sender, err.Error())
+		bot.tryEditMessage(msg, fmt.Sprintf(lnurlPaymentFailed, err))
+		return
+	}
+	qs := callbackUrl.Query()
+	qs.Set("amount", strconv.Itoa(stateResponse.Amount*1000))
+	callbackUrl.RawQuery = qs.Encode()
 
-		res, err := client.Get(callbackUrl.String())
-		if err != nil {
-			log.Errorln(err)
-			// bot.trySendMessage(c.Sender, err.Error())
-			bot.tryEditMessage(msg, fmt.Sprintf(lnurlPaymentFailed, err))
-			return
-		}
-		var response2 lnurl.LNURLPayResponse2
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			log.Errorln(err)
-			// bot.trySendMessage(c.Sender, err.Error())
-			bot.tryEditMessage(msg, fmt.Sprintf(lnurlPaymentFailed, err))
-			return
-		}
-		json.Unmarshal(body, &response2)
+	res, err := client.Get(callbackUrl.String())
+	if err != nil {
+		log.Errorln(err)
+		// bot.trySendMessage(c.Sender, err.Error())
+		bot.tryEditMessage(msg, fmt.Sprintf(lnurlPaymentFailed, err))
+		return
+	}
+	var response2 lnurl.LNURLPayResponse2
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		log.Errorln(err)
+		// bot.trySendMessage(c.Sender, err.Error())
+		bot.tryEditMessage(msg, fmt.Sprintf(lnurlPaymentFailed, err))
+		return
+	}
+	json.Unmarshal(body, &response2)
 
-		if len(response2.PR) < 1 {
-			bot.tryEditMessage(msg, fmt.Sprintf(lnurlPaymentFailed, "could not receive invoice (wrong address?)."))
-			return
-		}
-		bot.telegram.Delete(msg)
-		c.Text = fmt.Sprintf("/pay %s", response2.PR)
-		bot.confirmPaymentHandler(c)
+	if len(response2.PR) < 1 {
+		bot.tryEditMessage(msg, fmt.Sprintf(lnurlPaymentFailed, "could not receive invoice (wrong address?)."))
+		return
 	}
+	bot.telegram.Delete(msg)
+	c.Text = fmt.Sprintf("/pay %s", response2.PR)
+	bot.requireWallet(bot.confirmPaymentHandler)(&Context{Message: c})
 }
 
 func getHttpClient() (*http.Client, error) {
 	client := http.Client{}
-	if Configuration.Bot.HttpProxy != "" {
-		proxyUrl, err := url.Parse(Configuration.Bot.HttpProxy)
+	if proxy := currentConfiguration().Bot.HttpProxy; proxy != "" {
+		proxyUrl, err := url.Parse(proxy)
 		if err != nil {
 			log.Errorln(err)
 			return nil, err
@@ -388,6 +373,6 @@ func (bot *TipBot) sendToLightningAddress(m *tb.Message, address string, amount
 	} else {
 		m.Text = fmt.Sprintf("/lnurl %s", lnurl)
 	}
-	bot.lnurlHandler(m)
+	bot.requireWallet(bot.lnurlHandler)(&Context{Message: m})
 	return nil
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"strconv"
+	"strings"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	"github.com/LightningTipBot/LightningTipBot/internal/lnurl"
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const (
+	lnurlSettingsMessage = "⚙️ *LNURL settings*\n\n" +
+		"Minimum: %s\n" +
+		"Maximum: %s\n" +
+		"Description: %s\n" +
+		"Avatar: %s"
+	lnurlSettingsDefault         = "default"
+	lnurlSettingsUpdatedMessage  = "✅ LNURL settings updated."
+	lnurlSettingsNoAvatarMessage = "🚫 Could not find a profile photo. Set a profile photo in Telegram and try again."
+	lnurlSettingsAvatarMessage   = "🚫 Could not load your profile photo."
+	lnurlSettingsMinMaxMessage   = "🚫 The minimum can't be larger than the maximum."
+	lnurlSettingsHelpText        = "📖 Oops, that didn't work. %s\n\n" +
+		"*Usage:* `/lnurl <min|max> <amount>`, `/lnurl description [<text>]`, `/lnurl avatar [remove]`\n" +
+		"*Example:* `/lnurl min 100`"
+	lnurlSettingsAvatarSize      = 128 // px
+	lnurlSettingsDescriptionSize = 159
+)
+
+// lnurlSettingsCommands are the /lnurl arguments that change the LNURL settings of the user
+var lnurlSettingsCommands = []string{"settings", "min", "max", "description", "avatar"}
+
+// isLnurlSettingsCommand checks whether a /lnurl command is meant to change the settings
+func isLnurlSettingsCommand(text string) bool {
+	argument, err := getArgumentFromCommand(text, 1)
+	if err != nil {
+		return false
+	}
+	for _, command := range lnurlSettingsCommands {
+		if strings.ToLower(argument) == command {
+			return true
+		}
+	}
+	return false
+}
+
+func helpLnurlSettingsUsage(errormsg string) string {
+	return fmt.Sprintf(lnurlSettingsHelpText, errormsg)
+}
+
+// lnurlSettingsHandler is invoked on /lnurl <min|max|description|avatar|settings> commands
+func (bot TipBot) lnurlSettingsHandler(ctx *Context) {
+	m := ctx.Message
+	user := ctx.User
+	command, _ := getArgumentFromCommand(m.Text, 1)
+	argument, _ := getArgumentFromCommand(m.Text, 2)
+	switch strings.ToLower(command) {
+	case "settings":
+		bot.trySendMessage(m.Sender, lnurlSettingsString(user.LNURL))
+		return
+	case "min", "max":
+		amount, err := strconv.Atoi(argument)
+		if err != nil || amount < 0 {
+			bot.trySendMessage(m.Sender, helpLnurlSettingsUsage(lnurlInvalidAmountMessage))
+			return
+		}
+		// 0 resets the limit to the default of the server
+		min, max := lnurl.ReceivableBounds()
+		if amount > 0 && (int64(amount) < min || int64(amount) > max) {
+			bot.trySendMessage(m.Sender, helpLnurlSettingsUsage(fmt.Sprintf(lnurlInvalidAmountRangeMessage, min, max)))
+			return
+		}
+		settings := user.LNURL
+		if strings.ToLower(command) == "min" {
+			settings.MinReceivable = int64(amount)
+		} else {
+			settings.MaxReceivable = int64(amount)
+		}
+		if settings.MinReceivable > 0 && settings.MaxReceivable > 0 && settings.MinReceivable > settings.MaxReceivable {
+			bot.trySendMessage(m.Sender, lnurlSettingsMinMaxMessage)
+			return
+		}
+		user.LNURL = settings
+	case "description":
+		user.LNURL.Description = truncateRunes(GetMemoFromCommand(m.Text, 2), lnurlSettingsDescriptionSize)
+	case "avatar":
+		if strings.ToLower(argument) == "remove" {
+			user.LNURL.Avatar = ""
+			break
+		}
+		avatar, err := bot.getProfilePhotoAvatar(m.Sender)
+		if err != nil {
+			log.Errorf("[lnurlSettingsHandler] Could not get avatar of %s: %s", GetUserStr(m.Sender), err)
+			if err == errNoProfilePhoto {
+				bot.trySendMessage(m.Sender, lnurlSettingsNoAvatarMessage)
+			} else {
+				bot.trySendMessage(m.Sender, lnurlSettingsAvatarMessage)
+			}
+			return
+		}
+		user.LNURL.Avatar = avatar
+	}
+	err := UpdateUserRecord(user, bot)
+	if err != nil {
+		log.Errorf("[lnurlSettingsHandler] Error: %s", err)
+		bot.trySendMessage(m.Sender, errorTryLaterMessage)
+		return
+	}
+	log.Infof("[lnurlSettingsHandler] %s updated LNURL settings: %s", GetUserStr(m.Sender), command)
+	bot.trySendMessage(m.Sender, lnurlSettingsUpdatedMessage)
+	bot.trySendMessage(m.Sender, lnurlSettingsString(user.LNURL))
+}
+
+// lnurlSettingsString returns a human readable representation of the LNURL settings
+func lnurlSettingsString(settings lnbits.LNURLSettings) string {
+	min, max, description, avatar := lnurlSettingsDefault, lnurlSettingsDefault, lnurlSettingsDefault, "none"
+	if settings.MinReceivable > 0 {
+		min = fmt.Sprintf("%d sat", settings.MinReceivable)
+	}
+	if settings.MaxReceivable > 0 {
+		max = fmt.Sprintf("%d sat", settings.MaxReceivable)
+	}
+	if len(settings.Description) > 0 {
+		description = MarkdownEscape(settings.Description)
+	}
+	if len(settings.Avatar) > 0 {
+		avatar = "profile photo"
+	}
+	return fmt.Sprintf(lnurlSettingsMessage, min, max, description, avatar)
+}
+
+var errNoProfilePhoto = fmt.Errorf("user has no profile photo")
+
+// getProfilePhotoAvatar returns the current Telegram profile photo of the user
+// as a base64 encoded png that fits into the LNURL metadata
+func (bot TipBot) getProfilePhotoAvatar(user *tb.User) (string, error) {
+	photos, err := bot.telegram.ProfilePhotosOf(user)
+	if err != nil {
+		return "", err
+	}
+	if len(photos) == 0 {
+		return "", errNoProfilePhoto
+	}
+	reader, err := bot.telegram.GetFile(photos[0].MediaFile())
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	img, err := jpeg.Decode(reader)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = png.Encode(&buf, resizeImage(img, lnurlSettingsAvatarSize))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// resizeImage scales an image to a square of size x size pixels (nearest neighbour)
+func resizeImage(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	resized := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			srcX := bounds.Min.X + x*bounds.Dx()/size
+			srcY := bounds.Min.Y + y*bounds.Dy()/size
+			resized.Set(x, y, img.At(srcX, srcY))
+		}
+	}
+	return resized
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
-	log "github.com/sirupsen/logrus"
+	"fmt"
+	"os"
 	"runtime/debug"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // setLogger will initialize the log format
@@ -17,9 +20,47 @@ func setLogger() {
 func main() {
 	// set logger
 	setLogger()
+	if path := os.Getenv("LIGHTNINGTIPBOT_CONFIG"); len(path) > 0 {
+		configurationFile = path
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		err := configCommand(os.Args[2:])
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	err := loadConfiguration(configurationFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(os.Args) > 1 {
+		err = runCommand(os.Args[1], os.Args[2:])
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
 	defer withRecovery()
-	bot := NewBot()
-	bot.Start()
+	bot, err := NewBot()
+	if err != nil {
+		log.Fatalf("Could not start the bot: %s", err)
+	}
+	err = bot.Start()
+	if err != nil {
+		log.Fatalf("Could not start the bot: %s", err)
+	}
+}
+
+// runCommand runs a subcommand instead of the bot
+func runCommand(command string, args []string) error {
+	switch command {
+	case "migrate":
+		return migrateCommand(args)
+	case "copy-storage":
+		return copyStorageCommand(args)
+	}
+	return fmt.Errorf("unknown command %s, use migrate, copy-storage or config", command)
 }
 
 func withRecovery() {
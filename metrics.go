@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/metrics"
+	"github.com/LightningTipBot/LightningTipBot/internal/recovery"
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// endpointName returns the name of a telebot endpoint in metrics, e.g. /tip, text or confirm_pay
+func endpointName(endpoint string) string {
+	return strings.TrimLeft(endpoint, "\a\f")
+}
+
+// measured wraps a telebot handler so that the handled updates and their duration are counted per endpoint
+func (bot TipBot) measured(endpoint string, handler interface{}) interface{} {
+	name := endpointName(endpoint)
+	switch h := handler.(type) {
+	case func(*tb.Message):
+		return func(m *tb.Message) {
+			defer observeCommand(name, time.Now())
+			h(m)
+		}
+	case func(*tb.Callback):
+		return func(c *tb.Callback) {
+			defer observeCommand(name, time.Now())
+			h(c)
+		}
+	case func(*tb.Query):
+		return func(q *tb.Query) {
+			defer observeCommand(name, time.Now())
+			h(q)
+		}
+	case func(*tb.ChosenInlineResult):
+		return func(r *tb.ChosenInlineResult) {
+			defer observeCommand(name, time.Now())
+			h(r)
+		}
+	}
+	panic(fmt.Sprintf("measured: unsupported handler %T", handler))
+}
+
+func observeCommand(name string, start time.Time) {
+	metrics.Command(name, time.Since(start))
+}
+
+// handleButton registers the handler of an inline button with rate limits, panic recovery, metrics and draining
+func (bot TipBot) handleButton(button tb.CallbackEndpoint, handler func(*tb.Callback)) {
+	bot.telegram.Handle(button, bot.tracked(bot.rateLimited(bot.recovered(bot.measured(button.CallbackUnique(), handler)))))
+}
+
+// registerMetrics registers the metrics that are collected from the bot on every scrape
+func (bot TipBot) registerMetrics() {
+	metrics.MustRegister(
+		metrics.NewLabeledGaugeFunc("store_keys", "Keys in the ephemeral store by prefix.", "prefix", bot.storeKeys),
+		metrics.NewLabeledGaugeFunc("database_size_bytes", "Size of the database files by database.", "database", databaseSizes),
+		metrics.NewCounterFunc("rate_limited_total", "Updates rejected by the rate limits of users and chats.", func() float64 {
+			users, chats := bot.limiter.Rejected()
+			return float64(users + chats)
+		}),
+		metrics.NewCounterFunc("panics_total", "Panics recovered in handlers and HTTP servers.", func() float64 {
+			return float64(recovery.Panics())
+		}),
+	)
+}
+
+// storeKeys returns the number of keys per prefix in the ephemeral store
+func (bot TipBot) storeKeys() (map[string]float64, error) {
+	stats, err := bot.store.Stats()
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]float64, len(stats))
+	for prefix, n := range stats {
+		keys[prefix] = float64(n)
+	}
+	return keys, nil
+}
+
+// databaseSizes returns the sizes of the database files. Postgres databases have no files.
+func databaseSizes() (map[string]float64, error) {
+	files := make(map[string]string)
+	if Configuration.Database.Driver == storage.DriverSQLite || Configuration.Database.Driver == "" {
+		files["users"] = Configuration.Database.DbPath
+		files["transactions"] = Configuration.Database.TransactionsPath
+	}
+	if Configuration.Database.EphemeralStore == ephemeralStoreBunt || Configuration.Database.EphemeralStore == "" {
+		files["bunt"] = Configuration.Database.BuntDbPath
+	}
+	sizes := make(map[string]float64, len(files))
+	for database, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		sizes[database] = float64(info.Size())
+	}
+	return sizes, nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+func Test_endpointName(t *testing.T) {
+	for endpoint, want := range map[string]string{
+		"/tip":                               "/tip",
+		tb.OnText:                            "text",
+		tb.OnChosenInlineResult:              "chosen_inline_result",
+		btnPay.CallbackUnique():              "confirm_pay",
+		btnAcceptInlineSend.CallbackUnique(): "confirm_send_inline",
+	} {
+		if got := endpointName(endpoint); got != want {
+			t.Errorf("endpointName(%q) = %q, want %q", endpoint, got, want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	"github.com/LightningTipBot/LightningTipBot/internal/recovery"
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"gorm.io/gorm"
+)
+
+const (
+	privateChatOnlyMessage = "ℹ️ Please use this command in the private chat with the bot."
+	startInPrivateMessage  = "👋 %s, you don't have a wallet yet. Chat with %s 👈 and enter */start* to create one."
+)
+
+// Context is a message that passes through the middlewares of a handler
+type Context struct {
+	Message *tb.Message
+	// User is the sender of the message, set by loadUser and requireWallet
+	User *lnbits.User
+}
+
+// Handler handles a message after the middlewares
+type Handler func(ctx *Context)
+
+// Middleware runs before a handler and decides whether to call next
+type Middleware func(next Handler) Handler
+
+// chain wraps handler with middlewares, the first middleware runs first
+func chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// handle returns a telebot handler that runs handler after the middlewares.
+// Every message recovers from panics and is logged first.
+func (bot TipBot) handle(handler Handler, middlewares ...Middleware) func(*tb.Message) {
+	handler = chain(handler, append([]Middleware{bot.recoverPanics, bot.logMessage}, middlewares...)...)
+	return func(m *tb.Message) {
+		handler(&Context{Message: m})
+	}
+}
+
+// recoverPanics reports a panic of a handler with the message that caused it and tells the sender,
+// the bot keeps running
+func (bot TipBot) recoverPanics(next Handler) Handler {
+	return func(ctx *Context) {
+		m := ctx.Message
+		defer recovery.Recover(commandName(m), messageFields(bot, m), func() {
+			bot.trySendMessage(m.Sender, errorTryLaterMessage)
+		})
+		next(ctx)
+	}
+}
+
+// logMessage logs every message without secrets
+func (bot TipBot) logMessage(next Handler) Handler {
+	return func(ctx *Context) {
+		m := ctx.Message
+		text := bot.loggableText(m)
+		if m.Photo != nil {
+			text = "<Photo>"
+		}
+		log.Infof("[%s:%d %s:%d] %s", m.Chat.Title, m.Chat.ID, GetUserStr(m.Sender), m.Sender.ID, text)
+		next(ctx)
+	}
+}
+
+// requirePrivate stops commands outside of the private chat with the bot
+// and asks the sender to use the private chat
+func (bot TipBot) requirePrivate(next Handler) Handler {
+	return func(ctx *Context) {
+		if ctx.Message.Chat.Type != tb.ChatPrivate {
+			bot.trySendMessage(ctx.Message.Sender, privateChatOnlyMessage)
+			return
+		}
+		next(ctx)
+	}
+}
+
+// ignoreGroups silently stops messages outside of the private chat with the bot
+func (bot TipBot) ignoreGroups(next Handler) Handler {
+	return func(ctx *Context) {
+		if ctx.Message.Chat.Type != tb.ChatPrivate {
+			return
+		}
+		next(ctx)
+	}
+}
+
+// loadUser loads the sender into ctx.User, it stays nil if the sender has no wallet
+func (bot TipBot) loadUser(next Handler) Handler {
+	return func(ctx *Context) {
+		user, err := GetUser(ctx.Message.Sender, bot)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Errorf("[loadUser] Could not load %s: %s", GetUserStr(ctx.Message.Sender), err)
+			bot.trySendMessage(ctx.Message.Sender, errorTryLaterMessage)
+			return
+		}
+		if err == nil {
+			ctx.User = user
+		}
+		next(ctx)
+	}
+}
+
+// requireWallet loads the sender into ctx.User and stops if they have no wallet yet.
+// In the private chat, the wallet is created. In groups, the sender is asked to start the bot.
+func (bot TipBot) requireWallet(next Handler) Handler {
+	return bot.loadUser(func(ctx *Context) {
+		if ctx.User == nil || !ctx.User.Initialized {
+			if !ctx.Message.Private() {
+				// the message can already be deleted, the hint is no reply
+				bot.trySendMessage(ctx.Message.Chat, fmt.Sprintf(startInPrivateMessage, GetUserStrMd(ctx.Message.Sender), GetUserStrMd(bot.telegram.Me)))
+				return
+			}
+			bot.startHandler(ctx)
+			return
+		}
+		next(ctx)
+	})
+}
+
+// autoDispose deletes messages in groups after duration, the bot replies in the private chat
+func (bot TipBot) autoDispose(duration time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx *Context) {
+			NewMessage(ctx.Message, WithDuration(duration, bot.telegram))
+			next(ctx)
+		}
+	}
+}
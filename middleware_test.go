@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	middleware := func(name string, stop bool) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx *Context) {
+				calls = append(calls, name)
+				if !stop {
+					next(ctx)
+				}
+			}
+		}
+	}
+	handler := func(ctx *Context) {
+		calls = append(calls, "handler")
+	}
+
+	chain(handler, middleware("a", false), middleware("b", false))(&Context{})
+	if len(calls) != 3 || calls[0] != "a" || calls[1] != "b" || calls[2] != "handler" {
+		t.Errorf("calls = %v, want [a b handler]", calls)
+	}
+	calls = nil
+	chain(handler, middleware("a", true), middleware("b", false))(&Context{})
+	if len(calls) != 1 {
+		t.Errorf("calls = %v, want [a]", calls)
+	}
+}
+
+func TestTipBot_loadUser(t *testing.T) {
+	db, txLogger := openFixture(t, "", "")
+	if err := migrateDatabases(db, txLogger); err != nil {
+		t.Fatal(err)
+	}
+	bot := TipBot{users: gormUsers{db: db}}
+	sender := &tb.User{ID: 1, Username: "alice"}
+	if err := bot.users.CreateUser(&lnbits.User{Name: "1", Initialized: true, Telegram: sender, Wallet: &lnbits.Wallet{ID: "w1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var loaded *lnbits.User
+	handler := bot.loadUser(func(ctx *Context) {
+		loaded = ctx.User
+	})
+	handler(&Context{Message: &tb.Message{Sender: sender}})
+	if loaded == nil || loaded.Wallet.ID != "w1" {
+		t.Errorf("loadUser() loaded %+v", loaded)
+	}
+	handler(&Context{Message: &tb.Message{Sender: &tb.User{ID: 2}}})
+	if loaded != nil {
+		t.Errorf("loadUser() of user without wallet loaded %+v", loaded)
+	}
+}
+
+func TestTipBot_ignoreGroups(t *testing.T) {
+	bot := TipBot{}
+	called := false
+	handler := bot.ignoreGroups(func(ctx *Context) {
+		called = true
+	})
+	handler(&Context{Message: &tb.Message{Chat: &tb.Chat{Type: tb.ChatGroup}}})
+	if called {
+		t.Error("handler called in group")
+	}
+	handler(&Context{Message: &tb.Message{Chat: &tb.Chat{Type: tb.ChatPrivate}}})
+	if !called {
+		t.Error("handler not called in private chat")
+	}
+}
+
+func TestScenario_requireWallet(t *testing.T) {
+	s := newScenario(t)
+	carol := &tb.User{ID: 2003, Username: "carol", FirstName: "Carol"}
+
+	s.group(carol, "/balance")
+	s.expectIn(scenarioGroup.ID, "@carol, you don't have a wallet yet")
+	if _, err := s.bot.users.GetUser(carol.ID); err == nil {
+		t.Error("wallet was created in the group")
+	}
+
+	s.private(carol, "/balance")
+	s.expect(carol, startWalletReadyMessage)
+}
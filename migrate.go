@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/migrations"
+	"github.com/LightningTipBot/LightningTipBot/internal/secret"
+)
+
+const migrateUsage = "usage: LightningTipBot migrate status | up | down <users|transactions> [<steps>] | encrypt-keys"
+
+// migrateCommand shows, applies or rolls back the migrations of the databases in config.yaml
+func migrateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf(migrateUsage)
+	}
+	db, txLogger, err := openDatabases(Configuration.Database.Driver, Configuration.Database.DbPath, Configuration.Database.TransactionsPath)
+	if err != nil {
+		return err
+	}
+	migrators := map[string]*migrations.Migrator{
+		"users":        newUserMigrator(db),
+		"transactions": newTransactionMigrator(txLogger),
+	}
+	switch args[0] {
+	case "status":
+		for _, name := range []string{"users", "transactions"} {
+			err = printMigrationStatus(name, migrators[name])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "up":
+		return migrateDatabases(db, txLogger)
+	case "encrypt-keys":
+		// after rotating the master key, this re-encrypts with the new key so the old keys can be removed
+		keyring := secret.DefaultKeyring()
+		if keyring == nil {
+			return fmt.Errorf("configure a master_key to encrypt wallet keys")
+		}
+		n, err := reencryptWalletKeys(db, keyring, false)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("encrypted the wallet keys of %d users\n", n)
+		return nil
+	case "down":
+		if len(args) < 2 || migrators[args[1]] == nil {
+			return fmt.Errorf(migrateUsage)
+		}
+		steps := 1
+		if len(args) > 2 {
+			steps, err = strconv.Atoi(args[2])
+			if err != nil || steps < 1 {
+				return fmt.Errorf(migrateUsage)
+			}
+		}
+		_, err = migrators[args[1]].Down(steps)
+		return err
+	}
+	return fmt.Errorf(migrateUsage)
+}
+
+func printMigrationStatus(name string, migrator *migrations.Migrator) error {
+	version, err := migrator.Version()
+	if err != nil {
+		return err
+	}
+	pending, err := migrator.Pending()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: version %d, %d pending\n", name, version, len(pending))
+	for _, migration := range pending {
+		fmt.Printf("  %d %s\n", migration.Version, migration.Description)
+	}
+	if err := migrator.Check(); err != nil && len(pending) == 0 {
+		fmt.Printf("  %s\n", err)
+	}
+	return nil
+}
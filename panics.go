@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/recovery"
+	"github.com/LightningTipBot/LightningTipBot/internal/runtime"
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// panicAlertInterval is the minimum time between two panic summaries in the admin chat
+const panicAlertInterval = 10 * time.Minute
+
+// commandName returns the command of a message for panic reports, e.g. /tip
+func commandName(m *tb.Message) string {
+	if m.Photo != nil {
+		return "photo"
+	}
+	if !strings.HasPrefix(m.Text, "/") {
+		return "text"
+	}
+	command := strings.Fields(m.Text)[0]
+	return strings.ToLower(strings.SplitN(command, "@", 2)[0])
+}
+
+// messageFields describes a message in panic reports, without secrets
+func messageFields(bot TipBot, m *tb.Message) log.Fields {
+	fields := log.Fields{"message": m.ID}
+	if m.Chat != nil {
+		fields["chat"] = m.Chat.ID
+	}
+	if m.Sender != nil {
+		fields["user"] = GetUserStr(m.Sender)
+		fields["user_id"] = m.Sender.ID
+		fields["text"] = bot.loggableText(m)
+	}
+	return fields
+}
+
+// recovered wraps a telebot handler of callbacks and inline queries so that panics are reported.
+// Messages recover in the middlewares of bot.handle only.
+func (bot TipBot) recovered(handler interface{}) interface{} {
+	switch h := handler.(type) {
+	case func(*tb.Callback):
+		return func(c *tb.Callback) {
+			fields := log.Fields{"data": c.Data}
+			if c.Sender != nil {
+				fields["user"] = GetUserStr(c.Sender)
+				fields["user_id"] = c.Sender.ID
+			}
+			defer recovery.Recover("callback", fields, func() {
+				runtime.IgnoreError(bot.telegram.Respond(c, &tb.CallbackResponse{Text: errorTryLaterMessage}))
+			})
+			h(c)
+		}
+	case func(*tb.Query):
+		return func(q *tb.Query) {
+			defer recovery.Recover("inline query", log.Fields{"user": GetUserStr(&q.From), "user_id": q.From.ID, "query": q.Text}, nil)
+			h(q)
+		}
+	case func(*tb.ChosenInlineResult):
+		return func(r *tb.ChosenInlineResult) {
+			defer recovery.Recover("inline result", log.Fields{"user": GetUserStr(&r.From), "user_id": r.From.ID, "result": r.ResultID}, nil)
+			h(r)
+		}
+	}
+	panic(fmt.Sprintf("recovered: unsupported handler %T", handler))
+}
+
+// startPanicAlerts sends summaries of panics to the admin chat, if one is configured
+func (bot TipBot) startPanicAlerts() {
+	recovery.SetNotifier(bot.alertAdmins, panicAlertInterval)
+}
+
+// alertAdmins sends text to the admin chat, if one is configured
+func (bot TipBot) alertAdmins(text string) {
+	// the admin chat can change when the configuration is reloaded
+	chatID := currentConfiguration().Telegram.AdminChatID
+	if chatID == 0 {
+		return
+	}
+	bot.trySendMessage(&tb.Chat{ID: chatID}, MarkdownEscape(text), tb.NoPreview)
+}
+
+// logPanicStats logs the number of recovered panics
+func logPanicStats() {
+	if panics := recovery.Panics(); panics > 0 {
+		log.Warnf("[Janitor] %d panics recovered since the start", panics)
+	}
+}
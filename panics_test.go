@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/recovery"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+func Test_commandName(t *testing.T) {
+	for text, want := range map[string]string{
+		"/tip 21":                  "/tip",
+		"/Balance@LightningTipBot": "/balance",
+		"lnbc1...":                 "text",
+	} {
+		if got := commandName(&tb.Message{Text: text}); got != want {
+			t.Errorf("commandName(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestTipBot_recovered(t *testing.T) {
+	bot := TipBot{}
+	before := recovery.Panics()
+	handler := bot.recovered(func(q *tb.Query) {
+		var user *tb.User
+		_ = user.ID
+	}).(func(*tb.Query))
+	handler(&tb.Query{Text: "send 21"})
+	if recovery.Panics() != before+1 {
+		t.Error("panic of inline query was not recovered")
+	}
+}
+
+func TestTipBot_handleRecovers(t *testing.T) {
+	s := newScenario(t)
+	alice := s.newUser(2001, "alice", 0)
+	before := recovery.Panics()
+	handler := s.bot.handle(func(ctx *Context) {
+		panic("broken handler")
+	})
+	handler(&tb.Message{Text: "/broken", Sender: alice, Chat: &tb.Chat{ID: int64(alice.ID), Type: tb.ChatPrivate}})
+	if recovery.Panics() != before+1 {
+		t.Errorf("%d panics reported, want 1", recovery.Panics()-before)
+	}
+	s.expect(alice, errorTryLaterMessage)
+}
+
+func TestTipBot_backgroundRecovers(t *testing.T) {
+	tracker := newHandlerTracker()
+	bot := TipBot{inFlight: tracker}
+	before := recovery.Panics()
+	bot.goTracked("test", func() {
+		panic("test")
+	})
+	if running := tracker.drain(time.Second); running != 0 {
+		t.Errorf("drain() = %d running handlers after a panic, want 0", running)
+	}
+	if recovery.Panics() != before+1 {
+		t.Errorf("%d panics recovered, want 1", recovery.Panics()-before)
+	}
+
+	// the tasks of the janitor panic without a store, every task still runs
+	before = recovery.Panics()
+	bot.cleanUp()
+	if recovery.Panics() < before+3 {
+		t.Errorf("%d panics of the janitor recovered, want at least 3", recovery.Panics()-before)
+	}
+}
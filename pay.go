@@ -6,23 +6,21 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
-	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
 	decodepay "github.com/fiatjaf/ln-decodepay"
 	tb "gopkg.in/tucnak/telebot.v2"
 )
 
 const (
-	paymentCancelledMessage            = "🚫 Payment cancelled."
-	invoicePaidMessage                 = "⚡️ Payment sent."
-	invoicePrivateChatOnlyErrorMessage = "You can pay invoices only in the private chat with the bot."
-	invalidInvoiceHelpMessage          = "Did you enter a valid Lightning invoice? Try /send if you want to send to a Telegram user or Lightning address."
-	invoiceNoAmountMessage             = "🚫 Can't pay invoices without an amount."
-	insufficientFundsMessage           = "🚫 Insufficient funds. You have %d sat but you need at least %d sat."
-	feeReserveMessage                  = "⚠️ Sending your entire balance might fail because of network fees. If it fails, try sending a bit less."
-	invoicePaymentFailedMessage        = "🚫 Payment failed: %s"
-	confirmPayInvoiceMessage           = "Do you want to send this payment?\n\n💸 Amount: %d sat"
-	confirmPayAppendMemo               = "\n✉️ %s"
-	payHelpText                        = "📖 Oops, that didn't work. %s\n\n" +
+	paymentCancelledMessage     = "🚫 Payment cancelled."
+	invoicePaidMessage          = "⚡️ Payment sent."
+	invalidInvoiceHelpMessage   = "Did you enter a valid Lightning invoice? Try /send if you want to send to a Telegram user or Lightning address."
+	invoiceNoAmountMessage      = "🚫 Can't pay invoices without an amount."
+	insufficientFundsMessage    = "🚫 Insufficient funds. You have %d sat but you need at least %d sat."
+	feeReserveMessage           = "⚠️ Sending your entire balance might fail because of network fees. If it fails, try sending a bit less."
+	invoicePaymentFailedMessage = "🚫 Payment failed: %s"
+	confirmPayInvoiceMessage    = "Do you want to send this payment?\n\n💸 Amount: %d sat"
+	confirmPayAppendMemo        = "\n✉️ %s"
+	payHelpText                 = "📖 Oops, that didn't work. %s\n\n" +
 		"*Usage:* `/pay <invoice>`\n" +
 		"*Example:* `/pay lnbc20n1psscehd...`"
 )
@@ -35,28 +33,28 @@ func helpPayInvoiceUsage(errormsg string) string {
 	}
 }
 
+const (
+	payCommand                        = "pay"
+	payDialogConfirm      DialogState = "confirm"
+	payDialogSecondFactor DialogState = "second_factor"
+)
+
+// payDialogData is the invoice that waits for the confirmation of the user
+type payDialogData struct {
+	Invoice      string       `json:"invoice"`
+	Amount       int          `json:"amount"`
+	Memo         string       `json:"memo,omitempty"`
+	SecondFactor secondFactor `json:"second_factor"`
+}
+
 // confirmPaymentHandler invoked on "/pay lnbc..." command
-func (bot TipBot) confirmPaymentHandler(m *tb.Message) {
-	// check and print all commands
-	bot.anyTextHandler(m)
-	if m.Chat.Type != tb.ChatPrivate {
-		// delete message
-		NewMessage(m, WithDuration(0, bot.telegram))
-		bot.trySendMessage(m.Sender, helpPayInvoiceUsage(invoicePrivateChatOnlyErrorMessage))
-		return
-	}
+func (bot TipBot) confirmPaymentHandler(ctx *Context) {
+	m := ctx.Message
 	if len(strings.Split(m.Text, " ")) < 2 {
 		NewMessage(m, WithDuration(0, bot.telegram))
 		bot.trySendMessage(m.Sender, helpPayInvoiceUsage(""))
 		return
 	}
-	user, err := GetUser(m.Sender, bot)
-	if err != nil {
-		NewMessage(m, WithDuration(0, bot.telegram))
-		errmsg := fmt.Sprintf("[/pay] Error: Could not GetUser: %s", err)
-		log.Errorln(errmsg)
-		return
-	}
 	userStr := GetUserStr(m.Sender)
 	paymentRequest, err := getArgumentFromCommand(m.Text, 1)
 	if err != nil {
@@ -107,7 +105,20 @@ func (bot TipBot) confirmPaymentHandler(m *tb.Message) {
 
 	log.Printf("[/pay] User: %s, amount: %d sat.", userStr, amount)
 
-	SetUserState(user, bot, lnbits.UserStateConfirmPayment, paymentRequest)
+	// check the limits before the user confirms, they are checked again when paying
+	err = bot.checkSpending(ctx.User, amount, true)
+	if err != nil {
+		bot.trySendMessage(m.Sender, fmt.Sprintf(invoicePaymentFailedMessage, err))
+		log.Infof("[/pay] %s: %s", userStr, err)
+		return
+	}
+
+	_, err = bot.startDialog(m.Sender, payCommand, payDialogConfirm, payDialogData{Invoice: paymentRequest, Amount: amount, Memo: bolt11.Description})
+	if err != nil {
+		log.Errorf("[/pay] Could not start dialog: %s", err)
+		bot.trySendMessage(m.Sender, errorTryLaterMessage)
+		return
+	}
 
 	// // // create inline buttons
 	paymentConfirmationMenu.Inline(paymentConfirmationMenu.Row(btnPay, btnCancelPay))
@@ -120,12 +131,11 @@ func (bot TipBot) confirmPaymentHandler(m *tb.Message) {
 
 // cancelPaymentHandler invoked when user clicked cancel on payment confirmation
 func (bot TipBot) cancelPaymentHandler(c *tb.Callback) {
-	// reset state immediately
-	user, err := GetUser(c.Sender, bot)
-	if err != nil {
-		return
+	// end the dialog immediately
+	dialog, err := bot.getDialog(c.Sender, payCommand)
+	if err == nil {
+		bot.endDialog(dialog)
 	}
-	ResetUserState(user, bot)
 
 	bot.tryDeleteMessage(c.Message)
 	_, err = bot.telegram.Send(c.Sender, paymentCancelledMessage)
@@ -144,24 +154,67 @@ func (bot TipBot) payHandler(c *tb.Callback) {
 		log.Printf("[GetUser] User: %d: %s", c.Sender.ID, err.Error())
 		return
 	}
-	if user.StateKey == lnbits.UserStateConfirmPayment {
-		invoiceString := user.StateData
-
-		// reset state immediatelly
-		ResetUserState(user, bot)
-
-		userStr := GetUserStr(c.Sender)
-		// pay invoice
-		invoice, err := user.Wallet.Pay(lnbits.PaymentParams{Out: true, Bolt11: invoiceString}, *user.Wallet)
+	// the dialog ends here unless a second factor is needed
+	dialog, err := bot.takeDialog(c.Sender, payCommand, payDialogConfirm)
+	if err != nil {
+		bot.trySendMessage(c.Sender, dialogExpiredMessage)
+		return
+	}
+	var data payDialogData
+	err = dialog.Decode(&data)
+	if err != nil {
+		log.Errorf("[/pay] Could not decode dialog: %s", err)
+		return
+	}
+	if data.Amount < 1 {
+		// dialogs of older versions don't have the amount
+		bot.trySendMessage(c.Sender, dialogExpiredMessage)
+		return
+	}
+	if needsSecondFactor(user, data.Amount) {
+		data.SecondFactor, err = bot.askSecondFactor(user, c.Sender, data.Amount)
+		if err == nil {
+			err = bot.continueDialog(dialog, payDialogSecondFactor, data)
+		}
 		if err != nil {
-			errmsg := fmt.Sprintf("[/pay] Could not pay invoice of user %s: %s", userStr, err)
-			bot.trySendMessage(c.Sender, fmt.Sprintf(invoicePaymentFailedMessage, err))
-			log.Errorln(errmsg)
-			return
+			log.Errorf("[/pay] Could not ask for confirmation: %s", err)
+			bot.trySendMessage(c.Sender, errorTryLaterMessage)
 		}
-		bot.trySendMessage(c.Sender, invoicePaidMessage)
-		log.Printf("[/pay] User %s paid invoice %s", userStr, invoice.PaymentHash)
 		return
 	}
+	bot.pay(c.Sender, data, false)
+}
 
+// paySecondFactorStep handles the PIN or code that the user entered to confirm a payment
+func (bot TipBot) paySecondFactorStep(m *tb.Message, dialog *Dialog) {
+	var data payDialogData
+	err := dialog.Decode(&data)
+	if err != nil {
+		bot.endDialog(dialog)
+		log.Errorf("[/pay] Could not decode dialog: %s", err)
+		return
+	}
+	user, err := GetUser(m.Sender, bot)
+	if err != nil {
+		log.Errorf("[/pay] Error: %s", err)
+		return
+	}
+	if bot.secondFactorStep(m, dialog, user, &data.SecondFactor, &data) {
+		bot.pay(m.Sender, data, true)
+	}
+}
+
+// pay pays the invoice of a /pay dialog
+func (bot TipBot) pay(from *tb.User, data payDialogData, confirmed bool) {
+	userStr := GetUserStr(from)
+	// pay invoice
+	invoice, err := bot.payInvoice(from, data.Invoice, data.Amount, data.Memo, "pay", confirmed)
+	if err != nil {
+		errmsg := fmt.Sprintf("[/pay] Could not pay invoice of user %s: %s", userStr, err)
+		bot.trySendMessage(from, fmt.Sprintf(invoicePaymentFailedMessage, err))
+		log.Errorln(errmsg)
+		return
+	}
+	bot.trySendMessage(from, invoicePaidMessage)
+	log.Printf("[/pay] User %s paid invoice %s", userStr, invoice.PaymentHash)
 }
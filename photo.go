@@ -10,7 +10,6 @@ import (
 	"github.com/makiuchi-d/gozxing"
 	"github.com/makiuchi-d/gozxing/qrcode"
 	log "github.com/sirupsen/logrus"
-	tb "gopkg.in/tucnak/telebot.v2"
 )
 
 var (
@@ -38,14 +37,11 @@ func TryRecognizeQrCode(img image.Image) (*gozxing.Result, error) {
 }
 
 // privatePhotoHandler is the handler function for every photo from a private chat that the bot receives
-func (bot TipBot) privatePhotoHandler(m *tb.Message) {
-	if m.Chat.Type != tb.ChatPrivate {
-		return
-	}
+func (bot TipBot) privatePhotoHandler(ctx *Context) {
+	m := ctx.Message
 	if m.Photo == nil {
 		return
 	}
-	log.Infof("[%s:%d %s:%d] %s", m.Chat.Title, m.Chat.ID, GetUserStr(m.Sender), m.Sender.ID, "<Photo>")
 	// get file reader closer from telegram api
 	reader, err := bot.telegram.GetFile(m.Photo.MediaFile())
 	if err != nil {
@@ -69,11 +65,11 @@ func (bot TipBot) privatePhotoHandler(m *tb.Message) {
 	// invoke payment handler
 	if lightning.IsInvoice(data.String()) {
 		m.Text = fmt.Sprintf("/pay %s", data.String())
-		bot.confirmPaymentHandler(m)
+		bot.confirmPaymentHandler(ctx)
 		return
 	} else if lightning.IsLnurl(data.String()) {
 		m.Text = fmt.Sprintf("/lnurl %s", data.String())
-		bot.lnurlHandler(m)
+		bot.lnurlHandler(ctx)
 		return
 	}
 }
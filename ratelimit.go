@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/ratelimit"
+	"github.com/LightningTipBot/LightningTipBot/internal/runtime"
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const (
+	rateLimitMessage = "⏳ Slow down please. Try again in %d seconds."
+	// rateLimitNoticesPerMinute limits the cooldown replies, so that they don't become spam themselves
+	rateLimitNoticesPerMinute = 1
+)
+
+// rateLimiter limits the updates that users and group chats send to the bot. Inline queries
+// have their own limit, Telegram sends them while the user types.
+type rateLimiter struct {
+	users   *ratelimit.Limiter
+	queries *ratelimit.Limiter
+	chats   *ratelimit.Limiter
+	notices *ratelimit.Limiter
+}
+
+func newRateLimiter(config RateLimitConfiguration) *rateLimiter {
+	return &rateLimiter{
+		users:   ratelimit.New(config.UserPerMinute, config.UserBurst),
+		queries: ratelimit.New(config.QueryPerMinute, config.QueryBurst),
+		chats:   ratelimit.New(config.ChatPerMinute, config.ChatBurst),
+		notices: ratelimit.New(rateLimitNoticesPerMinute, 1),
+	}
+}
+
+// configure changes the limits of users, queries and chats, e.g. after the configuration was reloaded
+func (r *rateLimiter) configure(config RateLimitConfiguration) {
+	if r == nil {
+		return
+	}
+	r.users.SetLimit(config.UserPerMinute, config.UserBurst)
+	r.queries.SetLimit(config.QueryPerMinute, config.QueryBurst)
+	r.chats.SetLimit(config.ChatPerMinute, config.ChatBurst)
+}
+
+// allow takes a token of the user and of the chat. chat is nil for updates without chat,
+// private chats are only limited per user.
+func (r *rateLimiter) allow(user *tb.User, chat *tb.Chat) (bool, time.Duration) {
+	if r == nil || user == nil {
+		return true, 0
+	}
+	if ok, wait := r.users.Allow(strconv.Itoa(user.ID)); !ok {
+		return false, wait
+	}
+	if chat != nil && chat.Type != tb.ChatPrivate {
+		return r.chats.Allow(strconv.FormatInt(chat.ID, 10))
+	}
+	return true, 0
+}
+
+// allowQuery takes a token of the inline queries of the user
+func (r *rateLimiter) allowQuery(user *tb.User) bool {
+	if r == nil {
+		return true
+	}
+	ok, _ := r.queries.Allow(strconv.Itoa(user.ID))
+	return ok
+}
+
+// shouldNotify reports whether the user gets a cooldown reply
+func (r *rateLimiter) shouldNotify(user *tb.User) bool {
+	ok, _ := r.notices.Allow(strconv.Itoa(user.ID))
+	return ok
+}
+
+// Rejected returns the number of updates that were rejected by the limits of users, including
+// their inline queries, and of chats
+func (r *rateLimiter) Rejected() (users uint64, chats uint64) {
+	if r == nil {
+		return 0, 0
+	}
+	return r.users.Rejected() + r.queries.Rejected(), r.chats.Rejected()
+}
+
+// rateLimited wraps a telebot handler so that it only runs within the rate limits
+func (bot TipBot) rateLimited(handler interface{}) interface{} {
+	switch h := handler.(type) {
+	case func(*tb.Message):
+		return func(m *tb.Message) {
+			// text in groups is only logged, only commands count towards the limit of the chat
+			if m.Chat.Type != tb.ChatPrivate && !strings.HasPrefix(m.Text, "/") {
+				h(m)
+				return
+			}
+			ok, wait := bot.limiter.allow(m.Sender, m.Chat)
+			if ok {
+				h(m)
+				return
+			}
+			log.Debugf("[rateLimit] Rejected message of %s in %d", GetUserStr(m.Sender), m.Chat.ID)
+			if m.Chat.Type != tb.ChatPrivate {
+				// delete message
+				NewMessage(m, WithDuration(0, bot.telegram))
+			}
+			if bot.limiter.shouldNotify(m.Sender) {
+				bot.trySendMessage(m.Sender, fmt.Sprintf(rateLimitMessage, cooldownSeconds(wait)))
+			}
+		}
+	case func(*tb.Callback):
+		return func(c *tb.Callback) {
+			var chat *tb.Chat
+			if c.Message != nil {
+				chat = c.Message.Chat
+			}
+			ok, wait := bot.limiter.allow(c.Sender, chat)
+			if ok {
+				h(c)
+				return
+			}
+			log.Debugf("[rateLimit] Rejected callback of %s", GetUserStr(c.Sender))
+			runtime.IgnoreError(bot.telegram.Respond(c, &tb.CallbackResponse{Text: fmt.Sprintf(rateLimitMessage, cooldownSeconds(wait))}))
+		}
+	case func(*tb.Query):
+		return func(q *tb.Query) {
+			// inline queries are sent while typing, rejected queries just get no results
+			if bot.limiter.allowQuery(&q.From) {
+				h(q)
+			}
+		}
+	case func(*tb.ChosenInlineResult):
+		// results were chosen from queries that were already limited
+		return h
+	}
+	panic(fmt.Sprintf("rateLimited: unsupported handler %T", handler))
+}
+
+func cooldownSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+// logRateLimitStats logs the number of updates that were rejected by the rate limits
+func (bot TipBot) logRateLimitStats() {
+	users, chats := bot.limiter.Rejected()
+	if users > 0 || chats > 0 {
+		log.Infof("[Janitor] Rate limits rejected %d updates of users and %d of chats", users, chats)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+func TestRateLimiter_allow(t *testing.T) {
+	limiter := newRateLimiter(RateLimitConfiguration{UserPerMinute: 1, UserBurst: 5, ChatPerMinute: 1, ChatBurst: 2})
+	group := &tb.Chat{ID: -1, Type: tb.ChatGroup}
+	for i, user := range []*tb.User{{ID: 1}, {ID: 2}} {
+		if ok, _ := limiter.allow(user, group); !ok {
+			t.Fatalf("command %d in group rejected", i)
+		}
+	}
+	if ok, _ := limiter.allow(&tb.User{ID: 3}, group); ok {
+		t.Error("limit of the group not applied")
+	}
+	// private chats are only limited per user
+	for i := 0; i < 4; i++ {
+		if ok, _ := limiter.allow(&tb.User{ID: 1}, &tb.Chat{ID: 1, Type: tb.ChatPrivate}); !ok {
+			t.Fatalf("private command %d rejected", i)
+		}
+	}
+	if ok, _ := limiter.allow(&tb.User{ID: 1}, nil); ok {
+		t.Error("limit of the user not applied")
+	}
+	if users, chats := limiter.Rejected(); users != 1 || chats != 1 {
+		t.Errorf("Rejected() = %d, %d, want 1, 1", users, chats)
+	}
+}
+
+func TestRateLimiter_queries(t *testing.T) {
+	limiter := newRateLimiter(RateLimitConfiguration{UserPerMinute: 1, UserBurst: 1, QueryPerMinute: 1, QueryBurst: 3})
+	user := &tb.User{ID: 1}
+	for i := 0; i < 3; i++ {
+		if !limiter.allowQuery(user) {
+			t.Fatalf("query %d rejected", i)
+		}
+	}
+	if limiter.allowQuery(user) {
+		t.Error("limit of the queries not applied")
+	}
+	// typing an inline query doesn't use up the button presses and commands of the user
+	if ok, _ := limiter.allow(user, nil); !ok {
+		t.Error("button press after inline queries rejected")
+	}
+	if users, _ := limiter.Rejected(); users != 1 {
+		t.Errorf("Rejected() = %d rejected updates of users, want 1", users)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	"gorm.io/gorm"
+)
+
+// errWalletReplaced is returned if the wallet of a user was replaced in the meantime
+var errWalletReplaced = errors.New("wallet was replaced in the meantime")
+
+// UserRepository stores the wallets of telegram users.
+// Users that don't exist are reported with gorm.ErrRecordNotFound.
+type UserRepository interface {
+	GetUser(telegramID int) (*lnbits.User, error)
+	GetUserByUsername(username string) (*lnbits.User, error)
+	// CreateUser saves a new user with their wallet
+	CreateUser(user *lnbits.User) error
+	// SaveUser saves an existing user without their wallet, spending settings and freeze. They are
+	// saved with ReplaceWallet, SaveBalance, SaveLimits, SavePin and SetFrozen.
+	SaveUser(user *lnbits.User) error
+	// SaveTelegram saves only the telegram details of the user
+	SaveTelegram(user *lnbits.User) error
+	// SaveBalance saves only the balance of the wallet of the user if the wallet was not replaced
+	SaveBalance(user *lnbits.User) error
+	// SaveLimits saves only the spending limits of the user
+	SaveLimits(user *lnbits.User) error
+	// SavePin saves only the PIN hash of the user
+	SavePin(user *lnbits.User) error
+	// ReplaceWallet saves only the wallet of the user if their wallet is still oldWalletID.
+	// It returns errWalletReplaced otherwise.
+	ReplaceWallet(user *lnbits.User, oldWalletID string) error
+	// AllUsers returns the users with a wallet, e.g. for statistics and broadcasts
+	AllUsers() ([]*lnbits.User, error)
+	// SetFrozen saves whether the user is frozen and adds the change to the history of freezes
+	SetFrozen(user *lnbits.User, change *AccountFreeze) error
+}
+
+// TransactionRepository logs the transactions between users
+type TransactionRepository interface {
+	SaveTransaction(t *Transaction) error
+	// SpentSince returns the sum of the successful payments of a user since a time
+	SpentSince(telegramID int, since time.Time) (int, error)
+	// PaidSince reports whether a successful payment between two users was logged since a time
+	PaidSince(fromID int, toID int, amount int, transactionType string, since time.Time) (bool, error)
+	// VolumeSince returns the number and the sum of the successful payments of all users since a time
+	VolumeSince(since time.Time) (count int, amount int, err error)
+}
+
+// gormUsers is a UserRepository in a SQL database
+type gormUsers struct {
+	db *gorm.DB
+}
+
+func (r gormUsers) GetUser(telegramID int) (*lnbits.User, error) {
+	user := &lnbits.User{Name: strconv.Itoa(telegramID)}
+	tx := r.db.First(user)
+	return user, tx.Error
+}
+
+func (r gormUsers) GetUserByUsername(username string) (*lnbits.User, error) {
+	user := &lnbits.User{}
+	tx := r.db.Where("telegram_username = ?", strings.ToLower(username)).First(user)
+	return user, tx.Error
+}
+
+func (r gormUsers) CreateUser(user *lnbits.User) error {
+	return r.db.Create(user).Error
+}
+
+func (r gormUsers) SaveUser(user *lnbits.User) error {
+	wallet, err := r.embeddedColumns("wallet_")
+	if err != nil {
+		return err
+	}
+	spending, err := r.embeddedColumns("spending_")
+	if err != nil {
+		return err
+	}
+	omit := append(append([]string{"Frozen", "FrozenReason", "FrozenAt"}, wallet...), spending...)
+	return r.db.Model(user).Select("*").Omit(omit...).Updates(user).Error
+}
+
+func (r gormUsers) SaveBalance(user *lnbits.User) error {
+	return r.db.Model(user).Where("wallet_id = ?", user.Wallet.ID).Update("wallet_balance", user.Wallet.Balance).Error
+}
+
+func (r gormUsers) SaveLimits(user *lnbits.User) error {
+	return r.db.Model(user).
+		Select("spending_max_payment", "spending_daily_limit", "spending_confirm_above").Updates(user).Error
+}
+
+func (r gormUsers) SavePin(user *lnbits.User) error {
+	return r.db.Model(user).Update("spending_pin_hash", user.Spending.PinHash).Error
+}
+
+func (r gormUsers) SaveTelegram(user *lnbits.User) error {
+	columns, err := r.embeddedColumns("telegram_")
+	if err != nil {
+		return err
+	}
+	return r.db.Model(user).Select(columns).Updates(user).Error
+}
+
+func (r gormUsers) ReplaceWallet(user *lnbits.User, oldWalletID string) error {
+	columns, err := r.embeddedColumns("wallet_")
+	if err != nil {
+		return err
+	}
+	tx := r.db.Model(user).Where("wallet_id = ?", oldWalletID).Select(columns).Updates(user)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return errWalletReplaced
+	}
+	return nil
+}
+
+// embeddedColumns returns the columns of the struct that is embedded in lnbits.User with prefix
+func (r gormUsers) embeddedColumns(prefix string) ([]string, error) {
+	stmt := &gorm.Statement{DB: r.db}
+	err := stmt.Parse(&lnbits.User{})
+	if err != nil {
+		return nil, err
+	}
+	var columns []string
+	for _, field := range stmt.Schema.Fields {
+		if strings.HasPrefix(field.DBName, prefix) {
+			columns = append(columns, field.DBName)
+		}
+	}
+	return columns, nil
+}
+
+func (r gormUsers) AllUsers() ([]*lnbits.User, error) {
+	var users []*lnbits.User
+	tx := r.db.Where("wallet_id <> ?", "").Order("name").Find(&users)
+	return users, tx.Error
+}
+
+func (r gormUsers) SetFrozen(user *lnbits.User, change *AccountFreeze) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(user).Select("Frozen", "FrozenReason", "FrozenAt").Updates(user).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(change).Error
+	})
+}
+
+// gormTransactions is a TransactionRepository in a SQL database
+type gormTransactions struct {
+	db *gorm.DB
+}
+
+func (r gormTransactions) SaveTransaction(t *Transaction) error {
+	return r.db.Save(t).Error
+}
+
+func (r gormTransactions) SpentSince(telegramID int, since time.Time) (int, error) {
+	var spent int
+	tx := r.db.Model(&Transaction{}).
+		Where("from_id = ? AND success = ? AND time >= ?", telegramID, true, since).
+		Select("COALESCE(SUM(amount), 0)").Scan(&spent)
+	return spent, tx.Error
+}
+
+func (r gormTransactions) PaidSince(fromID int, toID int, amount int, transactionType string, since time.Time) (bool, error) {
+	var n int64
+	tx := r.db.Model(&Transaction{}).
+		Where("from_id = ? AND to_id = ? AND amount = ? AND type = ? AND success = ? AND time >= ?", fromID, toID, amount, transactionType, true, since).
+		Count(&n)
+	return n > 0, tx.Error
+}
+
+func (r gormTransactions) VolumeSince(since time.Time) (int, int, error) {
+	var volume struct {
+		Count  int
+		Amount int
+	}
+	tx := r.db.Model(&Transaction{}).
+		Where("success = ? AND time >= ?", true, since).
+		Select("COUNT(*) AS count, COALESCE(SUM(amount), 0) AS amount").Scan(&volume)
+	return volume.Count, volume.Amount, tx.Error
+}
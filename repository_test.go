@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+func TestGormUsers_concurrentChanges(t *testing.T) {
+	s := newScenario(t)
+	alice := s.newUser(2001, "alice", 0)
+	users := s.bot.users
+	get := func() *lnbits.User {
+		t.Helper()
+		user, err := users.GetUser(alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+
+	// a user that was read before the freeze, the PIN and the limits were changed is saved
+	stale := get()
+	changed := get()
+	now := time.Now()
+	changed.Frozen, changed.FrozenReason, changed.FrozenAt = true, "test", &now
+	if err := users.SetFrozen(changed, &AccountFreeze{Time: now, UserName: changed.Name, Frozen: true}); err != nil {
+		t.Fatal(err)
+	}
+	changed.Spending.PinHash = "pin-hash"
+	if err := users.SavePin(changed); err != nil {
+		t.Fatal(err)
+	}
+	stale.Spending.DailyLimit = 500
+	if err := users.SaveLimits(stale); err != nil {
+		t.Fatal(err)
+	}
+	stale.LNURL.Description = "tips"
+	if err := users.SaveUser(stale); err != nil {
+		t.Fatal(err)
+	}
+	if user := get(); !user.Frozen || user.Spending.PinHash != "pin-hash" || user.Spending.DailyLimit != 500 || user.LNURL.Description != "tips" {
+		t.Errorf("frozen %t, PIN hash %q, daily limit %d, description %q after saving a stale user, want true, pin-hash, 500 and tips",
+			user.Frozen, user.Spending.PinHash, user.Spending.DailyLimit, user.LNURL.Description)
+	}
+
+	// the wallet is only replaced if it did not change in the meantime
+	user := get()
+	oldWallet := user.Wallet.ID
+	user.Wallet = &lnbits.Wallet{ID: "new-wallet", Adminkey: "admin-key", Inkey: "invoice-key"}
+	if err := users.ReplaceWallet(user, "other-wallet"); !errors.Is(err, errWalletReplaced) {
+		t.Errorf("ReplaceWallet() of a changed wallet = %v, want errWalletReplaced", err)
+	}
+	if err := users.ReplaceWallet(user, oldWallet); err != nil {
+		t.Fatal(err)
+	}
+	if user := get(); user.Wallet.ID != "new-wallet" || user.Wallet.Adminkey != "admin-key" || !user.Frozen {
+		t.Errorf("wallet %s, frozen %t after replacing the wallet, want new-wallet and true", user.Wallet.ID, user.Frozen)
+	}
+
+	// saving the stale user and the balance of its old wallet keeps the new wallet
+	if err := users.SaveUser(stale); err != nil {
+		t.Fatal(err)
+	}
+	stale.Wallet.Balance = 21000
+	if err := users.SaveBalance(stale); err != nil {
+		t.Fatal(err)
+	}
+	if user := get(); user.Wallet.ID != "new-wallet" || user.Wallet.Adminkey != "admin-key" || user.Wallet.Balance != 0 {
+		t.Errorf("wallet %s with balance %d after saving a stale user, want new-wallet with 0", user.Wallet.ID, user.Wallet.Balance)
+	}
+	user = get()
+	user.Wallet.Balance = 42000
+	if err := users.SaveBalance(user); err != nil {
+		t.Fatal(err)
+	}
+	if user := get(); user.Wallet.Balance != 42000 {
+		t.Errorf("balance %d, want 42000", user.Wallet.Balance)
+	}
+
+	// new telegram details of the stale user don't change the rest of the user
+	stale.Telegram = &tb.User{ID: alice.ID, Username: "alicia"}
+	if err := users.SaveTelegram(stale); err != nil {
+		t.Fatal(err)
+	}
+	user = get()
+	if user.Telegram.Username != "alicia" || user.Wallet.ID != "new-wallet" || !user.Frozen {
+		t.Errorf("username %s, wallet %s, frozen %t after saving the telegram details, want alicia, new-wallet and true",
+			user.Telegram.Username, user.Wallet.ID, user.Frozen)
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	"github.com/LightningTipBot/LightningTipBot/internal/lnurl"
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// scenarioGroup is the group chat of scenarios
+var scenarioGroup = &tb.Chat{ID: -1001234567890, Title: "Lightning Chat", Type: tb.ChatSuperGroup}
+
+// scenario is a conversation of users with a bot that talks to a fake Telegram API and a fake LNbits.
+// Updates are handled synchronously, the bot has answered when a step returns.
+type scenario struct {
+	t        *testing.T
+	bot      TipBot
+	telegram *fakeTelegram
+	lnbits   *fakeLNbits
+	lastID   int
+}
+
+// useExampleConfiguration configures the bot with config.yaml.example until the test ends
+func useExampleConfiguration(t *testing.T) {
+	configuration, err := readConfiguration("config.yaml.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := currentConfiguration()
+	Configuration = configuration
+	t.Cleanup(func() { Configuration = previous })
+}
+
+// newTestBot returns a bot with empty databases and registers its handlers at telegram
+func newTestBot(t *testing.T, telegram *tb.Bot, client *lnbits.Client) TipBot {
+	useExampleConfiguration(t)
+	db, txLogger := openFixture(t, "", "")
+	if err := migrateDatabases(db, txLogger); err != nil {
+		t.Fatal(err)
+	}
+	bot := TipBot{
+		database:     db,
+		txLogger:     txLogger,
+		users:        gormUsers{db: db},
+		transactions: gormTransactions{db: txLogger},
+		store:        storage.NewBunt(":memory:"),
+		telegram:     telegram,
+		client:       client,
+		dialogs:      make(dialogRegistry),
+		limiter:      newRateLimiter(RateLimitConfiguration{}),
+		inFlight:     newHandlerTracker(),
+	}
+	// every test bot registers its handlers
+	telegramHandlerRegistration = sync.Once{}
+	bot.registerTelegramHandlers()
+	return bot
+}
+
+func newScenario(t *testing.T) *scenario {
+	telegram, fakeTelegram := newFakeTelegram(t, nil)
+	fakeLNbits, lnbitsUrl := newFakeLNbits(t)
+	return &scenario{
+		t:        t,
+		bot:      newTestBot(t, telegram, lnbits.NewClient("admin", lnbitsUrl)),
+		telegram: fakeTelegram,
+		lnbits:   fakeLNbits,
+	}
+}
+
+// newUser returns a user that started the bot and has a wallet with sat
+func (s *scenario) newUser(id int, username string, sat int) *tb.User {
+	user := &tb.User{ID: id, Username: username, FirstName: strings.Title(username)}
+	s.private(user, "/start")
+	s.expect(user, startWalletReadyMessage)
+	if sat > 0 {
+		s.lnbits.deposit(s.wallet(user), sat)
+	}
+	return user
+}
+
+// wallet returns the ID of the wallet of user
+func (s *scenario) wallet(user *tb.User) string {
+	s.t.Helper()
+	stored, err := s.bot.users.GetUser(user.ID)
+	if err != nil {
+		s.t.Fatalf("%s has no wallet: %s", GetUserStr(user), err)
+	}
+	return stored.Wallet.ID
+}
+
+// balance returns the balance of the wallet of user
+func (s *scenario) balance(user *tb.User) int {
+	return s.lnbits.balance(s.wallet(user))
+}
+
+func (s *scenario) checkBalance(user *tb.User, want int) {
+	s.t.Helper()
+	if balance := s.balance(user); balance != want {
+		s.t.Errorf("balance of %s = %d sat, want %d sat", GetUserStr(user), balance, want)
+	}
+}
+
+// private sends text to the bot in the private chat of from
+func (s *scenario) private(from *tb.User, text string) *tb.Message {
+	return s.message(from, &tb.Chat{ID: int64(from.ID), Type: tb.ChatPrivate, Username: from.Username}, text, nil)
+}
+
+// group sends text to the group
+func (s *scenario) group(from *tb.User, text string) *tb.Message {
+	return s.message(from, scenarioGroup, text, nil)
+}
+
+// reply replies to msg with text in the chat of msg
+func (s *scenario) reply(from *tb.User, msg *tb.Message, text string) *tb.Message {
+	return s.message(from, msg.Chat, text, msg)
+}
+
+var mentionPattern = regexp.MustCompile(`@\w+`)
+
+func (s *scenario) message(from *tb.User, chat *tb.Chat, text string, replyTo *tb.Message) *tb.Message {
+	sent := s.telegram.addMessage(&fakeMessage{ChatID: chat.ID, From: from.ID, Text: text})
+	m := &tb.Message{ID: sent.ID, Sender: from, Chat: chat, Text: text, ReplyTo: replyTo, Unixtime: time.Now().Unix()}
+	// Telegram marks commands and mentions, the bot looks for them
+	if strings.HasPrefix(text, "/") {
+		m.Entities = append(m.Entities, tb.MessageEntity{Type: tb.EntityCommand, Offset: 0, Length: len(strings.Fields(text)[0])})
+	}
+	for _, mention := range mentionPattern.FindAllStringIndex(text, -1) {
+		if mention[0] > 0 && text[mention[0]-1] != ' ' {
+			// part of a Lightning address
+			continue
+		}
+		m.Entities = append(m.Entities, tb.MessageEntity{Type: tb.EntityMention, Offset: mention[0], Length: mention[1] - mention[0]})
+	}
+	s.update(tb.Update{Message: m})
+	return m
+}
+
+// press presses the button with the text of msg
+func (s *scenario) press(from *tb.User, msg *fakeMessage, button string) {
+	s.t.Helper()
+	s.update(tb.Update{Callback: s.callback(from, msg, button)})
+}
+
+// callback returns the callback of a press of the button with the text of msg
+func (s *scenario) callback(from *tb.User, msg *fakeMessage, button string) *tb.Callback {
+	s.t.Helper()
+	current := s.telegram.lookup(msg)
+	btn, ok := current.button(button)
+	if !ok {
+		s.t.Fatalf("message %q has no button %q", current.Text, button)
+	}
+	s.lastID++
+	callback := &tb.Callback{ID: strconv.Itoa(s.lastID), Sender: from, Data: btn.Data}
+	if len(current.InlineID) > 0 {
+		callback.MessageID = current.InlineID
+	} else {
+		callback.Message = current.message()
+	}
+	return callback
+}
+
+// query sends an inline query and returns the results of the bot
+func (s *scenario) query(from *tb.User, text string) []fakeInlineResult {
+	s.lastID++
+	query := &tb.Query{ID: strconv.Itoa(s.lastID), From: *from, Text: text}
+	s.update(tb.Update{Query: query})
+	return s.telegram.inlineAnswer(query.ID)
+}
+
+// choose sends an inline result to a chat and returns the inline message
+func (s *scenario) choose(from *tb.User, query string, result fakeInlineResult) *fakeMessage {
+	msg := &fakeMessage{InlineID: fmt.Sprintf("inline-%s", result.ID), Text: result.Text}
+	if result.ReplyMarkup != nil {
+		msg.Buttons = result.ReplyMarkup.InlineKeyboard
+	}
+	msg = s.telegram.addMessage(msg)
+	s.update(tb.Update{ChosenInlineResult: &tb.ChosenInlineResult{From: *from, ResultID: result.ID, Query: query, MessageID: msg.InlineID}})
+	return msg
+}
+
+func (s *scenario) update(update tb.Update) {
+	s.lastID++
+	update.ID = s.lastID
+	s.bot.telegram.ProcessUpdate(update)
+}
+
+// expect waits until the bot sent a message that contains text to the private chat of user and returns it
+func (s *scenario) expect(user *tb.User, text string) *fakeMessage {
+	s.t.Helper()
+	return s.expectIn(int64(user.ID), text)
+}
+
+// expectIn waits until a message of the bot in the chat contains text and returns it.
+// Inline messages are in the chat 0.
+func (s *scenario) expectIn(chatID int64, text string) *fakeMessage {
+	s.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		messages := s.telegram.botMessages(chatID)
+		for i := len(messages) - 1; i >= 0; i-- {
+			if strings.Contains(messages[i].Text, text) {
+				return s.telegram.byID(messages[i].ID)
+			}
+		}
+		if time.Now().After(deadline) {
+			var texts []string
+			for _, msg := range messages {
+				texts = append(texts, msg.Text)
+			}
+			s.t.Fatalf("no message with %q in chat %d, messages: %q", text, chatID, texts)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// freeAddress returns a local address that a server can listen at
+func freeAddress(t *testing.T) *url.URL {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return &url.URL{Scheme: "http", Host: listener.Addr().String()}
+}
+
+func TestScenario_tip(t *testing.T) {
+	s := newScenario(t)
+	alice := s.newUser(2001, "alice", 0)
+	bob := s.newUser(2002, "bob", 1000)
+
+	meme := s.group(alice, "look at this meme")
+	s.reply(bob, meme, "/tip 21 dank meme")
+	s.expect(bob, "21 sat sent to @alice")
+	s.expect(alice, "@bob has tipped you 21 sat")
+	s.expect(alice, "dank meme")
+	s.expect(alice, "look at this meme")
+	s.expectIn(scenarioGroup.ID, "🏅 21 sat (by @bob)")
+	s.checkBalance(alice, 21)
+	s.checkBalance(bob, 979)
+
+	// users that never started the bot get a wallet
+	carol := &tb.User{ID: 2003, Username: "carol", FirstName: "Carol"}
+	s.reply(bob, s.group(carol, "hi"), "/tip 10")
+	s.expect(carol, "@bob has tipped you 10 sat")
+	s.checkBalance(carol, 10)
+
+	s.reply(alice, meme, "/tip 1000")
+	s.expect(alice, "You can't tip yourself")
+	s.reply(bob, meme, "/tip 5000")
+	s.expect(bob, "Transaction failed: "+balanceTooLowMessage)
+	s.checkBalance(bob, 969)
+}
+
+func TestScenario_send(t *testing.T) {
+	s := newScenario(t)
+	alice := s.newUser(2001, "alice", 0)
+	bob := s.newUser(2002, "bob", 1000)
+
+	s.private(bob, "/send 50 @alice for lunch")
+	confirmation := s.expect(bob, "Do you want to pay to @alice?")
+	s.press(bob, confirmation, btnSend.Text)
+	s.expect(bob, "50 sat sent to @alice")
+	s.expect(alice, "@bob sent you 50 sat")
+	s.expect(alice, "for lunch")
+	s.checkBalance(alice, 50)
+	s.checkBalance(bob, 950)
+	if buttons := s.telegram.lookup(confirmation).Buttons; len(buttons) > 0 {
+		t.Errorf("confirmation still has buttons %v", buttons)
+	}
+
+	// the dialog asks for the missing recipient and amount
+	s.private(bob, "/send")
+	s.expect(bob, sendEnterRecipientMessage)
+	s.private(bob, "@alice")
+	s.expect(bob, "Enter the amount you want to send to @alice")
+	s.private(bob, "25")
+	s.press(bob, s.expect(bob, "Do you want to pay to @alice?"), btnSend.Text)
+	s.expect(bob, "25 sat sent to @alice")
+	s.checkBalance(alice, 75)
+
+	s.private(bob, "/send 10 @alice")
+	s.press(bob, s.expect(bob, "Amount: 10 sat"), btnCancelSend.Text)
+	s.expect(bob, sendCancelledMessage)
+	s.checkBalance(bob, 925)
+
+	s.private(bob, "/send 5000 @alice")
+	s.press(bob, s.expect(bob, "Amount: 5000 sat"), btnSend.Text)
+	s.expect(bob, "Transaction failed: "+balanceTooLowMessage)
+
+	s.private(bob, "/send 10 @carol")
+	s.expect(bob, "User @carol hasn't created a wallet yet")
+}
+
+func TestScenario_sendConfirmedTwice(t *testing.T) {
+	s := newScenario(t)
+	alice := s.newUser(2001, "alice", 0)
+	bob := s.newUser(2002, "bob", 1000)
+
+	s.private(bob, "/send 10 @alice")
+	confirmation := s.expect(bob, "Amount: 10 sat")
+	// both presses read the dialog at the same time
+	s.bot.store = newBarrierStore(s.bot.store, "dialog:", 2)
+	telegramHandlerRegistration = sync.Once{}
+	s.bot.registerTelegramHandlers()
+	presses := []*tb.Callback{s.callback(bob, confirmation, btnSend.Text), s.callback(bob, confirmation, btnSend.Text)}
+	var wg sync.WaitGroup
+	for i, callback := range presses {
+		wg.Add(1)
+		go func(id int, callback *tb.Callback) {
+			defer wg.Done()
+			s.bot.telegram.ProcessUpdate(tb.Update{ID: id, Callback: callback})
+		}(s.lastID+i+1, callback)
+	}
+	wg.Wait()
+	s.lastID += len(presses)
+	s.expect(bob, dialogExpiredMessage)
+	s.checkBalance(bob, 990)
+	s.checkBalance(alice, 10)
+}
+
+func TestScenario_pay(t *testing.T) {
+	s := newScenario(t)
+	alice := s.newUser(2001, "alice", 1000)
+
+	invoice := s.lnbits.externalInvoice(t, 300, "coffee")
+	s.private(alice, "/pay "+invoice)
+	confirmation := s.expect(alice, "Do you want to send this payment?\n\n💸 Amount: 300 sat")
+	stale := s.telegram.lookup(confirmation)
+	s.press(alice, confirmation, btnPay.Text)
+	s.expect(alice, invoicePaidMessage)
+	s.checkBalance(alice, 700)
+	if payments := s.lnbits.externalPayments(); len(payments) != 1 || payments[0] != invoice {
+		t.Errorf("external payments = %v, want the invoice", payments)
+	}
+
+	// a client that still shows the buttons can't pay twice
+	s.press(alice, &stale, btnPay.Text)
+	s.expect(alice, dialogExpiredMessage)
+	s.checkBalance(alice, 700)
+
+	s.private(alice, "/pay "+s.lnbits.externalInvoice(t, 800, ""))
+	s.expect(alice, "Insufficient funds. You have 700 sat but you need at least 800 sat.")
+	s.private(alice, "/pay lnbc1invalid")
+	s.expect(alice, invalidInvoiceHelpMessage)
+	s.private(alice, "/pay "+s.lnbits.externalInvoice(t, 100, ""))
+	s.press(alice, s.expect(alice, "Amount: 100 sat"), btnCancelPay.Text)
+	s.expect(alice, paymentCancelledMessage)
+	s.checkBalance(alice, 700)
+}
+
+func TestScenario_faucet(t *testing.T) {
+	s := newScenario(t)
+	alice := s.newUser(2001, "alice", 0)
+	bob := s.newUser(2002, "bob", 1000)
+	carol := &tb.User{ID: 2003, Username: "carol", FirstName: "Carol"}
+
+	s.group(bob, "/faucet 210 21")
+	faucet := s.expectIn(scenarioGroup.ID, "Press ✅ to collect 21 sat from this faucet.")
+	s.press(alice, faucet, btnAcceptInlineFaucet.Text)
+	s.expect(alice, "@bob sent you 21 sat")
+	s.expect(bob, "21 sat sent to @alice")
+	s.expectIn(scenarioGroup.ID, "Remaining: 189/210 sat (given to 1/10 users)")
+	// every user collects once
+	s.press(alice, faucet, btnAcceptInlineFaucet.Text)
+	s.press(carol, faucet, btnAcceptInlineFaucet.Text)
+	s.expectIn(scenarioGroup.ID, "Remaining: 168/210 sat (given to 2/10 users)")
+	s.checkBalance(alice, 21)
+	s.checkBalance(carol, 21)
+	s.checkBalance(bob, 958)
+
+	stale := s.telegram.lookup(faucet)
+	s.press(bob, faucet, btnCancelInlineFaucet.Text)
+	s.expectIn(scenarioGroup.ID, inlineFaucetCancelledMessage)
+	s.press(alice, &stale, btnAcceptInlineFaucet.Text)
+	s.checkBalance(alice, 21)
+
+	s.group(alice, "/faucet 100 30")
+	s.expect(alice, inlineFaucetInvalidPeruserAmountMessage)
+	s.private(alice, "/faucet 100 10")
+	s.expect(alice, inlineFaucetHelpFaucetInGroup)
+}
+
+func TestScenario_inlineSend(t *testing.T) {
+	s := newScenario(t)
+	alice := s.newUser(2001, "alice", 0)
+	bob := s.newUser(2002, "bob", 1000)
+
+	results := s.query(bob, "send 30 thanks")
+	if len(results) != 1 {
+		t.Fatalf("inline results = %v, want one", results)
+	}
+	send := s.choose(bob, "send 30 thanks", results[0])
+	stale := s.telegram.lookup(send)
+	s.press(alice, send, btnAcceptInlineSend.Text)
+	s.expectIn(0, "30 sat sent from @bob to @alice.\n✉️ thanks")
+	s.expect(alice, "@bob sent you 30 sat")
+	s.checkBalance(alice, 30)
+	s.checkBalance(bob, 970)
+	// the send is paid once
+	s.press(&tb.User{ID: 2003, Username: "carol"}, &stale, btnAcceptInlineSend.Text)
+	s.checkBalance(bob, 970)
+
+	results = s.query(bob, "send 5000")
+	if len(results) != 1 || !strings.Contains(results[0].Title, "Your balance is too low") {
+		t.Errorf("inline results = %v, want a low balance", results)
+	}
+
+	cancelled := s.choose(bob, "send 10", s.query(bob, "send 10")[0])
+	s.press(bob, cancelled, btnCancelInlineSend.Text)
+	if msg := s.telegram.lookup(cancelled); msg.Text != sendCancelledMessage {
+		t.Errorf("cancelled send = %q, want %q", msg.Text, sendCancelledMessage)
+	}
+}
+
+func TestScenario_inlineReceive(t *testing.T) {
+	s := newScenario(t)
+	alice := s.newUser(2001, "alice", 0)
+	bob := s.newUser(2002, "bob", 1000)
+
+	receive := s.choose(alice, "receive 40", s.query(alice, "receive 40")[0])
+	s.press(bob, receive, btnAcceptInlineReceive.Text)
+	s.expectIn(0, "40 sat sent from @bob to @alice.")
+	s.expect(alice, "@bob sent you 40 sat")
+	s.expect(bob, "40 sat sent to @alice")
+	s.checkBalance(alice, 40)
+	s.checkBalance(bob, 960)
+
+	expensive := s.choose(alice, "receive 5000", s.query(alice, "receive 5000")[0])
+	s.press(bob, expensive, btnAcceptInlineReceive.Text)
+	s.expect(bob, "Your balance is too low (👑 960 sat).")
+	s.press(alice, expensive, btnAcceptInlineReceive.Text)
+	s.expect(alice, sendYourselfMessage)
+	s.checkBalance(alice, 40)
+}
+
+func TestScenario_lnurl(t *testing.T) {
+	s := newScenario(t)
+	alice := s.newUser(2001, "alice", 0)
+	bob := s.newUser(2002, "bob", 1000)
+
+	// the invoices of the LNURL server notify the bot with the webhook server
+	webhookAddress, lnurlAddress := freeAddress(t), freeAddress(t)
+	webhookServer, err := lnbits.NewWebhookServer(webhookAddress, s.bot.telegram, s.bot.client, s.bot.database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer webhookServer.Shutdown(nil)
+	lnurlServer, err := lnurl.NewServer(lnurlAddress, lnurlAddress, webhookAddress.String(), s.bot.telegram, s.bot.client, s.bot.database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lnurlServer.Shutdown(nil)
+	hostName := Configuration.Bot.LNURLHostName
+	Configuration.Bot.LNURLHostName = lnurlAddress.String()
+	defer func() { Configuration.Bot.LNURLHostName = hostName }()
+
+	s.private(alice, "/lnurl")
+	s.expect(alice, lnurlReceiveInfoText)
+	aliceLnurl := strings.Trim(s.expect(alice, "`LNURL").Text, "`")
+
+	s.private(bob, "/lnurl 100 "+aliceLnurl)
+	confirmation := s.expect(bob, "Do you want to send this payment?\n\n💸 Amount: 100 sat")
+	s.press(bob, confirmation, btnPay.Text)
+	s.expect(bob, invoicePaidMessage)
+	s.expect(alice, "You received 100 sat.")
+	s.checkBalance(alice, 100)
+	s.checkBalance(bob, 900)
+
+	// without an amount, the bot asks for it
+	s.private(bob, "/lnurl "+aliceLnurl)
+	s.expect(bob, "Enter an amount between 1 and 1000000 sat")
+	s.private(bob, "50")
+	s.press(bob, s.expect(bob, "Amount: 50 sat"), btnPay.Text)
+	s.expect(alice, "You received 50 sat.")
+	s.checkBalance(alice, 150)
+}
+
+func TestScenario_lnurlSettings(t *testing.T) {
+	s := newScenario(t)
+	alice := s.newUser(2001, "alice", 0)
+
+	s.private(alice, "/lnurl max 2000000")
+	s.expect(alice, "Amount must be between 1 and 1000000 sat")
+	s.private(alice, "/lnurl max 5000")
+	s.expect(alice, "Maximum: 5000 sat")
+
+	// long descriptions are cut between characters
+	s.private(alice, "/lnurl description "+strings.Repeat("⚡", 200))
+	s.expect(alice, lnurlSettingsUpdatedMessage)
+	user, err := s.bot.users.GetUser(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if description := user.LNURL.Description; description != strings.Repeat("⚡", lnurlSettingsDescriptionSize) {
+		t.Errorf("description = %q, want %d characters", description, lnurlSettingsDescriptionSize)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/migrations"
+	"github.com/LightningTipBot/LightningTipBot/internal/secret"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	userMigrationsTable        = "schema_migrations"
+	transactionMigrationsTable = "transaction_schema_migrations"
+)
+
+// The v1 types are the tables as AutoMigrate created them before versioned migrations.
+// They are frozen, later changes of the models need a new migration.
+
+type v1User struct {
+	ID                      string
+	Name                    string `gorm:"primaryKey"`
+	Initialized             bool
+	TelegramID              int
+	TelegramFirstName       string
+	TelegramLastName        string
+	TelegramUsername        string
+	TelegramLanguageCode    string
+	TelegramIsBot           bool
+	TelegramCanJoinGroups   bool
+	TelegramCanReadMessages bool
+	TelegramSupportsInline  bool
+	WalletID                string
+	WalletAdminkey          string
+	WalletInkey             string
+	WalletBalance           int64
+	WalletName              string
+	WalletUser              string
+	LnurlMinReceivable      int64
+	LnurlMaxReceivable      int64
+	LnurlDescription        string
+	LnurlAvatar             string
+}
+
+func (v1User) TableName() string {
+	return "users"
+}
+
+type v1InvoiceWebhook struct {
+	Token       string `gorm:"primaryKey"`
+	PaymentHash string `gorm:"index"`
+	WalletID    string
+	ChatID      int64
+	MessageID   string
+	CreatedAt   time.Time
+	DeliveredAt *time.Time
+}
+
+func (v1InvoiceWebhook) TableName() string {
+	return "invoice_webhooks"
+}
+
+type v1Alias struct {
+	Name       string `gorm:"primaryKey"`
+	UserName   string `gorm:"index"`
+	Kind       int    `gorm:"index"`
+	CreatedAt  time.Time
+	ReleasedAt *time.Time
+}
+
+func (v1Alias) TableName() string {
+	return "aliases"
+}
+
+type v1ZapRequest struct {
+	PaymentHash string `gorm:"primaryKey"`
+	UserName    string `gorm:"index"`
+	Request     string
+	Amount      int64
+	CreatedAt   time.Time
+	PublishedAt *time.Time
+}
+
+func (v1ZapRequest) TableName() string {
+	return "zap_requests"
+}
+
+type v1Transaction struct {
+	ID           uint `gorm:"primarykey"`
+	Time         time.Time
+	FromId       int
+	ToId         int
+	FromUser     string
+	ToUser       string
+	Type         string
+	Amount       int
+	ChatID       int64
+	ChatName     string
+	Memo         string
+	Success      bool
+	FromWallet   string
+	ToWallet     string
+	FromLNbitsID string
+	ToLNbitsID   string
+}
+
+func (v1Transaction) TableName() string {
+	return "transactions"
+}
+
+// v4Spending are the columns of the spending settings of users
+type v4Spending struct {
+	Name                 string `gorm:"primaryKey"`
+	SpendingMaxPayment   int64
+	SpendingDailyLimit   int64
+	SpendingConfirmAbove int64
+	SpendingPinHash      string
+}
+
+func (v4Spending) TableName() string {
+	return "users"
+}
+
+var v4SpendingColumns = []string{"SpendingMaxPayment", "SpendingDailyLimit", "SpendingConfirmAbove", "SpendingPinHash"}
+
+// v5Frozen is the column that freezes the payments of users
+type v5Frozen struct {
+	Name   string `gorm:"primaryKey"`
+	Frozen bool
+}
+
+func (v5Frozen) TableName() string {
+	return "users"
+}
+
+// v6Freeze are the columns of the reason and the time of a freeze
+type v6Freeze struct {
+	Name         string `gorm:"primaryKey"`
+	FrozenReason string
+	FrozenAt     *time.Time
+}
+
+func (v6Freeze) TableName() string {
+	return "users"
+}
+
+var v6FreezeColumns = []string{"FrozenReason", "FrozenAt"}
+
+type v6AccountFreeze struct {
+	ID       uint `gorm:"primarykey"`
+	Time     time.Time
+	UserName string `gorm:"index"`
+	Frozen   bool
+	Reason   string
+	AdminID  int
+}
+
+func (v6AccountFreeze) TableName() string {
+	return "account_freezes"
+}
+
+// userMigrations are the migrations of the user database
+var userMigrations = []migrations.Migration{
+	{
+		Version:     1,
+		Description: "create users, invoice webhooks, aliases and zap requests",
+		// AutoMigrate only creates what is missing, databases created before migrations keep their data
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&v1User{}, &v1InvoiceWebhook{}, &v1Alias{}, &v1ZapRequest{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&v1User{}, &v1InvoiceWebhook{}, &v1Alias{}, &v1ZapRequest{})
+		},
+	},
+	{
+		Version:     2,
+		Description: "index users by telegram username",
+		Up: func(tx *gorm.DB) error {
+			return tx.Exec("CREATE INDEX IF NOT EXISTS idx_users_telegram_username ON users (telegram_username)").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Exec("DROP INDEX IF EXISTS idx_users_telegram_username").Error
+		},
+	},
+	{
+		Version:     3,
+		Description: "encrypt wallet keys",
+		Up: func(tx *gorm.DB) error {
+			keyring := secret.DefaultKeyring()
+			if keyring == nil {
+				log.Warnf("[Migrations] No master_key configured, wallet keys stay in plaintext until you configure one and run `LightningTipBot migrate encrypt-keys`")
+				return nil
+			}
+			_, err := reencryptWalletKeys(tx, keyring, false)
+			return err
+		},
+		Down: func(tx *gorm.DB) error {
+			_, err := reencryptWalletKeys(tx, secret.DefaultKeyring(), true)
+			return err
+		},
+	},
+	{
+		Version:     4,
+		Description: "add spending limits and PIN of users",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range v4SpendingColumns {
+				if tx.Migrator().HasColumn(&v4Spending{}, column) {
+					continue
+				}
+				err := tx.Migrator().AddColumn(&v4Spending{}, column)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, column := range v4SpendingColumns {
+				err := tx.Migrator().DropColumn(&v4Spending{}, column)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     5,
+		Description: "add frozen flag of users",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&v5Frozen{}, "Frozen") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&v5Frozen{}, "Frozen")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&v5Frozen{}, "Frozen")
+		},
+	},
+	{
+		Version:     6,
+		Description: "record reasons and history of freezes",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range v6FreezeColumns {
+				if tx.Migrator().HasColumn(&v6Freeze{}, column) {
+					continue
+				}
+				err := tx.Migrator().AddColumn(&v6Freeze{}, column)
+				if err != nil {
+					return err
+				}
+			}
+			if tx.Migrator().HasTable(&v6AccountFreeze{}) {
+				return nil
+			}
+			return tx.Migrator().CreateTable(&v6AccountFreeze{})
+		},
+		Down: func(tx *gorm.DB) error {
+			err := tx.Migrator().DropTable(&v6AccountFreeze{})
+			if err != nil {
+				return err
+			}
+			for _, column := range v6FreezeColumns {
+				err := tx.Migrator().DropColumn(&v6Freeze{}, column)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// transactionMigrations are the migrations of the transaction database
+var transactionMigrations = []migrations.Migration{
+	{
+		Version:     1,
+		Description: "create transactions",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&v1Transaction{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&v1Transaction{})
+		},
+	},
+	{
+		Version:     2,
+		Description: "rename from_l_nbits_id and to_l_nbits_id",
+		Up: func(tx *gorm.DB) error {
+			return renameColumns(tx, "transactions", map[string]string{
+				"from_l_nbits_id": "from_lnbits_id",
+				"to_l_nbits_id":   "to_lnbits_id",
+			})
+		},
+		Down: func(tx *gorm.DB) error {
+			return renameColumns(tx, "transactions", map[string]string{
+				"from_lnbits_id": "from_l_nbits_id",
+				"to_lnbits_id":   "to_l_nbits_id",
+			})
+		},
+	},
+	{
+		Version:     3,
+		Description: "index transactions by sender and time for spending limits",
+		Up: func(tx *gorm.DB) error {
+			return tx.Exec("CREATE INDEX IF NOT EXISTS idx_transactions_from_id_time ON transactions (from_id, time)").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Exec("DROP INDEX IF EXISTS idx_transactions_from_id_time").Error
+		},
+	},
+}
+
+// renameColumns renames the columns of table from the keys to the values of columns
+func renameColumns(tx *gorm.DB, table string, columns map[string]string) error {
+	for from, to := range columns {
+		// Migrator().RenameColumn needs a model, the models of the bot can't be used in migrations
+		err := tx.Exec("ALTER TABLE ? RENAME COLUMN ? TO ?", clause.Table{Name: table}, clause.Column{Name: from}, clause.Column{Name: to}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walletKeys are the encrypted columns of the users table
+type walletKeys struct {
+	Name           string `gorm:"primaryKey"`
+	WalletAdminkey string
+	WalletInkey    string
+}
+
+func (walletKeys) TableName() string {
+	return "users"
+}
+
+// reencryptWalletKeys encrypts the wallet keys of all users with the current master key of keyring,
+// or stores them in plaintext with decrypt. It returns the number of updated users.
+func reencryptWalletKeys(db *gorm.DB, keyring *secret.Keyring, decrypt bool) (int, error) {
+	convert := func(value string) (string, bool, error) {
+		if decrypt {
+			plaintext, err := keyring.Decrypt(value)
+			return plaintext, plaintext != value, err
+		}
+		return keyring.Reencrypt(value)
+	}
+	updated := 0
+	var batch []walletKeys
+	res := db.FindInBatches(&batch, copyBatchSize, func(_ *gorm.DB, _ int) error {
+		for _, keys := range batch {
+			adminkey, adminkeyChanged, err := convert(keys.WalletAdminkey)
+			if err != nil {
+				return fmt.Errorf("user %s: %w", keys.Name, err)
+			}
+			inkey, inkeyChanged, err := convert(keys.WalletInkey)
+			if err != nil {
+				return fmt.Errorf("user %s: %w", keys.Name, err)
+			}
+			if !adminkeyChanged && !inkeyChanged {
+				continue
+			}
+			err = db.Model(&walletKeys{}).Where("name = ?", keys.Name).
+				Updates(map[string]interface{}{"wallet_adminkey": adminkey, "wallet_inkey": inkey}).Error
+			if err != nil {
+				return err
+			}
+			updated++
+		}
+		return nil
+	})
+	return updated, res.Error
+}
+
+func newUserMigrator(db *gorm.DB) *migrations.Migrator {
+	return migrations.New(db, userMigrationsTable, userMigrations)
+}
+
+func newTransactionMigrator(txLogger *gorm.DB) *migrations.Migrator {
+	return migrations.New(txLogger, transactionMigrationsTable, transactionMigrations)
+}
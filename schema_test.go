@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/migrations"
+	"github.com/LightningTipBot/LightningTipBot/internal/secret"
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
+	"gorm.io/gorm"
+)
+
+// openFixture opens sqlite databases and loads the fixtures into them, empty fixtures give fresh databases
+func openFixture(t *testing.T, usersFixture string, transactionsFixture string) (db *gorm.DB, txLogger *gorm.DB) {
+	dir := t.TempDir()
+	db, txLogger, err := openDatabases(storage.DriverSQLite, filepath.Join(dir, "users.db"), filepath.Join(dir, "transactions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fixture, db := range map[string]*gorm.DB{usersFixture: db, transactionsFixture: txLogger} {
+		if len(fixture) == 0 {
+			continue
+		}
+		sql, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Exec(string(sql)).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db, txLogger
+}
+
+// stepUp applies the migrations one by one
+func stepUp(t *testing.T, migrator *migrations.Migrator, all []migrations.Migration) {
+	for _, migration := range all {
+		n, err := migrator.UpTo(migration.Version)
+		if err != nil || n != 1 {
+			t.Fatalf("UpTo(%d) = %d, %v", migration.Version, n, err)
+		}
+	}
+	if err := migrator.Check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkFixtureData(t *testing.T, db *gorm.DB, txLogger *gorm.DB) {
+	user, err := gormUsers{db: db}.GetUserByUsername("bob")
+	if err != nil || user.Wallet.Adminkey != "admin2" {
+		t.Errorf("GetUserByUsername() = %+v, %v", user, err)
+	}
+	tx := &Transaction{}
+	if err := txLogger.First(tx, 1).Error; err != nil {
+		t.Fatal(err)
+	}
+	if tx.FromLNbitsID != "u1" || tx.ToLNbitsID != "u2" || tx.Amount != 21 {
+		t.Errorf("transaction = %+v", tx)
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	db, txLogger := openFixture(t, "legacy_users.sql", "legacy_transactions.sql")
+	users, transactions := newUserMigrator(db), newTransactionMigrator(txLogger)
+	stepUp(t, users, userMigrations)
+	stepUp(t, transactions, transactionMigrations)
+	checkFixtureData(t, db, txLogger)
+
+	// roll back everything but the baseline and apply it again
+	if _, err := users.Down(len(userMigrations) - 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transactions.Down(len(transactionMigrations) - 1); err != nil {
+		t.Fatal(err)
+	}
+	if !txLogger.Migrator().HasColumn(&v1Transaction{}, "from_l_nbits_id") {
+		t.Error("rollback did not restore from_l_nbits_id")
+	}
+	if err := migrateDatabases(db, txLogger); err != nil {
+		t.Fatal(err)
+	}
+	checkFixtureData(t, db, txLogger)
+}
+
+func TestMigrateFreshDatabase(t *testing.T) {
+	db, txLogger := openFixture(t, "", "")
+	users, transactions := newUserMigrator(db), newTransactionMigrator(txLogger)
+	stepUp(t, users, userMigrations)
+	stepUp(t, transactions, transactionMigrations)
+	for _, model := range userModels {
+		if !db.Migrator().HasTable(model) {
+			t.Errorf("table of %T missing", model)
+		}
+	}
+	if err := (gormTransactions{db: txLogger}).SaveTransaction(&Transaction{FromLNbitsID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := users.Down(len(userMigrations)); err != nil || n != len(userMigrations) {
+		t.Fatalf("Down() = %d, %v", n, err)
+	}
+	if n, err := transactions.Down(len(transactionMigrations)); err != nil || n != len(transactionMigrations) {
+		t.Fatalf("Down() = %d, %v", n, err)
+	}
+	if db.Migrator().HasTable("users") || txLogger.Migrator().HasTable("transactions") {
+		t.Error("Down() did not drop the tables")
+	}
+	if err := migrateDatabases(db, txLogger); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptWalletKeys(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	keyring, _ := secret.NewKeyring(oldKey)
+	secret.SetKeyring(keyring)
+	defer secret.SetKeyring(nil)
+
+	db, txLogger := openFixture(t, "legacy_users.sql", "legacy_transactions.sql")
+	if err := migrateDatabases(db, txLogger); err != nil {
+		t.Fatal(err)
+	}
+	storedAdminkey := func() string {
+		var adminkey string
+		db.Raw("SELECT wallet_adminkey FROM users WHERE name = '2'").Scan(&adminkey)
+		return adminkey
+	}
+	encrypted := storedAdminkey()
+	if !secret.IsEncrypted(encrypted) {
+		t.Fatalf("wallet_adminkey = %s, want encrypted", encrypted)
+	}
+	checkFixtureData(t, db, txLogger)
+
+	rotated, _ := secret.NewKeyring(newKey, oldKey)
+	secret.SetKeyring(rotated)
+	if n, err := reencryptWalletKeys(db, rotated, false); err != nil || n != 2 {
+		t.Fatalf("reencryptWalletKeys() = %d, %v", n, err)
+	}
+	keyring, _ = secret.NewKeyring(newKey)
+	secret.SetKeyring(keyring)
+	checkFixtureData(t, db, txLogger)
+
+	// roll back to version 2, before the wallet keys were encrypted
+	if _, err := newUserMigrator(db).Down(len(userMigrations) - 2); err != nil {
+		t.Fatal(err)
+	}
+	if adminkey := storedAdminkey(); adminkey != "admin2" {
+		t.Errorf("wallet_adminkey after rollback = %s", adminkey)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"strconv"
 	"strings"
 
 	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
@@ -23,12 +22,31 @@ const (
 	confirmSendAppendMemo      = "\n✉️ %s"
 	sendCancelledMessage       = "🚫 Send cancelled."
 	errorTryLaterMessage       = "🚫 Internal error. Please try again later.."
+	sendEnterRecipientMessage  = "⌨️ Who do you want to send to? Enter a @username or a Lightning address, or /cancel."
+	sendEnterAmountMessage     = "⌨️ Enter the amount you want to send to %s, or /cancel."
 	sendHelpText               = "📖 Oops, that didn't work. %s\n\n" +
 		"*Usage:* `/send <amount> <user> [<memo>]`\n" +
 		"*Example:* `/send 1000 @LightningTipBot I just like the bot ❤️`\n" +
 		"*Example:* `/send 1234 LightningTipBot@ln.tips`"
 )
 
+const (
+	sendCommand                        = "send"
+	sendDialogRecipient    DialogState = "recipient"
+	sendDialogAmount       DialogState = "amount"
+	sendDialogConfirm      DialogState = "confirm"
+	sendDialogSecondFactor DialogState = "second_factor"
+)
+
+// sendDialogData is the send that the user is preparing
+type sendDialogData struct {
+	ToID         int          `json:"to_id"`
+	ToUsername   string       `json:"to_username"`
+	Amount       int          `json:"amount"`
+	Memo         string       `json:"memo"`
+	SecondFactor secondFactor `json:"second_factor"`
+}
+
 func helpSendUsage(errormsg string) string {
 	if len(errormsg) > 0 {
 		return fmt.Sprintf(sendHelpText, fmt.Sprintf("%s", errormsg))
@@ -52,19 +70,21 @@ func (bot *TipBot) SendCheckSyntax(m *tb.Message) (bool, string) {
 }
 
 // confirmPaymentHandler invoked on "/send 123 @user" command
-func (bot *TipBot) confirmSendHandler(m *tb.Message) {
-	// reset state immediately
-	user, err := GetUser(m.Sender, *bot)
-	if err != nil {
+func (bot *TipBot) confirmSendHandler(ctx *Context) {
+	m := ctx.Message
+	// If the send is a reply, then trigger /tip handler
+	if m.IsReply() {
+		bot.disposeTip(bot.tipHandler)(ctx)
 		return
 	}
-	ResetUserState(user, *bot)
 
-	// check and print all commands
-	bot.anyTextHandler(m)
-	// If the send is a reply, then trigger /tip handler
-	if m.IsReply() {
-		bot.tipHandler(m)
+	// get send amount, returns 0 if no amount is given
+	amount, err := decodeAmountFromCommand(m.Text)
+	arguments := len(strings.Split(m.Text, " "))
+
+	// in the private chat, ask for the recipient if only /send [<amount>] is given
+	if m.Chat.Type == tb.ChatPrivate && (arguments < 2 || (arguments == 2 && err == nil)) {
+		bot.askSendRecipient(m.Sender, amount)
 		return
 	}
 
@@ -74,16 +94,13 @@ func (bot *TipBot) confirmSendHandler(m *tb.Message) {
 		return
 	}
 
-	// get send amount, returns 0 if no amount is given
-	amount, err := decodeAmountFromCommand(m.Text)
 	// info: /send 10 <user> DEMANDS an amount, while /send <ln@address.com> also works without
-	// todo: /send <user> should also invoke amount input dialog if no amount is given
 
 	// CHECK whether first or second argument is a LIGHTNING ADDRESS
 	arg := ""
-	if len(strings.Split(m.Text, " ")) > 2 {
+	if arguments > 2 {
 		arg, err = getArgumentFromCommand(m.Text, 2)
-	} else if len(strings.Split(m.Text, " ")) == 2 {
+	} else if arguments == 2 {
 		arg, err = getArgumentFromCommand(m.Text, 1)
 	}
 	if err == nil {
@@ -98,6 +115,15 @@ func (bot *TipBot) confirmSendHandler(m *tb.Message) {
 		}
 	}
 
+	// in the private chat, ask for the amount if only a user is given: /send <user> [<memo>]
+	if amount < 1 && m.Chat.Type == tb.ChatPrivate && len(m.Entities) > 1 && m.Entities[1].Type == "mention" {
+		recipient, _ := getArgumentFromCommand(m.Text, 1)
+		if strings.HasPrefix(recipient, "@") {
+			bot.askSendAmount(m, sendDialogData{ToUsername: strings.TrimPrefix(recipient, "@"), Memo: GetMemoFromCommand(m.Text, 2)})
+			return
+		}
+	}
+
 	// ASSUME INTERNAL SEND TO TELEGRAM USER
 	if err != nil || amount < 1 {
 		errmsg := fmt.Sprintf("[/send] Error: Send amount not valid.")
@@ -149,59 +175,164 @@ func (bot *TipBot) confirmSendHandler(m *tb.Message) {
 		return
 	}
 
-	toUserDb := &lnbits.User{}
-	tx := bot.database.Where("telegram_username = ?", strings.ToLower(toUserStrWithoutAt)).First(toUserDb)
-	if tx.Error != nil || toUserDb.Wallet == nil || toUserDb.Initialized == false {
+	toUserDb, err := bot.getSendRecipient(toUserStrWithoutAt)
+	if err != nil {
 		NewMessage(m, WithDuration(0, bot.telegram))
-		err = fmt.Errorf(sendUserHasNoWalletMessage, MarkdownEscape(toUserStrMention))
-		bot.trySendMessage(m.Sender, err.Error())
-		if tx.Error != nil {
-			log.Printf("[/send] Error: %v %v", err, tx.Error)
-			return
-		}
+		bot.trySendMessage(m.Sender, fmt.Sprintf(sendUserHasNoWalletMessage, MarkdownEscape(toUserStrMention)))
 		log.Printf("[/send] Error: %v", err)
 		return
 	}
-	// string that holds all information about the send payment
-	sendData := strconv.Itoa(toUserDb.Telegram.ID) + "|" + toUserStrWithoutAt + "|" +
-		strconv.Itoa(amount)
-	if len(sendMemo) > 0 {
-		sendData = sendData + "|" + sendMemo
+	bot.confirmSend(m.Sender, sendDialogData{ToID: toUserDb.Telegram.ID, ToUsername: toUserStrWithoutAt, Amount: amount, Memo: sendMemo})
+}
+
+// getSendRecipient returns the user with the Telegram username if the user can receive sends
+func (bot *TipBot) getSendRecipient(username string) (*lnbits.User, error) {
+	toUserDb, err := bot.users.GetUserByUsername(username)
+	if err != nil {
+		return nil, err
 	}
+	if toUserDb.Wallet == nil || toUserDb.Initialized == false {
+		return nil, fmt.Errorf("user %s has no wallet", username)
+	}
+	return toUserDb, nil
+}
 
-	// save the send data to the database
-	log.Debug(sendData)
-	user, err = GetUser(m.Sender, *bot)
+// confirmSend asks the user to confirm the send with the buttons of the confirmation message
+func (bot *TipBot) confirmSend(sender *tb.User, data sendDialogData) {
+	// check the limits before the user confirms, they are checked again when sending
+	user, err := GetUser(sender, *bot)
 	if err != nil {
-		NewMessage(m, WithDuration(0, bot.telegram))
-		log.Printf("[/send] Error: %s\n", err.Error())
-		bot.trySendMessage(m.Sender, fmt.Sprint(errorTryLaterMessage))
+		log.Errorf("[/send] Error: %s", err)
+		return
+	}
+	err = bot.checkSpending(user, data.Amount, true)
+	if err != nil {
+		bot.trySendMessage(sender, fmt.Sprintf(sendErrorMessage, err))
+		return
+	}
+	_, err = bot.startDialog(sender, sendCommand, sendDialogConfirm, data)
+	if err != nil {
+		log.Errorf("[/send] Could not start dialog: %s", err)
+		bot.trySendMessage(sender, errorTryLaterMessage)
 		return
 	}
-
-	SetUserState(user, *bot, lnbits.UserStateConfirmSend, sendData)
 
 	sendConfirmationMenu.Inline(sendConfirmationMenu.Row(btnSend, btnCancelSend))
-	confirmText := fmt.Sprintf(confirmSendInvoiceMessage, MarkdownEscape(toUserStrMention), amount)
-	if len(sendMemo) > 0 {
-		confirmText = confirmText + fmt.Sprintf(confirmSendAppendMemo, MarkdownEscape(sendMemo))
+	confirmText := fmt.Sprintf(confirmSendInvoiceMessage, MarkdownEscape("@"+data.ToUsername), data.Amount)
+	if len(data.Memo) > 0 {
+		confirmText = confirmText + fmt.Sprintf(confirmSendAppendMemo, MarkdownEscape(data.Memo))
 	}
-	_, err = bot.telegram.Send(m.Sender, confirmText, sendConfirmationMenu)
+	_, err = bot.telegram.Send(sender, confirmText, sendConfirmationMenu)
 	if err != nil {
 		log.Error("[confirmSendHandler]" + err.Error())
 		return
 	}
 }
 
-// cancelPaymentHandler invoked when user clicked cancel on payment confirmation
-func (bot *TipBot) cancelSendHandler(c *tb.Callback) {
-	// reset state immediately
-	user, err := GetUser(c.Sender, *bot)
+// askSendRecipient starts a send dialog that asks for the recipient
+func (bot *TipBot) askSendRecipient(sender *tb.User, amount int) {
+	_, err := bot.startDialog(sender, sendCommand, sendDialogRecipient, sendDialogData{Amount: amount})
 	if err != nil {
-		log.Errorln(err.Error())
+		log.Errorf("[/send] Could not start dialog: %s", err)
+		bot.trySendMessage(sender, errorTryLaterMessage)
 		return
 	}
-	ResetUserState(user, *bot)
+	bot.trySendMessage(sender, sendEnterRecipientMessage, tb.ForceReply)
+}
+
+// askSendAmount asks for the amount of a send to a Telegram user
+func (bot *TipBot) askSendAmount(m *tb.Message, data sendDialogData) {
+	toUserDb, err := bot.getSendRecipient(data.ToUsername)
+	if err != nil {
+		bot.trySendMessage(m.Sender, fmt.Sprintf(sendUserHasNoWalletMessage, MarkdownEscape("@"+data.ToUsername)))
+		log.Printf("[/send] Error: %v", err)
+		return
+	}
+	data.ToID = toUserDb.Telegram.ID
+	_, err = bot.startDialog(m.Sender, sendCommand, sendDialogAmount, data)
+	if err != nil {
+		log.Errorf("[/send] Could not start dialog: %s", err)
+		bot.trySendMessage(m.Sender, errorTryLaterMessage)
+		return
+	}
+	bot.trySendMessage(m.Sender, fmt.Sprintf(sendEnterAmountMessage, MarkdownEscape("@"+data.ToUsername)), tb.ForceReply)
+}
+
+// sendRecipientStep handles the recipient that the user entered in a send dialog
+func (bot TipBot) sendRecipientStep(m *tb.Message, dialog *Dialog) {
+	var data sendDialogData
+	err := dialog.Decode(&data)
+	if err != nil {
+		log.Errorf("[/send] Could not decode dialog: %s", err)
+		bot.endDialog(dialog)
+		return
+	}
+	recipient := strings.TrimSpace(m.Text)
+	if lightning.IsLightningAddress(recipient) {
+		bot.endDialog(dialog)
+		err = bot.sendToLightningAddress(m, recipient, data.Amount)
+		if err != nil {
+			log.Errorln(err.Error())
+		}
+		return
+	}
+	username := strings.TrimPrefix(recipient, "@")
+	if len(username) == 0 || strings.Contains(username, " ") {
+		bot.trySendMessage(m.Sender, sendEnterRecipientMessage, tb.ForceReply)
+		return
+	}
+	if data.Amount < 1 {
+		data.ToUsername = username
+		bot.askSendAmount(m, data)
+		return
+	}
+	toUserDb, err := bot.getSendRecipient(username)
+	if err != nil {
+		bot.trySendMessage(m.Sender, fmt.Sprintf(sendUserHasNoWalletMessage, MarkdownEscape("@"+username)))
+		log.Printf("[/send] Error: %v", err)
+		return
+	}
+	data.ToID, data.ToUsername = toUserDb.Telegram.ID, username
+	bot.confirmSendDialog(m, dialog, data)
+}
+
+// sendAmountStep handles the amount that the user entered in a send dialog
+func (bot TipBot) sendAmountStep(m *tb.Message, dialog *Dialog) {
+	var data sendDialogData
+	err := dialog.Decode(&data)
+	if err != nil {
+		log.Errorf("[/send] Could not decode dialog: %s", err)
+		bot.endDialog(dialog)
+		return
+	}
+	amount, err := parseDialogAmount(m.Text)
+	if err != nil {
+		bot.trySendMessage(m.Sender, fmt.Sprintf(sendEnterAmountMessage, MarkdownEscape("@"+data.ToUsername)), tb.ForceReply)
+		return
+	}
+	data.Amount = amount
+	bot.confirmSendDialog(m, dialog, data)
+}
+
+// confirmSendDialog asks for the confirmation of a send that was completed in a dialog
+func (bot TipBot) confirmSendDialog(m *tb.Message, dialog *Dialog, data sendDialogData) {
+	// donations to the bot itself are handled by parseCmdDonHandler
+	donation := *m
+	donation.Text = fmt.Sprintf("/send %d @%s", data.Amount, data.ToUsername)
+	if bot.parseCmdDonHandler(&donation) == nil {
+		bot.endDialog(dialog)
+		return
+	}
+	bot.confirmSend(m.Sender, data)
+}
+
+// cancelPaymentHandler invoked when user clicked cancel on payment confirmation
+func (bot *TipBot) cancelSendHandler(c *tb.Callback) {
+	// end the dialog immediately
+	dialog, err := bot.getDialog(c.Sender, sendCommand)
+	if err == nil {
+		bot.endDialog(dialog)
+	}
 
 	// delete the confirmation message
 	err = bot.telegram.Delete(c.Message)
@@ -223,58 +354,80 @@ func (bot *TipBot) sendHandler(c *tb.Callback) {
 	if err != nil {
 		log.Errorln("[sendHandler] " + err.Error())
 	}
-	// decode callback data
-	// log.Debug("[sendHandler] Callback: %s", c.Data)
-	user, err := GetUser(c.Sender, *bot)
+	// the dialog ends here unless a second factor is needed
+	dialog, err := bot.takeDialog(c.Sender, sendCommand, sendDialogConfirm)
 	if err != nil {
-		log.Printf("[GetUser] User: %d: %s", c.Sender.ID, err.Error())
+		log.Errorf("[sendHandler] No send to confirm for user %d: %v", c.Sender.ID, err)
+		bot.trySendMessage(c.Sender, dialogExpiredMessage)
 		return
 	}
-	if user.StateKey != lnbits.UserStateConfirmSend {
-		log.Errorf("[sendHandler] User StateKey does not match! User: %d: StateKey: %d", c.Sender.ID, user.StateKey)
+	var data sendDialogData
+	err = dialog.Decode(&data)
+	if err != nil {
+		log.Errorf("[sendHandler] Could not decode dialog: %s", err)
 		return
 	}
-
-	// decode StateData in which we have information about the send payment
-	splits := strings.Split(user.StateData, "|")
-	if len(splits) < 3 {
-		log.Error("[sendHandler] Not enough arguments in callback data")
-		log.Errorf("user.StateData: %s", user.StateData)
+	user, err := GetUser(c.Sender, *bot)
+	if err != nil {
+		log.Errorf("[sendHandler] Error: %s", err)
 		return
 	}
-	toId, err := strconv.Atoi(splits[0])
+	if needsSecondFactor(user, data.Amount) {
+		data.SecondFactor, err = bot.askSecondFactor(user, c.Sender, data.Amount)
+		if err == nil {
+			err = bot.continueDialog(dialog, sendDialogSecondFactor, data)
+		}
+		if err != nil {
+			log.Errorf("[sendHandler] Could not ask for confirmation: %s", err)
+			bot.trySendMessage(c.Sender, errorTryLaterMessage)
+		}
+		return
+	}
+	bot.send(c.Sender, data, false)
+}
+
+// sendSecondFactorStep handles the PIN or code that the user entered to confirm a send
+func (bot TipBot) sendSecondFactorStep(m *tb.Message, dialog *Dialog) {
+	var data sendDialogData
+	err := dialog.Decode(&data)
 	if err != nil {
-		log.Errorln("[sendHandler] " + err.Error())
+		bot.endDialog(dialog)
+		log.Errorf("[/send] Could not decode dialog: %s", err)
+		return
 	}
-	toUserStrWithoutAt := splits[1]
-	amount, err := strconv.Atoi(splits[2])
+	user, err := GetUser(m.Sender, bot)
 	if err != nil {
-		log.Errorln("[sendHandler] " + err.Error())
+		log.Errorf("[/send] Error: %s", err)
+		return
 	}
-	sendMemo := ""
-	if len(splits) > 3 {
-		sendMemo = strings.Join(splits[3:], "|")
+	if bot.secondFactorStep(m, dialog, user, &data.SecondFactor, &data) {
+		bot.send(m.Sender, data, true)
 	}
+}
 
-	// reset state
-	ResetUserState(user, *bot)
+// send sends the sats of a /send dialog
+func (bot *TipBot) send(from *tb.User, data sendDialogData, confirmed bool) {
+	toId, toUserStrWithoutAt, amount, sendMemo := data.ToID, data.ToUsername, data.Amount, data.Memo
 
 	// we can now get the wallets of both users
 	to := &tb.User{ID: toId, Username: toUserStrWithoutAt}
-	from := c.Sender
 	toUserStrMd := GetUserStrMd(to)
 	fromUserStrMd := GetUserStrMd(from)
 	toUserStr := GetUserStr(to)
 	fromUserStr := GetUserStr(from)
 
 	transactionMemo := fmt.Sprintf("Send from %s to %s (%d sat).", fromUserStr, toUserStr, amount)
-	t := NewTransaction(bot, from, to, amount, TransactionType("send"))
+	options := []TransactionOption{TransactionType("send")}
+	if confirmed {
+		options = append(options, TransactionConfirmed())
+	}
+	t := NewTransaction(bot, from, to, amount, options...)
 	t.Memo = transactionMemo
 
 	success, err := t.Send()
 	if !success || err != nil {
 		// NewMessage(m, WithDuration(0, bot.telegram))
-		bot.trySendMessage(c.Sender, fmt.Sprintf(sendErrorMessage, err))
+		bot.trySendMessage(from, fmt.Sprintf(sendErrorMessage, err))
 		errmsg := fmt.Sprintf("[/send] Error: Transaction failed. %s", err)
 		log.Errorln(errmsg)
 		return
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/recovery"
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+	"gorm.io/gorm"
+)
+
+// shutdownTimeout is how long the bot waits for running handlers and requests when it stops
+const shutdownTimeout = 20 * time.Second
+
+// handlerTracker counts the running telegram handlers so that they can finish before the bot stops
+type handlerTracker struct {
+	mu       sync.Mutex
+	running  int
+	closed   bool
+	idle     chan struct{}
+	stopping chan struct{}
+}
+
+func newHandlerTracker() *handlerTracker {
+	return &handlerTracker{stopping: make(chan struct{})}
+}
+
+// done is closed when the bot starts to stop, background jobs don't start new work afterwards
+func (t *handlerTracker) done() <-chan struct{} {
+	if t == nil {
+		return nil
+	}
+	return t.stopping
+}
+
+// begin registers a running handler. It returns false if the bot stopped and the update must be dropped.
+func (t *handlerTracker) begin() bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.running++
+	return true
+}
+
+// end unregisters a handler that finished
+func (t *handlerTracker) end() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running--
+	if t.running == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// drain waits up to timeout for the running handlers and stops new handlers afterwards. Handlers that
+// begin while it waits are waited for too, the updates must be stopped before. It returns the number
+// of handlers that are still running.
+func (t *handlerTracker) drain(timeout time.Duration) int {
+	deadline := time.After(timeout)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		close(t.stopping)
+	}
+	for t.running > 0 {
+		idle := make(chan struct{})
+		t.idle = idle
+		t.mu.Unlock()
+		select {
+		case <-idle:
+			t.mu.Lock()
+		case <-deadline:
+			t.mu.Lock()
+			t.closed = true
+			return t.running
+		}
+	}
+	t.closed = true
+	return 0
+}
+
+// tracked wraps a telebot handler so that it is drained when the bot stops
+func (bot TipBot) tracked(handler interface{}) interface{} {
+	switch h := handler.(type) {
+	case func(*tb.Message):
+		return func(m *tb.Message) {
+			if !bot.inFlight.begin() {
+				return
+			}
+			defer bot.inFlight.end()
+			h(m)
+		}
+	case func(*tb.Callback):
+		return func(c *tb.Callback) {
+			if !bot.inFlight.begin() {
+				return
+			}
+			defer bot.inFlight.end()
+			h(c)
+		}
+	case func(*tb.Query):
+		return func(q *tb.Query) {
+			if !bot.inFlight.begin() {
+				return
+			}
+			defer bot.inFlight.end()
+			h(q)
+		}
+	case func(*tb.ChosenInlineResult):
+		return func(r *tb.ChosenInlineResult) {
+			if !bot.inFlight.begin() {
+				return
+			}
+			defer bot.inFlight.end()
+			h(r)
+		}
+	}
+	panic(fmt.Sprintf("tracked: unsupported handler %T", handler))
+}
+
+// goTracked runs f in a goroutine that is drained like the handlers when the bot stops. Panics of f
+// are recovered and reported with source. f is not run if the bot stopped.
+func (bot TipBot) goTracked(source string, f func()) {
+	if !bot.inFlight.begin() {
+		return
+	}
+	go func() {
+		defer bot.inFlight.end()
+		defer recovery.Recover(source, nil, nil)
+		f()
+	}()
+}
+
+// httpServer is a server that is shut down with the bot
+type httpServer interface {
+	Shutdown(ctx context.Context) error
+}
+
+// stopOnSignal stops the updates on SIGTERM or SIGINT, bot.telegram.Start returns afterwards
+func (bot TipBot) stopOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		log.Infof("[Shutdown] Received %s, stopping", sig)
+		bot.stopUpdates()
+	}()
+}
+
+// stopUpdates stops the telegram poller. The webhook rejects new updates before, so that
+// Telegram delivers them again after the restart.
+func (bot TipBot) stopUpdates() {
+	if webhook, ok := bot.telegram.Poller.(*telegramWebhook); ok {
+		webhook.close()
+	}
+	bot.telegram.Stop()
+}
+
+// handlePendingUpdates handles the updates that the webhook accepted but the stopped poller did not
+// hand to the handlers anymore. Pending updates of the long poller were not confirmed to Telegram yet.
+func (bot TipBot) handlePendingUpdates() {
+	if _, ok := bot.telegram.Poller.(*telegramWebhook); !ok {
+		return
+	}
+	for {
+		select {
+		case update := <-bot.telegram.Updates:
+			bot.telegram.ProcessUpdate(update)
+		default:
+			return
+		}
+	}
+}
+
+// shutdown waits for the running handlers, shuts down the HTTP servers and closes the databases.
+// The updates must be stopped before, updates that were not handled yet are delivered again by
+// Telegram after the restart.
+func (bot TipBot) shutdown(servers map[string]httpServer) {
+	bot.handlePendingUpdates()
+	if running := bot.inFlight.drain(shutdownTimeout); running > 0 {
+		log.Warnf("[Shutdown] %d handlers did not finish within %s", running, shutdownTimeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for name, server := range servers {
+		err := server.Shutdown(ctx)
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("[Shutdown] Could not shut down %s server: %s", name, err)
+		}
+	}
+	err := bot.store.Close()
+	if err != nil {
+		log.Errorf("[Shutdown] Could not close store: %s", err)
+	}
+	for name, db := range map[string]*gorm.DB{"user": bot.database, "transaction": bot.txLogger} {
+		err = closeDatabase(db)
+		if err != nil {
+			log.Errorf("[Shutdown] Could not close %s database: %s", name, err)
+		}
+	}
+	log.Infof("[Shutdown] Stopped")
+}
+
+func closeDatabase(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+func TestHandlerTracker(t *testing.T) {
+	tracker := newHandlerTracker()
+	bot := TipBot{inFlight: tracker}
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	handler := bot.tracked(func(c *tb.Callback) {
+		close(started)
+		<-finish
+	}).(func(*tb.Callback))
+	go handler(&tb.Callback{})
+	<-started
+
+	drained := make(chan int)
+	go func() {
+		drained <- tracker.drain(time.Second)
+	}()
+	select {
+	case <-drained:
+		t.Fatal("drain returned while a handler was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(finish)
+	if running := <-drained; running != 0 {
+		t.Errorf("drain() = %d running handlers, want 0", running)
+	}
+
+	called := false
+	bot.tracked(func(c *tb.Callback) {
+		called = true
+	}).(func(*tb.Callback))(&tb.Callback{})
+	if called {
+		t.Error("handler was called after the bot stopped")
+	}
+}
+
+func TestHandlerTracker_timeout(t *testing.T) {
+	tracker := newHandlerTracker()
+	tracker.begin()
+	if running := tracker.drain(10 * time.Millisecond); running != 1 {
+		t.Errorf("drain() = %d running handlers, want 1", running)
+	}
+	select {
+	case <-tracker.done():
+	default:
+		t.Error("background jobs were not stopped")
+	}
+}
+
+func TestHandlerTracker_lateHandler(t *testing.T) {
+	tracker := newHandlerTracker()
+	bot := TipBot{inFlight: tracker}
+	tracker.begin()
+	drained := make(chan int)
+	go func() {
+		drained <- tracker.drain(time.Second)
+	}()
+
+	// an update that was accepted before the poller stopped is still handled
+	finish := make(chan struct{})
+	saved := make(chan struct{})
+	handled := false
+	bot.tracked(func(m *tb.Message) {
+		handled = true
+		bot.goTracked("test", func() {
+			<-finish
+			close(saved)
+		})
+	}).(func(*tb.Message))(&tb.Message{})
+	if !handled {
+		t.Fatal("handler was not called while draining")
+	}
+	tracker.end()
+	select {
+	case <-drained:
+		t.Fatal("drain returned while a goroutine of a handler was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(finish)
+	if running := <-drained; running != 0 {
+		t.Errorf("drain() = %d running handlers, want 0", running)
+	}
+	<-saved
+
+	bot.goTracked("test", func() {
+		t.Error("goroutine was started after the bot stopped")
+	})
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	"github.com/LightningTipBot/LightningTipBot/internal/metrics"
+	"github.com/LightningTipBot/LightningTipBot/internal/storage"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const (
+	secondFactorPinMessage    = "🔐 Enter your PIN to confirm the payment of %d sat."
+	secondFactorCodeMessage   = "🔐 Enter the code `%s` to confirm the payment of %d sat."
+	secondFactorWrongMessage  = "🚫 Wrong. %d attempts left."
+	secondFactorFailedMessage = "🚫 Too many wrong attempts. The payment was cancelled."
+	limitsMessage             = "🛡 *Spending limits*\n\n" +
+		"Per payment: %s\n" +
+		"Per 24 hours: %s (%d sat spent)\n" +
+		"Confirmation above: %s (%s)\n\n" +
+		"Set lower limits with `/limits <payment|daily|confirm> <amount>`, `0` resets a limit. Set a PIN with `/pin <pin>`."
+	limitsUpdatedMessage = "✅ Spending limit updated."
+	limitsHelpText       = "📖 Oops, that didn't work. %s\n\n" +
+		"*Usage:* `/limits [<payment|daily|confirm> <amount> [<pin>]]`\n" +
+		"*Example:* `/limits daily 50000`\n" +
+		"If you have a PIN, you need it to raise a limit."
+	pinSetMessage     = "✅ PIN set. You need it to confirm large payments."
+	pinRemovedMessage = "✅ PIN removed. Large payments are confirmed with a code."
+	pinWrongMessage   = "🚫 Wrong PIN."
+	pinHelpText       = "📖 Oops, that didn't work. %s\n\n" +
+		"*Usage:* `/pin <new pin> [<current pin>]` or `/pin remove <current pin>`\n" +
+		"Your PIN must have %d to %d digits. Your message is deleted right away."
+	pinInvalidMessage = "Your PIN must have %d to %d digits."
+	pinLockedMessage  = "🔒 PIN locked: %s."
+	pinLockoutAlert   = "🔒 %s entered %d wrong PINs or codes and is locked out for %d minutes."
+
+	// spendingWindow is the period of the daily limit
+	spendingWindow = 24 * time.Hour
+	// spendingLockTTL is the lease of the lock that serializes the payments of a user. /link revoke makes
+	// up to eight requests to LNbits under the lock, the lease outlasts them even if they time out.
+	spendingLockTTL     = 10 * lnbits.RequestTimeout
+	spendingLockTimeout = 10 * time.Second
+
+	secondFactorAttempts = 3
+	confirmationCodeSize = 6
+	pinMinLength         = 4
+	pinMaxLength         = 8
+
+	// pinLockoutThreshold is the number of wrong PINs and codes of a user after which PIN checks are locked
+	pinLockoutThreshold = 5
+	// pinLockoutBase is the first lockout, every further wrong PIN doubles it up to pinLockoutMax
+	pinLockoutBase = 5 * time.Minute
+	pinLockoutMax  = 24 * time.Hour
+	// pinFailuresTTL is the time after the last wrong PIN after which the failures are forgotten
+	pinFailuresTTL = 2 * pinLockoutMax
+)
+
+var (
+	errSpendingLimit        = errors.New("spending limit exceeded")
+	errConfirmationRequired = errors.New("payment needs a confirmation")
+	errAccountFrozen        = errors.New("your account is frozen")
+	errPinWrong             = errors.New("wrong PIN")
+	errPinLocked            = errors.New("too many wrong PINs")
+)
+
+// spendingLimits are the limits of a user in sat, 0 means no limit
+type spendingLimits struct {
+	MaxPayment   int
+	DailyLimit   int
+	ConfirmAbove int
+}
+
+// effectiveLimit returns the lower of the limit of the bot and of the user, 0 if neither is set
+func effectiveLimit(bot int, user int64) int {
+	if bot > 0 && (user <= 0 || int(user) > bot) {
+		return bot
+	}
+	if user > 0 {
+		return int(user)
+	}
+	return 0
+}
+
+// userSpendingLimits returns the limits that apply to the payments of user
+func userSpendingLimits(user *lnbits.User) spendingLimits {
+	spending := currentConfiguration().Spending
+	return spendingLimits{
+		MaxPayment:   effectiveLimit(spending.MaxPayment, user.Spending.MaxPayment),
+		DailyLimit:   effectiveLimit(spending.DailyLimit, user.Spending.DailyLimit),
+		ConfirmAbove: effectiveLimit(spending.ConfirmAbove, user.Spending.ConfirmAbove),
+	}
+}
+
+// checkSpending returns errAccountFrozen if the user is frozen, errSpendingLimit if a payment
+// of amount exceeds a limit of the user and errConfirmationRequired if it needs a confirmation
+// that it didn't get. The error messages are shown to the user.
+func (bot TipBot) checkSpending(user *lnbits.User, amount int, confirmed bool) error {
+	if user.Frozen {
+		return fmt.Errorf("%w, you can receive payments but you can't send or pay until the operators of the bot unfreeze it", errAccountFrozen)
+	}
+	limits := userSpendingLimits(user)
+	if limits.MaxPayment > 0 && amount > limits.MaxPayment {
+		return fmt.Errorf("%w, you can spend at most %d sat per payment", errSpendingLimit, limits.MaxPayment)
+	}
+	if limits.ConfirmAbove > 0 && amount > limits.ConfirmAbove && !confirmed {
+		return fmt.Errorf("%w, payments above %d sat can only be made with /send or /pay in the private chat with the bot", errConfirmationRequired, limits.ConfirmAbove)
+	}
+	if limits.DailyLimit > 0 {
+		spent, err := bot.transactions.SpentSince(user.Telegram.ID, time.Now().Add(-spendingWindow))
+		if err != nil {
+			return err
+		}
+		if spent+amount > limits.DailyLimit {
+			left := limits.DailyLimit - spent
+			if left < 0 {
+				left = 0
+			}
+			return fmt.Errorf("%w, you can spend %d more sat in the next 24 hours", errSpendingLimit, left)
+		}
+	}
+	return nil
+}
+
+// checkUserSpending checks the limits of a Telegram user for a payment that can't be confirmed,
+// e.g. before an inline send or a faucet is created
+func (bot TipBot) checkUserSpending(from *tb.User, amount int) error {
+	user, err := GetUser(from, bot)
+	if err != nil {
+		return err
+	}
+	return bot.checkSpending(user, amount, false)
+}
+
+// lockSpending serializes the payments of a user so that concurrent payments can't exceed the daily limit
+func (bot TipBot) lockSpending(user *tb.User) (*storage.Lock, error) {
+	return bot.store.Lock("spending:"+strconv.Itoa(user.ID), RandStringRunes(8), spendingLockTTL, spendingLockTimeout)
+}
+
+func (bot TipBot) unlockSpending(lock *storage.Lock) {
+	err := bot.store.Release(lock)
+	if err != nil {
+		log.Errorf("[unlockSpending] Could not release %s: %s", lock.Key, err)
+	}
+}
+
+// payInvoice pays an invoice of amount sat from the wallet of the user if it is within the
+// spending limits of the user and logs the payment
+func (bot TipBot) payInvoice(from *tb.User, paymentRequest string, amount int, memo string, transactionType string, confirmed bool) (lnbits.BitInvoice, error) {
+	lock, err := bot.lockSpending(from)
+	if err != nil {
+		return lnbits.BitInvoice{}, err
+	}
+	defer bot.unlockSpending(lock)
+	user, err := GetUser(from, bot)
+	if err != nil {
+		return lnbits.BitInvoice{}, err
+	}
+	err = bot.checkSpending(user, amount, confirmed)
+	if err != nil {
+		metrics.Payment(transactionType, metrics.PaymentRejected, amount)
+		return lnbits.BitInvoice{}, err
+	}
+	invoice, err := user.Wallet.Pay(lnbits.PaymentParams{Out: true, Bolt11: paymentRequest}, *user.Wallet)
+	if err != nil {
+		metrics.Payment(transactionType, metrics.PaymentFailed, amount)
+	} else {
+		metrics.Payment(transactionType, metrics.PaymentSuccess, amount)
+	}
+	t := &Transaction{
+		Time:         time.Now(),
+		FromId:       from.ID,
+		FromUser:     GetUserStr(from),
+		Type:         transactionType,
+		Amount:       amount,
+		Memo:         memo,
+		Success:      err == nil,
+		FromWallet:   user.Wallet.ID,
+		FromLNbitsID: user.ID,
+	}
+	logErr := bot.transactions.SaveTransaction(t)
+	if logErr != nil {
+		log.Errorf("[payInvoice] Could not log payment: %s", logErr)
+	}
+	return invoice, err
+}
+
+// secondFactor is part of the dialog data of payments that wait for the PIN of the user or a confirmation code
+type secondFactor struct {
+	// CodeHash is the hash of the code that was sent to a user without PIN
+	CodeHash string `json:"code_hash,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+}
+
+// needsSecondFactor reports whether a payment of amount has to be confirmed with the PIN or a code
+func needsSecondFactor(user *lnbits.User, amount int) bool {
+	limits := userSpendingLimits(user)
+	return limits.ConfirmAbove > 0 && amount > limits.ConfirmAbove
+}
+
+// askSecondFactor asks the user for the PIN or sends a confirmation code if the user has no PIN
+func (bot TipBot) askSecondFactor(user *lnbits.User, to *tb.User, amount int) (secondFactor, error) {
+	if len(user.Spending.PinHash) > 0 {
+		bot.trySendMessage(to, fmt.Sprintf(secondFactorPinMessage, amount), tb.ForceReply)
+		return secondFactor{}, nil
+	}
+	code, err := newConfirmationCode()
+	if err != nil {
+		return secondFactor{}, err
+	}
+	codeHash, err := hashSecret(code)
+	if err != nil {
+		return secondFactor{}, err
+	}
+	bot.trySendMessage(to, fmt.Sprintf(secondFactorCodeMessage, code, amount), tb.ForceReply)
+	return secondFactor{CodeHash: codeHash}, nil
+}
+
+// verify checks the PIN or code that the user entered
+func (f secondFactor) verify(user *lnbits.User, input string) bool {
+	input = strings.TrimSpace(input)
+	if len(f.CodeHash) > 0 {
+		return verifySecret(f.CodeHash, input)
+	}
+	return verifyPin(user, input)
+}
+
+// PinFailures counts the wrong PINs and codes of a user in all PIN checks
+type PinFailures struct {
+	TelegramID  int       `json:"telegram_id"`
+	Count       int       `json:"count"`
+	LockedUntil time.Time `json:"locked_until"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func (f PinFailures) Key() string {
+	return "pin-failures:" + strconv.Itoa(f.TelegramID)
+}
+
+// Expires returns when the failures are forgotten
+func (f PinFailures) Expires() time.Time {
+	return f.UpdatedAt.Add(pinFailuresTTL)
+}
+
+// pinLockout returns how long PIN checks are locked after count wrong PINs, 0 below pinLockoutThreshold
+func pinLockout(count int) time.Duration {
+	if count < pinLockoutThreshold {
+		return 0
+	}
+	lockout := pinLockoutBase
+	for i := pinLockoutThreshold; i < count && lockout < pinLockoutMax; i++ {
+		lockout *= 2
+	}
+	if lockout > pinLockoutMax {
+		lockout = pinLockoutMax
+	}
+	return lockout
+}
+
+// attemptPin checks a PIN or code of the user with verify unless the user is locked out after too many
+// wrong attempts. It returns errPinWrong and counts the failure if verify rejects the PIN. While the user is
+// locked out, it returns an error wrapping errPinLocked that tells the user how long to wait.
+func (bot TipBot) attemptPin(from *tb.User, verify func() bool) error {
+	failures := &PinFailures{TelegramID: from.ID}
+	// checks of the same user wait for each other so that no failure is lost
+	lock, err := bot.store.Lock(failures.Key(), RandStringRunes(8), spendingLockTTL, spendingLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer bot.store.Release(lock)
+	err = bot.store.Get(failures)
+	if err != nil && err != storage.ErrNotFound {
+		return err
+	}
+	if wait := time.Until(failures.LockedUntil); wait > 0 {
+		return fmt.Errorf("%w, please try again in %d minutes", errPinLocked, int(math.Ceil(wait.Minutes())))
+	}
+	if verify() {
+		if failures.Count > 0 {
+			return bot.store.DeleteKey(failures.Key())
+		}
+		return nil
+	}
+	failures.Count++
+	failures.UpdatedAt = time.Now()
+	if lockout := pinLockout(failures.Count); lockout > 0 {
+		failures.LockedUntil = failures.UpdatedAt.Add(lockout)
+		log.Warnf("[pin] %s entered %d wrong PINs or codes and is locked out for %s", GetUserStr(from), failures.Count, lockout)
+		bot.alertAdmins(fmt.Sprintf(pinLockoutAlert, GetUserStr(from), failures.Count, int(lockout.Minutes())))
+	}
+	err = bot.store.SetLocked(lock, failures)
+	if err != nil {
+		return err
+	}
+	return errPinWrong
+}
+
+// checkPin checks the PIN of the user with attemptPin
+func (bot TipBot) checkPin(from *tb.User, user *lnbits.User, pin string) error {
+	return bot.attemptPin(from, func() bool {
+		return verifyPin(user, pin)
+	})
+}
+
+// pinFailedMessage returns the message for a failed PIN check, help returns the usage of the command
+func pinFailedMessage(err error, help func(string) string) string {
+	switch {
+	case errors.Is(err, errPinLocked):
+		return fmt.Sprintf(pinLockedMessage, err)
+	case errors.Is(err, errPinWrong):
+		return help(pinWrongMessage)
+	}
+	log.Errorf("[pin] Could not check PIN: %s", err)
+	return errorTryLaterMessage
+}
+
+// secondFactorStep checks the PIN or code that the user entered in a dialog of a payment.
+// It returns true if the payment is confirmed. Wrong attempts are counted in the dialog,
+// f has to point into data.
+func (bot TipBot) secondFactorStep(m *tb.Message, dialog *Dialog, user *lnbits.User, f *secondFactor, data interface{}) bool {
+	// don't leave the PIN in the chat
+	bot.tryDeleteMessage(m)
+	var err error
+	if len(f.CodeHash) > 0 {
+		err = bot.attemptPin(m.Sender, func() bool {
+			return f.verify(user, m.Text)
+		})
+	} else {
+		err = bot.checkPin(m.Sender, user, strings.TrimSpace(m.Text))
+	}
+	if err == nil {
+		// a PIN that was sent twice confirms the payment once
+		_, err = bot.takeDialog(m.Sender, dialog.Command, dialog.State)
+		return err == nil
+	}
+	if errors.Is(err, errPinLocked) {
+		bot.endDialog(dialog)
+		bot.trySendMessage(m.Sender, fmt.Sprintf(pinLockedMessage, err))
+		return false
+	}
+	if !errors.Is(err, errPinWrong) {
+		bot.endDialog(dialog)
+		log.Errorf("[secondFactor] Could not check PIN: %s", err)
+		bot.trySendMessage(m.Sender, errorTryLaterMessage)
+		return false
+	}
+	f.Attempts++
+	if f.Attempts >= secondFactorAttempts {
+		bot.endDialog(dialog)
+		log.Warnf("[secondFactor] %s entered a wrong PIN or code for /%s %d times", GetUserStr(m.Sender), dialog.Command, f.Attempts)
+		bot.trySendMessage(m.Sender, secondFactorFailedMessage)
+		return false
+	}
+	err = bot.continueDialog(dialog, dialog.State, data)
+	if err != nil {
+		log.Errorf("[secondFactor] Could not update dialog: %s", err)
+		bot.trySendMessage(m.Sender, errorTryLaterMessage)
+		return false
+	}
+	bot.trySendMessage(m.Sender, fmt.Sprintf(secondFactorWrongMessage, secondFactorAttempts-f.Attempts), tb.ForceReply)
+	return false
+}
+
+// isSecondFactorDialog reports whether the dialog waits for a PIN or a confirmation code
+func isSecondFactorDialog(dialog *Dialog) bool {
+	return (dialog.Command == payCommand && dialog.State == payDialogSecondFactor) ||
+		(dialog.Command == sendCommand && dialog.State == sendDialogSecondFactor)
+}
+
+// loggableText returns the text of a message without PINs and confirmation codes
+func (bot TipBot) loggableText(m *tb.Message) string {
+	fields := strings.Fields(m.Text)
+	if len(fields) == 0 {
+		return m.Text
+	}
+	command := strings.ToLower(fields[0])
+	switch {
+	case strings.HasPrefix(command, "/pin"):
+		return fields[0] + " [redacted]"
+	case strings.HasPrefix(command, "/limits") && len(fields) > 3:
+		return strings.Join(fields[:3], " ") + " [redacted]"
+	case m.Chat.Type == tb.ChatPrivate && !strings.HasPrefix(command, "/"):
+		dialogs := bot.userDialogs(m.Sender)
+		if len(dialogs) > 0 && isSecondFactorDialog(dialogs[0]) {
+			return "[redacted]"
+		}
+	}
+	return m.Text
+}
+
+// newConfirmationCode returns a random code of digits
+func newConfirmationCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", confirmationCodeSize, n.Int64()), nil
+}
+
+// hashSecret returns the bcrypt hash of a PIN or code, it includes a random salt
+func hashSecret(secret string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// verifySecret checks a PIN or code against its hash
+func verifySecret(hash string, secret string) bool {
+	return len(hash) > 0 && bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) == nil
+}
+
+// verifyPin checks the PIN of the user
+func verifyPin(user *lnbits.User, pin string) bool {
+	return verifySecret(user.Spending.PinHash, pin)
+}
+
+// validPin reports whether pin consists of pinMinLength to pinMaxLength digits
+func validPin(pin string) bool {
+	if len(pin) < pinMinLength || len(pin) > pinMaxLength {
+		return false
+	}
+	_, err := strconv.ParseUint(pin, 10, 64)
+	return err == nil
+}
+
+// raisesLimits reports whether a limit of after is higher than in before
+func raisesLimits(before spendingLimits, after spendingLimits) bool {
+	raises := func(before int, after int) bool {
+		return before > 0 && (after == 0 || after > before)
+	}
+	return raises(before.MaxPayment, after.MaxPayment) ||
+		raises(before.DailyLimit, after.DailyLimit) ||
+		raises(before.ConfirmAbove, after.ConfirmAbove)
+}
+
+func formatLimit(limit int) string {
+	if limit == 0 {
+		return "no limit"
+	}
+	return fmt.Sprintf("%d sat", limit)
+}
+
+func helpLimitsUsage(errormsg string) string {
+	return fmt.Sprintf(limitsHelpText, errormsg)
+}
+
+func helpPinUsage(errormsg string) string {
+	return fmt.Sprintf(pinHelpText, errormsg, pinMinLength, pinMaxLength)
+}
+
+// limitsHandler is invoked on /limits [<payment|daily|confirm> <amount>]
+func (bot TipBot) limitsHandler(ctx *Context) {
+	m := ctx.Message
+	user := ctx.User
+	kind, err := getArgumentFromCommand(m.Text, 1)
+	if err != nil {
+		limits := userSpendingLimits(user)
+		spent, err := bot.transactions.SpentSince(m.Sender.ID, time.Now().Add(-spendingWindow))
+		if err != nil {
+			log.Errorf("[/limits] Could not get spending of %s: %s", GetUserStr(m.Sender), err)
+			bot.trySendMessage(m.Sender, errorTryLaterMessage)
+			return
+		}
+		confirmation := "with a code"
+		if len(user.Spending.PinHash) > 0 {
+			confirmation = "with your PIN"
+		}
+		bot.trySendMessage(m.Sender, fmt.Sprintf(limitsMessage,
+			formatLimit(limits.MaxPayment), formatLimit(limits.DailyLimit), spent, formatLimit(limits.ConfirmAbove), confirmation))
+		return
+	}
+	argument, _ := getArgumentFromCommand(m.Text, 2)
+	amount, err := strconv.Atoi(argument)
+	if err != nil || amount < 0 {
+		bot.trySendMessage(m.Sender, helpLimitsUsage("Please enter an amount."))
+		return
+	}
+	before := userSpendingLimits(user)
+	switch strings.ToLower(kind) {
+	case "payment":
+		user.Spending.MaxPayment = int64(amount)
+	case "daily":
+		user.Spending.DailyLimit = int64(amount)
+	case "confirm":
+		user.Spending.ConfirmAbove = int64(amount)
+	default:
+		bot.trySendMessage(m.Sender, helpLimitsUsage(""))
+		return
+	}
+	after := userSpendingLimits(user)
+	if len(user.Spending.PinHash) > 0 && raisesLimits(before, after) {
+		// the PIN is in the message
+		bot.tryDeleteMessage(m)
+		pin, _ := getArgumentFromCommand(m.Text, 3)
+		err = bot.checkPin(m.Sender, user, pin)
+		if err != nil {
+			log.Warnf("[/limits] %s tried to raise a limit without their PIN", GetUserStr(m.Sender))
+			bot.trySendMessage(m.Sender, pinFailedMessage(err, helpLimitsUsage))
+			return
+		}
+	}
+	err = bot.users.SaveLimits(user)
+	if err != nil {
+		log.Errorf("[/limits] Could not save limits of %s: %s", GetUserStr(m.Sender), err)
+		bot.trySendMessage(m.Sender, errorTryLaterMessage)
+		return
+	}
+	log.Infof("[/limits] %s set %s limit to %d sat", GetUserStr(m.Sender), strings.ToLower(kind), amount)
+	bot.trySendMessage(m.Sender, limitsUpdatedMessage)
+}
+
+// pinHandler is invoked on /pin <new pin> [<current pin>] and /pin remove <current pin>
+func (bot TipBot) pinHandler(ctx *Context) {
+	m := ctx.Message
+	// the message contains the PIN, it is deleted in the private chat as well
+	bot.tryDeleteMessage(m)
+	user := ctx.User
+	pin, err := getArgumentFromCommand(m.Text, 1)
+	if err != nil {
+		bot.trySendMessage(m.Sender, helpPinUsage(""))
+		return
+	}
+	current, _ := getArgumentFromCommand(m.Text, 2)
+	if len(user.Spending.PinHash) > 0 {
+		err = bot.checkPin(m.Sender, user, current)
+		if err != nil {
+			log.Warnf("[/pin] %s entered a wrong PIN", GetUserStr(m.Sender))
+			bot.trySendMessage(m.Sender, pinFailedMessage(err, helpPinUsage))
+			return
+		}
+	}
+	message := pinSetMessage
+	if strings.ToLower(pin) == "remove" {
+		user.Spending.PinHash = ""
+		message = pinRemovedMessage
+	} else {
+		if !validPin(pin) {
+			bot.trySendMessage(m.Sender, helpPinUsage(fmt.Sprintf(pinInvalidMessage, pinMinLength, pinMaxLength)))
+			return
+		}
+		user.Spending.PinHash, err = hashSecret(pin)
+		if err != nil {
+			log.Errorf("[/pin] Could not hash PIN: %s", err)
+			bot.trySendMessage(m.Sender, errorTryLaterMessage)
+			return
+		}
+	}
+	err = bot.users.SavePin(user)
+	if err != nil {
+		log.Errorf("[/pin] Could not save PIN of %s: %s", GetUserStr(m.Sender), err)
+		bot.trySendMessage(m.Sender, errorTryLaterMessage)
+		return
+	}
+	log.Infof("[/pin] %s changed their PIN", GetUserStr(m.Sender))
+	bot.trySendMessage(m.Sender, message)
+}
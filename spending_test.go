@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	"golang.org/x/crypto/bcrypt"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+func Test_effectiveLimit(t *testing.T) {
+	tests := []struct {
+		bot  int
+		user int64
+		want int
+	}{
+		{0, 0, 0},
+		{100, 0, 100},
+		{0, 50, 50},
+		{100, 50, 50},
+		// users can't raise the limit of the bot
+		{100, 500, 100},
+	}
+	for _, tt := range tests {
+		if got := effectiveLimit(tt.bot, tt.user); got != tt.want {
+			t.Errorf("effectiveLimit(%d, %d) = %d, want %d", tt.bot, tt.user, got, tt.want)
+		}
+	}
+}
+
+func Test_raisesLimits(t *testing.T) {
+	before := spendingLimits{MaxPayment: 100, DailyLimit: 1000}
+	tests := []struct {
+		after spendingLimits
+		want  bool
+	}{
+		{spendingLimits{MaxPayment: 50, DailyLimit: 1000}, false},
+		{spendingLimits{MaxPayment: 100, DailyLimit: 1000, ConfirmAbove: 10}, false},
+		{spendingLimits{MaxPayment: 200, DailyLimit: 1000}, true},
+		{spendingLimits{MaxPayment: 100}, true},
+	}
+	for _, tt := range tests {
+		if got := raisesLimits(before, tt.after); got != tt.want {
+			t.Errorf("raisesLimits(%+v, %+v) = %v, want %v", before, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestTipBot_checkSpending(t *testing.T) {
+	db, txLogger := openFixture(t, "", "")
+	if err := migrateDatabases(db, txLogger); err != nil {
+		t.Fatal(err)
+	}
+	bot := TipBot{transactions: gormTransactions{db: txLogger}}
+	defer func(spending SpendingConfiguration) { Configuration.Spending = spending }(Configuration.Spending)
+	Configuration.Spending = SpendingConfiguration{MaxPayment: 1000, DailyLimit: 1500, ConfirmAbove: 500}
+
+	user := &lnbits.User{Telegram: &tb.User{ID: 1}}
+	for _, transaction := range []*Transaction{
+		{Time: time.Now().Add(-time.Hour), FromId: 1, Amount: 800, Success: true},
+		// failed, old and other payments don't count
+		{Time: time.Now(), FromId: 1, Amount: 800},
+		{Time: time.Now().Add(-2 * spendingWindow), FromId: 1, Amount: 800, Success: true},
+		{Time: time.Now(), FromId: 2, Amount: 800, Success: true},
+	} {
+		if err := bot.transactions.SaveTransaction(transaction); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		amount    int
+		confirmed bool
+		want      error
+	}{
+		{100, false, nil},
+		{600, false, errConfirmationRequired},
+		{700, true, nil},
+		{701, true, errSpendingLimit},
+		{1001, true, errSpendingLimit},
+	}
+	for _, tt := range tests {
+		if err := bot.checkSpending(user, tt.amount, tt.confirmed); !errors.Is(err, tt.want) {
+			t.Errorf("checkSpending(%d, %v) = %v, want %v", tt.amount, tt.confirmed, err, tt.want)
+		}
+	}
+
+	user.Spending.MaxPayment = 50
+	if err := bot.checkSpending(user, 100, false); !errors.Is(err, errSpendingLimit) {
+		t.Errorf("checkSpending() above limit of user = %v, want errSpendingLimit", err)
+	}
+}
+
+func TestSecondFactor(t *testing.T) {
+	user := &lnbits.User{}
+	if validPin("12a4") || validPin("123") || validPin("123456789") || !validPin("0123") {
+		t.Error("validPin() accepts invalid PINs or rejects valid ones")
+	}
+	if verifyPin(user, "") {
+		t.Error("verifyPin() accepts a user without PIN")
+	}
+	var err error
+	user.Spending.PinHash, err = hashSecret("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bcrypt.Cost([]byte(user.Spending.PinHash)); err != nil {
+		t.Errorf("hashSecret() = %q, want a bcrypt hash", user.Spending.PinHash)
+	}
+	if !verifyPin(user, "1234") || verifyPin(user, "4321") {
+		t.Error("verifyPin() does not check the PIN")
+	}
+	if !(secondFactor{}).verify(user, " 1234\n") {
+		t.Error("verify() rejects the PIN")
+	}
+
+	codeHash, err := hashSecret("123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := secondFactor{CodeHash: codeHash}
+	if !code.verify(user, "123456") || code.verify(user, "1234") {
+		t.Error("verify() of a code accepts the PIN or rejects the code")
+	}
+
+	// only bcrypt hashes are accepted
+	user.Spending.PinHash = "03ac674216f3e15c761ee1a5e255f067953623c8b388b4459e13f978d7c846f4"
+	if verifyPin(user, "1234") {
+		t.Error("verifyPin() accepts a SHA-256 hash")
+	}
+}
+
+func TestAttemptPin(t *testing.T) {
+	bot := newDialogTestBot()
+	user := &tb.User{ID: 1}
+	right := func() bool { return true }
+	wrong := func() bool { return false }
+	for i := 1; i < pinLockoutThreshold; i++ {
+		if err := bot.attemptPin(user, wrong); err != errPinWrong {
+			t.Fatalf("attemptPin() of wrong PIN = %v, want errPinWrong", err)
+		}
+	}
+	// the right PIN resets the failures
+	if err := bot.attemptPin(user, right); err != nil {
+		t.Fatalf("attemptPin() = %v", err)
+	}
+	for i := 0; i < pinLockoutThreshold; i++ {
+		if err := bot.attemptPin(user, wrong); err != errPinWrong {
+			t.Fatalf("attemptPin() of wrong PIN = %v, want errPinWrong", err)
+		}
+	}
+	if err := bot.attemptPin(user, right); !errors.Is(err, errPinLocked) {
+		t.Errorf("attemptPin() while locked out = %v, want errPinLocked", err)
+	}
+	if err := bot.attemptPin(&tb.User{ID: 2}, right); err != nil {
+		t.Errorf("attemptPin() of another user = %v", err)
+	}
+
+	for count, want := range map[int]time.Duration{
+		pinLockoutThreshold - 1: 0,
+		pinLockoutThreshold:     pinLockoutBase,
+		pinLockoutThreshold + 1: 2 * pinLockoutBase,
+		100:                     pinLockoutMax,
+	} {
+		if got := pinLockout(count); got != want {
+			t.Errorf("pinLockout(%d) = %s, want %s", count, got, want)
+		}
+	}
+}
+
+func TestTipBot_loggableText(t *testing.T) {
+	bot := newDialogTestBot()
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"/pin 1234 5678", "/pin [redacted]"},
+		{"/limits daily 100", "/limits daily 100"},
+		{"/limits daily 100 1234", "/limits daily 100 [redacted]"},
+		{"/balance", "/balance"},
+	}
+	for _, tt := range tests {
+		m := &tb.Message{Text: tt.text, Sender: &tb.User{ID: 1}, Chat: &tb.Chat{Type: tb.ChatPrivate}}
+		if got := bot.loggableText(m); got != tt.want {
+			t.Errorf("loggableText(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+
+	user := &tb.User{ID: 1}
+	if _, err := bot.startDialog(user, payCommand, payDialogSecondFactor, payDialogData{}); err != nil {
+		t.Fatal(err)
+	}
+	m := &tb.Message{Text: "1234", Sender: user, Chat: &tb.Chat{Type: tb.ChatPrivate}}
+	if got := bot.loggableText(m); got != "[redacted]" {
+		t.Errorf("loggableText() of PIN = %q, want [redacted]", got)
+	}
+}
+
+func TestScenario_pinLockout(t *testing.T) {
+	s := newScenario(t)
+	alice := s.newUser(2001, "alice", 1000)
+	bob := s.newUser(2002, "bob", 0)
+	Configuration.Telegram.AdminChatID = -100
+
+	s.private(alice, "/pin 1234")
+	s.expect(alice, pinSetMessage)
+	for i := 0; i < pinLockoutThreshold; i++ {
+		s.private(alice, "/pin 5678 0000")
+	}
+	s.expectIn(Configuration.Telegram.AdminChatID, "@alice entered 5 wrong PINs or codes")
+
+	// the right PIN is rejected in all PIN checks until the lockout ends
+	expectLocked := func() {
+		t.Helper()
+		messages := s.telegram.botMessages(int64(alice.ID))
+		if last := messages[len(messages)-1].Text; !strings.HasPrefix(last, "🔒 PIN locked: too many wrong PINs, please try again in 5 minutes") {
+			t.Errorf("last message = %q, want PIN locked", last)
+		}
+	}
+	s.private(alice, "/pin 5678 1234")
+	expectLocked()
+	s.private(alice, "/limits confirm 100")
+	s.expect(alice, limitsUpdatedMessage)
+	s.private(alice, "/limits confirm 0 1234")
+	expectLocked()
+	s.private(alice, "/send 500 @bob")
+	s.press(alice, s.expect(alice, "Do you want to pay to @bob?"), btnSend.Text)
+	s.expect(alice, "Enter your PIN to confirm the payment of 500 sat")
+	s.private(alice, "1234")
+	expectLocked()
+	s.checkBalance(alice, 1000)
+	s.checkBalance(bob, 0)
+}
@@ -17,10 +17,11 @@ const (
 	startWalletCreatedMessage = "🧮 Wallet created."
 	startWalletReadyMessage   = "✅ *Your wallet is ready.*"
 	startWalletErrorMessage   = "🚫 Error initializing your wallet. Try again later."
-	startNoUsernameMessage    = "☝️ It looks like you don't have a Telegram @username yet. That's ok, you don't need one to use this bot. However, to make better use of your wallet, set up a username in the Telegram settings. Then, enter /balance so the bot can update its record of you."
+	startNoUsernameMessage    = "☝️ It looks like you don't have a Telegram @username yet. That's ok, you don't need one to use this bot. However, to make better use of your wallet, set up a username in the Telegram settings. Then, enter /balance so the bot can update its record of you. You can also claim a Lightning Address with /address."
 )
 
-func (bot TipBot) startHandler(m *tb.Message) {
+func (bot TipBot) startHandler(ctx *Context) {
+	m := ctx.Message
 	if !m.Private() {
 		return
 	}
@@ -37,9 +38,9 @@ func (bot TipBot) startHandler(m *tb.Message) {
 	}
 	bot.tryDeleteMessage(walletCreationMsg)
 
-	bot.helpHandler(m)
+	bot.helpHandler(ctx)
 	bot.trySendMessage(m.Sender, startWalletReadyMessage)
-	bot.balanceHandler(m)
+	bot.balanceHandler(ctx)
 
 	// send the user a warning about the fact that they need to set a username
 	if len(m.Sender.Username) == 0 {
@@ -104,7 +105,8 @@ func (bot TipBot) createWallet(user *lnbits.User) error {
 	user.Wallet = &wallet[0]
 	user.Wallet.Client = bot.client
 	user.Initialized = false
-	err = UpdateUserRecord(user, bot)
+	user.Telegram = bot.copyLowercaseUser(user.Telegram)
+	err = bot.users.CreateUser(user)
 	if err != nil {
 		errormsg := fmt.Sprintf("[createWallet] Update user record error: %s", err)
 		log.Errorln(errormsg)
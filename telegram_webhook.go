@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const (
+	// telegramSecretHeader carries the secret token of the webhook in every request of Telegram
+	telegramSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+	// maxUpdateSize limits the size of an update that is read from a request
+	maxUpdateSize = 1 << 20
+)
+
+// telegramWebhook is a telebot poller that receives updates from Telegram with a webhook.
+// It is an http.Handler that is served by the webhook server of lnbits.
+type telegramWebhook struct {
+	secret string
+
+	mu      sync.RWMutex
+	updates chan tb.Update
+	stopped chan struct{}
+	stop    sync.Once
+}
+
+func newTelegramWebhook(secret string) *telegramWebhook {
+	return &telegramWebhook{secret: secret, stopped: make(chan struct{})}
+}
+
+// newTelegramPoller returns the poller of the configured updates mode
+func newTelegramPoller() tb.Poller {
+	if Configuration.Telegram.Updates == telegramUpdatesWebhook {
+		return newTelegramWebhook(Configuration.Telegram.WebhookSecret)
+	}
+	return &tb.LongPoller{Timeout: 60 * time.Second}
+}
+
+// Poll delivers the updates of the webhook to the bot until stop is closed
+func (w *telegramWebhook) Poll(b *tb.Bot, updates chan tb.Update, stop chan struct{}) {
+	w.mu.Lock()
+	select {
+	case <-w.stopped:
+	default:
+		w.updates = updates
+	}
+	w.mu.Unlock()
+	<-stop
+	w.close()
+}
+
+// close rejects all further updates. It returns when the updates that were accepted before are in
+// the channel of the bot.
+func (w *telegramWebhook) close() {
+	w.stop.Do(func() {
+		close(w.stopped)
+	})
+	w.mu.Lock()
+	w.updates = nil
+	w.mu.Unlock()
+}
+
+// ServeHTTP receives an update from Telegram. Requests without the secret token are rejected.
+// Telegram delivers an update again if the bot does not answer with 200 OK, e.g. while it restarts.
+func (w *telegramWebhook) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(request.Header.Get(telegramSecretHeader)), []byte(w.secret)) != 1 {
+		log.Warnf("[Telegram] Webhook request without secret token from %s", request.RemoteAddr)
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var update tb.Update
+	err := json.NewDecoder(io.LimitReader(request.Body, maxUpdateSize)).Decode(&update)
+	if err != nil {
+		log.Errorf("[Telegram] Could not decode update: %s", err)
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.updates == nil {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case w.updates <- update:
+		writer.WriteHeader(http.StatusOK)
+	case <-w.stopped:
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	case <-request.Context().Done():
+	}
+}
+
+// configureTelegramUpdates sets the webhook of the bot at Telegram in webhook mode and deletes it in
+// polling mode, Telegram doesn't answer getUpdates while a webhook is set. Pending updates are kept.
+func (bot TipBot) configureTelegramUpdates() error {
+	if _, ok := bot.telegram.Poller.(*telegramWebhook); !ok {
+		_, err := bot.telegram.Raw("deleteWebhook", map[string]bool{"drop_pending_updates": false})
+		if err != nil {
+			return fmt.Errorf("could not delete telegram webhook: %w", err)
+		}
+		return nil
+	}
+	params := map[string]string{
+		"url":          Configuration.Telegram.WebhookUrl,
+		"secret_token": Configuration.Telegram.WebhookSecret,
+	}
+	_, err := callTelegramMultipart(bot.telegram, "setWebhook", params, "certificate", Configuration.Telegram.WebhookCertificate)
+	if err != nil {
+		return fmt.Errorf("could not set telegram webhook: %w", err)
+	}
+	log.Infof("[Telegram] Receiving updates at %s", Configuration.Telegram.WebhookUrl)
+	return nil
+}
+
+// telegramWebhookPath is the path of the Telegram webhook on the webhook server of lnbits
+func telegramWebhookPath() string {
+	webhookUrl, err := url.Parse(Configuration.Telegram.WebhookUrl)
+	if err != nil {
+		return ""
+	}
+	return webhookUrl.Path
+}
+
+// callTelegramMultipart calls a method of the Telegram API with a multipart form. The file at path
+// is uploaded as field if path is not empty. telebot can't send all parameters of setWebhook.
+func callTelegramMultipart(b *tb.Bot, method string, params map[string]string, field string, path string) ([]byte, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for key, value := range params {
+		err := form.WriteField(key, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(path) > 0 {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		part, err := form.CreateFormFile(field, filepath.Base(path))
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(part, file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := form.Close()
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(b.URL+"/bot"+b.Token+"/"+method, form.FormDataContentType(), &body)
+	if urlErr, ok := err.(*url.Error); ok {
+		// the URL contains the api key
+		return nil, urlErr.Err
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Ok          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response of telegram: %w", err)
+	}
+	if !result.Ok {
+		return nil, fmt.Errorf("telegram: %s", result.Description)
+	}
+	return data, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// postUpdate sends an update to the webhook like Telegram does and returns the status
+func postUpdate(webhook http.Handler, secret string, update []byte) int {
+	request := httptest.NewRequest(http.MethodPost, "/telegram", bytes.NewReader(update))
+	request.Header.Set(telegramSecretHeader, secret)
+	recorder := httptest.NewRecorder()
+	webhook.ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+func TestTelegramWebhook(t *testing.T) {
+	webhook := newTelegramWebhook("s3cr3t")
+	update := []byte(`{"update_id": 1, "message": {"message_id": 1, "text": "/help"}}`)
+	if status := postUpdate(webhook, "s3cr3t", update); status != http.StatusServiceUnavailable {
+		t.Errorf("update before polling: status %d, want 503", status)
+	}
+
+	updates := make(chan tb.Update, 1)
+	stop := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		webhook.Poll(nil, updates, stop)
+		close(polled)
+	}()
+	for webhook.connected() == false {
+		time.Sleep(time.Millisecond)
+	}
+	for secret, want := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "s3cr3t": http.StatusOK} {
+		if status := postUpdate(webhook, secret, update); status != want {
+			t.Errorf("secret %q: status %d, want %d", secret, status, want)
+		}
+	}
+	if received := <-updates; received.ID != 1 || received.Message.Text != "/help" {
+		t.Errorf("received update %+v", received)
+	}
+	if status := postUpdate(webhook, "s3cr3t", []byte("{")); status != http.StatusBadRequest {
+		t.Errorf("invalid update: status %d, want 400", status)
+	}
+
+	// updates that can't be delivered while the bot stops are rejected, Telegram sends them again
+	updates <- tb.Update{}
+	done := make(chan int)
+	go func() {
+		done <- postUpdate(webhook, "s3cr3t", update)
+	}()
+	close(stop)
+	<-polled
+	if status := <-done; status != http.StatusServiceUnavailable {
+		t.Errorf("update while stopping: status %d, want 503", status)
+	}
+}
+
+func TestTelegramWebhook_close(t *testing.T) {
+	webhook := newTelegramWebhook("s3cr3t")
+	update := []byte(`{"update_id": 1, "message": {"message_id": 1, "text": "/help"}}`)
+	updates := make(chan tb.Update, 1)
+	stop := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		webhook.Poll(nil, updates, stop)
+		close(polled)
+	}()
+	for webhook.connected() == false {
+		time.Sleep(time.Millisecond)
+	}
+	if status := postUpdate(webhook, "s3cr3t", update); status != http.StatusOK {
+		t.Fatalf("update before closing: status %d, want 200", status)
+	}
+
+	// the webhook rejects updates before the poller stops, accepted updates stay in the channel
+	webhook.close()
+	if status := postUpdate(webhook, "s3cr3t", update); status != http.StatusServiceUnavailable {
+		t.Errorf("update after closing: status %d, want 503", status)
+	}
+	if len(updates) != 1 {
+		t.Errorf("%d updates in the channel, want 1", len(updates))
+	}
+	close(stop)
+	<-polled
+}
+
+func (w *telegramWebhook) connected() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.updates != nil
+}
+
+// TestRecordedUpdates feeds the recorded updates in testdata/updates through the webhook and the handlers
+func TestRecordedUpdates(t *testing.T) {
+	webhook := newTelegramWebhook("s3cr3t")
+	telegram, fake := newFakeTelegram(t, webhook)
+	newTestBot(t, telegram, nil)
+	go telegram.Start()
+	defer telegram.Stop()
+	for !webhook.connected() {
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, test := range []struct {
+		update   string
+		messages int
+		contains string
+	}{
+		{"help_private.json", 1, "/tip"},
+		{"text_group.json", 1, ""},
+		{"basics_private.json", 2, "Lightning"},
+	} {
+		update, err := ioutil.ReadFile(filepath.Join("testdata", "updates", test.update))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := postUpdate(webhook, "s3cr3t", update); status != http.StatusOK {
+			t.Fatalf("%s: status %d", test.update, status)
+		}
+		messages := fake.waitForCalls(t, "sendMessage", test.messages)
+		last := messages[len(messages)-1]
+		if len(test.contains) > 0 && (last["chat_id"] != "2001" || !strings.Contains(last["text"], test.contains)) {
+			t.Errorf("%s: sent %v, want a message to 2001 with %q", test.update, last, test.contains)
+		}
+	}
+	// the group message was ignored
+	if messages := fake.calls("sendMessage"); len(messages) != 2 {
+		t.Errorf("sent %d messages, want 2", len(messages))
+	}
+}
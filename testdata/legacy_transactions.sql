@@ -0,0 +1,3 @@
+-- transaction database as created by AutoMigrate before versioned migrations
+CREATE TABLE `transactions` (`id` integer,`time` datetime,`from_id` integer,`to_id` integer,`from_user` text,`to_user` text,`type` text,`amount` integer,`chat_id` integer,`chat_name` text,`memo` text,`success` numeric,`from_wallet` text,`to_wallet` text,`from_l_nbits_id` text,`to_l_nbits_id` text,PRIMARY KEY (`id`));
+INSERT INTO transactions (id, time, from_id, to_id, type, amount, success, from_wallet, to_wallet, from_l_nbits_id, to_l_nbits_id) VALUES (1, '2021-08-01 12:00:00', 1, 2, 'tip', 21, 1, 'w1', 'w2', 'u1', 'u2');
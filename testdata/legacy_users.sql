@@ -0,0 +1,12 @@
+-- user database as created by AutoMigrate before versioned migrations, in the SQL of gorm
+CREATE TABLE `users` (`id` text,`name` text,`initialized` numeric,`telegram_id` integer,`telegram_first_name` text,`telegram_last_name` text,`telegram_username` text,`telegram_language_code` text,`telegram_is_bot` numeric,`telegram_can_join_groups` numeric,`telegram_can_read_messages` numeric,`telegram_supports_inline` numeric,`wallet_id` text,`wallet_adminkey` text,`wallet_inkey` text,`wallet_balance` integer,`wallet_name` text,`wallet_user` text,`lnurl_min_receivable` integer,`lnurl_max_receivable` integer,`lnurl_description` text,`lnurl_avatar` text,PRIMARY KEY (`name`));
+CREATE TABLE `invoice_webhooks` (`token` text,`payment_hash` text,`wallet_id` text,`chat_id` integer,`message_id` text,`created_at` datetime,`delivered_at` datetime,PRIMARY KEY (`token`));
+CREATE INDEX `idx_invoice_webhooks_payment_hash` ON `invoice_webhooks`(`payment_hash`);
+CREATE TABLE `aliases` (`name` text,`user_name` text,`kind` integer,`created_at` datetime,`released_at` datetime,PRIMARY KEY (`name`));
+CREATE INDEX `idx_aliases_kind` ON `aliases`(`kind`);
+CREATE INDEX `idx_aliases_user_name` ON `aliases`(`user_name`);
+CREATE TABLE `zap_requests` (`payment_hash` text,`user_name` text,`request` text,`amount` integer,`created_at` datetime,`published_at` datetime,PRIMARY KEY (`payment_hash`));
+CREATE INDEX `idx_zap_requests_user_name` ON `zap_requests`(`user_name`);
+INSERT INTO users (id, name, initialized, telegram_id, telegram_username, wallet_id, wallet_adminkey, wallet_inkey) VALUES ('u1', '1', 1, 1, 'alice', 'w1', 'admin1', 'in1');
+INSERT INTO users (id, name, initialized, telegram_id, telegram_username, wallet_id, wallet_adminkey, wallet_inkey) VALUES ('u2', '2', 1, 2, 'bob', 'w2', 'admin2', 'in2');
+INSERT INTO aliases (name, user_name, kind, created_at) VALUES ('satoshi', '1', 0, '2021-08-01 12:00:00');
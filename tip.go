@@ -40,13 +40,18 @@ func TipCheckSyntax(m *tb.Message) (bool, string) {
 	return true, ""
 }
 
-func (bot *TipBot) tipHandler(m *tb.Message) {
-	// delete the tip message after a few seconds, this is default behaviour
-	defer NewMessage(m, WithDuration(time.Second*time.Duration(Configuration.Telegram.MessageDisposeDuration), bot.telegram))
-	// check and print all commands
-	bot.anyTextHandler(m)
-	// only if message is a reply
-	if !m.IsReply() {
+// disposeTip deletes tips after the message_dispose_duration
+func (bot TipBot) disposeTip(next Handler) Handler {
+	return func(ctx *Context) {
+		duration := time.Second * time.Duration(currentConfiguration().Telegram.MessageDisposeDuration)
+		bot.autoDispose(duration)(next)(ctx)
+	}
+}
+
+func (bot *TipBot) tipHandler(ctx *Context) {
+	m := ctx.Message
+	// only if message is a reply to a user, replies to channel posts have no sender
+	if !m.IsReply() || m.ReplyTo.Sender == nil {
 		NewMessage(m, WithDuration(0, bot.telegram))
 		bot.trySendMessage(m.Sender, helpTipUsage(fmt.Sprintf(tipDidYouReplyMessage)))
 		bot.trySendMessage(m.Sender, tipInviteGroupMessage)
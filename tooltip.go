@@ -9,7 +9,6 @@ import (
 
 	"github.com/LightningTipBot/LightningTipBot/internal/runtime"
 	"github.com/LightningTipBot/LightningTipBot/internal/storage"
-	"github.com/tidwall/buntdb"
 	"github.com/tidwall/gjson"
 
 	log "github.com/sirupsen/logrus"
@@ -102,7 +101,7 @@ func getTippersString(tippers []*tb.User) string {
 // tipTooltipExists checks if this tip is already known
 func tipTooltipExists(replyToId int, bot *TipBot) (bool, *TipTooltip) {
 	message := NewTipTooltip(&tb.Message{ReplyTo: &tb.Message{ID: replyToId}})
-	err := bot.bunt.Get(message)
+	err := bot.store.Get(message)
 	if err != nil {
 		return false, message
 	}
@@ -136,7 +135,7 @@ func tipTooltipHandler(m *tb.Message, bot *TipBot, amount int, initializedWallet
 		}
 		message := NewTipTooltip(msg, TipAmount(amount), Tips(1))
 		message.Tippers = appendUinqueUsersToSlice(message.Tippers, m.Sender)
-		runtime.IgnoreError(bot.bunt.Set(message))
+		runtime.IgnoreError(bot.store.Set(message))
 	}
 	// first call will return false, every following call will return true
 	return hasTip
@@ -152,30 +151,27 @@ func (ttt *TipTooltip) updateTooltip(bot *TipBot, user *tb.User, amount int, not
 	if err != nil {
 		return err
 	}
-	return bot.bunt.Set(ttt)
+	return bot.store.Set(ttt)
 }
 
 // tipTooltipInitializedHandler is called when the user initializes the wallet
 func tipTooltipInitializedHandler(user *tb.User, bot TipBot) {
-	runtime.IgnoreError(bot.bunt.View(func(tx *buntdb.Tx) error {
-		err := tx.Ascend(storage.MessageOrderedByReplyToFrom, func(key, value string) bool {
-			replyToUserId := gjson.Get(value, storage.MessageOrderedByReplyToFrom)
-			if replyToUserId.String() == strconv.Itoa(user.ID) {
-				log.Debugln("loading persistent tip tool tip messages")
-				ttt := &TipTooltip{}
-				err := json.Unmarshal([]byte(value), ttt)
-				if err != nil {
-					log.Errorln(err)
-				}
-				err = ttt.editTooltip(&bot, false)
-				if err != nil {
-					log.Errorf("[tipTooltipInitializedHandler] could not edit tooltip: %s", err.Error())
-				}
+	runtime.IgnoreError(bot.store.Ascend("*", func(key, value string) bool {
+		replyToUserId := gjson.Get(value, storage.MessageOrderedByReplyToFrom)
+		if replyToUserId.String() == strconv.Itoa(user.ID) {
+			log.Debugln("loading persistent tip tool tip messages")
+			ttt := &TipTooltip{}
+			err := json.Unmarshal([]byte(value), ttt)
+			if err != nil {
+				log.Errorln(err)
 			}
+			err = ttt.editTooltip(&bot, false)
+			if err != nil {
+				log.Errorf("[tipTooltipInitializedHandler] could not edit tooltip: %s", err.Error())
+			}
+		}
 
-			return true
-		})
-		return err
+		return true
 	}))
 }
 
@@ -183,6 +179,14 @@ func (ttt TipTooltip) Key() string {
 	return strconv.Itoa(ttt.Message.Message.ReplyTo.ID)
 }
 
+// Expires returns when the tooltip is removed from the database
+func (ttt TipTooltip) Expires() time.Time {
+	if ttt.LastTip.IsZero() {
+		return time.Time{}
+	}
+	return ttt.LastTip.Add(tooltipTTL)
+}
+
 // editTooltip updates the tooltip message with the new tip amount and tippers and edits it
 func (ttt *TipTooltip) editTooltip(bot *TipBot, notInitializedWallet bool) error {
 	tipToolTip := ttt.getUpdatedTipTooltipMessage(GetUserStrMd(bot.telegram.Me), notInitializedWallet)
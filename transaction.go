@@ -7,6 +7,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/LightningTipBot/LightningTipBot/internal/lnbits"
+	"github.com/LightningTipBot/LightningTipBot/internal/metrics"
 	tb "gopkg.in/tucnak/telebot.v2"
 )
 
@@ -32,8 +33,14 @@ type Transaction struct {
 	Success      bool      `json:"success"`
 	FromWallet   string    `json:"from_wallet"`
 	ToWallet     string    `json:"to_wallet"`
-	FromLNbitsID string    `json:"from_lnbits"`
-	ToLNbitsID   string    `json:"to_lnbits"`
+	FromLNbitsID string    `json:"from_lnbits" gorm:"column:from_lnbits_id"`
+	ToLNbitsID   string    `json:"to_lnbits" gorm:"column:to_lnbits_id"`
+	// Confirmed is set if the sender confirmed the transaction with the PIN or a code
+	Confirmed bool `json:"-" gorm:"-"`
+	// PaymentHash is the hash of the invoice of the receiver
+	PaymentHash string `json:"-" gorm:"-"`
+	// beforePayment is called after the invoice was created and before it is paid
+	beforePayment func(t *Transaction) error
 }
 
 type TransactionOption func(t *Transaction)
@@ -51,6 +58,21 @@ func TransactionType(transactionType string) TransactionOption {
 	}
 }
 
+// TransactionConfirmed marks a transaction that the sender confirmed with the PIN or a code
+func TransactionConfirmed() TransactionOption {
+	return func(t *Transaction) {
+		t.Confirmed = true
+	}
+}
+
+// TransactionBeforePayment calls f after the invoice of the receiver was created and before it is paid.
+// The payment is not made if f returns an error.
+func TransactionBeforePayment(f func(t *Transaction) error) TransactionOption {
+	return func(t *Transaction) {
+		t.beforePayment = f
+	}
+}
+
 func NewTransaction(bot *TipBot, from *tb.User, to *tb.User, amount int, opts ...TransactionOption) *Transaction {
 	t := &Transaction{
 		Bot:      bot,
@@ -79,18 +101,37 @@ func (t *Transaction) Send() (success bool, err error) {
 	// 	return false, err
 	// }
 
+	// the spending limits are checked under a lock of the sender, every payment of users goes through here
+	lock, err := t.Bot.lockSpending(t.From)
+	if err != nil {
+		return false, err
+	}
+	defer t.Bot.unlockSpending(lock)
+	fromUser, err := GetUser(t.From, *t.Bot)
+	if err != nil {
+		return false, err
+	}
+	err = t.Bot.checkSpending(fromUser, t.Amount, t.Confirmed)
+	if err != nil {
+		metrics.Payment(t.Type, metrics.PaymentRejected, t.Amount)
+		return false, err
+	}
+
 	// todo: remove this commend if the backend is back up
 	success, err = t.SendTransaction(t.Bot, t.From, t.To, t.Amount, t.Memo)
 	// success = true
 	if success {
 		t.Success = success
 		// TODO: call post-send methods
+		metrics.Payment(t.Type, metrics.PaymentSuccess, t.Amount)
+	} else {
+		metrics.Payment(t.Type, metrics.PaymentFailed, t.Amount)
 	}
 
 	// save transaction to db
-	tx := t.Bot.logger.Save(t)
-	if tx.Error != nil {
-		errMsg := fmt.Sprintf("Error: Could not log transaction: %s", err)
+	logErr := t.Bot.transactions.SaveTransaction(t)
+	if logErr != nil {
+		errMsg := fmt.Sprintf("Error: Could not log transaction: %s", logErr)
 		log.Errorln(errMsg)
 	}
 
@@ -120,7 +161,7 @@ func (t *Transaction) SendTransaction(bot *TipBot, from *tb.User, to *tb.User, a
 	// check if fromUser has balance
 	if balance < amount {
 		errmsg := fmt.Sprintf(balanceTooLowMessage)
-		log.Errorln("Balance of user %s too low", fromUserStr)
+		log.Errorf("Balance of user %s too low", fromUserStr)
 		return false, fmt.Errorf(errmsg)
 	}
 
@@ -145,6 +186,14 @@ func (t *Transaction) SendTransaction(bot *TipBot, from *tb.User, to *tb.User, a
 		log.Errorln(errmsg)
 		return false, err
 	}
+	t.PaymentHash = invoice.PaymentHash
+	if t.beforePayment != nil {
+		err = t.beforePayment(t)
+		if err != nil {
+			log.Errorf("[SendTransaction] Error: Payment from %s to %s of %d sat was stopped: %s", fromUserStr, toUserStr, amount, err)
+			return false, err
+		}
+	}
 	// pay invoice
 	_, err = fromUser.Wallet.Pay(lnbits.PaymentParams{Out: true, Bolt11: invoice.PaymentRequest}, *fromUser.Wallet)
 	if err != nil {
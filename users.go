@@ -12,25 +12,6 @@ import (
 	"gorm.io/gorm"
 )
 
-func SetUserState(user *lnbits.User, bot TipBot, stateKey lnbits.UserStateKey, stateData string) {
-	user.StateKey = stateKey
-	user.StateData = stateData
-	err := UpdateUserRecord(user, bot)
-	if err != nil {
-		log.Errorln(err.Error())
-		return
-	}
-}
-
-func ResetUserState(user *lnbits.User, bot TipBot) {
-	user.ResetState()
-	err := UpdateUserRecord(user, bot)
-	if err != nil {
-		log.Errorln(err.Error())
-		return
-	}
-}
-
 var markdownV2Escapes = []string{"_", "[", "]", "(", ")", "~", "`", ">", "#", "+", "-", "=", "|", "{", "}", ".", "!"}
 var markdownEscapes = []string{"_", "*", "`", "["}
 
@@ -108,8 +89,9 @@ func (bot *TipBot) GetUserBalance(user *tb.User) (amount int, err error) {
 		return
 	}
 	fromUser.Wallet.Balance = wallet.Balance
-	err = UpdateUserRecord(fromUser, *bot)
+	err = bot.users.SaveBalance(fromUser)
 	if err != nil {
+		log.Errorf("[GetUserBalance] Couldn't save %s's balance: %s", GetUserStr(user), err)
 		return
 	}
 	// msat to sat
@@ -136,9 +118,9 @@ func (bot *TipBot) CreateWalletForTelegramUser(tbUser *tb.User) error {
 		log.Errorln(errmsg)
 		return err
 	}
-	tx := bot.database.Save(user)
-	if tx.Error != nil {
-		return tx.Error
+	err = bot.users.SaveUser(user)
+	if err != nil {
+		return err
 	}
 	log.Printf("[CreateWalletForTelegramUser] Wallet created for user %s. ", userStr)
 	return nil